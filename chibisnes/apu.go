@@ -51,10 +51,8 @@ func (apu *APU) Cycle() {
 	}
 	apu.cpuCyclesLeft--
 
-	if (apu.cycles & 0x1F) == 0 {
-		// every 32 cycles
-		apu.dsp.Cycle()
-	}
+	// one step of the dsp pipeline, a sample every 32 cycles
+	apu.dsp.Cycle()
 
 	// handle timers
 	for i := 0; i < len(apu.timer); i++ {
@@ -142,3 +140,23 @@ func (apu *APU) Write(addr uint16, value byte) {
 
 	apu.ram[addr] = value
 }
+
+func (apu *APU) serialize(s *serializer) {
+	s.bytes(apu.ram[:])
+	s.bool(&apu.romReadable)
+	s.u8(&apu.dspAddr)
+	s.u32(&apu.cycles)
+	s.bytes(apu.inPorts[:])
+	s.bytes(apu.outPorts[:])
+	for i := 0; i < len(apu.timer); i++ {
+		s.u8(&apu.timer[i].cycles)
+		s.u8(&apu.timer[i].divider)
+		s.u8(&apu.timer[i].target)
+		s.u8(&apu.timer[i].counter)
+		s.bool(&apu.timer[i].enabled)
+	}
+	s.u8(&apu.cpuCyclesLeft)
+
+	apu.spc.serialize(s)
+	apu.dsp.serialize(s)
+}
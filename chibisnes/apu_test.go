@@ -0,0 +1,29 @@
+package chibisnes
+
+import "testing"
+
+func TestAPUClockRate(t *testing.T) {
+	var tests = []struct {
+		name         string
+		pal          bool
+		masterClocks int64 // about one second
+		apuCycles    uint32
+	}{
+		{"NTSC", false, 21477272, 1023999}, // 236250000 / 11 Hz, 0.73 clocks short
+		{"PAL", true, 21281370, 1024000},
+	}
+	for _, test := range tests {
+		var console *Console = NewConsole()
+		console.pal = test.pal
+		console.Reset(true)
+		var clocks int64 = 0
+		for ; clocks+1364 <= test.masterClocks; clocks += 1364 {
+			console.syncAPU(1364)
+		}
+		console.syncAPU(test.masterClocks - clocks)
+		console.catchupAPU()
+		if console.APU.cycles != test.apuCycles {
+			t.Errorf("%s: %d apu cycles in a second, want %d", test.name, console.APU.cycles, test.apuCycles)
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package chibisnes
+
+import "math/bits"
+
+// ARM is an ARMv3 core (ARM6, 32 bit modes only): data processing, MRS/MSR,
+// MUL/MLA, SWP, single and block transfers, branches and SWI. Coprocessor
+// instructions take the undefined instruction trap. Each bus access takes a
+// clock, the memory map is the one of the ST018.
+type ARM struct {
+	st018 *ST018
+
+	r    [16]uint32 // registers of the current mode, r15 reads as the instruction + 8
+	cpsr uint32
+	spsr [6]uint32 // by bank, 0 (user) is unused
+
+	// banked registers of the modes not in use
+	usrR8  [5]uint32 // r8-r12 outside of fiq mode
+	fiqR8  [5]uint32 // r8-r12 in fiq mode
+	r13r14 [6][2]uint32
+
+	pc       uint32 // address of the next instruction
+	branched bool   // r15 was written by the instruction
+}
+
+const (
+	armFlagN uint32 = 1 << 31
+	armFlagZ uint32 = 1 << 30
+	armFlagC uint32 = 1 << 29
+	armFlagV uint32 = 1 << 28
+	armFlagI uint32 = 1 << 7
+	armFlagF uint32 = 1 << 6
+
+	armModeUSR uint32 = 0x10
+	armModeFIQ uint32 = 0x11
+	armModeIRQ uint32 = 0x12
+	armModeSVC uint32 = 0x13
+	armModeABT uint32 = 0x17
+	armModeUND uint32 = 0x1b
+	armModeSYS uint32 = 0x1f
+)
+
+func NewARM(st018 *ST018) *ARM {
+	return &ARM{
+		st018: st018,
+	}
+}
+
+func (arm *ARM) Reset() {
+	for i := 0; i < 16; i++ {
+		arm.r[i] = 0
+	}
+	for i := 0; i < 6; i++ {
+		arm.spsr[i] = 0
+		arm.r13r14[i][0] = 0
+		arm.r13r14[i][1] = 0
+	}
+	for i := 0; i < 5; i++ {
+		arm.usrR8[i] = 0
+		arm.fiqR8[i] = 0
+	}
+	arm.cpsr = armModeSVC | armFlagI | armFlagF
+	arm.pc = 0
+	arm.branched = false
+}
+
+// bank returns the register bank of a mode
+func armBank(mode uint32) int {
+	switch mode {
+	case armModeFIQ:
+		return 1
+	case armModeIRQ:
+		return 2
+	case armModeSVC:
+		return 3
+	case armModeABT:
+		return 4
+	case armModeUND:
+		return 5
+	}
+	return 0
+}
+
+// setMode switches the banked registers to another mode
+func (arm *ARM) setMode(mode uint32) {
+	var oldBank int = armBank(arm.cpsr & 0x1f)
+	var newBank int = armBank(mode)
+	arm.cpsr = (arm.cpsr &^ 0x1f) | mode
+	if oldBank == newBank {
+		return
+	}
+	arm.r13r14[oldBank][0] = arm.r[13]
+	arm.r13r14[oldBank][1] = arm.r[14]
+	if oldBank == 1 {
+		copy(arm.fiqR8[:], arm.r[8:13])
+		copy(arm.r[8:13], arm.usrR8[:])
+	} else if newBank == 1 {
+		copy(arm.usrR8[:], arm.r[8:13])
+		copy(arm.r[8:13], arm.fiqR8[:])
+	}
+	arm.r[13] = arm.r13r14[newBank][0]
+	arm.r[14] = arm.r13r14[newBank][1]
+}
+
+// setCPSR writes the cpsr, in user mode only the flags can be changed
+func (arm *ARM) setCPSR(value uint32, mask uint32) {
+	if (arm.cpsr & 0x1f) == armModeUSR {
+		mask &= 0xff000000
+	}
+	value = (arm.cpsr &^ mask) | (value & mask)
+	arm.setMode(value & 0x1f)
+	arm.cpsr = value
+}
+
+func (arm *ARM) read(addr uint32, byteAccess bool) uint32 {
+	return arm.st018.armRead(addr, byteAccess)
+}
+
+func (arm *ARM) write(addr uint32, value uint32, byteAccess bool) {
+	arm.st018.armWrite(addr, value, byteAccess)
+}
+
+func (arm *ARM) idle() {
+	arm.st018.step(1)
+}
+
+// setR writes a register, writing r15 is a branch
+func (arm *ARM) setR(reg uint32, value uint32) {
+	arm.r[reg] = value
+	if reg == 15 {
+		arm.branched = true
+	}
+}
+
+func (arm *ARM) setNZ(value uint32) {
+	arm.cpsr &^= armFlagN | armFlagZ
+	arm.cpsr |= value & armFlagN
+	if value == 0 {
+		arm.cpsr |= armFlagZ
+	}
+}
+
+func (arm *ARM) flag(flag uint32) bool {
+	return (arm.cpsr & flag) > 0
+}
+
+func (arm *ARM) setFlag(flag uint32, set bool) {
+	if set {
+		arm.cpsr |= flag
+	} else {
+		arm.cpsr &^= flag
+	}
+}
+
+func (arm *ARM) condition(cond uint32) bool {
+	var n bool = arm.flag(armFlagN)
+	var z bool = arm.flag(armFlagZ)
+	var c bool = arm.flag(armFlagC)
+	var v bool = arm.flag(armFlagV)
+	switch cond {
+	case 0x0:
+		return z
+	case 0x1:
+		return !z
+	case 0x2:
+		return c
+	case 0x3:
+		return !c
+	case 0x4:
+		return n
+	case 0x5:
+		return !n
+	case 0x6:
+		return v
+	case 0x7:
+		return !v
+	case 0x8:
+		return c && !z
+	case 0x9:
+		return !c || z
+	case 0xa:
+		return n == v
+	case 0xb:
+		return n != v
+	case 0xc:
+		return !z && n == v
+	case 0xd:
+		return z || n != v
+	case 0xe:
+		return true
+	}
+	return false
+}
+
+// exception enters a mode at a vector, with the return address in r14
+func (arm *ARM) exception(mode uint32, vector uint32, returnAddr uint32) {
+	var cpsr uint32 = arm.cpsr
+	arm.setMode(mode)
+	arm.spsr[armBank(mode)] = cpsr
+	arm.r[14] = returnAddr
+	arm.cpsr |= armFlagI
+	arm.setR(15, vector)
+}
+
+// Step runs an instruction
+func (arm *ARM) Step() {
+	var addr uint32 = arm.pc
+	var opcode uint32 = arm.read(addr, false)
+	arm.r[15] = addr + 8
+	arm.branched = false
+
+	if arm.condition(opcode >> 28) {
+		arm.execute(opcode, addr)
+	}
+
+	if arm.branched {
+		arm.pc = arm.r[15] &^ 3
+	} else {
+		arm.pc = addr + 4
+	}
+}
+
+func (arm *ARM) execute(opcode uint32, addr uint32) {
+	switch (opcode >> 25) & 7 {
+	case 0:
+		switch {
+		case (opcode & 0x0fc000f0) == 0x00000090:
+			arm.multiply(opcode)
+		case (opcode & 0x0fb00ff0) == 0x01000090:
+			arm.swap(opcode)
+		case (opcode & 0x00000090) == 0x00000090:
+			// halfword transfers are ARMv4
+			arm.exception(armModeUND, 0x04, addr+4)
+		case (opcode & 0x0fbf0fff) == 0x010f0000:
+			arm.mrs(opcode)
+		case (opcode & 0x0fb0fff0) == 0x0120f000:
+			arm.msr(opcode, arm.r[opcode&15])
+		default:
+			arm.dataProcessing(opcode)
+		}
+	case 1:
+		if (opcode & 0x0fb0f000) == 0x0320f000 {
+			arm.msr(opcode, bits.RotateLeft32(opcode&0xff, -int((opcode>>8)&15)*2))
+		} else {
+			arm.dataProcessing(opcode)
+		}
+	case 2:
+		arm.singleTransfer(opcode)
+	case 3:
+		if (opcode & 0x10) > 0 {
+			arm.exception(armModeUND, 0x04, addr+4)
+		} else {
+			arm.singleTransfer(opcode)
+		}
+	case 4:
+		arm.blockTransfer(opcode)
+	case 5:
+		if (opcode & 0x01000000) > 0 {
+			arm.r[14] = addr + 4
+		}
+		var offset uint32 = uint32(int32(opcode<<8) >> 6)
+		arm.setR(15, arm.r[15]+offset)
+	case 6:
+		arm.exception(armModeUND, 0x04, addr+4)
+	case 7:
+		if (opcode & 0x01000000) > 0 {
+			arm.exception(armModeSVC, 0x08, addr+4)
+		} else {
+			arm.exception(armModeUND, 0x04, addr+4)
+		}
+	}
+}
+
+// shift applies a barrel shifter operation, amount 0 is the special case
+// of an immediate amount (LSR/ASR #32, RRX)
+func (arm *ARM) shift(value uint32, shiftType uint32, amount uint32, immediate bool) (uint32, bool) {
+	var carry bool = arm.flag(armFlagC)
+	if amount == 0 && !immediate {
+		return value, carry
+	}
+	switch shiftType {
+	case 0:
+		switch {
+		case amount == 0:
+			return value, carry
+		case amount < 32:
+			return value << amount, (value>>(32-amount))&1 > 0
+		case amount == 32:
+			return 0, value&1 > 0
+		}
+		return 0, false
+	case 1:
+		if amount == 0 {
+			amount = 32
+		}
+		switch {
+		case amount < 32:
+			return value >> amount, (value>>(amount-1))&1 > 0
+		case amount == 32:
+			return 0, value>>31 > 0
+		}
+		return 0, false
+	case 2:
+		if amount == 0 || amount >= 32 {
+			if (value >> 31) > 0 {
+				return 0xffffffff, true
+			}
+			return 0, false
+		}
+		return uint32(int32(value) >> amount), (value>>(amount-1))&1 > 0
+	}
+	if amount == 0 {
+		// RRX
+		var result uint32 = value >> 1
+		if carry {
+			result |= 0x80000000
+		}
+		return result, value&1 > 0
+	}
+	amount &= 31
+	if amount == 0 {
+		return value, value>>31 > 0
+	}
+	return bits.RotateLeft32(value, -int(amount)), (value>>(amount-1))&1 > 0
+}
+
+// operand2 returns the second operand of a data processing instruction and
+// the carry out of the shifter
+func (arm *ARM) operand2(opcode uint32) (uint32, bool) {
+	if (opcode & 0x02000000) > 0 {
+		var rotate uint32 = ((opcode >> 8) & 15) * 2
+		var value uint32 = bits.RotateLeft32(opcode&0xff, -int(rotate))
+		if rotate == 0 {
+			return value, arm.flag(armFlagC)
+		}
+		return value, value>>31 > 0
+	}
+	var rm uint32 = opcode & 15
+	var value uint32 = arm.r[rm]
+	if (opcode & 0x10) > 0 {
+		// shift by register, one more cycle and r15 is 4 further
+		arm.idle()
+		if rm == 15 {
+			value += 4
+		}
+		return arm.shift(value, (opcode>>5)&3, arm.r[(opcode>>8)&15]&0xff, false)
+	}
+	return arm.shift(value, (opcode>>5)&3, (opcode>>7)&31, true)
+}
+
+func (arm *ARM) dataProcessing(opcode uint32) {
+	var op uint32 = (opcode >> 21) & 15
+	var setFlags bool = (opcode & 0x00100000) > 0
+	var rn uint32 = (opcode >> 16) & 15
+	var rd uint32 = (opcode >> 12) & 15
+	var operand uint32
+	var carry bool
+	operand, carry = arm.operand2(opcode)
+	var a uint32 = arm.r[rn]
+	if rn == 15 && (opcode&0x02000010) == 0x10 {
+		a += 4
+	}
+
+	var result uint32
+	var logical bool = false
+	var c bool = arm.flag(armFlagC)
+	var v bool = arm.flag(armFlagV)
+	switch op {
+	case 0x0, 0x8: // AND, TST
+		result = a & operand
+		logical = true
+	case 0x1, 0x9: // EOR, TEQ
+		result = a ^ operand
+		logical = true
+	case 0x2, 0xa: // SUB, CMP
+		result, c, v = armSubtract(a, operand, true)
+	case 0x3: // RSB
+		result, c, v = armSubtract(operand, a, true)
+	case 0x4, 0xb: // ADD, CMN
+		result, c, v = armAdd(a, operand, false)
+	case 0x5: // ADC
+		result, c, v = armAdd(a, operand, arm.flag(armFlagC))
+	case 0x6: // SBC
+		result, c, v = armSubtract(a, operand, arm.flag(armFlagC))
+	case 0x7: // RSC
+		result, c, v = armSubtract(operand, a, arm.flag(armFlagC))
+	case 0xc: // ORR
+		result = a | operand
+		logical = true
+	case 0xd: // MOV
+		result = operand
+		logical = true
+	case 0xe: // BIC
+		result = a &^ operand
+		logical = true
+	case 0xf: // MVN
+		result = ^operand
+		logical = true
+	}
+
+	if op < 0x8 || op > 0xb {
+		arm.setR(rd, result)
+	}
+	if !setFlags {
+		return
+	}
+	if rd == 15 {
+		// return from an exception
+		var bank int = armBank(arm.cpsr & 0x1f)
+		if bank > 0 {
+			arm.setCPSR(arm.spsr[bank], 0xffffffff)
+		}
+		return
+	}
+	arm.setNZ(result)
+	if logical {
+		arm.setFlag(armFlagC, carry)
+	} else {
+		arm.setFlag(armFlagC, c)
+		arm.setFlag(armFlagV, v)
+	}
+}
+
+func armAdd(a uint32, b uint32, carryIn bool) (uint32, bool, bool) {
+	var carry uint32 = 0
+	if carryIn {
+		carry = 1
+	}
+	result, carryOut := bits.Add32(a, b, carry)
+	var overflow bool = (^(a ^ b) & (a ^ result) & 0x80000000) > 0
+	return result, carryOut > 0, overflow
+}
+
+// armSubtract returns a - b - !carryIn, the carry out is set when there is
+// no borrow
+func armSubtract(a uint32, b uint32, carryIn bool) (uint32, bool, bool) {
+	var borrow uint32 = 1
+	if carryIn {
+		borrow = 0
+	}
+	result, borrowOut := bits.Sub32(a, b, borrow)
+	var overflow bool = ((a ^ b) & (a ^ result) & 0x80000000) > 0
+	return result, borrowOut == 0, overflow
+}
+
+func (arm *ARM) mrs(opcode uint32) {
+	var rd uint32 = (opcode >> 12) & 15
+	if (opcode & 0x00400000) > 0 {
+		arm.setR(rd, arm.spsr[armBank(arm.cpsr&0x1f)])
+	} else {
+		arm.setR(rd, arm.cpsr)
+	}
+}
+
+func (arm *ARM) msr(opcode uint32, value uint32) {
+	var mask uint32 = 0
+	if (opcode & 0x00080000) > 0 {
+		mask |= 0xff000000
+	}
+	if (opcode & 0x00010000) > 0 {
+		mask |= 0x000000ff
+	}
+	if (opcode & 0x00400000) > 0 {
+		var bank int = armBank(arm.cpsr & 0x1f)
+		if bank > 0 {
+			arm.spsr[bank] = (arm.spsr[bank] &^ mask) | (value & mask)
+		}
+		return
+	}
+	arm.setCPSR(value, mask)
+}
+
+func (arm *ARM) multiply(opcode uint32) {
+	var rd uint32 = (opcode >> 16) & 15
+	var rn uint32 = (opcode >> 12) & 15
+	var rs uint32 = (opcode >> 8) & 15
+	var rm uint32 = opcode & 15
+	var multiplier uint32 = arm.r[rs]
+	var result uint32 = arm.r[rm] * multiplier
+	if (opcode & 0x00200000) > 0 {
+		arm.idle()
+		result += arm.r[rn]
+	}
+	// booth's algorithm, 2 bits per cycle until the rest is all 0 or 1
+	for i := 0; i < 16; i++ {
+		arm.idle()
+		multiplier = uint32(int32(multiplier) >> 2)
+		if multiplier == 0 || multiplier == 0xffffffff {
+			break
+		}
+	}
+	arm.setR(rd, result)
+	if (opcode & 0x00100000) > 0 {
+		arm.setNZ(result)
+	}
+}
+
+func (arm *ARM) swap(opcode uint32) {
+	var byteAccess bool = (opcode & 0x00400000) > 0
+	var rn uint32 = (opcode >> 16) & 15
+	var rd uint32 = (opcode >> 12) & 15
+	var rm uint32 = opcode & 15
+	var addr uint32 = arm.r[rn]
+	var value uint32 = arm.read(addr, byteAccess)
+	if !byteAccess {
+		value = bits.RotateLeft32(value, -int(addr&3)*8)
+	}
+	arm.write(addr, arm.r[rm], byteAccess)
+	arm.idle()
+	arm.setR(rd, value)
+}
+
+func (arm *ARM) singleTransfer(opcode uint32) {
+	var pre bool = (opcode & 0x01000000) > 0
+	var up bool = (opcode & 0x00800000) > 0
+	var byteAccess bool = (opcode & 0x00400000) > 0
+	var writeback bool = (opcode & 0x00200000) > 0
+	var load bool = (opcode & 0x00100000) > 0
+	var rn uint32 = (opcode >> 16) & 15
+	var rd uint32 = (opcode >> 12) & 15
+
+	var offset uint32
+	if (opcode & 0x02000000) > 0 {
+		offset, _ = arm.shift(arm.r[opcode&15], (opcode>>5)&3, (opcode>>7)&31, true)
+	} else {
+		offset = opcode & 0xfff
+	}
+	var addr uint32 = arm.r[rn]
+	var result uint32 = addr
+	if up {
+		result += offset
+	} else {
+		result -= offset
+	}
+	if pre {
+		addr = result
+	}
+
+	if load {
+		var value uint32 = arm.read(addr, byteAccess)
+		if !byteAccess {
+			value = bits.RotateLeft32(value, -int(addr&3)*8)
+		}
+		arm.idle()
+		if !pre || writeback {
+			arm.setR(rn, result)
+		}
+		arm.setR(rd, value)
+		return
+	}
+	var value uint32 = arm.r[rd]
+	if rd == 15 {
+		value += 4
+	}
+	arm.write(addr, value, byteAccess)
+	if !pre || writeback {
+		arm.setR(rn, result)
+	}
+}
+
+func (arm *ARM) blockTransfer(opcode uint32) {
+	var pre bool = (opcode & 0x01000000) > 0
+	var up bool = (opcode & 0x00800000) > 0
+	var userBank bool = (opcode & 0x00400000) > 0
+	var writeback bool = (opcode & 0x00200000) > 0
+	var load bool = (opcode & 0x00100000) > 0
+	var rn uint32 = (opcode >> 16) & 15
+	var list uint32 = opcode & 0xffff
+
+	var count uint32 = uint32(bits.OnesCount32(list))
+	var base uint32 = arm.r[rn]
+	var addr uint32
+	var final uint32
+	if up {
+		addr = base
+		final = base + count*4
+		if pre {
+			addr += 4
+		}
+	} else {
+		addr = base - count*4
+		final = addr
+		if !pre {
+			addr += 4
+		}
+	}
+
+	// the S bit without r15 in a load (or in any store) transfers the user
+	// registers
+	var restoreMode uint32 = arm.cpsr & 0x1f
+	var switchBank bool = userBank && !(load && (list&0x8000) > 0)
+	if switchBank {
+		arm.setMode(armModeUSR)
+	}
+
+	if load {
+		if writeback {
+			arm.setR(rn, final)
+		}
+		for i := uint32(0); i < 16; i++ {
+			if (list & (1 << i)) == 0 {
+				continue
+			}
+			arm.setR(i, arm.read(addr, false))
+			addr += 4
+		}
+		arm.idle()
+	} else {
+		var first bool = true
+		for i := uint32(0); i < 16; i++ {
+			if (list & (1 << i)) == 0 {
+				continue
+			}
+			var value uint32 = arm.r[i]
+			if i == 15 {
+				value += 4
+			}
+			arm.write(addr, value, false)
+			addr += 4
+			if first && writeback {
+				arm.setR(rn, final)
+			}
+			first = false
+		}
+	}
+
+	if switchBank {
+		arm.setMode(restoreMode)
+	}
+	if userBank && load && (list&0x8000) > 0 {
+		var bank int = armBank(arm.cpsr & 0x1f)
+		if bank > 0 {
+			arm.setCPSR(arm.spsr[bank], 0xffffffff)
+		}
+	}
+}
+
+func (arm *ARM) serialize(s *serializer) {
+	for i := 0; i < 16; i++ {
+		s.u32(&arm.r[i])
+	}
+	s.u32(&arm.cpsr)
+	for i := 0; i < 6; i++ {
+		s.u32(&arm.spsr[i])
+		s.u32(&arm.r13r14[i][0])
+		s.u32(&arm.r13r14[i][1])
+	}
+	for i := 0; i < 5; i++ {
+		s.u32(&arm.usrR8[i])
+		s.u32(&arm.fiqR8[i])
+	}
+	s.u32(&arm.pc)
+}
@@ -0,0 +1,149 @@
+package chibisnes
+
+import (
+	"log"
+	"os"
+)
+
+// BSMemory is a Satellaview memory pack, a flash chip programmed with
+// commands written to any of its addresses. The pack is the .bs file itself,
+// mmapped like the save ram, so everything written to it is kept.
+//
+// commands: $00/$ff read array, $10/$40 program byte, $20 $d0 erase 64KB
+// block, $50 clear status, $70 read status, $71 read extended status, $75
+// read chip information, $a7 $d0 erase chip.
+type BSMemory struct {
+	flash *SRAM
+	size  uint32
+
+	command     uint32 // last command bytes
+	programByte bool   // next write is programmed
+	readID      bool   // chip information at $ff00-$ff13
+	readStatus  bool   // compatible status register
+	readExtend  bool   // page and global status registers
+}
+
+// chip information of a type 1 8Mbit pack
+var bsMemoryChipInfo = [20]byte{0x4d, 0x00, 0x50, 0x00, 0x00, 0x00, 0x1a, 0x00}
+
+const bsMemoryBlockSize = 0x10000
+
+// NewBSMemory maps the memory pack at filePath, an erased 1MB pack is
+// created if there is none
+func NewBSMemory(filePath string) *BSMemory {
+	var size int = 0x100000
+	var created bool = true
+	if info, err := os.Stat(filePath); err == nil {
+		created = false
+		size = int(info.Size())
+	}
+	if size < bsMemoryBlockSize {
+		log.Printf("BS-X: memory pack %s is too small (%d bytes)\n", filePath, size)
+		return nil
+	}
+	var flash *SRAM = NewSRAM(filePath, size)
+	if flash == nil {
+		return nil
+	}
+	if created {
+		for i := 0; i < size; i++ {
+			flash.Write(uint32(i), 0xff)
+		}
+	}
+	return &BSMemory{
+		flash: flash,
+		size:  uint32(size),
+	}
+}
+
+func (bsMemory *BSMemory) Reset() {
+	bsMemory.command = 0
+	bsMemory.programByte = false
+	bsMemory.readID = false
+	bsMemory.readStatus = false
+	bsMemory.readExtend = false
+}
+
+func (bsMemory *BSMemory) Close() {
+	bsMemory.flash.Close()
+}
+
+// Read reads offset in the pack, addr is the cpu address
+func (bsMemory *BSMemory) Read(offset uint32, addr uint16) byte {
+	if bsMemory.readStatus {
+		// ready, read once
+		bsMemory.readStatus = false
+		return 0x80
+	}
+	switch {
+	case bsMemory.readExtend && (addr == 0x0002 || addr == 0x8002):
+		// page status
+		return 0xc0
+	case bsMemory.readExtend && (addr == 0x0004 || addr == 0x8004):
+		// global status
+		return 0x82
+	case bsMemory.readID && addr >= 0xff00 && addr < 0xff14:
+		return bsMemoryChipInfo[addr-0xff00]
+	}
+	return bsMemory.flash.Read(offset % bsMemory.size)
+}
+
+// Write writes a command to the pack, or programs the byte at offset
+func (bsMemory *BSMemory) Write(offset uint32, value byte) {
+	offset %= bsMemory.size
+	if bsMemory.programByte {
+		// flash can only clear bits
+		bsMemory.flash.Write(offset, bsMemory.flash.Read(offset)&value)
+		bsMemory.programByte = false
+		return
+	}
+
+	bsMemory.command = (bsMemory.command << 8) | uint32(value)
+	switch value {
+	case 0x00, 0xff:
+		bsMemory.Reset()
+	case 0x10, 0x40:
+		bsMemory.readID = false
+		bsMemory.readExtend = false
+		bsMemory.readStatus = true
+		bsMemory.programByte = true
+	case 0x50:
+		bsMemory.readStatus = false
+		bsMemory.readExtend = false
+	case 0x70:
+		bsMemory.readID = false
+		bsMemory.readExtend = false
+		bsMemory.readStatus = true
+	case 0x71:
+		bsMemory.readID = false
+		bsMemory.readStatus = false
+		bsMemory.readExtend = true
+	case 0x75:
+		bsMemory.readStatus = false
+		bsMemory.readExtend = false
+		bsMemory.readID = true
+	case 0xd0:
+		switch bsMemory.command & 0xffff {
+		case 0x20d0:
+			var start uint32 = offset &^ (bsMemoryBlockSize - 1)
+			for i := start; i < start+bsMemoryBlockSize && i < bsMemory.size; i++ {
+				bsMemory.flash.Write(i, 0xff)
+			}
+			bsMemory.readStatus = true
+		case 0xa7d0:
+			for i := uint32(0); i < bsMemory.size; i++ {
+				bsMemory.flash.Write(i, 0xff)
+			}
+			bsMemory.readStatus = true
+		}
+	}
+}
+
+func (bsMemory *BSMemory) serialize(s *serializer) {
+	bsMemory.flash.serialize(s)
+	s.u32(&bsMemory.command)
+	s.bool(&bsMemory.programByte)
+	s.bool(&bsMemory.readID)
+	s.bool(&bsMemory.readStatus)
+	s.bool(&bsMemory.readExtend)
+}
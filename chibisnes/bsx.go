@@ -0,0 +1,276 @@
+package chibisnes
+
+import (
+	"log"
+	"strings"
+)
+
+// BSX is the BS-X Satellaview base cartridge: the BIOS rom, 512KB of PSRAM,
+// 32KB of battery backed ram at $10-17:5000-5fff, the memory pack slot and
+// the MCC mapping chip. The MCC registers are bit 7 of $00-0f:5000, written
+// values take effect when $0e:5000 bit 7 is set.
+//
+// registers: 1 irq enable, 2 mapping (0: LoROM, 1: HiROM), 3/4 PSRAM enable
+// in banks 00-7d/80-ff, 5-6 PSRAM location, 7/8 BIOS enable in banks
+// 00-3f/80-bf, 9/10 expansion enable, 11 expansion location, 12 internally
+// writable, 13 memory pack writable, 14 commit.
+type BSX struct {
+	cartridge *Cartridge
+
+	psram    *SRAM
+	bsMemory *BSMemory // nil without a memory pack
+
+	irqFlag   bool
+	irqEnable bool
+	written   [16]bool // written registers
+	regs      [16]bool // active registers
+}
+
+const (
+	bsxMapping            = 2
+	bsxPSRAMEnableLo      = 3
+	bsxPSRAMEnableHi      = 4
+	bsxPSRAMMapping0      = 5
+	bsxPSRAMMapping1      = 6
+	bsxROMEnableLo        = 7
+	bsxROMEnableHi        = 8
+	bsxExEnableLo         = 9
+	bsxExEnableHi         = 10
+	bsxExMapping          = 11
+	bsxInternallyWritable = 12
+	bsxExternallyWritable = 13
+)
+
+const bsxPSRAMSize = 0x80000
+
+func init() {
+	registerBoard(mapperRegistration{
+		name:     "BS-X",
+		priority: 1,
+		match:    isBSXHeader,
+		ram: func(header *CartridgeHeader, ramSize int, saveSize int) (int, int) {
+			// the BIOS always has 32KB of ram
+			return 0x8000, 0x8000
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			var bsMemory *BSMemory = NewBSMemory(cartridge.bsMemoryFilePath())
+			log.Printf("ROM: BS-X enabled, memory pack: %t\n", bsMemory != nil)
+			return NewBSX(cartridge, bsMemory), nil
+		},
+	})
+}
+
+// isBSXHeader reports if the header is the one of the BS-X BIOS
+func isBSXHeader(header *CartridgeHeader) bool {
+	return header.cartType == 1 && (string(header.gameCode[:4]) == "ZBSJ" || strings.HasPrefix(string(header.name[:]), "Satellaview BS-X"))
+}
+
+func NewBSX(cartridge *Cartridge, bsMemory *BSMemory) *BSX {
+	return &BSX{
+		cartridge: cartridge,
+		psram:     newVolatileSRAM(bsxPSRAMSize),
+		bsMemory:  bsMemory,
+	}
+}
+
+func (bsx *BSX) Reset() {
+	bsx.irqFlag = false
+	bsx.irqEnable = false
+	for i := 0; i < len(bsx.written); i++ {
+		bsx.written[i] = false
+	}
+	bsx.written[bsxMapping] = true
+	bsx.written[bsxPSRAMEnableLo] = true
+	bsx.written[bsxPSRAMMapping0] = true
+	bsx.written[bsxPSRAMMapping1] = true
+	bsx.written[bsxROMEnableLo] = true
+	bsx.written[bsxROMEnableHi] = true
+	bsx.written[bsxExEnableLo] = true
+	bsx.written[bsxExMapping] = true
+	bsx.regs = bsx.written
+	if bsx.bsMemory != nil {
+		bsx.bsMemory.Reset()
+	}
+}
+
+func (bsx *BSX) Close() {
+	if bsx.bsMemory != nil {
+		bsx.bsMemory.Close()
+	}
+}
+
+func (bsx *BSX) psramMapping() byte {
+	var mapping byte = 0
+	if bsx.regs[bsxPSRAMMapping0] {
+		mapping |= 1
+	}
+	if bsx.regs[bsxPSRAMMapping1] {
+		mapping |= 2
+	}
+	return mapping
+}
+
+func (bsx *BSX) Read(bank byte, addr uint16) byte {
+	var address uint32 = uint32(bank)<<16 | uint32(addr)
+
+	if (address & 0x70f000) == 0x005000 {
+		// $00-0f:5000, mcc registers
+		var index byte = (bank & 0x0f)
+		switch index {
+		case 0:
+			return boolBit7(bsx.irqFlag)
+		case 1:
+			return boolBit7(bsx.irqEnable)
+		case 14, 15:
+			return 0
+		}
+		return boolBit7(bsx.regs[index])
+	}
+	if (address & 0x78f000) == 0x105000 {
+		// $10-17:5000-5fff, battery backed ram
+		return bsx.ramRead(address)
+	}
+
+	switch target, offset := bsx.mapAddress(address); target {
+	case bsxTargetROM:
+		var cartridge *Cartridge = bsx.cartridge
+		return cartridge.rom[offset&(cartridge.romSize-1)]
+	case bsxTargetPSRAM:
+		return bsx.psram.Read(offset & (bsxPSRAMSize - 1))
+	case bsxTargetBSMemory:
+		return bsx.bsMemory.Read(offset, addr)
+	}
+	return bsx.cartridge.console.openBus
+}
+
+func (bsx *BSX) Write(bank byte, addr uint16, value byte) {
+	var address uint32 = uint32(bank)<<16 | uint32(addr)
+
+	if (address & 0x70f000) == 0x005000 {
+		var index byte = (bank & 0x0f)
+		switch index {
+		case 0, 15:
+			// nothing done
+		case 1:
+			bsx.irqEnable = (value & 0x80) > 0
+		case 14:
+			if (value & 0x80) > 0 {
+				bsx.regs = bsx.written
+			}
+		default:
+			bsx.written[index] = (value & 0x80) > 0
+		}
+		return
+	}
+	if (address & 0x78f000) == 0x105000 {
+		bsx.ramWrite(address, value)
+		return
+	}
+
+	switch target, offset := bsx.mapAddress(address); target {
+	case bsxTargetPSRAM:
+		bsx.psram.Write(offset&(bsxPSRAMSize-1), value)
+	case bsxTargetBSMemory:
+		if bsx.regs[bsxExternallyWritable] {
+			bsx.bsMemory.Write(offset, value)
+		}
+	}
+}
+
+func (bsx *BSX) ramRead(address uint32) byte {
+	var cartridge *Cartridge = bsx.cartridge
+	if cartridge.ramSize == 0 {
+		return cartridge.console.openBus
+	}
+	return cartridge.ram.Read((((address>>16)&7)<<12 | (address & 0xfff)) & (cartridge.ramSize - 1))
+}
+
+func (bsx *BSX) ramWrite(address uint32, value byte) {
+	var cartridge *Cartridge = bsx.cartridge
+	if cartridge.ramSize == 0 {
+		return
+	}
+	cartridge.ram.Write((((address>>16)&7)<<12|(address&0xfff))&(cartridge.ramSize-1), value)
+}
+
+const (
+	bsxTargetNone = iota
+	bsxTargetROM
+	bsxTargetPSRAM
+	bsxTargetBSMemory
+)
+
+// mapAddress returns what the mcc maps at address and the offset in it
+func (bsx *BSX) mapAddress(address uint32) (int, uint32) {
+	var regs *[16]bool = &bsx.regs
+	var hiROM bool = regs[bsxMapping]
+	var psramMapping byte = bsx.psramMapping()
+
+	// BIOS, always LoROM
+	if (regs[bsxROMEnableLo] && (address&0xc08000) == 0x008000) || (regs[bsxROMEnableHi] && (address&0xc08000) == 0x808000) {
+		return bsxTargetROM, (address&0x3f0000)>>1 | (address & 0x7fff)
+	}
+
+	// PSRAM, 1 of 4 locations and $70-7d:0000-7fff
+	for i := 0; i < 2; i++ {
+		var enabled bool = regs[bsxPSRAMEnableLo]
+		var base uint32 = 0
+		if i == 1 {
+			enabled = regs[bsxPSRAMEnableHi]
+			base = 0x800000
+		}
+		if !enabled {
+			continue
+		}
+		if !hiROM {
+			if ((address&0xf08000) == base|0x008000 && psramMapping == 0) ||
+				((address&0xf08000) == base|0x208000 && psramMapping == 1) ||
+				((address&0xf00000) == base|0x400000 && psramMapping == 2) ||
+				((address&0xf00000) == base|0x600000 && psramMapping == 3) ||
+				(address&0xf08000) == base|0x700000 {
+				return bsxTargetPSRAM, (address&0x0f0000)>>1 | (address & 0x7fff)
+			}
+		} else {
+			if ((address&0xf88000) == base|0x008000 && psramMapping == 0) ||
+				((address&0xf88000) == base|0x108000 && psramMapping == 1) ||
+				((address&0xf80000) == base|0x400000 && psramMapping == 2) ||
+				((address&0xf80000) == base|0x500000 && psramMapping == 3) ||
+				(address&0xf88000) == base|0x700000 {
+				return bsxTargetPSRAM, address & 0x07ffff
+			}
+		}
+	}
+
+	// expansion memory, not present on the BS-X cartridge
+
+	// memory pack
+	if bsx.bsMemory != nil && ((address&0x408000) == 0x008000 || (address&0x400000) == 0x400000) {
+		if hiROM {
+			return bsxTargetBSMemory, address & 0x3fffff
+		}
+		return bsxTargetBSMemory, (address&0x3f0000)>>1 | (address & 0x7fff)
+	}
+
+	return bsxTargetNone, 0
+}
+
+func boolBit7(value bool) byte {
+	if value {
+		return 0x80
+	}
+	return 0
+}
+
+func (bsx *BSX) Cycle() {
+}
+
+func (bsx *BSX) Serialize(s *serializer) {
+	bsx.psram.serialize(s)
+	if bsx.bsMemory != nil {
+		bsx.bsMemory.serialize(s)
+	}
+	s.bool(&bsx.irqFlag)
+	s.bool(&bsx.irqEnable)
+	s.bools(bsx.written[:])
+	s.bools(bsx.regs[:])
+}
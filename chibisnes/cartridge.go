@@ -1,6 +1,11 @@
 package chibisnes
 
-import "path/filepath"
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+)
 
 type CartridgeHeader struct {
 	// normal header
@@ -26,23 +31,36 @@ type CartridgeHeader struct {
 	specialVersion byte    // $ffbe
 	exCoprocessor  byte    // $ffbf (if coprocessor = $f)
 	// calculated stuff
-	score    int16 // score for header, to see which mapping is most likely
-	pal      bool  // if this is a rom for PAL regions instead of NTSC
-	cartType byte  // calculated type
+	score    int16  // score for header, to see which mapping is most likely
+	pal      bool   // if this is a rom for PAL regions instead of NTSC
+	cartType byte   // calculated type: 1 LoROM, 2 HiROM, 3 SPC7110, 4 ExHiROM, 5 ExLoROM
+	board    string // board from a rom database, picks the mapper if set
 }
 
 type Cartridge struct {
 	console *Console
 
-	coprocessor *CPU
-	cartType    byte
-	rom         []byte
-	romSize     uint32
+	board    Mapper // LoROM, HiROM, ... or a chip mapping the whole bus
+	chips    []Chip // coprocessors in front of the board
+	cartType byte
+	rom      []byte
+	romSize  uint32
+	romCRC   uint32 // crc32 of the loaded (expanded) rom, ties save states to a rom
 	// ram      []byte
 	ram     *SRAM
 	ramSize uint32
 }
 
+// dmaReader is a chip answering the reads of a dma channel itself
+type dmaReader interface {
+	dmaRead(channel int, addr uint32, size uint16) (byte, bool)
+}
+
+// sampleMixer is a chip with its own audio
+type sampleMixer interface {
+	mixSamples(sampleData []int16, samplesPerFrame int)
+}
+
 func NewCartridge(console *Console) *Cartridge {
 	return &Cartridge{
 		console: console,
@@ -50,18 +68,59 @@ func NewCartridge(console *Console) *Cartridge {
 }
 
 func (cartridge *Cartridge) Reset() {
-	// nothing done
+	if cartridge.board != nil {
+		cartridge.board.Reset()
+	}
+	for i := 0; i < len(cartridge.chips); i++ {
+		cartridge.chips[i].Reset()
+	}
+}
+
+// cycle runs the coprocessors for 2 master cycles
+func (cartridge *Cartridge) cycle() {
+	if cartridge.board != nil {
+		cartridge.board.Cycle()
+	}
+	for i := 0; i < len(cartridge.chips); i++ {
+		cartridge.chips[i].Cycle()
+	}
 }
 
-func (cartridge *Cartridge) Load(cartType int, rom []byte, romSize int, ramSize int, coprocessor byte) {
+// addChip puts a chip in front of the board, for the chips coming with
+// other files than the rom (Sufami Turbo, Super Game Boy)
+func (cartridge *Cartridge) addChip(chip Chip) {
+	cartridge.chips = append(cartridge.chips, chip)
+}
+
+func (cartridge *Cartridge) Load(cartType int, rom []byte, romSize int, ramSize int, header *CartridgeHeader) error {
 	// XXX: correct? (byte cast)
 	cartridge.cartType = byte(cartType)
+	cartridge.board = nil
+	cartridge.chips = nil
+
+	board, err := findBoard(header)
+	if err != nil {
+		return err
+	}
+	var chips []*mapperRegistration = findChips(header)
 
 	cartridge.rom = make([]byte, romSize)
 	cartridge.romSize = uint32(romSize)
 	for i := 0; i < len(rom); i++ {
 		cartridge.rom[i] = rom[i]
 	}
+	cartridge.romCRC = crc32.ChecksumIEEE(cartridge.rom)
+
+	// the board and the chips can change the ram, or save more after it
+	var saveSize int = ramSize
+	if board.ram != nil {
+		ramSize, saveSize = board.ram(header, ramSize, saveSize)
+	}
+	for i := 0; i < len(chips); i++ {
+		if chips[i].ram != nil {
+			ramSize, saveSize = chips[i].ram(header, ramSize, saveSize)
+		}
+	}
 
 	if ramSize > 0 {
 		// cartridge.ram = make([]byte, ramSize)
@@ -71,89 +130,104 @@ func (cartridge *Cartridge) Load(cartType int, rom []byte, romSize int, ramSize
 		// }
 
 		cartridge.ramSize = uint32(ramSize)
-
-		filePath := cartridge.console.RomFilePath
-		ramFileName := getFileNameWithoutExtension(filePath)
-		ramFileDir := filepath.Dir(filepath.Clean(filePath))
-		ramFilePath := filepath.Join(ramFileDir, ramFileName+`.srm`)
-
-		cartridge.ram = NewSRAM(ramFilePath, ramSize)
+		cartridge.ram = NewSRAM(cartridge.saveFilePath(), saveSize)
 	} else {
 		cartridge.ram = nil
 		cartridge.ramSize = 0
 	}
 
-	if coprocessor == 3 {
-		cartridge.coprocessor = NewCPU(cartridge.console)
+	mapper, err := board.create(cartridge, header)
+	if err != nil {
+		cartridge.unload()
+		return err
+	}
+	cartridge.board = mapper
+	for i := 0; i < len(chips); i++ {
+		mapper, err := chips[i].create(cartridge, header)
+		if err != nil {
+			cartridge.unload()
+			return err
+		}
+		chip, ok := mapper.(Chip)
+		if !ok {
+			mapper.Close()
+			cartridge.unload()
+			return errors.New(fmt.Sprintf("Failed to load rom: %s is not a chip\n", chips[i].name))
+		}
+		cartridge.addChip(chip)
 	}
+
+	return nil
 }
 
-func (cartridge *Cartridge) Read(bank byte, addr uint16) byte {
-	switch cartridge.cartType {
-	case 0:
-		return cartridge.console.openBus
-	case 1:
-		return cartridge.readLoROM(bank, addr)
-	case 2:
-		return cartridge.readHiROM(bank, addr)
-	}
+// unload closes what a failed Load already created
+func (cartridge *Cartridge) unload() {
+	cartridge.Close()
+	cartridge.ram = nil
+	cartridge.ramSize = 0
+	cartridge.board = nil
+	cartridge.chips = nil
+}
 
-	return cartridge.console.openBus
+// bsMemoryFilePath returns the path of the .bs memory pack next to the rom
+func (cartridge *Cartridge) bsMemoryFilePath() string {
+	filePath := cartridge.console.RomFilePath
+	packFileName := getFileNameWithoutExtension(filePath)
+	packFileDir := filepath.Dir(filepath.Clean(filePath))
+	return filepath.Join(packFileDir, packFileName+`.bs`)
 }
 
-func (cartridge *Cartridge) Write(bank byte, addr uint16, value byte) {
-	switch cartridge.cartType {
-	case 0:
-		// nothing done
-	case 1:
-		cartridge.writeLoROM(bank, addr, value)
-	case 2:
-		cartridge.writeHiROM(bank, addr, value)
-	}
+// saveFilePath returns the path of the .srm file next to the rom
+func (cartridge *Cartridge) saveFilePath() string {
+	filePath := cartridge.console.RomFilePath
+	ramFileName := getFileNameWithoutExtension(filePath)
+	ramFileDir := filepath.Dir(filepath.Clean(filePath))
+	return filepath.Join(ramFileDir, ramFileName+`.srm`)
 }
 
-func (cartridge *Cartridge) readLoROM(bank byte, addr uint16) byte {
-	if ((bank >= 0x70 && bank < 0x7e) || bank >= 0xf0) && addr < 0x8000 && cartridge.ramSize > 0 {
-		// banks 70-7e and f0-ff, adr 0000-7fff
-		// return cartridge.ram[(((uint32(bank)&0xf)<<15)|uint32(addr))&(uint32(cartridge.ramSize)-1)]
-		return cartridge.ram.Read((((uint32(bank) & 0xf) << 15) | uint32(addr)) & (uint32(cartridge.ramSize) - 1))
+func (cartridge *Cartridge) Read(bank byte, addr uint16) byte {
+	for i := 0; i < len(cartridge.chips); i++ {
+		if cartridge.chips[i].Mapped(bank, addr) {
+			return cartridge.chips[i].Read(bank, addr)
+		}
 	}
-	bank &= 0x7f
-	if addr >= 0x8000 || bank >= 0x40 {
-		// adr 8000-ffff in all banks or all addresses in banks 40-7f and c0-ff
-		return cartridge.rom[((uint32(bank)<<15)|(uint32(addr)&0x7fff))&(cartridge.romSize-1)]
+	if cartridge.board == nil {
+		return cartridge.console.openBus
 	}
-	return cartridge.console.openBus
+	return cartridge.board.Read(bank, addr)
 }
 
-func (cartridge *Cartridge) writeLoROM(bank byte, addr uint16, value byte) {
-	if ((bank >= 0x70 && bank < 0x7e) || bank > 0xf0) && addr < 0x8000 && cartridge.ramSize > 0 {
-		// banks 70-7e and f0-ff, adr 0000-7fff
-		// cartridge.ram[(((uint32(bank)&0xf)<<15)|uint32(addr))&(uint32(cartridge.ramSize)-1)] = value
-		cartridge.ram.Write((((uint32(bank)&0xf)<<15)|uint32(addr))&(uint32(cartridge.ramSize)-1), value)
+func (cartridge *Cartridge) Write(bank byte, addr uint16, value byte) {
+	for i := 0; i < len(cartridge.chips); i++ {
+		if cartridge.chips[i].Mapped(bank, addr) {
+			cartridge.chips[i].Write(bank, addr, value)
+			return
+		}
+	}
+	if cartridge.board != nil {
+		cartridge.board.Write(bank, addr, value)
 	}
 }
 
-func (cartridge *Cartridge) readHiROM(bank byte, addr uint16) byte {
-	bank &= 0x7f
-	if bank < 0x40 && addr >= 0x6000 && addr < 0x8000 && cartridge.ramSize > 0 {
-		// banks 00-3f and 80-bf, adr 6000-7fff
-		// return cartridge.ram[(((uint32(bank)&0x3f)<<13)|(uint32(addr)&0x1fff))&(uint32(cartridge.ramSize)-1)]
-		return cartridge.ram.Read((((uint32(bank) & 0x3f) << 13) | (uint32(addr) & 0x1fff)) & (uint32(cartridge.ramSize) - 1))
-	}
-	if addr >= 0x8000 || bank >= 0x40 {
-		// addr 8000-ffff in all banks or all addresses in banks 40-7f and c0-ff
-		return cartridge.rom[(((uint32(bank)&0x3f)<<16)|uint32(addr))&(uint32(cartridge.romSize)-1)]
+// dmaRead is a read of a dma channel from the cartridge, for chips
+// answering it themselves (the S-DD1 decompresses while dma reads from it)
+func (cartridge *Cartridge) dmaRead(channel int, addr uint32, size uint16) (byte, bool) {
+	for i := 0; i < len(cartridge.chips); i++ {
+		if reader, ok := cartridge.chips[i].(dmaReader); ok {
+			if value, ok := reader.dmaRead(channel, addr, size); ok {
+				return value, true
+			}
+		}
 	}
-	return cartridge.console.openBus
+	return 0, false
 }
 
-func (cartridge *Cartridge) writeHiROM(bank byte, addr uint16, value byte) {
-	bank &= 0x7f
-	if bank < 0x40 && addr >= 0x6000 && addr < 0x8000 && cartridge.ramSize > 0 {
-		// banks 00-3f and 80-bf, adr 6000-7fff
-		// cartridge.ram[(((uint32(bank)&0x3f)<<13)|(uint32(addr)&0x1fff))&(uint32(cartridge.ramSize)-1)] = value
-		cartridge.ram.Write((((uint32(bank)&0x3f)<<13)|(uint32(addr)&0x1fff))&(uint32(cartridge.ramSize)-1), value)
+// mixSamples adds the audio of the chips to sampleData
+func (cartridge *Cartridge) mixSamples(sampleData []int16, samplesPerFrame int) {
+	for i := 0; i < len(cartridge.chips); i++ {
+		if mixer, ok := cartridge.chips[i].(sampleMixer); ok {
+			mixer.mixSamples(sampleData, samplesPerFrame)
+		}
 	}
 }
 
@@ -161,4 +235,22 @@ func (cartridge *Cartridge) Close() {
 	if cartridge.ram != nil {
 		cartridge.ram.Close()
 	}
+	if cartridge.board != nil {
+		cartridge.board.Close()
+	}
+	for i := 0; i < len(cartridge.chips); i++ {
+		cartridge.chips[i].Close()
+	}
+}
+
+func (cartridge *Cartridge) serialize(s *serializer) {
+	if cartridge.ram != nil {
+		cartridge.ram.serialize(s)
+	}
+	if cartridge.board != nil {
+		cartridge.board.Serialize(s)
+	}
+	for i := 0; i < len(cartridge.chips); i++ {
+		cartridge.chips[i].Serialize(s)
+	}
 }
@@ -4,9 +4,32 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-const apuCyclesPerMaster float64 = (32040.0 * 32.0) / (1364.0 * 262.0 * 60.0)
+// the apu runs apuClockNum cycles every apuClockDen master clocks: the
+// 1024000 Hz of the spc700 against the 236250000 / 11 Hz (NTSC) or 21281370
+// Hz (PAL) master clock, reduced
+const (
+	apuClockNumNTSC int64 = 5632
+	apuClockDenNTSC int64 = 118125
+	apuClockNumPAL  int64 = 102400
+	apuClockDenPAL  int64 = 2128137
+
+	// apu cycles the apu may lag behind the cpu before it is run, ports
+	// accesses always catch it up
+	DefaultAPUSyncWindow int = 8
+)
+
+type Region int
+
+const (
+	RegionAuto Region = iota // use the region from the cartridge header
+	RegionNTSC
+	RegionPAL
+)
 
 type Console struct {
 	CPU       *CPU
@@ -18,6 +41,9 @@ type Console struct {
 	Controller1 *Controller
 	Controller2 *Controller
 
+	msu1        *MSU1        // nil if the rom has no msu-1 files
+	satellaview *Satellaview // BS-X receiver, nil without the BS-X cartridge
+
 	RAM     [0x20000]byte
 	RAMAddr uint32
 
@@ -25,9 +51,21 @@ type Console struct {
 	vPos   uint16
 	frames uint32
 
-	cpuCyclesLeft    byte
-	cpuMemOps        byte
-	apuCatchupCycles float64
+	frameDone     bool // set when the frame ends, RunFrame stops after the opcode
+	masterClock   uint64
+	cpuCycleTime  byte  // master clocks of the last cpu cycle
+	cpuCycleStart bool  // the cpu cycle hasn't run yet, dma can take the bus
+	apuClock      int64 // master clocks the apu is behind, times apuClockNum
+	apuClockNum   int64
+	apuClockDen   int64
+	apuSyncWindow int64 // apu cycles, see DefaultAPUSyncWindow
+
+	region Region // region override, set before LoadROM
+	pal    bool   // running with PAL timing
+
+	romInfo    ROMInfo // rom database entry of the loaded rom
+	romKnown   bool    // if the loaded rom is in the rom database
+	checksumOK bool    // if the header checksum matches the loaded rom
 
 	hIRQEnabled bool
 	vIRQEnabled bool
@@ -67,6 +105,8 @@ func NewConsole() *Console {
 	c.Cartridge = NewCartridge(c)
 	c.Controller1 = NewController(c)
 	c.Controller2 = NewController(c)
+	c.apuSyncWindow = int64(DefaultAPUSyncWindow)
+	c.cpuCycleTime = 8
 
 	return c
 }
@@ -79,6 +119,12 @@ func (console *Console) Reset(hard bool) {
 	console.DMA.Reset()
 	console.Controller1.Reset()
 	console.Controller2.Reset()
+	if console.msu1 != nil {
+		console.msu1.Reset()
+	}
+	if console.satellaview != nil {
+		console.satellaview.Reset()
+	}
 	if hard {
 		for i := 0; i < len(console.RAM); i++ {
 			console.RAM[i] = 0
@@ -88,9 +134,17 @@ func (console *Console) Reset(hard bool) {
 	console.hPos = 0
 	console.vPos = 0
 	console.frames = 0
-	console.cpuCyclesLeft = 52 // 5 reads (8) + 2 IntOp (6)
-	console.cpuMemOps = 0
-	console.apuCatchupCycles = 0.0
+	console.masterClock = 0
+	console.cpuCycleTime = 8
+	console.cpuCycleStart = false
+	console.apuClock = 0
+	if console.pal {
+		console.apuClockNum = apuClockNumPAL
+		console.apuClockDen = apuClockDenPAL
+	} else {
+		console.apuClockNum = apuClockNumNTSC
+		console.apuClockDen = apuClockDenNTSC
+	}
 	console.hIRQEnabled = false
 	console.vIRQEnabled = false
 	console.nmiEnabled = false
@@ -108,18 +162,103 @@ func (console *Console) Reset(hard bool) {
 	console.openBus = 0
 }
 
+// SetRegion overrides the region detected from the cartridge header. It takes
+// effect on the next LoadROM.
+func (console *Console) SetRegion(region Region) {
+	console.region = region
+}
+
+// SetDotRenderer picks the dot renderer, which draws the pixels in step with
+// the beam so register writes in the middle of a line show up there, or the
+// faster line renderer (the default), which draws each line at once.
+func (console *Console) SetDotRenderer(on bool) {
+	console.PPU.dotRenderer = on
+}
+
+// SetAPUSyncWindow sets how many apu cycles the apu may lag behind the cpu
+// before it is run (DefaultAPUSyncWindow by default). 1 keeps them in step
+// at every cycle, larger windows are faster. Accesses to the apu ports
+// always bring the apu up to date.
+func (console *Console) SetAPUSyncWindow(cycles int) {
+	if cycles < 1 {
+		cycles = 1
+	}
+	console.apuSyncWindow = int64(cycles)
+}
+
+// DMAStats returns the time dma and hdma took the bus on each line of the
+// last frame, in master clocks (1364 per line). The cpu is stopped for that
+// time.
+func (console *Console) DMAStats() []DMALineStats {
+	var stats []DMALineStats = make([]DMALineStats, console.DMA.frameLines)
+	copy(stats, console.DMA.frameStats[:console.DMA.frameLines])
+	return stats
+}
+
+// IsPAL reports whether the loaded cartridge runs with PAL timing.
+func (console *Console) IsPAL() bool {
+	return console.pal
+}
+
+// ROMInfo returns the rom database entry of the loaded rom, false if the
+// rom isn't in the database.
+func (console *Console) ROMInfo() (ROMInfo, bool) {
+	return console.romInfo, console.romKnown
+}
+
+// HeaderChecksumOK reports whether the checksum in the header of the loaded
+// rom matches the rom, a bad dump or a hacked rom otherwise.
+func (console *Console) HeaderChecksumOK() bool {
+	return console.checksumOK
+}
+
+// FrameRate returns the number of frames per second of the current region.
+func (console *Console) FrameRate() float64 {
+	if console.pal {
+		return 21281370.0 / (1364.0 * 312.0)
+	}
+	return 21477272.0 / (1364.0*262.0 - 2.0)
+}
+
+// CPURead reads at the time the cpu does, the data is latched 4 master
+// clocks before the end of the access
 func (console *Console) CPURead(addr uint32) byte {
-	console.cpuMemOps++
-	console.cpuCyclesLeft += byte(console.getAccessTime(addr))
-	return console.Read(addr)
+	var accessTime int = console.getAccessTime(addr)
+	console.cpuCycleTime = byte(accessTime)
+	console.cpuCycleStart = true
+	console.cpuStep(accessTime - 4)
+	var value byte = console.Read(addr)
+	console.cpuStep(4)
+	return value
 }
 
+// CPUWrite writes at the end of the access
 func (console *Console) CPUWrite(addr uint32, value byte) {
-	console.cpuMemOps++
-	console.cpuCyclesLeft += byte(console.getAccessTime(addr))
+	var accessTime int = console.getAccessTime(addr)
+	console.cpuCycleTime = byte(accessTime)
+	console.cpuCycleStart = true
+	console.cpuStep(accessTime)
 	console.Write(addr, value)
 }
 
+// CPUIdle is an internal cycle of the cpu
+func (console *Console) CPUIdle() {
+	console.cpuCycleTime = 6
+	console.cpuCycleStart = true
+	console.cpuStep(6)
+}
+
+// cpuStep runs the console for clocks master clocks of the cpu, the cpu
+// waits while dma or the dram refresh have the bus
+func (console *Console) cpuStep(clocks int) {
+	for clocks > 0 {
+		if console.runCycle() {
+			clocks -= 2
+			console.cpuCycleStart = false
+		}
+	}
+}
+
 func (console *Console) getAccessTime(addr uint32) int {
 	var bank byte = byte(addr >> 16)
 	addr &= 0xFFFF
@@ -169,6 +308,8 @@ func (console *Console) RRead(addr uint32) byte {
 		switch {
 		case addr < 0x2000:
 			return console.RAM[addr]
+		case addr < 0x2008 && console.msu1 != nil:
+			return console.msu1.Read(uint16(addr))
 		case addr >= 0x2100 && addr < 0x2200:
 			return console.ReadBBus(byte(addr & 0xFF))
 		case addr == 0x4016:
@@ -199,6 +340,8 @@ func (console *Console) Write(addr uint32, value byte) {
 		switch {
 		case addr < 0x2000:
 			console.RAM[addr] = value
+		case addr < 0x2008 && console.msu1 != nil:
+			console.msu1.Write(uint16(addr), value)
 		case addr >= 0x2100 && addr < 0x2200:
 			console.WriteBBus(byte(addr&0xFF), value)
 		case addr == 0x4016:
@@ -226,6 +369,8 @@ func (console *Console) ReadBBus(addr byte) byte {
 		console.RAMAddr++
 		console.RAMAddr &= 0x1FFFF
 		return ret
+	case addr >= 0x88 && addr < 0xa0 && console.satellaview != nil:
+		return console.satellaview.Read(addr, console.openBus)
 	}
 
 	return console.openBus
@@ -253,6 +398,10 @@ func (console *Console) WriteBBus(addr byte, value byte) {
 		console.RAMAddr = (console.RAMAddr & 0x100FF) | (uint32(value) << 8)
 	case 0x83:
 		console.RAMAddr = (console.RAMAddr & 0x0FFFF) | ((uint32(value) & 1) << 16)
+	default:
+		if addr >= 0x88 && addr < 0xa0 && console.satellaview != nil {
+			console.satellaview.Write(addr, value)
+		}
 	}
 }
 
@@ -392,30 +541,44 @@ func (console *Console) WriteReg(addr uint16, value byte) {
 	}
 }
 
+// catchupAPU runs the apu up to the current master clock
 func (console *Console) catchupAPU() {
-	var catchupCycles int = int(console.apuCatchupCycles)
-	for i := 0; i < catchupCycles; i++ {
+	for console.apuClock >= console.apuClockDen {
 		console.APU.Cycle()
+		console.apuClock -= console.apuClockDen
+	}
+}
+
+// syncAPU advances the master clock for the apu, running it once it lags
+// more than the sync window behind
+func (console *Console) syncAPU(masterClocks int64) {
+	console.apuClock += masterClocks * console.apuClockNum
+	if console.apuClock >= console.apuSyncWindow*console.apuClockDen {
+		console.catchupAPU()
 	}
-	console.apuCatchupCycles -= float64(catchupCycles)
 }
 
 func (console *Console) RunFrame() {
-	console.runCycle()
-	for !(console.hPos == 0 && console.vPos == 0) {
-		console.runCycle()
+	console.frameDone = false
+	for !console.frameDone {
+		console.runCPU()
 	}
 }
 
-func (console *Console) runCycle() {
-	console.apuCatchupCycles += apuCyclesPerMaster * 2.0
+// runCycle runs everything but the cpu for 2 master clocks, it returns
+// false when the cpu can't use them (dma, dram refresh)
+func (console *Console) runCycle() bool {
+	console.syncAPU(2)
 	console.Controller1.Cycle()
 	console.Controller2.Cycle()
-	// if not in dram refresh, if we are busy with hdma/dma, do that, else do cpu cycle
+	// if not in dram refresh, if we are busy with hdma/dma, do that, else the cpu has the bus
+	var cpuFree bool = false
 	if console.hPos < 536 || console.hPos >= 576 {
-		if !console.DMA.Cycle() {
-			console.runCPU()
-		}
+		cpuFree = !console.DMA.Cycle()
+	}
+	console.Cartridge.cycle()
+	if console.msu1 != nil {
+		console.msu1.Cycle()
 	}
 
 	// check for h/v timer irq's
@@ -437,12 +600,18 @@ func (console *Console) runCycle() {
 	}
 
 	// handle positional stuff
-	if console.hPos == 512 {
+	if console.PPU.dotRenderer {
+		// draw the pixels up to this dot
+		if !console.inVBlank {
+			console.PPU.runDot(int(console.vPos), console.hPos)
+		}
+	} else if console.hPos == 512 {
 		// render the line halfway of the screen for better compatibility
 		if !console.inVBlank {
 			console.PPU.runLine(int(console.vPos))
 		}
-	} else if console.hPos == 1024 {
+	}
+	if console.hPos == 1024 {
 		// start of hblank
 		if !console.inVBlank {
 			console.DMA.doHDMA()
@@ -455,23 +624,31 @@ func (console *Console) runCycle() {
 	}
 
 	// increment position
-	// exact frame timing line 240 on odd frame is 4 cycles shorter. (1360)
+	// exact frame timing line 240 on odd frame is 4 cycles shorter. (1360) (NTSC only)
 	console.hPos += 2
-	if console.hPos == 1364 || (!console.PPU.interlace && !console.PPU.evenFrame && console.vPos == 240 && console.hPos == 1360) {
+	console.masterClock += 2
+	if console.hPos == 1364 || (!console.pal && !console.PPU.interlace && !console.PPU.evenFrame && console.vPos == 240 && console.hPos == 1360) {
+		console.DMA.endLine(console.vPos)
 		console.hPos = 0
 		console.vPos++
 
+		// NTSC has 262 lines, PAL has 312 lines
 		var endVPos uint16
-		// even frames in interlace is 1 extra line
-		if console.PPU.interlace && console.PPU.evenFrame {
-			endVPos = 262
+		if console.pal {
+			endVPos = 311
 		} else {
 			endVPos = 261
 		}
+		// even frames in interlace is 1 extra line
+		if console.PPU.interlace && console.PPU.evenFrame {
+			endVPos++
+		}
 
 		if console.vPos == (endVPos + 1) {
+			console.DMA.endFrame(int(console.vPos))
 			console.vPos = 0
 			console.frames++
+			console.frameDone = true
 			console.catchupAPU() // catch up the apu at the end of the frame
 		}
 	}
@@ -514,22 +691,57 @@ func (console *Console) runCycle() {
 	if console.Debug {
 		console.debugPrint()
 	}
+
+	return cpuFree
 }
 
+// runCPU runs an opcode, its accesses run the rest of the console
 func (console *Console) runCPU() {
-	if console.cpuCyclesLeft == 0 {
-		console.cpuMemOps = 0
-		var cycles int = console.CPU.runOpcode()
-		console.CPU.cycleCounter += uint64(cycles)
-		console.cpuCyclesLeft += byte((cycles - int(console.cpuMemOps)) * 6)
+	if console.Debug {
+		fmt.Printf("%s\n", console.CPU.getProcessorStateCPU())
+	}
+	var cycles int = console.CPU.runOpcode()
+	console.CPU.cycleCounter += uint64(cycles)
+}
 
+// LoadROMs loads a rom made of several files: the Sufami Turbo BIOS with one
+// or two mini cartridges (slot A first), or the Super Game Boy BIOS with a
+// Game Boy rom. A single file is loaded with LoadROM.
+func (console *Console) LoadROMs(files []ROMFile) error {
+	if len(files) == 1 {
+		return console.LoadROM(files[0].Path, files[0].Data, len(files[0].Data))
 	}
-	console.cpuCyclesLeft -= 2
+	for i := 0; i < len(files); i++ {
+		if isGameBoyFile(files[i].Path) {
+			return console.loadSuperGameBoy(files)
+		}
+	}
+	return console.loadSufamiTurbo(files)
 }
 
 func (console *Console) LoadROM(romFilePath string, data []byte, dataLen int) error {
+	if isGameBoyFile(romFilePath) {
+		// Game Boy rom, run it in the Super Game Boy
+		var biosPath string = filepath.Join(filepath.Dir(filepath.Clean(romFilePath)), "sgb.rom")
+		bios, err := os.ReadFile(biosPath)
+		if err != nil {
+			return errors.New("Failed to load rom: Super Game Boy BIOS sgb.rom not found next to the Game Boy rom\n")
+		}
+		return console.loadSuperGameBoy([]ROMFile{{Path: biosPath, Data: bios}, {Path: romFilePath, Data: data[:dataLen]}})
+	}
+
 	console.RomFilePath = romFilePath
 
+	if strings.EqualFold(filepath.Ext(romFilePath), ".bs") {
+		// memory pack, boot it with the BS-X BIOS
+		bios, err := os.ReadFile(filepath.Join(filepath.Dir(filepath.Clean(romFilePath)), "bsx.rom"))
+		if err != nil {
+			return errors.New("Failed to load rom: BS-X BIOS bsx.rom not found next to the memory pack\n")
+		}
+		data = bios
+		dataLen = len(bios)
+	}
+
 	if len(data) < 0x8000 {
 		// if smaller than smallest possible, don't load
 		msg := fmt.Sprintf("Failed to load rom: rom to small (%d bytes)\n", len(data))
@@ -537,7 +749,7 @@ func (console *Console) LoadROM(romFilePath string, data []byte, dataLen int) er
 	}
 
 	// check headers
-	var headers [4]CartridgeHeader
+	var headers [8]CartridgeHeader
 	for i := 0; i < len(headers); i++ {
 		headers[i].score = -50
 	}
@@ -553,6 +765,18 @@ func (console *Console) LoadROM(romFilePath string, data []byte, dataLen int) er
 	if dataLen >= 0x10200 {
 		console.readHeader(data, 0x101c0, &headers[3])
 	}
+	if dataLen >= 0x408000 {
+		console.readHeader(data, 0x407fc0, &headers[4])
+	}
+	if dataLen >= 0x408200 {
+		console.readHeader(data, 0x4081c0, &headers[5])
+	}
+	if dataLen >= 0x410000 {
+		console.readHeader(data, 0x40ffc0, &headers[6])
+	}
+	if dataLen >= 0x410200 {
+		console.readHeader(data, 0x4101c0, &headers[7])
+	}
 	// see which it is
 	var max int = 0
 	var used int = 0
@@ -562,14 +786,49 @@ func (console *Console) LoadROM(romFilePath string, data []byte, dataLen int) er
 			used = i
 		}
 	}
+	// a known dump is mapped like the rom database says, a manifest next to
+	// the rom wins over both
+	var overrides []*manifest
+	console.romInfo = ROMInfo{}
+	console.romKnown = false
+	if entry, copier := lookupROM(data[:dataLen]); entry != nil {
+		var dbManifest manifest = *entry.manifest
+		dbManifest.copier = copier
+		overrides = append(overrides, &dbManifest)
+		console.romInfo = entry.info
+		console.romKnown = true
+		log.Printf("ROM: Database: \"%s\", CRC32: %08x\n", entry.info.Title, entry.info.CRC32)
+		if !entry.info.Good {
+			log.Printf("ROM: Known bad dump\n")
+		}
+	}
+	romManifest, err := loadManifest(romFilePath)
+	if err != nil {
+		return err
+	}
+	if romManifest != nil {
+		overrides = append(overrides, romManifest)
+	}
+	for i := 0; i < len(overrides); i++ {
+		used, err = overrides[i].headerIndex(used, dataLen)
+		if err != nil {
+			return err
+		}
+		overrides[i].apply(&headers[used])
+	}
 	if (used & 1) > 0 {
 		// odd-numbered ones are for headered roms
 		// data += 0x200    // move pointer past header
 		copy(data[:], data[0x200:])
 		dataLen -= 0x200 // and subtract from size
 	}
+	for i := 0; i < len(overrides); i++ {
+		if overrides[i].romSize > 0 && dataLen > overrides[i].romSize {
+			dataLen = overrides[i].romSize
+		}
+	}
 	// check if we can load it
-	if headers[used].cartType > 2 {
+	if headers[used].cartType > 5 {
 		msg := fmt.Sprintf("Failed to load rom: unsupported type (%d)\n", headers[used].cartType)
 		return errors.New(msg)
 	}
@@ -594,23 +853,71 @@ func (console *Console) LoadROM(romFilePath string, data []byte, dataLen int) er
 		test *= 2
 	}
 
+	var checksum uint16 = romChecksum(newData)
+	console.checksumOK = headers[used].checksum == checksum && (headers[used].checksum^headers[used].checksumComplement) == 0xffff
+	if !console.checksumOK {
+		log.Printf("ROM: Header checksum $%04x (complement $%04x) does not match the rom checksum $%04x\n", headers[used].checksum, headers[used].checksumComplement, checksum)
+	}
+
 	// load it
-	if headers[used].cartType == 2 {
+	switch headers[used].cartType {
+	case 2:
 		log.Printf("ROM: Loaded %s rom \"%s\"\n", "HiROM", headers[used].name)
-	} else {
+	case 3:
+		log.Printf("ROM: Loaded %s rom \"%s\"\n", "SPC7110", headers[used].name)
+	case 4:
+		log.Printf("ROM: Loaded %s rom \"%s\"\n", "ExHiROM", headers[used].name)
+	case 5:
+		log.Printf("ROM: Loaded %s rom \"%s\"\n", "ExLoROM", headers[used].name)
+	default:
 		log.Printf("ROM: Loaded %s rom \"%s\"\n", "LoROM", headers[used].name)
 	}
 
+	switch console.region {
+	case RegionNTSC:
+		console.pal = false
+	case RegionPAL:
+		console.pal = true
+	default:
+		console.pal = headers[used].pal
+	}
+	if console.pal {
+		log.Printf("ROM: Region: %s\n", "PAL")
+	} else {
+		log.Printf("ROM: Region: %s\n", "NTSC")
+	}
+
 	var ramSize int
 	if headers[used].chips > 0 {
 		ramSize = int(headers[used].ramSize)
 	} else {
 		ramSize = 0
 	}
-	console.Cartridge.Load(int(headers[used].cartType), newData, newLength, ramSize, headers[used].coprocessor)
+	if headers[used].coprocessor == 1 && headers[used].exRamSize > 0 {
+		// SuperFX: the game pak ram size is in the expansion ram field
+		ramSize = int(headers[used].exRamSize)
+	}
+	for i := 0; i < len(overrides); i++ {
+		if overrides[i].ramSize >= 0 {
+			ramSize = overrides[i].ramSize
+		}
+	}
+	if err := console.Cartridge.Load(int(headers[used].cartType), newData, newLength, ramSize, &headers[used]); err != nil {
+		return err
+	}
 
 	log.Printf("ROM: Coprocessor Type: %d\n", headers[used].coprocessor)
 
+	if console.msu1 != nil {
+		console.msu1.Close()
+	}
+	console.msu1 = NewMSU1(console, romFilePath)
+
+	console.satellaview = nil
+	if _, ok := console.Cartridge.board.(*BSX); ok {
+		console.satellaview = NewSatellaview(romFilePath)
+	}
+
 	console.Reset(true) // reset after loading
 
 	return nil
@@ -666,7 +973,9 @@ func (console *Console) readHeader(data []byte, offset int, header *CartridgeHea
 		}
 		header.gameCode[4] = 0
 		header.flashSize = 0x400 << data[offset-4]
-		header.exRamSize = 0x400 << data[offset-3]
+		if data[offset-3] > 0 {
+			header.exRamSize = 0x400 << data[offset-3]
+		}
 		header.specialVersion = data[offset-2]
 		header.exCoprocessor = data[offset-1]
 	} else if data[offset+0x14] == 0 {
@@ -678,10 +987,21 @@ func (console *Console) readHeader(data []byte, offset int, header *CartridgeHea
 	header.pal = (header.region >= 0x2 && header.region <= 0xc) || header.region == 0x11
 
 	// set cartType
-	if offset < 0x9000 {
+	switch {
+	case offset < 0x9000:
 		header.cartType = 1
-	} else {
+	case offset < 0x400000:
 		header.cartType = 2
+		if header.mode == 0xa && header.coprocessor == 0xf {
+			// SPC7110 ($3a)
+			header.cartType = 3
+		}
+	case offset < 0x409000:
+		// ExLoROM, header at $407fc0
+		header.cartType = 5
+	default:
+		// ExHiROM, header at $40ffc0
+		header.cartType = 4
 	}
 
 	// get score
@@ -698,7 +1018,7 @@ func (console *Console) calculateScore(data []byte, offset int, header *Cartridg
 	} else {
 		score += -4
 	}
-	if header.mode <= 3 || header.mode == 5 {
+	if header.mode <= 3 || header.mode == 5 || header.mode == 0xa {
 		score += 5
 	} else {
 		score += -2
@@ -718,6 +1038,10 @@ func (console *Console) calculateScore(data []byte, offset int, header *Cartridg
 	} else {
 		score += -2
 	}
+	if header.cartType == 4 && header.mode == 5 {
+		// ExHiROM ($x5) header where it should be
+		score += 4
+	}
 	if header.checksum+header.checksumComplement == 0xffff {
 		score += 8
 	} else {
@@ -776,6 +1100,10 @@ func (console *Console) SetAudioSamples(sampleData []int16, samplesPerFrame int)
 	// size is 2 (int16) * 2 (stereo) * samplesPerFrame
 	// sets samples in the sampleData
 	console.APU.dsp.getSamples(sampleData, samplesPerFrame)
+	if console.msu1 != nil {
+		console.msu1.mixSamples(sampleData, samplesPerFrame)
+	}
+	console.Cartridge.mixSamples(sampleData, samplesPerFrame)
 }
 
 func (console *Console) SetButtonState(player int, button int, pressed bool) {
@@ -798,14 +1126,7 @@ func (console *Console) SetButtonState(player int, button int, pressed bool) {
 
 func (console *Console) debugPrint() {
 	console.catchupAPU()
-	if console.DMA.hdmaTimer > 0 || console.DMA.dmaBusy || (console.hPos >= 536 && console.hPos < 576) {
-		// nothing done
-	} else {
-		if console.cpuCyclesLeft == 0 {
-			fmt.Printf("%s\n", console.CPU.getProcessorStateCPU())
-		}
-	}
-	if console.apuCatchupCycles+(apuCyclesPerMaster*2.0) >= 1.0 {
+	if console.apuClock+2*console.apuClockNum >= console.apuClockDen {
 		// we will run a apu cycle next call, see if it also starts a opcode
 		if console.APU.cpuCyclesLeft == 0 {
 			fmt.Printf("%s\n", console.APU.spc.getProcessorStateSPC())
@@ -817,4 +1138,7 @@ func (console *Console) debugPrint() {
 
 func (console *Console) Close() {
 	console.Cartridge.Close()
+	if console.msu1 != nil {
+		console.msu1.Close()
+	}
 }
@@ -48,3 +48,10 @@ func (controller *Controller) Read() byte {
 	controller.latchedState |= 0x8000
 	return ret
 }
+
+func (controller *Controller) serialize(s *serializer) {
+	// currentState is host input, it is not part of the machine state
+	s.u8(&controller.controllerType)
+	s.bool(&controller.latchLine)
+	s.u16(&controller.latchedState)
+}
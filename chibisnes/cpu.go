@@ -1,7 +1,20 @@
 package chibisnes
 
+import "log"
+
+// cpuBus is the memory bus a 65816 core runs on, the S-CPU uses the console,
+// the SA-1 uses its own memory map. Each access and internal cycle is made
+// when the cpu gets to it, so the bus can run the rest of the machine for
+// its time.
+type cpuBus interface {
+	CPURead(addr uint32) byte
+	CPUWrite(addr uint32, value byte)
+	CPUIdle() // an internal cycle, without a bus access
+}
+
 type CPU struct {
 	console *Console
+	bus     cpuBus
 
 	a  uint16
 	x  uint16
@@ -26,6 +39,10 @@ type CPU struct {
 	// interrupts
 	irqWanted bool
 	nmiWanted bool
+	irqPoll   bool // irqWanted at the start of the last cycle
+	nmiPoll   bool // nmiWanted at the start of the last cycle
+
+	resetPending bool // the reset sequence runs as the next opcode
 
 	// power state (WAI/STP)
 	waiting bool
@@ -33,6 +50,8 @@ type CPU struct {
 
 	// internal use
 	cyclesUsed   uint8 // indicates how many cycles an opcode used
+	accesses     uint8 // bus accesses made by the opcode
+	idles        uint8 // internal cycles made by the opcode
 	cycleCounter uint64
 }
 
@@ -69,12 +88,20 @@ var cyclesPerCPUOpcode [256]int = [256]int{
 func NewCPU(c *Console) *CPU {
 	return &CPU{
 		console: c,
+		bus:     c,
+	}
+}
+
+func newCPUOnBus(c *Console, bus cpuBus) *CPU {
+	return &CPU{
+		console: c,
+		bus:     bus,
 	}
 }
 
 func (cpu *CPU) Reset() {
 	cpu.sp = 0x100
-	cpu.pc = uint16(cpu.Read(0xFFFC)) | (uint16(cpu.Read(0xFFFD)) << 8)
+	cpu.resetPending = true
 
 	// cpu.SetFlags(CPUFlagsInterrupt | CPUFlagsIndexRegisterSize | CPUFlagsAccumulateRegisterSize)
 	cpu.i = 0x01
@@ -147,33 +174,93 @@ func (cpu *CPU) CheckEmulationFlag() bool {
 }
 
 func (cpu *CPU) runOpcode() int {
-	cpu.cyclesUsed = 0
+	cpu.startOpcode(0)
 
+	if cpu.resetPending {
+		// 2 internal cycles, 3 stack reads in place of the pushes, the vector
+		cpu.resetPending = false
+		cpu.cyclesUsed = 7
+		cpu.idle()
+		cpu.idle()
+		for i := uint16(0); i < 3; i++ {
+			cpu.Read(uint32(0x0100 | ((cpu.sp - i) & 0xFF)))
+		}
+		cpu.pc = cpu.ReadWord(0xFFFC, 0xFFFD)
+		return int(cpu.cyclesUsed)
+	}
 	if cpu.stopped {
+		cpu.cyclesUsed = 1
+		cpu.idle()
 		return 1
 	}
 	if cpu.waiting {
 		if cpu.irqWanted || cpu.nmiWanted {
 			cpu.waiting = false
 		}
+		cpu.cyclesUsed = 1
+		cpu.idle()
 		return 1
 	}
 
 	var opcode uint8 = cpu.readOpcode()
 	cpu.cyclesUsed = uint8(cyclesPerCPUOpcode[opcode])
 	cpu.doOpcode(opcode)
-
-	if (!cpu.CheckFlag(CPUFlagsInterrupt) && cpu.irqWanted) || cpu.nmiWanted {
-		cpu.cyclesUsed = 7
-		if cpu.nmiWanted {
+	cpu.finishOpcode()
+	var cycles int = int(cpu.cyclesUsed)
+
+	// the interrupt lines are polled at the start of the last cycle, an
+	// interrupt coming later waits for the next opcode
+	if (!cpu.CheckFlag(CPUFlagsInterrupt) && cpu.irqPoll) || cpu.nmiPoll {
+		cpu.startOpcode(7)
+		cpu.idle()
+		cpu.idle()
+		if cpu.nmiPoll {
 			cpu.nmiWanted = false
 			cpu.doInterrupt(false)
 		} else {
 			cpu.doInterrupt(true)
 		}
+		cpu.finishOpcode()
+		cycles += int(cpu.cyclesUsed)
+	}
+
+	return cycles
+}
+
+func (cpu *CPU) startOpcode(cycles uint8) {
+	cpu.cyclesUsed = cycles
+	cpu.accesses = 0
+	cpu.idles = 0
+}
+
+// finishOpcode makes the internal cycles an opcode counted but didn't make
+// (the cpu test checks that there are none), in debug mode it logs them
+func (cpu *CPU) finishOpcode() {
+	if cpu.console.Debug && int(cpu.accesses)+int(cpu.idles) != int(cpu.cyclesUsed) {
+		log.Printf("CPU: %d cycles counted, %d accesses and %d internal cycles made\n", cpu.cyclesUsed, cpu.accesses, cpu.idles)
 	}
+	for int(cpu.accesses)+int(cpu.idles) < int(cpu.cyclesUsed) {
+		cpu.idle()
+	}
+}
+
+// idle runs an internal cycle counted in cyclesPerCPUOpcode
+func (cpu *CPU) idle() {
+	cpu.poll()
+	cpu.idles++
+	cpu.bus.CPUIdle()
+}
 
-	return int(cpu.cyclesUsed)
+// extraIdle runs an internal cycle added to cyclesPerCPUOpcode
+func (cpu *CPU) extraIdle() {
+	cpu.cyclesUsed++
+	cpu.idle()
+}
+
+// poll latches the interrupt lines at the start of a cycle
+func (cpu *CPU) poll() {
+	cpu.irqPoll = cpu.irqWanted
+	cpu.nmiPoll = cpu.nmiWanted
 }
 
 func (cpu *CPU) readOpcode() byte {
@@ -229,7 +316,7 @@ func (cpu *CPU) setZN(value uint16, isByte bool) {
 
 func (cpu *CPU) branch(value byte, check bool) {
 	if check {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 		// XXX: signed
 		cpu.pc = uint16(int16(cpu.pc) + int16(int8(value)))
 	}
@@ -262,11 +349,15 @@ func (cpu *CPU) pushWord(value uint16) {
 }
 
 func (cpu *CPU) Read(addr uint32) byte {
-	return cpu.console.CPURead(addr)
+	cpu.poll()
+	cpu.accesses++
+	return cpu.bus.CPURead(addr)
 }
 
 func (cpu *CPU) Write(addr uint32, value byte) {
-	cpu.console.CPUWrite(addr, value)
+	cpu.poll()
+	cpu.accesses++
+	cpu.bus.CPUWrite(addr, value)
 }
 
 func (cpu *CPU) ReadWord(addrLow uint32, addrHi uint32) uint16 {
@@ -320,7 +411,7 @@ func (cpu *CPU) addrImm(low *uint32, xFlag bool) uint32 {
 func (cpu *CPU) addrDp(low *uint32) uint32 {
 	addr := cpu.readOpcode()
 	if (cpu.dp & 0xFF) > 0 {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 	}
 	*low = uint32((cpu.dp + uint16(addr)) & 0xFFFF)
 	return uint32((cpu.dp + uint16(addr) + 1) & 0xFFFF)
@@ -329,8 +420,9 @@ func (cpu *CPU) addrDp(low *uint32) uint32 {
 func (cpu *CPU) addrDpx(low *uint32) uint32 {
 	addr := cpu.readOpcode()
 	if (cpu.dp & 0xFF) > 0 {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 	}
+	cpu.idle() // index
 	base := cpu.dp + uint16(addr) + cpu.x
 	*low = uint32(base & 0xFFFF)
 	return uint32((base + 1) & 0xFFFF)
@@ -339,8 +431,9 @@ func (cpu *CPU) addrDpx(low *uint32) uint32 {
 func (cpu *CPU) addrDpy(low *uint32) uint32 {
 	addr := cpu.readOpcode()
 	if (cpu.dp & 0xFF) > 0 {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 	}
+	cpu.idle() // index
 	base := cpu.dp + uint16(addr) + cpu.y
 	*low = uint32(base & 0xFFFF)
 	return uint32((base + 1) & 0xFFFF)
@@ -349,7 +442,7 @@ func (cpu *CPU) addrDpy(low *uint32) uint32 {
 func (cpu *CPU) addrIdp(low *uint32) uint32 {
 	addr := cpu.readOpcode()
 	if (cpu.dp & 0xFF) > 0 {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 	}
 	base := (cpu.dp + uint16(addr))
 	pointer := cpu.ReadWord(uint32(base&0xFFFF), uint32((base+1)&0xFFFF))
@@ -360,8 +453,9 @@ func (cpu *CPU) addrIdp(low *uint32) uint32 {
 func (cpu *CPU) addrIdx(low *uint32) uint32 {
 	addr := cpu.readOpcode()
 	if (cpu.dp & 0xFF) > 0 {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 	}
+	cpu.idle() // index
 	base := cpu.dp + uint16(addr) + cpu.x
 	pointer := cpu.ReadWord(uint32((base)&0xFFFF), uint32((base+1)&0xFFFF))
 	*low = (uint32(cpu.db) << 16) + uint32(pointer)
@@ -371,12 +465,15 @@ func (cpu *CPU) addrIdx(low *uint32) uint32 {
 func (cpu *CPU) addrIdy(low *uint32, write bool) uint32 {
 	addr := cpu.readOpcode()
 	if (cpu.dp & 0xFF) > 0 {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 	}
 	base := cpu.dp + uint16(addr)
 	pointer := cpu.ReadWord(uint32(base&0xFFFF), uint32((base+1)&0xFFFF))
 	if write && (!cpu.CheckFlag(CPUFlagsIndexRegisterSize) || ((pointer >> 8) != ((pointer + cpu.y) >> 8))) {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
+	}
+	if write {
+		cpu.idle() // index
 	}
 	// x = 0 or page crossed, with writing opcode: 1 extra cycle
 	*low = (uint32(cpu.db) << 16) + uint32(pointer) + uint32(cpu.y)&0xFFFFFFFF
@@ -386,7 +483,7 @@ func (cpu *CPU) addrIdy(low *uint32, write bool) uint32 {
 func (cpu *CPU) addrIdl(low *uint32) uint32 {
 	addr := cpu.readOpcode()
 	if (cpu.dp & 0xFF) > 0 {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 	}
 	base := (cpu.dp + uint16(addr))
 	pointer := uint32(cpu.ReadWord(uint32(base&0xFFFF), uint32((base+1)&0xFFFF)))
@@ -398,7 +495,7 @@ func (cpu *CPU) addrIdl(low *uint32) uint32 {
 func (cpu *CPU) addrIly(low *uint32) uint32 {
 	addr := cpu.readOpcode()
 	if (cpu.dp & 0xFF) > 0 {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
 	}
 	base := (cpu.dp + uint16(addr))
 	pointer := uint32(cpu.ReadWord(uint32(base&0xFFFF), uint32((base+1)&0xFFFF)))
@@ -409,6 +506,7 @@ func (cpu *CPU) addrIly(low *uint32) uint32 {
 
 func (cpu *CPU) addrSr(low *uint32) uint32 {
 	addr := cpu.readOpcode()
+	cpu.idle()
 	base := cpu.sp + uint16(addr)
 	*low = uint32((base) & 0xFFFF)
 	return uint32((base + 1) & 0xFFFF)
@@ -416,8 +514,10 @@ func (cpu *CPU) addrSr(low *uint32) uint32 {
 
 func (cpu *CPU) addrIsy(low *uint32) uint32 {
 	addr := cpu.readOpcode()
+	cpu.idle()
 	base := cpu.sp + uint16(addr)
 	pointer := cpu.ReadWord(uint32(base&0xFFFF), uint32((base+1)&0xFFFF))
+	cpu.idle() // index
 	*low = ((uint32(cpu.db) << 16) + uint32(pointer) + uint32(cpu.y)) & 0xFFFFFFFF
 	return ((uint32(cpu.db) << 16) + uint32(pointer) + uint32(cpu.y) + 1) & 0xFFFFFFFF
 }
@@ -431,7 +531,10 @@ func (cpu *CPU) addrAbs(low *uint32) uint32 {
 func (cpu *CPU) addrAbx(low *uint32, write bool) uint32 {
 	addr := cpu.readOpcodeWord()
 	if write && (!cpu.CheckFlag(CPUFlagsIndexRegisterSize) || ((addr >> 8) != ((addr + cpu.x) >> 8))) {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
+	}
+	if write {
+		cpu.idle() // index
 	}
 	base := (uint32(cpu.db) << 16) + uint32(addr) + uint32(cpu.x)
 	*low = (base & 0xFFFFFFFF)
@@ -441,7 +544,10 @@ func (cpu *CPU) addrAbx(low *uint32, write bool) uint32 {
 func (cpu *CPU) addrAby(low *uint32, write bool) uint32 {
 	addr := cpu.readOpcodeWord()
 	if write && (!cpu.CheckFlag(CPUFlagsIndexRegisterSize) || ((addr >> 8) != ((addr + cpu.y) >> 8))) {
-		cpu.cyclesUsed++
+		cpu.extraIdle()
+	}
+	if write {
+		cpu.idle() // index
 	}
 	base := (uint32(cpu.db) << 16) + uint32(addr) + uint32(cpu.y)
 	*low = (base & 0xFFFFFFFF)
@@ -464,8 +570,41 @@ func (cpu *CPU) addrAlx(low *uint32) uint32 {
 
 func (cpu *CPU) addrIax() uint16 {
 	addr := cpu.readOpcodeWord()
+	cpu.idle() // index
 	baseLow := uint32(addr) + uint32(cpu.x)
 	baseHigh := uint32(cpu.k) << 16
 	v := cpu.ReadWord((baseHigh | (baseLow & 0xFFFF)), (baseHigh | ((baseLow + 1) & 0xFFFF)))
 	return v
 }
+
+func (cpu *CPU) serialize(s *serializer) {
+	s.u16(&cpu.a)
+	s.u16(&cpu.x)
+	s.u16(&cpu.y)
+	s.u16(&cpu.sp)
+	s.u16(&cpu.pc)
+	s.u16(&cpu.dp)
+	s.u8(&cpu.k)
+	s.u8(&cpu.db)
+
+	s.u8(&cpu.c)
+	s.u8(&cpu.z)
+	s.u8(&cpu.i)
+	s.u8(&cpu.d)
+	s.u8(&cpu.xf)
+	s.u8(&cpu.mf)
+	s.u8(&cpu.v)
+	s.u8(&cpu.n)
+	s.u8(&cpu.e)
+
+	s.bool(&cpu.irqWanted)
+	s.bool(&cpu.nmiWanted)
+	s.bool(&cpu.irqPoll)
+	s.bool(&cpu.nmiPoll)
+	s.bool(&cpu.resetPending)
+	s.bool(&cpu.waiting)
+	s.bool(&cpu.stopped)
+
+	s.u8(&cpu.cyclesUsed)
+	s.u64(&cpu.cycleCounter)
+}
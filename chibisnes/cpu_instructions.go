@@ -4,8 +4,9 @@ func (cpu *CPU) doOpcode(opcode byte) {
 	switch opcode {
 	case 0x00:
 		// brk imp
+		cpu.readOpcode() // signature
 		cpu.pushByte(cpu.k)
-		cpu.pushWord(cpu.pc + 1)
+		cpu.pushWord(cpu.pc)
 		cpu.pushByte(cpu.Flags())
 		cpu.cyclesUsed++ // native mode: 1 extra cycle
 		cpu.SetFlags(CPUFlagsInterrupt)
@@ -55,6 +56,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.ora(low, high)
 	case 0x08:
 		// php imp
+		cpu.idle()
 		cpu.pushByte(cpu.Flags())
 	case 0x09:
 		// ora imm(m)
@@ -63,6 +65,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.ora(low, high)
 	case 0x0a:
 		// asla imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 			if (cpu.a & 0x80) > 0 {
 				cpu.SetFlags(CPUFlagsCarry)
@@ -81,6 +84,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.a, cpu.mf == 1)
 	case 0x0b:
 		// phd imp
+		cpu.idle()
 		cpu.pushWord(cpu.dp)
 	case 0x0c:
 		// tsb abs
@@ -142,6 +146,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.ora(low, high)
 	case 0x18:
 		// clc imp
+		cpu.idle()
 		cpu.ClearFlags(CPUFlagsCarry)
 	case 0x19:
 		// ora aby(r)
@@ -150,6 +155,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.ora(low, high)
 	case 0x1a:
 		// inca imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 			cpu.a = (cpu.a & 0xff00) | ((cpu.a + 1) & 0xff)
 		} else {
@@ -158,6 +164,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.a, cpu.mf == 1)
 	case 0x1b:
 		// tcs imp
+		cpu.idle()
 		cpu.sp = cpu.a
 	case 0x1c:
 		// trb abs
@@ -182,6 +189,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 	case 0x20:
 		// jsr abs
 		var value uint16 = cpu.readOpcodeWord()
+		cpu.idle()
 		cpu.pushWord(cpu.pc - 1)
 		cpu.pc = value
 	case 0x21:
@@ -192,8 +200,9 @@ func (cpu *CPU) doOpcode(opcode byte) {
 	case 0x22:
 		// jsl abl
 		var value uint16 = cpu.readOpcodeWord()
-		var newK byte = cpu.readOpcode()
 		cpu.pushByte(cpu.k)
+		cpu.idle()
+		var newK byte = cpu.readOpcode()
 		cpu.pushWord(cpu.pc - 1)
 		cpu.pc = value
 		cpu.k = newK
@@ -224,6 +233,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.and(low, high)
 	case 0x28:
 		// plp imp
+		cpu.idle()
+		cpu.idle()
 		cpu.SetAllFlags(cpu.pullByte())
 	case 0x29:
 		// and imm(m)
@@ -232,6 +243,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.and(low, high)
 	case 0x2a:
 		// rola imp
+		cpu.idle()
 		var result int = (int(cpu.a) << 1) | int(cpu.c)
 
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
@@ -253,6 +265,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.a, cpu.mf == 1)
 	case 0x2b:
 		// pld imp
+		cpu.idle()
+		cpu.idle()
 		cpu.dp = cpu.pullWord()
 		cpu.setZN(cpu.dp, false)
 	case 0x2c:
@@ -315,6 +329,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.and(low, high)
 	case 0x38:
 		// sec imp
+		cpu.idle()
 		cpu.SetFlags(CPUFlagsCarry)
 	case 0x39:
 		// and aby(r)
@@ -323,6 +338,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.and(low, high)
 	case 0x3a:
 		// deca imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 			cpu.a = (cpu.a & 0xff00) | ((cpu.a - 1) & 0xff)
 		} else {
@@ -331,6 +347,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.a, cpu.mf == 1)
 	case 0x3b:
 		// tsc imp
+		cpu.idle()
 		cpu.a = cpu.sp
 		cpu.setZN(cpu.a, false)
 	case 0x3c:
@@ -355,6 +372,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.and(low, high)
 	case 0x40:
 		// rti imp
+		cpu.idle()
+		cpu.idle()
 		cpu.SetAllFlags(cpu.pullByte())
 		cpu.cyclesUsed++ // native mode: 1 extra cycle
 		cpu.pc = cpu.pullWord()
@@ -378,6 +397,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		var src byte = cpu.readOpcode()
 		cpu.db = dest
 		cpu.Write((uint32(dest)<<16)|uint32(cpu.y), cpu.Read((uint32(src)<<16)|uint32(cpu.x)))
+		cpu.idle()
+		cpu.idle()
 		cpu.a--
 		cpu.x--
 		cpu.y--
@@ -405,6 +426,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.eor(low, high)
 	case 0x48:
 		// pha imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 			cpu.pushByte(byte(cpu.a))
 		} else {
@@ -418,6 +440,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.eor(low, high)
 	case 0x4a:
 		// lsra imp
+		cpu.idle()
 		if (cpu.a & 1) > 0 {
 			cpu.SetFlags(CPUFlagsCarry)
 		} else {
@@ -431,6 +454,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.a, cpu.mf == 1)
 	case 0x4b:
 		// phk imp
+		cpu.idle()
 		cpu.pushByte(cpu.k)
 	case 0x4c:
 		// jmp abs
@@ -474,6 +498,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		var src byte = cpu.readOpcode()
 		cpu.db = dest
 		cpu.Write((uint32(dest)<<16)|uint32(cpu.y), cpu.Read((uint32(src)<<16)|uint32(cpu.x)))
+		cpu.idle()
+		cpu.idle()
 		cpu.a--
 		cpu.x++
 		cpu.y++
@@ -501,6 +527,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.eor(low, high)
 	case 0x58:
 		// cli imp
+		cpu.idle()
 		cpu.ClearFlags(CPUFlagsInterrupt)
 	case 0x59:
 		// eor aby(r)
@@ -509,6 +536,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.eor(low, high)
 	case 0x5a:
 		// phy imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.pushByte(byte(cpu.y))
 		} else {
@@ -517,6 +545,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		}
 	case 0x5b:
 		// tcd imp
+		cpu.idle()
 		cpu.dp = cpu.a
 		cpu.setZN(cpu.dp, false)
 	case 0x5c:
@@ -541,7 +570,10 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.eor(low, high)
 	case 0x60:
 		// rts imp
+		cpu.idle()
+		cpu.idle()
 		cpu.pc = cpu.pullWord() + 1
+		cpu.idle()
 	case 0x61:
 		// adc idx
 		var low uint32 = 0
@@ -550,6 +582,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 	case 0x62:
 		// per rll
 		var value uint16 = cpu.readOpcodeWord()
+		cpu.idle()
 		cpu.pushWord(cpu.pc + uint16(value))
 	case 0x63:
 		// adc sr
@@ -578,6 +611,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.adc(low, high)
 	case 0x68:
 		// pla imp
+		cpu.idle()
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 			cpu.a = (cpu.a & 0xff00) | uint16(cpu.pullByte())
 		} else {
@@ -592,6 +627,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.adc(low, high)
 	case 0x6a:
 		// rora imp
+		cpu.idle()
 		var carry bool = (cpu.a & 1) > 0
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 			cpu.a = (cpu.a & 0xff00) | ((cpu.a >> 1) & 0x7f) | (uint16(cpu.c) << 7)
@@ -606,6 +642,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.a, cpu.mf == 1)
 	case 0x6b:
 		// rtl imp
+		cpu.idle()
+		cpu.idle()
 		cpu.pc = cpu.pullWord() + 1
 		cpu.k = cpu.pullByte()
 	case 0x6c:
@@ -667,6 +705,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.adc(low, high)
 	case 0x78:
 		// sei imp
+		cpu.idle()
 		cpu.SetFlags(CPUFlagsInterrupt)
 	case 0x79:
 		// adc aby(r)
@@ -675,6 +714,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.adc(low, high)
 	case 0x7a:
 		// ply imp
+		cpu.idle()
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.y = uint16(cpu.pullByte())
 		} else {
@@ -684,6 +725,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.y, cpu.xf == 1)
 	case 0x7b:
 		// tdc imp
+		cpu.idle()
 		cpu.a = cpu.dp
 		cpu.setZN(cpu.a, false)
 	case 0x7c:
@@ -708,6 +750,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		// bra rel
 		// XXX: signed
 		cpu.pc = uint16(int16(cpu.pc) + int16(int8(cpu.readOpcode())))
+		cpu.idle()
 	case 0x81:
 		// sta idx
 		var low uint32 = 0
@@ -716,6 +759,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 	case 0x82:
 		// brl rll
 		cpu.pc += uint16(cpu.readOpcodeWord())
+		cpu.idle()
 	case 0x83:
 		// sta sr
 		var low uint32 = 0
@@ -743,6 +787,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.sta(low, high)
 	case 0x88:
 		// dey imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.y = (cpu.y - 1) & 0xff
 		} else {
@@ -769,6 +814,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		}
 	case 0x8a:
 		// txa imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 			cpu.a = (cpu.a & 0xff00) | (cpu.x & 0xff)
 		} else {
@@ -777,6 +823,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.a, cpu.mf == 1)
 	case 0x8b:
 		// phb imp
+		cpu.idle()
 		cpu.pushByte(cpu.db)
 	case 0x8c:
 		// sty abs
@@ -838,6 +885,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.sta(low, high)
 	case 0x98:
 		// tya imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 			cpu.a = (cpu.a & 0xff00) | (cpu.y & 0xff)
 		} else {
@@ -851,9 +899,11 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.sta(low, high)
 	case 0x9a:
 		// txs imp
+		cpu.idle()
 		cpu.sp = cpu.x
 	case 0x9b:
 		// txy imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.y = cpu.x & 0xff
 		} else {
@@ -922,6 +972,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.lda(low, high)
 	case 0xa8:
 		// tay imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.y = cpu.a & 0xff
 		} else {
@@ -935,6 +986,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.lda(low, high)
 	case 0xaa:
 		// tax imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.x = cpu.a & 0xff
 		} else {
@@ -943,6 +995,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.x, cpu.xf == 1)
 	case 0xab:
 		// plb imp
+		cpu.idle()
+		cpu.idle()
 		cpu.db = cpu.pullByte()
 		cpu.setZN(uint16(cpu.db), true)
 	case 0xac:
@@ -1005,6 +1059,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.lda(low, high)
 	case 0xb8:
 		// clv imp
+		cpu.idle()
 		cpu.ClearFlags(CPUFlagsOverflow)
 	case 0xb9:
 		// lda aby(r)
@@ -1013,6 +1068,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.lda(low, high)
 	case 0xba:
 		// tsx imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.x = cpu.sp & 0xff
 		} else {
@@ -1021,6 +1077,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.x, cpu.xf == 1)
 	case 0xbb:
 		// tyx imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.x = cpu.y & 0xff
 		} else {
@@ -1061,6 +1118,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		// rep imm(s)
 		v := cpu.readOpcode()
 		cpu.SetAllFlags(cpu.Flags() & ^v)
+		cpu.idle()
 	case 0xc3:
 		// cmp sr
 		var low uint32 = 0
@@ -1088,6 +1146,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.cmp(low, high)
 	case 0xc8:
 		// iny imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.y = (cpu.y + 1) & 0xff
 		} else {
@@ -1101,6 +1160,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.cmp(low, high)
 	case 0xca:
 		// dex imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.x = (cpu.x - 1) & 0xff
 		} else {
@@ -1109,6 +1169,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.x, cpu.xf == 1)
 	case 0xcb:
 		// wai imp
+		cpu.idle()
+		cpu.idle()
 		cpu.waiting = true
 	case 0xcc:
 		// cpy abs
@@ -1170,6 +1232,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.cmp(low, high)
 	case 0xd8:
 		// cld imp
+		cpu.idle()
 		cpu.ClearFlags(CPUFlagsDecimal)
 	case 0xd9:
 		// cmp aby(r)
@@ -1178,6 +1241,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.cmp(low, high)
 	case 0xda:
 		// phx imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.pushByte(byte(cpu.x))
 		} else {
@@ -1186,6 +1250,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		}
 	case 0xdb:
 		// stp imp
+		cpu.idle()
+		cpu.idle()
 		cpu.stopped = true
 	case 0xdc:
 		// jml ial
@@ -1220,6 +1286,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 	case 0xe2:
 		// sep imm(s)
 		cpu.SetAllFlags(cpu.Flags() | cpu.readOpcode())
+		cpu.idle()
 	case 0xe3:
 		// sbc sr
 		var low uint32 = 0
@@ -1247,6 +1314,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.sbc(low, high)
 	case 0xe8:
 		// inx imp
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.x = (cpu.x + 1) & 0xff
 		} else {
@@ -1260,9 +1328,12 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.sbc(low, high)
 	case 0xea:
 		// nop imp
+		cpu.idle()
 		// no operation
 	case 0xeb:
 		// xba imp
+		cpu.idle()
+		cpu.idle()
 		var low uint16 = cpu.a & 0xff
 		var high uint16 = cpu.a >> 8
 		cpu.a = (low << 8) | high
@@ -1325,6 +1396,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.sbc(low, high)
 	case 0xf8:
 		// sed imp
+		cpu.idle()
 		cpu.SetFlags(CPUFlagsDecimal)
 	case 0xf9:
 		// sbc aby(r)
@@ -1333,6 +1405,8 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.sbc(low, high)
 	case 0xfa:
 		// plx imp
+		cpu.idle()
+		cpu.idle()
 		if cpu.CheckFlag(CPUFlagsIndexRegisterSize) {
 			cpu.x = uint16(cpu.pullByte())
 		} else {
@@ -1342,6 +1416,7 @@ func (cpu *CPU) doOpcode(opcode byte) {
 		cpu.setZN(cpu.x, cpu.xf == 1)
 	case 0xfb:
 		// xce imp
+		cpu.idle()
 		var temp byte = cpu.c
 		cpu.c = cpu.e
 		cpu.e = temp
@@ -1557,7 +1632,7 @@ func (cpu *CPU) sbc(low uint32, high uint32) {
 func (cpu *CPU) cmp(low uint32, high uint32) {
 	var result int = 0
 	if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
-		v := cpu.console.CPU.Read(low)
+		v := cpu.Read(low)
 		value := v ^ 0xFF
 		result = (int(cpu.a) & 0xFF) + int(value) + 1
 		if result > 0xFF {
@@ -1743,6 +1818,7 @@ func (cpu *CPU) ror(low uint32, high uint32) {
 			carry = false
 		}
 		result = (int(value) >> 1) | (int(cpu.c) << 7)
+		cpu.idle() // modify
 		cpu.Write(low, byte(result))
 	} else {
 		cpu.cyclesUsed += 2
@@ -1753,6 +1829,7 @@ func (cpu *CPU) ror(low uint32, high uint32) {
 			carry = false
 		}
 		result = (int(value) >> 1) | (int(cpu.c) << 15)
+		cpu.idle() // modify
 		cpu.WriteWord(low, high, uint16(result), true)
 	}
 	cpu.setZN(uint16(result), cpu.mf == 1)
@@ -1772,6 +1849,7 @@ func (cpu *CPU) rol(low uint32, high uint32) {
 		} else {
 			cpu.ClearFlags(CPUFlagsCarry)
 		}
+		cpu.idle() // modify
 		cpu.Write(low, byte(result))
 	} else {
 		cpu.cyclesUsed += 2
@@ -1781,6 +1859,7 @@ func (cpu *CPU) rol(low uint32, high uint32) {
 		} else {
 			cpu.ClearFlags(CPUFlagsCarry)
 		}
+		cpu.idle() // modify
 		cpu.WriteWord(low, high, uint16(result), true)
 	}
 	cpu.setZN(uint16(result), cpu.mf == 1)
@@ -1796,6 +1875,7 @@ func (cpu *CPU) lsr(low uint32, high uint32) {
 			cpu.ClearFlags(CPUFlagsCarry)
 		}
 		result = int(value >> 1)
+		cpu.idle() // modify
 		cpu.Write(low, byte(result))
 	} else {
 		cpu.cyclesUsed += 2
@@ -1806,6 +1886,7 @@ func (cpu *CPU) lsr(low uint32, high uint32) {
 			cpu.ClearFlags(CPUFlagsCarry)
 		}
 		result = int(value >> 1)
+		cpu.idle() // modify
 		cpu.WriteWord(low, high, uint16(result), true)
 	}
 	cpu.setZN(uint16(result), cpu.mf == 1)
@@ -1820,6 +1901,7 @@ func (cpu *CPU) asl(low uint32, high uint32) {
 		} else {
 			cpu.ClearFlags(CPUFlagsCarry)
 		}
+		cpu.idle() // modify
 		cpu.Write(low, byte(result))
 	} else {
 		cpu.cyclesUsed += 2
@@ -1829,6 +1911,7 @@ func (cpu *CPU) asl(low uint32, high uint32) {
 		} else {
 			cpu.ClearFlags(CPUFlagsCarry)
 		}
+		cpu.idle() // modify
 		cpu.WriteWord(low, high, uint16(result), true)
 	}
 	cpu.setZN(uint16(result), cpu.mf == 1)
@@ -1838,10 +1921,12 @@ func (cpu *CPU) inc(low uint32, high uint32) {
 	var result int = 0
 	if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 		result = int(cpu.Read(low)) + 1
+		cpu.idle() // modify
 		cpu.Write(low, byte(result))
 	} else {
 		cpu.cyclesUsed += 2
 		result = int(cpu.ReadWord(low, high)) + 1
+		cpu.idle() // modify
 		cpu.WriteWord(low, high, uint16(result), true)
 	}
 	cpu.setZN(uint16(result), cpu.mf == 1)
@@ -1851,10 +1936,12 @@ func (cpu *CPU) dec(low uint32, high uint32) {
 	var result int = 0
 	if cpu.CheckFlag(CPUFlagsAccumulateRegisterSize) {
 		result = int(cpu.Read(low)) - 1
+		cpu.idle() // modify
 		cpu.Write(low, byte(result))
 	} else {
 		cpu.cyclesUsed += 2
 		result = int(cpu.ReadWord(low, high)) - 1
+		cpu.idle() // modify
 		cpu.WriteWord(low, high, uint16(result), true)
 	}
 	cpu.setZN(uint16(result), cpu.mf == 1)
@@ -1868,6 +1955,7 @@ func (cpu *CPU) tsb(low uint32, high uint32) {
 		} else {
 			cpu.ClearFlags(CPUFlagsZero)
 		}
+		cpu.idle() // modify
 		cpu.Write(low, byte(uint16(value)|(cpu.a&0xFF)))
 	} else {
 		cpu.cyclesUsed += 2
@@ -1877,6 +1965,7 @@ func (cpu *CPU) tsb(low uint32, high uint32) {
 		} else {
 			cpu.ClearFlags(CPUFlagsZero)
 		}
+		cpu.idle() // modify
 		cpu.WriteWord(low, high, value|cpu.a, true)
 	}
 }
@@ -1889,6 +1978,7 @@ func (cpu *CPU) trb(low uint32, high uint32) {
 		} else {
 			cpu.ClearFlags(CPUFlagsZero)
 		}
+		cpu.idle() // modify
 		cpu.Write(low, byte(uint16(value) & ^(cpu.a&0xFF)))
 	} else {
 		cpu.cyclesUsed += 2
@@ -1898,6 +1988,7 @@ func (cpu *CPU) trb(low uint32, high uint32) {
 		} else {
 			cpu.ClearFlags(CPUFlagsZero)
 		}
+		cpu.idle() // modify
 		cpu.WriteWord(low, high, value & ^(cpu.a), true)
 	}
 }
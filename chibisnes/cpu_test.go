@@ -0,0 +1,92 @@
+package chibisnes
+
+import "testing"
+
+// cpuTestBus is a flat memory counting the cycles the cpu makes
+type cpuTestBus struct {
+	mem    map[uint32]byte
+	cycles int
+}
+
+func (bus *cpuTestBus) CPURead(addr uint32) byte {
+	bus.cycles++
+	return bus.mem[addr]
+}
+
+func (bus *cpuTestBus) CPUWrite(addr uint32, value byte) {
+	bus.cycles++
+	bus.mem[addr] = value
+}
+
+func (bus *cpuTestBus) CPUIdle() {
+	bus.cycles++
+}
+
+// runTestOpcode runs an opcode at $00:8000 with the operand bytes $20 $00 $00
+func runTestOpcode(opcode byte, flags byte, dp uint16) (*CPU, *cpuTestBus) {
+	var bus *cpuTestBus = &cpuTestBus{mem: map[uint32]byte{}}
+	var cpu *CPU = newCPUOnBus(nil, bus)
+	cpu.pc = 0x8000
+	cpu.sp = 0x1ff
+	cpu.dp = dp
+	cpu.x = 0x10
+	cpu.y = 0x10
+	cpu.SetAllFlags(flags)
+	bus.mem[0x8000] = opcode
+	bus.mem[0x8001] = 0x20
+	cpu.startOpcode(0)
+	var op byte = cpu.readOpcode()
+	cpu.cyclesUsed = uint8(cyclesPerCPUOpcode[op])
+	cpu.doOpcode(op)
+	return cpu, bus
+}
+
+func TestCPUOpcodeCycles(t *testing.T) {
+	for opcode := 0; opcode < 256; opcode++ {
+		for _, flags := range []byte{0x00, 0x10, 0x20, 0x30, 0xc3, 0xf3} {
+			for _, dp := range []uint16{0x0000, 0x0010} {
+				cpu, bus := runTestOpcode(byte(opcode), flags, dp)
+				// each counted cycle is made as an access or an internal cycle
+				if bus.cycles != int(cpu.cyclesUsed) {
+					t.Errorf("opcode %02x flags %02x dp %04x: %d cycles counted, %d made", opcode, flags, dp, cpu.cyclesUsed, bus.cycles)
+				}
+			}
+		}
+	}
+}
+
+// the flag of each conditional branch and the value it branches on
+var testBranchFlags = map[byte]struct {
+	flag byte
+	set  bool
+}{
+	0x10: {CPUFlagsNegative, false},
+	0x30: {CPUFlagsNegative, true},
+	0x50: {CPUFlagsOverflow, false},
+	0x70: {CPUFlagsOverflow, true},
+	0x90: {CPUFlagsCarry, false},
+	0xb0: {CPUFlagsCarry, true},
+	0xd0: {CPUFlagsZero, false},
+	0xf0: {CPUFlagsZero, true},
+}
+
+func TestCPUOpcodeCycleTable(t *testing.T) {
+	// 8-bit registers, dp on a page: the cycles of the table but for the
+	// native mode interrupts and the branches taken
+	for _, flags := range []byte{0x30, 0xf3} {
+		for opcode := 0; opcode < 256; opcode++ {
+			cpu, _ := runTestOpcode(byte(opcode), flags, 0)
+			var want int = cyclesPerCPUOpcode[opcode]
+			switch opcode {
+			case 0x00, 0x02, 0x40:
+				want++
+			}
+			if branch, ok := testBranchFlags[byte(opcode)]; ok && ((flags&branch.flag) != 0) == branch.set {
+				want++
+			}
+			if int(cpu.cyclesUsed) != want {
+				t.Errorf("opcode %02x flags %02x: %d cycles, want %d", opcode, flags, cpu.cyclesUsed, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,970 @@
+package chibisnes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// CX4 is the Capcom CX4 (Hitachi HG51B169): a 24 bit cpu running at 20 MHz
+// with 3KB of data ram, a 1024 word data rom (sine/cosine, division and
+// square root tables) and a 2 page program cache filled from the game rom.
+//
+// the wireframe and sprite transform helpers that Mega Man X2/X3 call are
+// HG51B programs in the game rom, they run on this core as-is. The data rom
+// is loaded from cx4.rom next to the rom (1024 24 bit words, little endian).
+type CX4 struct {
+	cartridge *Cartridge
+
+	// registers
+	pb  uint16 // program bank (15 bits)
+	pc  byte
+	n   bool
+	z   bool
+	c   bool
+	v   bool
+	i   bool   // irq pending
+	a   uint32 // 24 bit
+	p   uint16 // page register (15 bits)
+	mul uint64 // 48 bit
+	mdr uint32 // bus data register
+	rom uint32 // data rom buffer
+	ram uint32 // data ram buffer
+	mar uint32 // bus address register
+	dpr uint32 // data ram pointer
+	gpr [16]uint32
+
+	stack [8]uint32
+
+	// io
+	halt     bool
+	irqMask  bool // 1: irq disabled
+	romMode  byte
+	vector   [32]byte
+	waitROM  byte
+	waitRAM  byte
+	suspend  int // cycles left
+	locked   bool
+	dmaRun   bool
+	dmaSrc   uint32
+	dmaDst   uint32
+	dmaLen   uint16
+	busRun   bool
+	busRead  bool
+	busWrite bool
+	busWait  int
+	busAddr  uint32
+
+	cacheRun     bool
+	cachePage    byte
+	cacheLock    [2]bool
+	cacheAddress [2]uint32
+	cacheBase    uint32
+	cacheProgram uint16
+
+	programRAM [2][256]uint16
+	dataROM    [1024]uint32
+	dataRAM    [0xc00]byte
+
+	cyclesLeft int64 // master clocks * 20 MHz the chip may still run
+}
+
+// constant registers
+var cx4Constants [16]uint32 = [16]uint32{
+	0x000000, 0xffffff, 0x00ff00, 0xff0000, 0x00ffff, 0xffff00, 0x800000, 0x7fffff,
+	0x008000, 0x007fff, 0xff7fff, 0xffff7f, 0x010000, 0xfeffff, 0x000100, 0x00feff,
+}
+
+// shifts applied to A by the alu instructions
+var cx4Shifts [4]uint = [4]uint{0, 1, 8, 16}
+
+func init() {
+	registerChip(mapperRegistration{
+		name: "CX4",
+		match: func(header *CartridgeHeader) bool {
+			// chipset $f3, not every CX4 game has an extended header saying $10
+			return header.coprocessor == 0xf && !isST01xHeader(header) && !isST018Header(header) &&
+				(header.exCoprocessor == 0x10 || header.chips == 3)
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			cx4, err := NewCX4(cartridge)
+			if err != nil {
+				return nil, err
+			}
+			return cx4, nil
+		},
+	})
+}
+
+func NewCX4(cartridge *Cartridge) (*CX4, error) {
+	cx4 := &CX4{
+		cartridge: cartridge,
+	}
+
+	var romDir string = filepath.Dir(filepath.Clean(cartridge.console.RomFilePath))
+	data, err := os.ReadFile(filepath.Join(romDir, "cx4.rom"))
+	if err != nil {
+		return nil, errors.New("Failed to load rom: CX4 firmware cx4.rom not found next to the rom\n")
+	}
+	if len(data) < 3072 {
+		msg := fmt.Sprintf("Failed to load rom: CX4 firmware cx4.rom is %d bytes, want 3072\n", len(data))
+		return nil, errors.New(msg)
+	}
+	for i := 0; i < 1024; i++ {
+		cx4.dataROM[i] = uint32(data[i*3]) | (uint32(data[i*3+1]) << 8) | (uint32(data[i*3+2]) << 16)
+	}
+
+	log.Printf("ROM: CX4 enabled\n")
+
+	return cx4, nil
+}
+
+func (cx4 *CX4) Reset() {
+	cx4.pb = 0
+	cx4.pc = 0
+	cx4.n, cx4.z, cx4.c, cx4.v, cx4.i = false, false, false, false, false
+	cx4.a = 0
+	cx4.p = 0
+	cx4.mul = 0
+	cx4.mdr = 0
+	cx4.rom = 0
+	cx4.ram = 0
+	cx4.mar = 0
+	cx4.dpr = 0
+	for i := 0; i < 16; i++ {
+		cx4.gpr[i] = 0
+	}
+	for i := 0; i < 8; i++ {
+		cx4.stack[i] = 0
+	}
+
+	cx4.halt = true
+	cx4.irqMask = false
+	cx4.romMode = 1
+	for i := 0; i < 32; i++ {
+		cx4.vector[i] = 0
+	}
+	cx4.waitROM = 3
+	cx4.waitRAM = 3
+	cx4.suspend = 0
+	cx4.locked = false
+	cx4.dmaRun = false
+	cx4.dmaSrc = 0
+	cx4.dmaDst = 0
+	cx4.dmaLen = 0
+	cx4.busRun = false
+	cx4.busRead = false
+	cx4.busWrite = false
+	cx4.busWait = 0
+	cx4.busAddr = 0
+
+	cx4.cacheRun = false
+	cx4.cachePage = 0
+	cx4.cacheLock = [2]bool{false, false}
+	// nothing is cached yet
+	cx4.cacheAddress = [2]uint32{0xffffffff, 0xffffffff}
+	cx4.cacheBase = 0
+	cx4.cacheProgram = 0
+
+	for i := 0; i < len(cx4.dataRAM); i++ {
+		cx4.dataRAM[i] = 0
+	}
+	cx4.cyclesLeft = 0
+}
+
+// Cycle runs the CX4 for 2 master cycles
+func (cx4 *CX4) Cycle() {
+	if cx4.i && !cx4.irqMask {
+		cx4.cartridge.console.CPU.irqWanted = true
+	}
+
+	// 20 MHz, against the 21.477 MHz master clock
+	cx4.cyclesLeft += 2 * 20000000
+	for cx4.cyclesLeft > 0 {
+		cx4.main()
+	}
+}
+
+func (cx4 *CX4) step(clocks int) {
+	if cx4.busRun {
+		if cx4.busWait > clocks {
+			cx4.busWait -= clocks
+		} else {
+			cx4.busRun = false
+			cx4.busWait = 0
+			if cx4.busRead {
+				cx4.busRead = false
+				cx4.mdr = uint32(cx4.read(cx4.busAddr))
+			}
+			if cx4.busWrite {
+				cx4.busWrite = false
+				cx4.write(cx4.busAddr, byte(cx4.mdr))
+			}
+		}
+	}
+	cx4.cyclesLeft -= int64(clocks) * 21477272
+}
+
+func (cx4 *CX4) main() {
+	if cx4.locked || (cx4.halt && !cx4.cacheRun && !cx4.dmaRun) {
+		cx4.step(1)
+		return
+	}
+	if cx4.suspend > 0 {
+		cx4.suspend--
+		cx4.step(1)
+		return
+	}
+	if cx4.cacheRun {
+		cx4.cache()
+		return
+	}
+	if cx4.dmaRun {
+		cx4.dma()
+		return
+	}
+	cx4.execute()
+}
+
+// bus
+
+func (cx4 *CX4) isROM(addr uint32) bool {
+	return (addr & 0x408000) == 0x008000
+}
+
+func (cx4 *CX4) isRAM(addr uint32) bool {
+	return (addr & 0xf88000) == 0x700000
+}
+
+func (cx4 *CX4) wait(addr uint32) int {
+	if cx4.isROM(addr) {
+		return 1 + int(cx4.waitROM)
+	}
+	if cx4.isRAM(addr) {
+		return 1 + int(cx4.waitRAM)
+	}
+	return 1
+}
+
+func (cx4 *CX4) read(addr uint32) byte {
+	var cartridge *Cartridge = cx4.cartridge
+	if cx4.isROM(addr) {
+		var offset uint32 = ((addr & 0x7f0000) >> 1) | (addr & 0x7fff)
+		return cartridge.rom[offset&(cartridge.romSize-1)]
+	}
+	if cx4.isRAM(addr) {
+		if cartridge.ramSize == 0 {
+			return 0
+		}
+		return cartridge.ram.Read(addr & (cartridge.ramSize - 1))
+	}
+	if (addr & 0x40e000) == 0x006000 {
+		return cx4.readIO(uint16(addr))
+	}
+	return 0
+}
+
+func (cx4 *CX4) write(addr uint32, value byte) {
+	var cartridge *Cartridge = cx4.cartridge
+	if cx4.isRAM(addr) {
+		if cartridge.ramSize > 0 {
+			cartridge.ram.Write(addr&(cartridge.ramSize-1), value)
+		}
+		return
+	}
+	if (addr & 0x40e000) == 0x006000 {
+		cx4.writeIO(uint16(addr), value)
+	}
+}
+
+func (cx4 *CX4) cache() {
+	var address uint32 = (cx4.cacheBase + uint32(cx4.pb)*512) & 0xffffff
+
+	if cx4.cacheAddress[cx4.cachePage] != address {
+		cx4.cachePage ^= 1
+		if cx4.cacheAddress[cx4.cachePage] != address {
+			if cx4.cacheLock[cx4.cachePage] {
+				cx4.cachePage ^= 1
+				if cx4.cacheLock[cx4.cachePage] {
+					// both pages locked
+					cx4.haltCPU()
+					cx4.cacheRun = false
+					return
+				}
+			}
+			cx4.cacheAddress[cx4.cachePage] = address
+			for offset := 0; offset < 256; offset++ {
+				cx4.step(cx4.wait(address))
+				var low byte = cx4.read(address)
+				address++
+				cx4.step(cx4.wait(address))
+				var high byte = cx4.read(address)
+				address++
+				cx4.programRAM[cx4.cachePage][offset] = uint16(low) | (uint16(high) << 8)
+			}
+		}
+	}
+	cx4.cacheRun = false
+}
+
+func (cx4 *CX4) dma() {
+	for offset := uint32(0); offset < uint32(cx4.dmaLen); offset++ {
+		var source uint32 = (cx4.dmaSrc + offset) & 0xffffff
+		var target uint32 = (cx4.dmaDst + offset) & 0xffffff
+		if (cx4.isROM(source) && cx4.isROM(target)) || (cx4.isRAM(source) && cx4.isRAM(target)) {
+			// the bus can't do this, the chip hangs
+			cx4.locked = true
+			return
+		}
+		cx4.step(cx4.wait(source))
+		var value byte = cx4.read(source)
+		cx4.step(cx4.wait(target))
+		cx4.write(target, value)
+	}
+	cx4.dmaRun = false
+}
+
+func (cx4 *CX4) haltCPU() {
+	cx4.halt = true
+	cx4.i = true
+}
+
+func (cx4 *CX4) execute() {
+	cx4.cacheRun = true
+	cx4.cache()
+	if cx4.halt {
+		return
+	}
+	var opcode uint16 = cx4.programRAM[cx4.cachePage][cx4.pc]
+	cx4.advance()
+	cx4.step(1)
+	cx4.instruction(opcode)
+}
+
+func (cx4 *CX4) advance() {
+	cx4.pc++
+	if cx4.pc == 0 {
+		// ran off the page, continue in the other one
+		if cx4.cachePage == 1 {
+			cx4.haltCPU()
+			return
+		}
+		cx4.cachePage = 1
+		if cx4.cacheLock[cx4.cachePage] {
+			cx4.haltCPU()
+			return
+		}
+		cx4.pb = cx4.p
+		cx4.cacheRun = true
+		cx4.cache()
+	}
+}
+
+func (cx4 *CX4) push() {
+	for i := 7; i > 0; i-- {
+		cx4.stack[i] = cx4.stack[i-1]
+	}
+	cx4.stack[0] = (uint32(cx4.pb) << 8) | uint32(cx4.pc)
+}
+
+func (cx4 *CX4) pull() {
+	cx4.pc = byte(cx4.stack[0])
+	cx4.pb = uint16(cx4.stack[0]>>8) & 0x7fff
+	for i := 0; i < 7; i++ {
+		cx4.stack[i] = cx4.stack[i+1]
+	}
+	cx4.stack[7] = 0
+}
+
+// registers used as instruction operands
+
+func (cx4 *CX4) readRegister(reg byte) uint32 {
+	switch reg {
+	case 0x01:
+		return uint32(cx4.mul>>24) & 0xffffff
+	case 0x02:
+		return uint32(cx4.mul) & 0xffffff
+	case 0x03:
+		return cx4.mdr
+	case 0x08:
+		return cx4.rom
+	case 0x0c:
+		return cx4.ram
+	case 0x13:
+		return cx4.mar
+	case 0x1c:
+		return cx4.dpr
+	case 0x20:
+		return uint32(cx4.pc)
+	case 0x28:
+		return uint32(cx4.p)
+	case 0x2e:
+		// start a rom read into MDR
+		cx4.busRun = true
+		cx4.busRead = true
+		cx4.busWait = 1 + int(cx4.waitROM)
+		cx4.busAddr = cx4.mar
+		return 0
+	case 0x2f:
+		// start a ram read into MDR
+		cx4.busRun = true
+		cx4.busRead = true
+		cx4.busWait = 1 + int(cx4.waitRAM)
+		cx4.busAddr = cx4.mar
+		return 0
+	}
+	if reg >= 0x50 && reg <= 0x5f {
+		return cx4Constants[reg&0xf]
+	}
+	if reg >= 0x60 && reg <= 0x6f {
+		return cx4.gpr[reg&0xf]
+	}
+	return 0
+}
+
+func (cx4 *CX4) writeRegister(reg byte, value uint32) {
+	value &= 0xffffff
+	switch reg {
+	case 0x01:
+		cx4.mul = (cx4.mul & 0xffffff) | (uint64(value) << 24)
+	case 0x02:
+		cx4.mul = (cx4.mul & 0xffffff000000) | uint64(value)
+	case 0x03:
+		cx4.mdr = value
+	case 0x08:
+		cx4.rom = value
+	case 0x0c:
+		cx4.ram = value
+	case 0x13:
+		cx4.mar = value
+	case 0x1c:
+		cx4.dpr = value
+	case 0x20:
+		cx4.pc = byte(value)
+	case 0x28:
+		cx4.p = uint16(value) & 0x7fff
+	case 0x2e:
+		// start a rom write from MDR
+		cx4.busRun = true
+		cx4.busWrite = true
+		cx4.busWait = 1 + int(cx4.waitROM)
+		cx4.busAddr = cx4.mar
+	case 0x2f:
+		// start a ram write from MDR
+		cx4.busRun = true
+		cx4.busWrite = true
+		cx4.busWait = 1 + int(cx4.waitRAM)
+		cx4.busAddr = cx4.mar
+	default:
+		if reg >= 0x60 && reg <= 0x6f {
+			cx4.gpr[reg&0xf] = value
+		}
+	}
+}
+
+// instructions
+
+func (cx4 *CX4) instruction(opcode uint16) {
+	var op byte = byte(opcode >> 8)
+	var imm byte = byte(opcode)
+	var reg byte = imm & 0x7f
+	var shift uint = cx4Shifts[(op)&3]
+	var far bool = (op & 0x02) > 0
+
+	// operand: register (bit 10 clear) or 8 bit immediate (bit 10 set)
+	var operand = func() uint32 {
+		if (op & 0x04) > 0 {
+			return uint32(imm)
+		}
+		return cx4.readRegister(reg)
+	}
+
+	switch op >> 2 {
+	case 0x00, 0x01:
+		// NOP, unknown
+	case 0x02:
+		cx4.jump(imm, far, true) // JMP
+	case 0x03:
+		cx4.jump(imm, far, cx4.z) // JMP EQ
+	case 0x04:
+		cx4.jump(imm, far, cx4.c) // JMP GE
+	case 0x05:
+		cx4.jump(imm, far, cx4.n) // JMP MI
+	case 0x06:
+		cx4.jump(imm, far, cx4.v) // JMP VS
+	case 0x07:
+		// WAIT: for the pending bus transfer
+		if cx4.busRun {
+			cx4.step(cx4.busWait)
+		}
+	case 0x08:
+		// unknown
+	case 0x09:
+		// SKIP: skip the next instruction if the flag matches
+		var flag bool
+		switch op & 3 {
+		case 0:
+			flag = cx4.v
+		case 1:
+			flag = cx4.c
+		case 2:
+			flag = cx4.z
+		case 3:
+			flag = cx4.n
+		}
+		if flag == ((imm & 1) > 0) {
+			cx4.advance()
+			cx4.step(1)
+		}
+	case 0x0a:
+		cx4.call(imm, far, true) // JSR
+	case 0x0b:
+		cx4.call(imm, far, cx4.z) // JSR EQ
+	case 0x0c:
+		cx4.call(imm, far, cx4.c) // JSR GE
+	case 0x0d:
+		cx4.call(imm, far, cx4.n) // JSR MI
+	case 0x0e:
+		cx4.call(imm, far, cx4.v) // JSR VS
+	case 0x0f:
+		// RTS
+		cx4.pull()
+		cx4.step(2)
+	case 0x10:
+		// INC MAR
+		cx4.mar = (cx4.mar + 1) & 0xffffff
+	case 0x11:
+		// unknown
+	case 0x12, 0x13:
+		// CMPR: operand - (A << s)
+		cx4.subtract(operand(), (cx4.a<<shift)&0xffffff, false)
+	case 0x14, 0x15:
+		// CMP: (A << s) - operand
+		cx4.subtract((cx4.a<<shift)&0xffffff, operand(), false)
+	case 0x16:
+		// EXTS: sign extend A
+		switch op & 3 {
+		case 1:
+			cx4.a = uint32(int32(int8(cx4.a))) & 0xffffff
+		case 2:
+			cx4.a = uint32(int32(int16(cx4.a))) & 0xffffff
+		}
+		cx4.setNZ(cx4.a)
+	case 0x17:
+		// unknown
+	case 0x18, 0x19:
+		// LD A/MDR/MAR/P, operand
+		var value uint32 = operand()
+		switch op & 3 {
+		case 0:
+			cx4.a = value
+		case 1:
+			cx4.mdr = value
+		case 2:
+			cx4.mar = value
+		case 3:
+			cx4.p = uint16(value) & 0x7fff
+		}
+	case 0x1a, 0x1b:
+		// RDRAM n, [DPR + A] / [DPR + imm]
+		var offset uint32 = cx4.a
+		if (op & 0x04) > 0 {
+			offset = uint32(imm)
+		}
+		var byteIndex uint = uint(op & 3)
+		if byteIndex < 3 {
+			var value byte = cx4.dataRAM[cx4.dataRAMAddress(cx4.dpr+offset)]
+			cx4.ram = (cx4.ram & ^(uint32(0xff) << (byteIndex * 8))) | (uint32(value) << (byteIndex * 8))
+		}
+	case 0x1c:
+		// RDROM [A]
+		cx4.rom = cx4.dataROM[cx4.a&0x3ff]
+	case 0x1d:
+		// RDROM [imm]
+		cx4.rom = cx4.dataROM[opcode&0x3ff]
+	case 0x1e:
+		// unknown
+	case 0x1f:
+		// LD PL/PH, imm
+		if (op & 1) == 0 {
+			cx4.p = (cx4.p & 0x7f00) | uint16(imm)
+		} else {
+			cx4.p = (cx4.p & 0x00ff) | (uint16(imm&0x7f) << 8)
+		}
+	case 0x20, 0x21:
+		// ADD: (A << s) + operand
+		cx4.add((cx4.a<<shift)&0xffffff, operand())
+	case 0x22, 0x23:
+		// SUBR: operand - (A << s)
+		cx4.a = cx4.subtract(operand(), (cx4.a<<shift)&0xffffff, true)
+	case 0x24, 0x25:
+		// SUB: (A << s) - operand
+		cx4.a = cx4.subtract((cx4.a<<shift)&0xffffff, operand(), true)
+	case 0x26, 0x27:
+		// MUL: signed 24 x 24
+		var x int64 = int64(int32(cx4.a<<8) >> 8)
+		var y int64 = int64(int32(operand()<<8) >> 8)
+		cx4.mul = uint64(x*y) & 0xffffffffffff
+		cx4.step(1)
+	case 0x28, 0x29:
+		// XNOR
+		cx4.a = ^((cx4.a << shift) ^ operand()) & 0xffffff
+		cx4.setNZ(cx4.a)
+	case 0x2a, 0x2b:
+		// XOR
+		cx4.a = ((cx4.a << shift) ^ operand()) & 0xffffff
+		cx4.setNZ(cx4.a)
+	case 0x2c, 0x2d:
+		// AND
+		cx4.a = ((cx4.a << shift) & operand()) & 0xffffff
+		cx4.setNZ(cx4.a)
+	case 0x2e, 0x2f:
+		// OR
+		cx4.a = ((cx4.a << shift) | operand()) & 0xffffff
+		cx4.setNZ(cx4.a)
+	case 0x30, 0x31:
+		// SHR
+		cx4.a = cx4.a >> (cx4.shiftAmount(operand()))
+		cx4.setNZ(cx4.a)
+	case 0x32, 0x33:
+		// ASR
+		cx4.a = uint32(int32(cx4.a<<8)>>(8+cx4.shiftAmount(operand()))) & 0xffffff
+		cx4.setNZ(cx4.a)
+	case 0x34, 0x35:
+		// ROR
+		var amount uint = cx4.shiftAmount(operand())
+		cx4.a = ((cx4.a >> amount) | (cx4.a << (24 - amount))) & 0xffffff
+		cx4.setNZ(cx4.a)
+	case 0x36, 0x37:
+		// SHL
+		cx4.a = (cx4.a << cx4.shiftAmount(operand())) & 0xffffff
+		cx4.setNZ(cx4.a)
+	case 0x38:
+		// ST reg, A / MDR
+		if (op & 3) == 0 {
+			cx4.writeRegister(reg, cx4.a)
+		} else if (op & 3) == 1 {
+			cx4.writeRegister(reg, cx4.mdr)
+		}
+	case 0x39:
+		// unknown
+	case 0x3a, 0x3b:
+		// WRRAM n, [DPR + A] / [DPR + imm]
+		var offset uint32 = cx4.a
+		if (op & 0x04) > 0 {
+			offset = uint32(imm)
+		}
+		var byteIndex uint = uint(op & 3)
+		if byteIndex < 3 {
+			cx4.dataRAM[cx4.dataRAMAddress(cx4.dpr+offset)] = byte(cx4.ram >> (byteIndex * 8))
+		}
+	case 0x3c:
+		// SWAP A, gpr
+		var n byte = imm & 0xf
+		cx4.a, cx4.gpr[n] = cx4.gpr[n], cx4.a
+	case 0x3d:
+		// unknown
+	case 0x3e:
+		// CLEAR
+		cx4.a = 0
+		cx4.p = 0
+		cx4.ram = 0
+		cx4.dpr = 0
+	case 0x3f:
+		// HALT
+		cx4.haltCPU()
+	}
+}
+
+func (cx4 *CX4) shiftAmount(value uint32) uint {
+	var amount uint = uint(value & 31)
+	if amount > 24 {
+		amount = 24
+	}
+	return amount
+}
+
+func (cx4 *CX4) dataRAMAddress(addr uint32) uint32 {
+	addr &= 0xfff
+	if addr >= 0xc00 {
+		addr -= 0x400
+	}
+	return addr
+}
+
+func (cx4 *CX4) setNZ(value uint32) {
+	cx4.n = (value & 0x800000) > 0
+	cx4.z = (value & 0xffffff) == 0
+}
+
+func (cx4 *CX4) add(x uint32, y uint32) {
+	var result uint32 = x + y
+	cx4.setNZ(result)
+	cx4.c = (result & 0x1000000) > 0
+	cx4.v = (^(x ^ y) & (x ^ result) & 0x800000) > 0
+	cx4.a = result & 0xffffff
+}
+
+// subtract returns x - y and sets the flags, the result is only used by
+// SUB/SUBR, CMP/CMPR drop it
+func (cx4 *CX4) subtract(x uint32, y uint32, store bool) uint32 {
+	var result uint32 = x - y
+	cx4.setNZ(result)
+	cx4.c = (result & 0x1000000) == 0
+	cx4.v = ((x ^ y) & (x ^ result) & 0x800000) > 0
+	if !store {
+		return cx4.a
+	}
+	return result & 0xffffff
+}
+
+func (cx4 *CX4) jump(target byte, far bool, take bool) {
+	if !take {
+		return
+	}
+	if far {
+		cx4.pb = cx4.p
+	}
+	cx4.pc = target
+	cx4.step(2)
+}
+
+func (cx4 *CX4) call(target byte, far bool, take bool) {
+	if !take {
+		return
+	}
+	cx4.push()
+	cx4.jump(target, far, true)
+}
+
+// S-CPU side ($6000-$7fff in banks 00-3f, 80-bf)
+
+func (cx4 *CX4) Mapped(bank byte, addr uint16) bool {
+	return (bank&0x7f) < 0x40 && addr >= 0x6000 && addr < 0x8000
+}
+
+func (cx4 *CX4) Read(bank byte, addr uint16) byte {
+	return cx4.readIO(addr)
+}
+
+func (cx4 *CX4) Write(bank byte, addr uint16, value byte) {
+	cx4.writeIO(addr, value)
+}
+
+func (cx4 *CX4) readIO(addr uint16) byte {
+	if (addr & 0xfff) < 0xc00 {
+		return cx4.dataRAM[addr&0xfff]
+	}
+	if (addr & 0x1fff) < 0x1c00 {
+		return 0
+	}
+
+	addr = 0x7c00 | (addr & 0x3ff)
+	switch {
+	case addr >= 0x7f40 && addr <= 0x7f42:
+		return byte(cx4.dmaSrc >> ((addr - 0x7f40) * 8))
+	case addr >= 0x7f43 && addr <= 0x7f44:
+		return byte(cx4.dmaLen >> ((addr - 0x7f43) * 8))
+	case addr >= 0x7f45 && addr <= 0x7f47:
+		return byte(cx4.dmaDst >> ((addr - 0x7f45) * 8))
+	case addr == 0x7f48:
+		return cx4.cachePage
+	case addr >= 0x7f49 && addr <= 0x7f4b:
+		return byte(cx4.cacheBase >> ((addr - 0x7f49) * 8))
+	case addr == 0x7f4c:
+		var value byte = 0
+		if cx4.cacheLock[0] {
+			value |= 1
+		}
+		if cx4.cacheLock[1] {
+			value |= 2
+		}
+		return value
+	case addr >= 0x7f4d && addr <= 0x7f4e:
+		return byte(cx4.cacheProgram >> ((addr - 0x7f4d) * 8))
+	case addr == 0x7f4f:
+		return cx4.pc
+	case addr == 0x7f50:
+		return cx4.waitRAM | (cx4.waitROM << 4)
+	case addr == 0x7f51:
+		if cx4.irqMask {
+			return 1
+		}
+		return 0
+	case addr == 0x7f52:
+		return cx4.romMode
+	case addr >= 0x7f53 && addr <= 0x7f5f:
+		// status
+		var value byte = 0
+		if cx4.suspend > 0 {
+			value |= 0x01
+		}
+		if cx4.i {
+			value |= 0x02
+		}
+		if !cx4.halt {
+			value |= 0x40
+		}
+		if !cx4.halt || cx4.cacheRun || cx4.dmaRun || cx4.busRun || cx4.locked {
+			value |= 0x80
+		}
+		return value
+	case addr >= 0x7f60 && addr <= 0x7f7f:
+		return cx4.vector[addr&0x1f]
+	case (addr >= 0x7f80 && addr <= 0x7faf) || (addr >= 0x7fc0 && addr <= 0x7fef):
+		var offset uint16 = addr & 0x3f
+		return byte(cx4.gpr[offset/3] >> ((offset % 3) * 8))
+	}
+
+	return 0
+}
+
+func (cx4 *CX4) writeIO(addr uint16, value byte) {
+	if (addr & 0xfff) < 0xc00 {
+		cx4.dataRAM[addr&0xfff] = value
+		return
+	}
+	if (addr & 0x1fff) < 0x1c00 {
+		return
+	}
+
+	addr = 0x7c00 | (addr & 0x3ff)
+	switch {
+	case addr >= 0x7f40 && addr <= 0x7f42:
+		var shift uint16 = (addr - 0x7f40) * 8
+		cx4.dmaSrc = (cx4.dmaSrc & ^(uint32(0xff) << shift)) | (uint32(value) << shift)
+	case addr >= 0x7f43 && addr <= 0x7f44:
+		var shift uint16 = (addr - 0x7f43) * 8
+		cx4.dmaLen = (cx4.dmaLen & ^(uint16(0xff) << shift)) | (uint16(value) << shift)
+	case addr >= 0x7f45 && addr <= 0x7f47:
+		var shift uint16 = (addr - 0x7f45) * 8
+		cx4.dmaDst = (cx4.dmaDst & ^(uint32(0xff) << shift)) | (uint32(value) << shift)
+		if addr == 0x7f47 && cx4.halt {
+			cx4.dmaRun = true
+		}
+	case addr == 0x7f48:
+		cx4.cachePage = value & 1
+		if cx4.halt {
+			cx4.cacheRun = true
+		}
+	case addr >= 0x7f49 && addr <= 0x7f4b:
+		var shift uint16 = (addr - 0x7f49) * 8
+		cx4.cacheBase = (cx4.cacheBase & ^(uint32(0xff) << shift)) | (uint32(value) << shift)
+	case addr == 0x7f4c:
+		cx4.cacheLock[0] = (value & 1) > 0
+		cx4.cacheLock[1] = (value & 2) > 0
+	case addr >= 0x7f4d && addr <= 0x7f4e:
+		var shift uint16 = (addr - 0x7f4d) * 8
+		cx4.cacheProgram = (cx4.cacheProgram & ^(uint16(0xff) << shift)) | (uint16(value) << shift)
+	case addr == 0x7f4f:
+		// start execution at program page:pc
+		if cx4.halt {
+			cx4.pb = cx4.cacheProgram & 0x7fff
+			cx4.pc = value
+			cx4.halt = false
+		}
+	case addr == 0x7f50:
+		cx4.waitRAM = value & 7
+		cx4.waitROM = (value >> 4) & 7
+	case addr == 0x7f51:
+		cx4.irqMask = (value & 1) > 0
+		if cx4.irqMask {
+			var console *Console = cx4.cartridge.console
+			console.CPU.irqWanted = console.inIRQ
+		}
+	case addr == 0x7f52:
+		cx4.romMode = value & 1
+	case addr == 0x7f53:
+		// stop
+		cx4.locked = false
+		cx4.halt = true
+	case addr >= 0x7f55 && addr <= 0x7f5c:
+		// suspend for 0 (until resumed) or 32 .. 224 cycles
+		var duration int = int(addr-0x7f55) * 32
+		if duration == 0 {
+			duration = 1 << 30
+		}
+		cx4.suspend = duration
+	case addr == 0x7f5d:
+		// resume
+		cx4.suspend = 0
+	case addr == 0x7f5e:
+		// clear irq
+		cx4.i = false
+		var console *Console = cx4.cartridge.console
+		console.CPU.irqWanted = console.inIRQ
+	case addr >= 0x7f60 && addr <= 0x7f7f:
+		cx4.vector[addr&0x1f] = value
+	case (addr >= 0x7f80 && addr <= 0x7faf) || (addr >= 0x7fc0 && addr <= 0x7fef):
+		var offset uint16 = addr & 0x3f
+		var shift uint16 = (offset % 3) * 8
+		cx4.gpr[offset/3] = (cx4.gpr[offset/3] & ^(uint32(0xff) << shift)) | (uint32(value) << shift)
+	}
+}
+
+func (cx4 *CX4) Close() {
+}
+
+func (cx4 *CX4) Serialize(s *serializer) {
+	s.u16(&cx4.pb)
+	s.u8(&cx4.pc)
+	s.bool(&cx4.n)
+	s.bool(&cx4.z)
+	s.bool(&cx4.c)
+	s.bool(&cx4.v)
+	s.bool(&cx4.i)
+	s.u32(&cx4.a)
+	s.u16(&cx4.p)
+	s.u64(&cx4.mul)
+	s.u32(&cx4.mdr)
+	s.u32(&cx4.rom)
+	s.u32(&cx4.ram)
+	s.u32(&cx4.mar)
+	s.u32(&cx4.dpr)
+	for i := 0; i < 16; i++ {
+		s.u32(&cx4.gpr[i])
+	}
+	for i := 0; i < 8; i++ {
+		s.u32(&cx4.stack[i])
+	}
+
+	s.bool(&cx4.halt)
+	s.bool(&cx4.irqMask)
+	s.u8(&cx4.romMode)
+	s.bytes(cx4.vector[:])
+	s.u8(&cx4.waitROM)
+	s.u8(&cx4.waitRAM)
+	var suspend uint32 = uint32(cx4.suspend)
+	s.u32(&suspend)
+	cx4.suspend = int(suspend)
+	s.bool(&cx4.locked)
+	s.bool(&cx4.dmaRun)
+	s.u32(&cx4.dmaSrc)
+	s.u32(&cx4.dmaDst)
+	s.u16(&cx4.dmaLen)
+	s.bool(&cx4.busRun)
+	s.bool(&cx4.busRead)
+	s.bool(&cx4.busWrite)
+	var busWait uint32 = uint32(cx4.busWait)
+	s.u32(&busWait)
+	cx4.busWait = int(busWait)
+	s.u32(&cx4.busAddr)
+
+	s.bool(&cx4.cacheRun)
+	s.u8(&cx4.cachePage)
+	s.bools(cx4.cacheLock[:])
+	s.u32(&cx4.cacheAddress[0])
+	s.u32(&cx4.cacheAddress[1])
+	s.u32(&cx4.cacheBase)
+	s.u16(&cx4.cacheProgram)
+
+	s.u16s(cx4.programRAM[0][:])
+	s.u16s(cx4.programRAM[1][:])
+	s.bytes(cx4.dataRAM[:])
+
+	var cyclesLeft uint64 = uint64(cx4.cyclesLeft)
+	s.u64(&cyclesLeft)
+	cx4.cyclesLeft = int64(cyclesLeft)
+}
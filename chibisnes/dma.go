@@ -22,14 +22,53 @@ type DMAChannel struct {
 	offIndex   byte
 }
 
+// DMA timing, in master clocks: the cpu stops and the dma starts on a
+// multiple of 8 clocks. A general dma takes 8 clocks to set up, 8 per
+// channel and 8 per byte. HDMA takes 18 clocks on each line with an active
+// channel, 8 per channel, 8 per byte, 8 to read a new line counter and 16
+// for a new indirect address, it pauses a running general dma. Each hdma
+// byte and table read is made when its clocks start. When both are done,
+// the cpu gets the bus back at the start of one of its cycles.
 type DMA struct {
-	console   *Console
-	channels  [8]DMAChannel
-	hdmaTimer uint16
-	dmaTimer  uint32
-	dmaBusy   bool
+	console     *Console
+	channels    [8]DMAChannel
+	hdmaTimer   uint16
+	dmaTimer    uint32
+	dmaBusy     bool
+	alignTimer  byte   // clocks until the dma starts after the cpu stopped
+	stallClocks uint32 // clocks the cpu has been stopped for
+
+	// next step of the hdma of the line
+	hdmaBusy    bool
+	hdmaInit    bool // frame start: only the tables are read
+	hdmaStep    byte
+	hdmaChannel byte
+	hdmaByte    byte // next byte of the transfer
+
+	// bus time of the current frame and of the last one, per line
+	lineDMA    uint16
+	lineHDMA   uint16
+	lineStats  [313]DMALineStats
+	frameStats [313]DMALineStats
+	frameLines int
+}
+
+// DMALineStats is the time dma took the bus on a line, in master clocks
+type DMALineStats struct {
+	DMA  int // general dma, with its setup and the alignment with the cpu
+	HDMA int
 }
 
+// hdma steps, 8 clocks each but the overhead
+const (
+	hdmaStepOverhead    = iota // 18 clocks at the start
+	hdmaStepChannel            // each active channel
+	hdmaStepTransfer           // each byte transferred
+	hdmaStepCounter            // new line counter
+	hdmaStepIndirectLow        // new indirect address
+	hdmaStepIndirectHigh
+)
+
 var bAddrOffsets [8][4]int = [8][4]int{
 	{0, 0, 0, 0},
 	{0, 1, 0, 1},
@@ -76,6 +115,16 @@ func (dma *DMA) Reset() {
 	dma.hdmaTimer = 0
 	dma.dmaTimer = 0
 	dma.dmaBusy = false
+	dma.hdmaBusy = false
+	dma.hdmaInit = false
+	dma.hdmaStep = hdmaStepOverhead
+	dma.hdmaChannel = 0
+	dma.hdmaByte = 0
+	dma.alignTimer = 0
+	dma.stallClocks = 0
+	dma.lineDMA = 0
+	dma.lineHDMA = 0
+	dma.frameLines = 0
 }
 
 func (dma *DMA) Read(addr uint16) byte {
@@ -182,6 +231,7 @@ func (dma *DMA) doDMA() {
 	}
 	// do channel i
 	dma.transferByte(
+		i,
 		dma.channels[i].aAddr,
 		dma.channels[i].aBank,
 		dma.channels[i].bAddr+byte(bAddrOffsets[dma.channels[i].mode][dma.channels[i].offIndex]),
@@ -206,95 +256,134 @@ func (dma *DMA) doDMA() {
 	}
 }
 
+// hdmaActiveAfter reports if a channel after i still does hdma this frame
+func (dma *DMA) hdmaActiveAfter(i int) bool {
+	for j := i + 1; j < len(dma.channels); j++ {
+		if dma.channels[j].hdmaActive && !dma.channels[j].terminated {
+			return true
+		}
+	}
+	return false
+}
+
 func (dma *DMA) initHDMA() {
-	dma.hdmaTimer = 0
-	var hdmaHappened bool = false
 	for i := 0; i < len(dma.channels); i++ {
-		if dma.channels[i].hdmaActive {
-			hdmaHappened = true
-			// terminate any dma
-			dma.channels[i].dmaActive = false
-			dma.channels[i].offIndex = 0
-			// load address, repCount, and indirect address if needed
-			dma.channels[i].tableAddr = dma.channels[i].aAddr
-			dma.channels[i].repCount = dma.console.Read((uint32(dma.channels[i].aBank) << 16) | uint32(dma.channels[i].tableAddr))
-			dma.channels[i].tableAddr++
-			dma.hdmaTimer += 8 // 8 cycle overhead for each active channel
-			if dma.channels[i].indirect {
-				dma.channels[i].size = uint16(dma.console.Read((uint32(dma.channels[i].aBank) << 16) | uint32(dma.channels[i].tableAddr)))
-				dma.channels[i].tableAddr++
-				dma.channels[i].size |= uint16(dma.console.Read((uint32(dma.channels[i].aBank)<<16)|uint32(dma.channels[i].tableAddr))) << 8
-				dma.channels[i].tableAddr++
-				dma.hdmaTimer += 16 // another 16 cycles for indirect (total 24)
-			}
-			dma.channels[i].doTransfer = true
-		} else {
-			dma.channels[i].doTransfer = false
-		}
 		dma.channels[i].terminated = false
+		dma.channels[i].doTransfer = false
 	}
-	if hdmaHappened {
-		dma.hdmaTimer += 16 // 18 cycles overhead, -2 for this cycle
-	}
+	dma.startHDMA(true)
 }
 
 func (dma *DMA) doHDMA() {
-	dma.hdmaTimer = 0
-	var hdmaHappened bool = false
+	dma.startHDMA(false)
+}
+
+// startHDMA starts the hdma of a line, or the table reads of the frame
+// start, the steps are made by Cycle
+func (dma *DMA) startHDMA(init bool) {
+	dma.hdmaInit = init
+	dma.hdmaBusy = false
 	for i := 0; i < len(dma.channels); i++ {
 		if dma.channels[i].hdmaActive && !dma.channels[i].terminated {
-			hdmaHappened = true
+			dma.hdmaBusy = true
 			// terminate any dma
 			dma.channels[i].dmaActive = false
 			dma.channels[i].offIndex = 0
-			// do the hdma
-			dma.hdmaTimer += 8 // 8 cycles overhead for each active channel
-			if dma.channels[i].doTransfer {
-				for j := 0; j < transferLength[dma.channels[i].mode]; j++ {
-					dma.hdmaTimer += 8 // 8 cycles for each byte transferred
-					if dma.channels[i].indirect {
-						dma.transferByte(
-							dma.channels[i].size,
-							dma.channels[i].indBank,
-							dma.channels[i].bAddr+byte(bAddrOffsets[dma.channels[i].mode][j]),
-							dma.channels[i].fromB)
-						dma.channels[i].size++
-					} else {
-						dma.transferByte(
-							dma.channels[i].tableAddr,
-							dma.channels[i].aBank,
-							dma.channels[i].bAddr+byte(bAddrOffsets[dma.channels[i].mode][j]),
-							dma.channels[i].fromB)
-						dma.channels[i].tableAddr++
-					}
-				}
-			}
-			dma.channels[i].repCount--
-			dma.channels[i].doTransfer = (dma.channels[i].repCount & 0x80) > 0
-			if (dma.channels[i].repCount & 0x7f) == 0 {
-				dma.channels[i].repCount = dma.console.Read((uint32(dma.channels[i].aBank) << 16) | uint32(dma.channels[i].tableAddr))
-				dma.channels[i].tableAddr++
-				if dma.channels[i].indirect {
-					// TODO: oddness with not fetching high byte if last active channel and reCount is 0
-					dma.channels[i].size = uint16(dma.console.Read((uint32(dma.channels[i].aBank) << 16) | uint32(dma.channels[i].tableAddr)))
-					dma.channels[i].tableAddr++
-					dma.channels[i].size |= uint16(dma.console.Read((uint32(dma.channels[i].aBank)<<16)|uint32(dma.channels[i].tableAddr))) << 8
-					dma.channels[i].tableAddr++
-					dma.hdmaTimer += 16 // 16 cycles for new indirect address
-				}
-				if dma.channels[i].repCount == 0 {
-					dma.channels[i].terminated = true
-				}
-				dma.channels[i].doTransfer = true
+			if init {
+				dma.channels[i].tableAddr = dma.channels[i].aAddr
 			}
 		}
 	}
-	if hdmaHappened {
-		dma.hdmaTimer += 16 // 18 cycles overhead, -2 for this cycle
+	dma.hdmaStep = hdmaStepOverhead
+}
+
+// stepHDMA makes the next step of the hdma, it returns the clocks taken
+func (dma *DMA) stepHDMA() uint16 {
+	var i int = int(dma.hdmaChannel)
+	var ch *DMAChannel = &dma.channels[i]
+	var bank uint32 = uint32(ch.aBank) << 16
+	switch dma.hdmaStep {
+	case hdmaStepOverhead:
+		dma.nextHDMAChannel(0)
+		return 18
+	case hdmaStepChannel:
+		if ch.doTransfer {
+			dma.hdmaStep = hdmaStepTransfer
+			dma.hdmaByte = 0
+		} else {
+			dma.endHDMATransfer(i)
+		}
+	case hdmaStepTransfer:
+		var bAddr byte = ch.bAddr + byte(bAddrOffsets[ch.mode][dma.hdmaByte])
+		if ch.indirect {
+			dma.transferByte(i, ch.size, ch.indBank, bAddr, ch.fromB)
+			ch.size++
+		} else {
+			dma.transferByte(i, ch.tableAddr, ch.aBank, bAddr, ch.fromB)
+			ch.tableAddr++
+		}
+		dma.hdmaByte++
+		if int(dma.hdmaByte) == transferLength[ch.mode] {
+			dma.endHDMATransfer(i)
+		}
+	case hdmaStepCounter:
+		ch.repCount = dma.console.Read(bank | uint32(ch.tableAddr))
+		ch.tableAddr++
+		ch.terminated = ch.repCount == 0
+		ch.doTransfer = !ch.terminated
+		if ch.indirect {
+			dma.hdmaStep = hdmaStepIndirectLow
+		} else {
+			dma.nextHDMAChannel(i + 1)
+		}
+	case hdmaStepIndirectLow:
+		ch.size = uint16(dma.console.Read(bank|uint32(ch.tableAddr))) << 8
+		ch.tableAddr++
+		if ch.terminated && !dma.hdmaActiveAfter(i) {
+			// the last channel ending doesn't read the high byte
+			dma.nextHDMAChannel(i + 1)
+		} else {
+			dma.hdmaStep = hdmaStepIndirectHigh
+		}
+	case hdmaStepIndirectHigh:
+		ch.size = uint16(dma.console.Read(bank|uint32(ch.tableAddr)))<<8 | ch.size>>8
+		ch.tableAddr++
+		dma.nextHDMAChannel(i + 1)
+	}
+	return 8
+}
+
+// endHDMATransfer counts the line down after the transfer of channel i, a
+// new line counter is read when it runs out
+func (dma *DMA) endHDMATransfer(i int) {
+	var ch *DMAChannel = &dma.channels[i]
+	ch.repCount--
+	ch.doTransfer = (ch.repCount & 0x80) > 0
+	if (ch.repCount & 0x7f) == 0 {
+		dma.hdmaStep = hdmaStepCounter
+	} else {
+		dma.nextHDMAChannel(i + 1)
+	}
+}
+
+// nextHDMAChannel goes on with the first channel from i with hdma to do,
+// the hdma is done if there is none
+func (dma *DMA) nextHDMAChannel(i int) {
+	for ; i < len(dma.channels); i++ {
+		if dma.channels[i].hdmaActive && !dma.channels[i].terminated {
+			dma.hdmaChannel = byte(i)
+			if dma.hdmaInit {
+				dma.hdmaStep = hdmaStepCounter
+			} else {
+				dma.hdmaStep = hdmaStepChannel
+			}
+			return
+		}
 	}
+	dma.hdmaBusy = false
 }
 
-func (dma *DMA) transferByte(aAddr uint16, aBank byte, bAddr byte, fromB bool) {
+func (dma *DMA) transferByte(i int, aAddr uint16, aBank byte, bAddr byte, fromB bool) {
 	// TODO: invalid writes:
 	//   accesing b-bus via a-bus gives open bus,
 	//   $2180-$2183 while accessing ram via a-bus open busses $2180-$2183
@@ -302,19 +391,72 @@ func (dma *DMA) transferByte(aAddr uint16, aBank byte, bAddr byte, fromB bool) {
 	if fromB {
 		dma.console.Write((uint32(aBank)<<16)|uint32(aAddr), dma.console.ReadBBus(bAddr))
 	} else {
-		dma.console.WriteBBus(bAddr, dma.console.Read((uint32(aBank)<<16)|uint32(aAddr)))
+		var addr uint32 = (uint32(aBank) << 16) | uint32(aAddr)
+		if dma.channels[i].dmaActive {
+			// the S-DD1 decompresses while dma reads from it
+			if value, ok := dma.console.Cartridge.dmaRead(i, addr, dma.channels[i].size); ok {
+				dma.console.openBus = value
+				dma.console.WriteBBus(bAddr, value)
+				return
+			}
+		}
+		dma.console.WriteBBus(bAddr, dma.console.Read(addr))
 	}
 }
 
+// Cycle runs the dma for 2 master clocks, it returns false if the cpu has
+// the bus
 func (dma *DMA) Cycle() bool {
-	if dma.hdmaTimer > 0 {
+	var pending bool = dma.hdmaTimer > 0 || dma.hdmaBusy || dma.dmaBusy
+	if !pending {
+		// the cpu gets the bus back at the start of one of its cycles
+		if dma.stallClocks == 0 || dma.stallClocks%uint32(dma.console.cpuCycleTime) == 0 {
+			dma.stallClocks = 0
+			return false
+		}
+	} else if dma.stallClocks == 0 {
+		if !dma.console.cpuCycleStart {
+			// the cpu is in the middle of a cycle, it keeps the bus to its end
+			return false
+		}
+		// the cpu stops, the dma starts on a multiple of 8 clocks
+		dma.alignTimer = byte(-dma.console.masterClock & 7)
+	}
+	dma.stallClocks += 2
+
+	switch {
+	case dma.alignTimer > 0:
+		dma.alignTimer -= 2
+		dma.lineDMA += 2
+	case dma.hdmaTimer > 0 || dma.hdmaBusy:
+		if dma.hdmaTimer == 0 {
+			// the next hdma step starts on this cycle
+			dma.hdmaTimer = dma.stepHDMA()
+		}
 		dma.hdmaTimer -= 2
-		return true
-	} else if dma.dmaBusy {
+		dma.lineHDMA += 2
+	case dma.dmaBusy:
 		dma.doDMA()
-		return true
+		dma.lineDMA += 2
+	default:
+		dma.lineDMA += 2
 	}
-	return false
+	return true
+}
+
+// endLine keeps the bus time of a line
+func (dma *DMA) endLine(line uint16) {
+	if int(line) < len(dma.lineStats) {
+		dma.lineStats[line] = DMALineStats{DMA: int(dma.lineDMA), HDMA: int(dma.lineHDMA)}
+	}
+	dma.lineDMA = 0
+	dma.lineHDMA = 0
+}
+
+// endFrame publishes the bus time of the lines of the frame
+func (dma *DMA) endFrame(lines int) {
+	dma.frameStats = dma.lineStats
+	dma.frameLines = lines
 }
 
 func (dma *DMA) StartDMA(value byte, hdma bool) {
@@ -328,9 +470,44 @@ func (dma *DMA) StartDMA(value byte, hdma bool) {
 	if !hdma {
 		dma.dmaBusy = (value > 0)
 		if dma.dmaBusy {
-			dma.dmaTimer += 16
-		} else {
-			dma.dmaTimer += 0
+			dma.dmaTimer += 8 // 8 cycles to set up
 		}
 	}
 }
+
+func (dma *DMA) serialize(s *serializer) {
+	for i := 0; i < len(dma.channels); i++ {
+		var ch *DMAChannel = &dma.channels[i]
+		s.u8(&ch.bAddr)
+		s.u16(&ch.aAddr)
+		s.u8(&ch.aBank)
+		s.u16(&ch.size)
+		s.u8(&ch.indBank)
+		s.u16(&ch.tableAddr)
+		s.u8(&ch.repCount)
+		s.u8(&ch.unusedByte)
+		s.bool(&ch.dmaActive)
+		s.bool(&ch.hdmaActive)
+		s.u8(&ch.mode)
+		s.bool(&ch.fixed)
+		s.bool(&ch.decrement)
+		s.bool(&ch.indirect)
+		s.bool(&ch.fromB)
+		s.bool(&ch.unusedBit)
+		s.bool(&ch.doTransfer)
+		s.bool(&ch.terminated)
+		s.u8(&ch.offIndex)
+	}
+	s.u16(&dma.hdmaTimer)
+	s.u32(&dma.dmaTimer)
+	s.bool(&dma.dmaBusy)
+	s.bool(&dma.hdmaBusy)
+	s.bool(&dma.hdmaInit)
+	s.u8(&dma.hdmaStep)
+	s.u8(&dma.hdmaChannel)
+	s.u8(&dma.hdmaByte)
+	s.u8(&dma.alignTimer)
+	s.u32(&dma.stallClocks)
+	s.u16(&dma.lineDMA)
+	s.u16(&dma.lineHDMA)
+}
@@ -0,0 +1,41 @@
+package chibisnes
+
+import "testing"
+
+func TestHDMAStartsBetweenCPUCycles(t *testing.T) {
+	var console *Console = NewConsole()
+	console.Reset(true)
+	console.inVBlank = false
+	console.vPos = 10
+	console.hPos = 1020
+
+	var ch *DMAChannel = &console.DMA.channels[0]
+	ch.hdmaActive = true
+	ch.doTransfer = true
+	ch.repCount = 2
+	ch.mode = 0
+	ch.aBank = 0x00
+	ch.tableAddr = 0x0100
+	ch.bAddr = 0x80
+
+	// a 12 clocks read, the hdma starts at 1024 in the middle of it
+	var start uint64 = console.masterClock
+	console.CPURead(0x4016)
+	if clocks := console.masterClock - start; clocks != 12 {
+		t.Fatalf("read took %d clocks, want 12", clocks)
+	}
+	if !console.DMA.hdmaBusy || console.DMA.lineHDMA != 0 || console.DMA.lineDMA != 0 {
+		t.Fatalf("hdma took the bus in the read: busy %v, hdma %d, dma %d", console.DMA.hdmaBusy, console.DMA.lineHDMA, console.DMA.lineDMA)
+	}
+
+	// the stall lands before the next cpu cycle
+	start = console.masterClock
+	console.CPUIdle()
+	var clocks uint64 = console.masterClock - start
+	if console.DMA.hdmaBusy || console.DMA.lineHDMA == 0 {
+		t.Fatalf("hdma not done: busy %v, hdma %d", console.DMA.hdmaBusy, console.DMA.lineHDMA)
+	}
+	if want := 6 + uint64(console.DMA.lineHDMA) + uint64(console.DMA.lineDMA); clocks != want {
+		t.Errorf("idle took %d clocks, want %d (hdma %d, dma %d)", clocks, want, console.DMA.lineHDMA, console.DMA.lineDMA)
+	}
+}
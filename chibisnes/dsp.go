@@ -1,38 +1,53 @@
 package chibisnes
 
+// The DSP runs one step of its 32 step pipeline per APU cycle, giving a
+// sample every 32 cycles. The voices are processed in 9 steps (V1 to V9)
+// spread over the sample and overlapping with the next voices, echo is read
+// and written between them, so registers like ENVX, OUTX and ENDX change at
+// the same point of the sample as on hardware.
+//
+// voice steps:
+// V1: read SRCN, directory address
+// V2: read sample address from the directory, ADSR0, PITCHL
+// V3: PITCHH, read BRR header and byte, interpolate, envelope, KON/KOFF
+// V4: decode BRR, pitch, left output
+// V5: right output, ENDX buffered
+// V6: OUTX buffered
+// V7: ENDX written, ENVX buffered
+// V8: OUTX written
+// V9: ENVX written
+
 type DSPChannel struct {
-	// pitch
-	pitch           uint16
-	pitchCounter    uint16
-	pitchModulation bool
 	// brr decoding
-	decodeBuffer  [19]int16 // 16 samples per brr-block, +3 for interpolation
-	srcn          byte
-	decodeOffset  uint16
-	previousFlags byte // from last sample
-	old           int16
-	older         int16
-	useNoise      bool
+	buf       [dspBrrBufSize * 2]int16 // decoded samples, twice for wrap around
+	bufPos    int32                    // where the next 4 samples are decoded
+	interpPos int32                    // 4.12 position for interpolation
+	brrAddr   uint16                   // current brr block
+	brrOffset uint16                   // offset in the block of the next byte pair
 	// adsr, envelope, gain
-	adsrRates    [4]uint16 // attack, decay, sustain, gain
-	rateCounter  uint16
-	adsrState    byte // 0: attack, 1: decay, 2: sustain, 3: gain, 4: release
-	sustainLevel uint16
-	useGain      bool
-	gainMode     byte
-	directGain   bool
-	gainValue    uint16 // for direct gain
-	gain         uint16
-	// keyon/off
-	keyOn  bool
-	keyOff bool
-	// output
-	sampleOut  int16 // final sample, to be multiplied by channel volume
-	volumeL    int8
-	volumeR    int8
-	echoEnable bool
+	envMode   byte // 0: release, 1: attack, 2: decay, 3: sustain
+	env       int32
+	hiddenEnv int32 // last calculated envelope, even if not written
+	envxOut   byte  // ENVX for step V7
+	// keyon
+	konDelay byte // samples left until decoding starts after KON
 }
 
+const (
+	dspBrrBufSize   = 12
+	dspBrrBlockSize = 9
+	dspEchoHistSize = 8
+	// rate counter range, the rates divide it
+	dspCounterRange = 2048 * 5 * 3
+)
+
+const (
+	envRelease byte = iota
+	envAttack
+	envDecay
+	envSustain
+)
+
 type DSP struct {
 	apu *APU
 
@@ -40,43 +55,80 @@ type DSP struct {
 	ram [0x80]byte
 	// 8 channels
 	channel [8]DSPChannel
-	// overarching
-	dirPage       uint16
-	evenCycle     bool
-	mute          bool
-	reset         bool
-	masterVolumeL int8
-	masterVolumeR int8
-	// noise
-	noiseSample  int16
-	noiseRate    uint16
-	noiseCounter uint16
+	// pipeline
+	phase            byte // step in the sample, 0-31
+	everyOtherSample bool // KON and KOFF are polled every other sample
+	kon              byte
+	newKon           byte
+	counter          int32 // rate counter for the envelopes and noise
+	noise            int32
+	// ENDX, ENVX and OUTX are written some steps after they are calculated
+	endxBuf byte
+	envxBuf byte
+	outxBuf byte
+	// registers and values passed between the steps
+	tPmon        byte
+	tNon         byte
+	tEon         byte
+	tDir         byte
+	tKoff        byte
+	tSrcn        byte
+	tAdsr0       byte
+	tBrrHeader   byte
+	tBrrByte     byte
+	tBrrNextAddr uint16
+	tDirAddr     uint16
+	tPitch       int32
+	tOutput      int32 // output of the last voice, for pitch modulation
+	tLooped      byte
+	tMainOut     [2]int32
+	tEchoOut     [2]int32
+	tEchoIn      [2]int32
 	// echo
-	echoWrites      bool
-	echoVolumeL     int8
-	echoVolumeR     int8
-	feedbackVolume  int8
-	echoBufferAddr  uint16
-	echoDelay       uint16
-	echoRemain      uint16
-	echoBufferIndex uint16
-	firBufferIndex  uint8
-	firValues       [8]int8
-	firBufferL      [8]int16
-	firBufferR      [8]int16
-	// sample buffer (1 frame at 32040 Hz: 534 samples, *2 for stereo)
-	sampleBuffer [534 * 2]int16
+	tEsa         byte
+	tEchoEnabled byte // FLG, echo writes are disabled by bit 5
+	tEchoPtr     uint16
+	echoOffset   uint16
+	echoLength   uint16
+	echoHistPos  int32
+	echoHist     [dspEchoHistSize * 2 * 2]int16 // 8 stereo samples, twice for wrap around
+	// sample buffer (1 frame at 32000 Hz: about 533 samples (NTSC), 640 samples (PAL), *2 for stereo)
+	sampleBuffer [641 * 2]int16
 	sampleOffset uint16 // current offset in samplebuffer
 }
 
-var rateValues [32]int = [32]int{
-	0, 2048, 1536, 1280, 1024, 768, 640, 512,
-	384, 320, 256, 192, 160, 128, 96, 80,
-	64, 48, 40, 32, 24, 20, 16, 12,
-	10, 8, 6, 5, 4, 3, 2, 1,
+// a rate fires when (counter + offset) % rate is 0, rate 0 never fires
+var counterRates [32]int32 = [32]int32{
+	dspCounterRange + 1, 2048, 1536,
+	1280, 1024, 768,
+	640, 512, 384,
+	320, 256, 192,
+	160, 128, 96,
+	80, 64, 48,
+	40, 32, 24,
+	20, 16, 12,
+	10, 8, 6,
+	5, 4, 3,
+	2,
+	1,
+}
+
+var counterOffsets [32]int32 = [32]int32{
+	1, 0, 1040,
+	536, 0, 1040,
+	536, 0, 1040,
+	536, 0, 1040,
+	536, 0, 1040,
+	536, 0, 1040,
+	536, 0, 1040,
+	536, 0, 1040,
+	536, 0, 1040,
+	536, 0, 1040,
+	0,
+	0,
 }
 
-var gaussValues [512]int = [512]int{
+var gaussValues [512]int32 = [512]int32{
 	0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000, 0x000,
 	0x001, 0x001, 0x001, 0x001, 0x001, 0x001, 0x001, 0x001, 0x001, 0x001, 0x001, 0x002, 0x002, 0x002, 0x002, 0x002,
 	0x002, 0x002, 0x003, 0x003, 0x003, 0x003, 0x003, 0x004, 0x004, 0x004, 0x004, 0x004, 0x005, 0x005, 0x005, 0x005,
@@ -119,343 +171,544 @@ func NewDSP(apu *APU) *DSP {
 
 func (dsp *DSP) Reset() {
 	dsp.ram[0x7c] = 0xff // set ENDx
-	dsp.mute = true
-	dsp.reset = true
-	dsp.noiseSample = -0x4000
-	dsp.echoDelay = 1
-	dsp.echoRemain = 1
+	dsp.ram[0x6c] = 0xe0 // FLG: reset, mute, echo writes off
+	for i := 0; i < len(dsp.channel); i++ {
+		dsp.channel[i] = DSPChannel{}
+	}
+	dsp.phase = 0
+	dsp.everyOtherSample = true
+	dsp.kon = 0
+	dsp.newKon = 0
+	dsp.counter = 0
+	dsp.noise = 0x4000
+	dsp.endxBuf = 0
+	dsp.envxBuf = 0
+	dsp.outxBuf = 0
+	dsp.echoOffset = 0
+	dsp.echoLength = 0
+	dsp.echoHistPos = 0
+	dsp.echoHist = [dspEchoHistSize * 2 * 2]int16{}
+	dsp.tMainOut = [2]int32{}
+	dsp.tEchoOut = [2]int32{}
+	dsp.tEchoIn = [2]int32{}
 }
 
+// Cycle runs one step of the pipeline
 func (dsp *DSP) Cycle() {
-	var totalL int = 0
-	var totalR int = 0
-	for i := 0; i < len(dsp.channel); i++ {
-		dsp.cycleChannel(i)
-		totalL += (int(dsp.channel[i].sampleOut) * int(dsp.channel[i].volumeL)) >> 6
-		totalR += (int(dsp.channel[i].sampleOut) * int(dsp.channel[i].volumeR)) >> 6
-		totalL = clamp16bit(totalL)
-		totalR = clamp16bit(totalR)
-	}
-	totalL = (totalL * int(dsp.masterVolumeL)) >> 7
-	totalR = (totalR * int(dsp.masterVolumeR)) >> 7
-	totalL = clamp16bit(totalL)
-	totalR = clamp16bit(totalR)
-	dsp.handleEcho(&totalL, &totalR)
-	if dsp.mute {
-		totalL = 0
-		totalR = 0
-	}
-	dsp.handleNoise()
-	// put it in the samplebuffer
-	dsp.sampleBuffer[dsp.sampleOffset*2] = int16(totalL)
-	dsp.sampleBuffer[dsp.sampleOffset*2+1] = int16(totalR)
+	switch dsp.phase {
+	case 0:
+		dsp.voiceV5(0)
+		dsp.voiceV2(1)
+	case 1:
+		dsp.voiceV6(0)
+		dsp.voiceV3(1)
+	case 2, 5, 8, 11, 14:
+		// V7 of a voice, V4 of the next and V1 of the one after, every 3 steps
+		var v int = int(dsp.phase-2) / 3
+		dsp.voiceV7(v)
+		dsp.voiceV1(v + 3)
+		dsp.voiceV4(v + 1)
+	case 3, 6, 9, 12, 15, 18:
+		var v int = int(dsp.phase-3) / 3
+		dsp.voiceV8(v)
+		dsp.voiceV5(v + 1)
+		dsp.voiceV2(v + 2)
+	case 4, 7, 10, 13, 16, 19:
+		var v int = int(dsp.phase-4) / 3
+		dsp.voiceV9(v)
+		dsp.voiceV6(v + 1)
+		dsp.voiceV3(v + 2)
+	case 17:
+		dsp.voiceV1(0)
+		dsp.voiceV7(5)
+		dsp.voiceV4(6)
+	case 20:
+		dsp.voiceV1(1)
+		dsp.voiceV7(6)
+		dsp.voiceV4(7)
+	case 21:
+		dsp.voiceV8(6)
+		dsp.voiceV5(7)
+		dsp.voiceV2(0) // after V5 of voice 7, tBrrNextAddr is shared
+	case 22:
+		dsp.voiceV3a(0)
+		dsp.voiceV9(6)
+		dsp.voiceV6(7)
+		dsp.echo22()
+	case 23:
+		dsp.voiceV7(7)
+		dsp.echo23()
+	case 24:
+		dsp.voiceV8(7)
+		dsp.echo24()
+	case 25:
+		dsp.voiceV3b(0)
+		dsp.voiceV9(7)
+		dsp.echo25()
+	case 26:
+		dsp.echo26()
+	case 27:
+		dsp.misc27()
+		dsp.echo27()
+	case 28:
+		dsp.misc28()
+		dsp.echo28()
+	case 29:
+		dsp.misc29()
+		dsp.echo29()
+	case 30:
+		dsp.misc30()
+		dsp.voiceV3c(0)
+		dsp.echo30()
+	case 31:
+		dsp.voiceV4(0)
+		dsp.voiceV1(2)
+	}
+	dsp.phase = (dsp.phase + 1) & 0x1f
+}
 
-	// prevent sampleOffset from going above 534-1 (out of sampleBuffer bounds)
-	if dsp.sampleOffset < 533 {
-		dsp.sampleOffset++
+// voice steps
+
+func (dsp *DSP) voiceV1(v int) {
+	// the srcn read by the V1 before is of the voice whose V2 comes next
+	dsp.tDirAddr = uint16(dsp.tDir)<<8 + uint16(dsp.tSrcn)<<2
+	dsp.tSrcn = dsp.ram[v<<4|0x04]
+}
+
+func (dsp *DSP) voiceV2(v int) {
+	// sample start, or loop address once playing
+	var addr uint16 = dsp.tDirAddr
+	if dsp.channel[v].konDelay == 0 {
+		addr += 2
 	}
+	dsp.tBrrNextAddr = uint16(dsp.apu.ram[addr]) | uint16(dsp.apu.ram[addr+1])<<8
+	dsp.tAdsr0 = dsp.ram[v<<4|0x05]
+	dsp.tPitch = int32(dsp.ram[v<<4|0x02])
+}
 
-	dsp.evenCycle = !dsp.evenCycle
+func (dsp *DSP) voiceV3(v int) {
+	dsp.voiceV3a(v)
+	dsp.voiceV3b(v)
+	dsp.voiceV3c(v)
 }
 
-func (dsp *DSP) handleEcho(outputL *int, outputR *int) {
-	// get value out of ram
-	var addr uint16 = dsp.echoBufferAddr + dsp.echoBufferIndex*4
-	dsp.firBufferL[dsp.firBufferIndex] = (int16(dsp.apu.ram[addr]) + (int16(dsp.apu.ram[(addr+1)&0xffff]) << 8))
-	dsp.firBufferL[dsp.firBufferIndex] >>= 1
-	dsp.firBufferR[dsp.firBufferIndex] = (int16(dsp.apu.ram[(addr+2)&0xffff]) + (int16(dsp.apu.ram[(addr+3)&0xffff]) << 8))
-	dsp.firBufferR[dsp.firBufferIndex] >>= 1
-	// calculate FIR-sum
-	var sumL, sumR int = 0, 0
-	for i := 0; i < len(dsp.channel); i++ {
-		sumL += (int(dsp.firBufferL[(int(dsp.firBufferIndex)+i+1)&0x7]) * int(dsp.firValues[i])) >> 6
-		sumR += (int(dsp.firBufferR[(int(dsp.firBufferIndex)+i+1)&0x7]) * int(dsp.firValues[i])) >> 6
-		if i == 6 {
-			// clip to 16-bit before last addition
-			sumL = int(int16(sumL & 0xffff)) // clip 16-bit
-			sumR = int(int16(sumR & 0xffff)) // clip 16-bit
-		}
+func (dsp *DSP) voiceV3a(v int) {
+	dsp.tPitch += int32(dsp.ram[v<<4|0x03]&0x3f) << 8
+}
+
+func (dsp *DSP) voiceV3b(v int) {
+	var ch *DSPChannel = &dsp.channel[v]
+	dsp.tBrrByte = dsp.apu.ram[ch.brrAddr+ch.brrOffset]
+	dsp.tBrrHeader = dsp.apu.ram[ch.brrAddr]
+}
+
+func (dsp *DSP) voiceV3c(v int) {
+	var ch *DSPChannel = &dsp.channel[v]
+	var vbit byte = 1 << v
+	// pitch modulation by the output of the previous voice
+	if (dsp.tPmon & vbit) > 0 {
+		dsp.tPitch += ((dsp.tOutput >> 5) * dsp.tPitch) >> 10
 	}
-	sumL = clamp16bit(sumL)
-	sumR = clamp16bit(sumR)
-	// modify output with sum
-	var outL int = *outputL + ((sumL * int(dsp.echoVolumeL)) >> 7)
-	var outR int = *outputR + ((sumR * int(dsp.echoVolumeR)) >> 7)
-	*outputL = clamp16bit(outL)
-	*outputR = clamp16bit(outR)
-	// get echo input
-	var inL, inR int = 0, 0
-	for i := 0; i < len(dsp.channel); i++ {
-		if dsp.channel[i].echoEnable {
-			inL += (int(dsp.channel[i].sampleOut) * int(dsp.channel[i].volumeL)) >> 6
-			inR += (int(dsp.channel[i].sampleOut) * int(dsp.channel[i].volumeR)) >> 6
-			inL = clamp16bit(inL)
-			inR = clamp16bit(inR)
+	if ch.konDelay > 0 {
+		if ch.konDelay == 5 {
+			// start decoding on the next sample
+			ch.brrAddr = dsp.tBrrNextAddr
+			ch.brrOffset = 1
+			ch.bufPos = 0
+			dsp.tBrrHeader = 0 // header is ignored on this sample
 		}
-	}
-	// write this to ram
-	inL += (sumL * int(dsp.feedbackVolume)) >> 7
-	inR += (sumR * int(dsp.feedbackVolume)) >> 7
-	inL = clamp16bit(inL)
-	inR = clamp16bit(inR)
-	inL &= 0xfffe
-	inR &= 0xfffe
-	if dsp.echoWrites {
-		dsp.apu.ram[addr] = byte(inL & 0xff)
-		dsp.apu.ram[(addr+1)&0xffff] = byte(inL >> 8)
-		dsp.apu.ram[(addr+2)&0xffff] = byte(inR & 0xff)
-		dsp.apu.ram[(addr+3)&0xffff] = byte(inR >> 8)
-	}
-	// handle indexes
-	dsp.firBufferIndex++
-	dsp.firBufferIndex &= 7
-	dsp.echoBufferIndex++
-	dsp.echoRemain--
-	if dsp.echoRemain == 0 {
-		dsp.echoRemain = dsp.echoDelay
-		dsp.echoBufferIndex = 0
-	}
-}
-
-func (dsp *DSP) cycleChannel(ch int) {
-	// handle pitch counter
-	var pitch uint16 = dsp.channel[ch].pitch
-	if ch > 0 && dsp.channel[ch].pitchModulation {
-		var factor int = (int(dsp.channel[ch-1].sampleOut) >> 4) + 0x400
-		pitch = uint16((int(pitch) * factor) >> 10)
-		if pitch > 0x3fff {
-			pitch = 0x3fff
+		// no envelope and no pitch during KON, decoding in the last 3 samples
+		ch.env = 0
+		ch.hiddenEnv = 0
+		ch.interpPos = 0
+		ch.konDelay--
+		if (ch.konDelay & 3) > 0 {
+			ch.interpPos = 0x4000
 		}
+		dsp.tPitch = 0
 	}
-	var newCounter int = int(dsp.channel[ch].pitchCounter) + int(pitch)
-	if newCounter > 0xffff {
-		// next sample
-		dsp.decodeBrr(ch)
+
+	var output int32 = dsp.interpolate(ch)
+	if (dsp.tNon & vbit) > 0 {
+		output = int32(int16(dsp.noise * 2))
 	}
-	dsp.channel[ch].pitchCounter = uint16(newCounter)
-	var sample int16 = 0
-	if dsp.channel[ch].useNoise {
-		sample = dsp.noiseSample
-	} else {
-		sample = dsp.getSample(ch, int(dsp.channel[ch].pitchCounter)>>12, (int(dsp.channel[ch].pitchCounter)>>4)&0xff)
-	}
-	if dsp.evenCycle {
-		// handle keyon/off (every other cycle)
-		if dsp.channel[ch].keyOff {
-			// go to release
-			dsp.channel[ch].adsrState = 4
-		} else if dsp.channel[ch].keyOn {
-			dsp.channel[ch].keyOn = false
-			// restart current sample
-			dsp.channel[ch].previousFlags = 0
-			var samplePointer uint16 = dsp.dirPage + (4 * uint16(dsp.channel[ch].srcn))
-			dsp.channel[ch].decodeOffset = uint16(dsp.apu.ram[samplePointer])
-			dsp.channel[ch].decodeOffset |= uint16(dsp.apu.ram[(samplePointer+1)&0xffff]) << 8
-			// zero clear
-			for i := 0; i < len(dsp.channel[ch].decodeBuffer); i++ {
-				dsp.channel[ch].decodeBuffer[i] = 0
-			}
-			dsp.channel[ch].gain = 0
-			if dsp.channel[ch].useGain {
-				dsp.channel[ch].adsrState = 3
-			} else {
-				dsp.channel[ch].adsrState = 0
-			}
+	dsp.tOutput = (output * ch.env) >> 11 &^ 1
+	ch.envxOut = byte(ch.env >> 4)
+
+	// immediate silence on soft reset or end of sample without loop
+	if (dsp.ram[0x6c]&0x80) > 0 || (dsp.tBrrHeader&3) == 1 {
+		ch.envMode = envRelease
+		ch.env = 0
+	}
+	if dsp.everyOtherSample {
+		if (dsp.tKoff & vbit) > 0 {
+			ch.envMode = envRelease
+		}
+		if (dsp.kon & vbit) > 0 {
+			ch.konDelay = 5
+			ch.envMode = envAttack
 		}
 	}
-	// handle reset
-	if dsp.reset {
-		dsp.channel[ch].adsrState = 4
-		dsp.channel[ch].gain = 0
+	if ch.konDelay == 0 {
+		dsp.runEnvelope(v)
 	}
-	// handle envelope/adsr
-	var doingDirectGain bool = dsp.channel[ch].adsrState != 4 && dsp.channel[ch].useGain && dsp.channel[ch].directGain
-	var rate uint16
-	if dsp.channel[ch].adsrState == 4 {
-		rate = 0
-	} else {
-		rate = dsp.channel[ch].adsrRates[dsp.channel[ch].adsrState]
+}
+
+func (dsp *DSP) voiceV4(v int) {
+	var ch *DSPChannel = &dsp.channel[v]
+	dsp.tLooped = 0
+	if ch.interpPos >= 0x4000 {
+		dsp.decodeBrr(ch)
+		ch.brrOffset += 2
+		if ch.brrOffset >= dspBrrBlockSize {
+			// next block, or the loop
+			ch.brrAddr += dspBrrBlockSize
+			if (dsp.tBrrHeader & 1) > 0 {
+				ch.brrAddr = dsp.tBrrNextAddr
+				dsp.tLooped = 1 << v
+			}
+			ch.brrOffset = 1
+		}
 	}
-	if dsp.channel[ch].adsrState != 4 && !doingDirectGain && rate != 0 {
-		dsp.channel[ch].rateCounter++
+	ch.interpPos = (ch.interpPos & 0x3fff) + dsp.tPitch
+	// keep from getting too far ahead with pitch modulation
+	if ch.interpPos > 0x7fff {
+		ch.interpPos = 0x7fff
 	}
-	if dsp.channel[ch].adsrState == 4 || (!doingDirectGain && dsp.channel[ch].rateCounter >= rate && rate != 0) {
-		if dsp.channel[ch].adsrState != 4 {
-			dsp.channel[ch].rateCounter = 0
-		}
-		dsp.handleGain(ch)
+	dsp.voiceOutput(v, 0)
+}
+
+func (dsp *DSP) voiceV5(v int) {
+	dsp.voiceOutput(v, 1)
+	// ENDX, OUTX and ENVX don't update if written 1-2 steps earlier
+	var endx byte = dsp.ram[0x7c] | dsp.tLooped
+	if dsp.channel[v].konDelay == 5 {
+		endx &^= 1 << v
 	}
-	if doingDirectGain {
-		dsp.channel[ch].gain = dsp.channel[ch].gainValue
+	dsp.endxBuf = endx
+}
+
+func (dsp *DSP) voiceV6(v int) {
+	dsp.outxBuf = byte(dsp.tOutput >> 8)
+}
+
+func (dsp *DSP) voiceV7(v int) {
+	dsp.ram[0x7c] = dsp.endxBuf
+	dsp.envxBuf = dsp.channel[v].envxOut
+}
+
+func (dsp *DSP) voiceV8(v int) {
+	dsp.ram[v<<4|0x09] = dsp.outxBuf
+}
+
+func (dsp *DSP) voiceV9(v int) {
+	dsp.ram[v<<4|0x08] = dsp.envxBuf
+}
+
+// voiceOutput adds the output of the voice to the main and echo totals
+func (dsp *DSP) voiceOutput(v int, side int) {
+	var amp int32 = (dsp.tOutput * int32(int8(dsp.ram[v<<4|side]))) >> 7
+	dsp.tMainOut[side] = clamp16bit(dsp.tMainOut[side] + amp)
+	if (dsp.tEon & (1 << v)) > 0 {
+		dsp.tEchoOut[side] = clamp16bit(dsp.tEchoOut[side] + amp)
 	}
-	// set outputs
-	dsp.ram[(ch<<4)|8] = byte(dsp.channel[ch].gain >> 4)
-	// WARNING: convert to unsigned int
-	sample = int16(uint16((int(sample) * int(dsp.channel[ch].gain)) >> 11))
-	dsp.ram[(ch<<4)|9] = byte(sample >> 7)
-	dsp.channel[ch].sampleOut = sample
 }
 
-func (dsp *DSP) handleGain(ch int) {
-	switch dsp.channel[ch].adsrState {
-	case 0: // attack
-		var rate uint16 = dsp.channel[ch].adsrRates[dsp.channel[ch].adsrState]
-		if rate == 1 {
-			dsp.channel[ch].gain += 1024
-		} else {
-			dsp.channel[ch].gain += 32
-		}
-		if dsp.channel[ch].gain >= 0x7e0 {
-			dsp.channel[ch].adsrState = 1
-		}
-		if dsp.channel[ch].gain > 0x7ff {
-			dsp.channel[ch].gain = 0x7ff
-		}
-	case 1:
-		// decay
-		dsp.channel[ch].gain -= ((dsp.channel[ch].gain - 1) >> 8) + 1
-		if dsp.channel[ch].gain < dsp.channel[ch].sustainLevel {
-			dsp.channel[ch].adsrState = 2
-		}
-	case 2:
-		// sustain
-		sub := ((dsp.channel[ch].gain - 1) >> 8) + 1
-		// WARNING: overflow handling
-		if dsp.channel[ch].gain >= sub {
-			dsp.channel[ch].gain -= ((dsp.channel[ch].gain - 1) >> 8) + 1
-		} else {
-			dsp.channel[ch].gain = 0
+func (dsp *DSP) interpolate(ch *DSPChannel) int32 {
+	// gaussian interpolation of 4 samples around the position
+	var offset int32 = (ch.interpPos >> 4) & 0xff
+	var pos int32 = (ch.interpPos >> 12) + ch.bufPos
+	var out int32 = (gaussValues[0xff-offset] * int32(ch.buf[pos])) >> 11
+	out += (gaussValues[0x1ff-offset] * int32(ch.buf[pos+1])) >> 11
+	out += (gaussValues[0x100+offset] * int32(ch.buf[pos+2])) >> 11
+	out = int32(int16(out))
+	out += (gaussValues[offset] * int32(ch.buf[pos+3])) >> 11
+	return clamp16bit(out) &^ 1
+}
+
+func (dsp *DSP) runEnvelope(v int) {
+	var ch *DSPChannel = &dsp.channel[v]
+	var env int32 = ch.env
+	if ch.envMode == envRelease {
+		env -= 0x8
+		if env < 0 {
+			env = 0
 		}
-	case 3:
-		// gain
-		switch dsp.channel[ch].gainMode {
-		case 0:
-			// linear decrease
-			dsp.channel[ch].gain -= 32
-			// decreasing below 0 will underflow to above 0x7ff
-			if dsp.channel[ch].gain > 0x7ff {
-				dsp.channel[ch].gain = 0
-			}
-		case 1:
-			// exponential decrease
-			dsp.channel[ch].gain -= ((dsp.channel[ch].gain - 1) >> 8) + 1
-		case 2:
-			// linear increase
-			dsp.channel[ch].gain += 32
-			if dsp.channel[ch].gain > 0x7ff {
-				dsp.channel[ch].gain = 0x7ff
+		ch.env = env
+		return
+	}
+
+	var rate int32
+	var envData byte = dsp.ram[v<<4|0x06]
+	if (dsp.tAdsr0 & 0x80) > 0 {
+		// adsr
+		if ch.envMode >= envDecay {
+			env--
+			env -= env >> 8
+			rate = int32(envData & 0x1f)
+			if ch.envMode == envDecay {
+				rate = int32((dsp.tAdsr0>>3)&0x0e) + 0x10
 			}
-		case 3:
-			// bent increase
-			if dsp.channel[ch].gain < 0x600 {
-				dsp.channel[ch].gain += 32
+		} else {
+			rate = int32(dsp.tAdsr0&0x0f)*2 + 1
+			if rate < 31 {
+				env += 0x20
 			} else {
-				dsp.channel[ch].gain += 8
-			}
-			if dsp.channel[ch].gain > 0x7ff {
-				dsp.channel[ch].gain = 0x7ff
+				env += 0x400
 			}
 		}
-	case 4:
-		// release
-		dsp.channel[ch].gain -= 8
-		// decreasing below 0 will underflow to above 0x7ff
-		if dsp.channel[ch].gain > 0x7ff {
-			dsp.channel[ch].gain = 0
+	} else {
+		// gain
+		envData = dsp.ram[v<<4|0x07]
+		var mode byte = envData >> 5
+		if mode < 4 {
+			// direct
+			env = int32(envData) * 0x10
+			rate = 31
+		} else {
+			rate = int32(envData & 0x1f)
+			switch mode {
+			case 4:
+				// linear decrease
+				env -= 0x20
+			case 5:
+				// exponential decrease
+				env--
+				env -= env >> 8
+			default:
+				// linear increase, bent line for 7
+				env += 0x20
+				if mode == 7 && uint32(ch.hiddenEnv) >= 0x600 {
+					env += 0x8 - 0x20
+				}
+			}
 		}
 	}
-}
-
-func (dsp *DSP) getSample(ch int, sampleNum int, offset int) int16 {
-	var news int16 = dsp.channel[ch].decodeBuffer[sampleNum+3]
-	var olds int16 = dsp.channel[ch].decodeBuffer[sampleNum+2]
-	var olders int16 = dsp.channel[ch].decodeBuffer[sampleNum+1]
-	var oldests int16 = dsp.channel[ch].decodeBuffer[sampleNum]
-	var out int = (gaussValues[0xff-offset] * int(oldests)) >> 10
-
-	out += (gaussValues[0x1ff-offset] * int(olders)) >> 10
-	out += (gaussValues[0x100+offset] * int(olds)) >> 10
-	out = int(int16(out & 0xffff)) // clip 16-bit
-	out += (gaussValues[offset] * int(news)) >> 10
-	out = clamp16bit(out) // clamp 16-bit
-
-	return int16(out >> 1)
-}
-
-func (dsp *DSP) decodeBrr(ch int) {
-	// copy last 3 samples (16-18) to first 3 for interpolation
-	dsp.channel[ch].decodeBuffer[0] = dsp.channel[ch].decodeBuffer[16]
-	dsp.channel[ch].decodeBuffer[1] = dsp.channel[ch].decodeBuffer[17]
-	dsp.channel[ch].decodeBuffer[2] = dsp.channel[ch].decodeBuffer[18]
-	// handle flags from previous block
-	if dsp.channel[ch].previousFlags == 1 || dsp.channel[ch].previousFlags == 3 {
-		// loop sample
-		var samplePointer uint16 = uint16(int(dsp.dirPage) + (4 * int(dsp.channel[ch].srcn)))
-		dsp.channel[ch].decodeOffset = uint16(dsp.apu.ram[(samplePointer+2)&0xffff])
-		dsp.channel[ch].decodeOffset |= uint16(dsp.apu.ram[(samplePointer+3)&0xffff]) << 8
-		if dsp.channel[ch].previousFlags == 1 {
-			// also release and clear gain
-			dsp.channel[ch].adsrState = 4
-			dsp.channel[ch].gain = 0
-		}
-		dsp.ram[0x7c] |= 1 << ch // set ENDx
-	}
-	var header byte = dsp.apu.ram[dsp.channel[ch].decodeOffset]
-	dsp.channel[ch].decodeOffset++
-	var shift int = int(header) >> 4
-	var filter int = int(header&0xc) >> 2
-	dsp.channel[ch].previousFlags = header & 0x3
-	var curByte byte = 0
-	var old int = int(dsp.channel[ch].old)
-	var older int = int(dsp.channel[ch].older)
-	for i := 0; i < 16; i++ {
-		var s int = 0
-		if (i & 1) > 0 {
-			s = int(curByte) & 0x0f
+	// sustain level
+	if (env>>8) == int32(envData>>5) && ch.envMode == envDecay {
+		ch.envMode = envSustain
+	}
+	ch.hiddenEnv = env
+	if env < 0 || env > 0x7ff {
+		if env < 0 {
+			env = 0
 		} else {
-			curByte = dsp.apu.ram[dsp.channel[ch].decodeOffset]
-			dsp.channel[ch].decodeOffset++
-			s = int(curByte) >> 4
+			env = 0x7ff
 		}
-		if s > 7 {
-			s -= 16
+		if ch.envMode == envAttack {
+			ch.envMode = envDecay
 		}
-		if shift <= 0xc {
-			s = (s << shift) >> 1
-		} else {
-			s = (s >> 3) << 12
+	}
+	if dsp.readCounter(rate) {
+		ch.env = env
+	}
+}
+
+// decodeBrr decodes the next 4 samples of the brr block
+func (dsp *DSP) decodeBrr(ch *DSPChannel) {
+	var nybbles int32 = int32(dsp.tBrrByte)<<8 | int32(dsp.apu.ram[ch.brrAddr+ch.brrOffset+1])
+	var header byte = dsp.tBrrHeader
+	var shift byte = header >> 4
+	var filter byte = header & 0x0c
+	var pos int32 = ch.bufPos
+	ch.bufPos += 4
+	if ch.bufPos >= dspBrrBufSize {
+		ch.bufPos = 0
+	}
+	for i := int32(0); i < 4; i++ {
+		var s int32 = int32(int16(nybbles<<(i*4))) >> 12
+		s = (s << shift) >> 1
+		if shift >= 0xd {
+			// invalid range
+			if s < 0 {
+				s = -0x800
+			} else {
+				s = 0
+			}
 		}
+		// previous samples, wrapping around the buffer
+		var p1 int32 = int32(ch.buf[pos+i+dspBrrBufSize-1])
+		var p2 int32 = int32(ch.buf[pos+i+dspBrrBufSize-2]) >> 1
 		switch filter {
-		case 1:
-			s += old + (-old >> 4)
-			break
-		case 2:
-			s += 2*old + ((3 * -old) >> 5) - older + (older >> 4)
-			break
-		case 3:
-			s += 2*old + ((13 * -old) >> 6) - older + ((3 * older) >> 4)
-			break
+		case 0x4:
+			s += p1 >> 1
+			s += (-p1) >> 5
+		case 0x8:
+			s += p1 - p2
+			s += p2 >> 4
+			s += (p1 * -3) >> 6
+		case 0xc:
+			s += p1 - p2
+			s += (p1 * -13) >> 7
+			s += (p2 * 3) >> 4
 		}
-		s = clamp16bit(s)
-		s = int((int16((s & 0x7fff) << 1)) >> 1) // clip 15-bit
-		older = old
-		old = s
-		dsp.channel[ch].decodeBuffer[i+3] = int16(s)
+		s = int32(int16(clamp16bit(s) * 2))
+		ch.buf[pos+i] = int16(s)
+		ch.buf[pos+i+dspBrrBufSize] = int16(s)
+	}
+}
+
+// counter
+
+func (dsp *DSP) runCounter() {
+	dsp.counter--
+	if dsp.counter < 0 {
+		dsp.counter = dspCounterRange - 1
+	}
+}
+
+// readCounter reports if the rate fires on this sample
+func (dsp *DSP) readCounter(rate int32) bool {
+	return (dsp.counter+counterOffsets[rate])%counterRates[rate] == 0
+}
+
+// misc steps
+
+func (dsp *DSP) misc27() {
+	dsp.tPmon = dsp.ram[0x2d] & 0xfe // voice 0 has no pitch modulation
+}
+
+func (dsp *DSP) misc28() {
+	dsp.tNon = dsp.ram[0x3d]
+	dsp.tEon = dsp.ram[0x4d]
+	dsp.tDir = dsp.ram[0x5d]
+}
+
+func (dsp *DSP) misc29() {
+	dsp.everyOtherSample = !dsp.everyOtherSample
+	if dsp.everyOtherSample {
+		// KON is cleared 63 steps after it was read
+		dsp.newKon &^= dsp.kon
+	}
+}
+
+func (dsp *DSP) misc30() {
+	if dsp.everyOtherSample {
+		dsp.kon = dsp.newKon
+		dsp.tKoff = dsp.ram[0x5c]
+	}
+	dsp.runCounter()
+	if dsp.readCounter(int32(dsp.ram[0x6c] & 0x1f)) {
+		var feedback int32 = (dsp.noise << 13) ^ (dsp.noise << 14)
+		dsp.noise = (feedback & 0x4000) ^ (dsp.noise >> 1)
 	}
-	dsp.channel[ch].older = int16(older)
-	dsp.channel[ch].old = int16(old)
 }
 
-func (dsp *DSP) handleNoise() {
-	if dsp.noiseRate != 0 {
-		dsp.noiseCounter++
+// echo steps
+
+// echoFir returns the i-th echo history sample of a side
+func (dsp *DSP) echoFir(i int32, side int32) int32 {
+	return int32(dsp.echoHist[(dsp.echoHistPos+i)*2+side])
+}
+
+func (dsp *DSP) calcFir(i int32, side int32) int32 {
+	return (dsp.echoFir(i+1, side) * int32(int8(dsp.ram[i<<4|0x0f]))) >> 6
+}
+
+func (dsp *DSP) echoRead(side int32) {
+	var addr uint16 = dsp.tEchoPtr + uint16(side*2)
+	var s int32 = int32(int16(uint16(dsp.apu.ram[addr]) | uint16(dsp.apu.ram[addr+1])<<8))
+	// twice in the history for wrap around
+	dsp.echoHist[dsp.echoHistPos*2+side] = int16(s >> 1)
+	dsp.echoHist[(dsp.echoHistPos+dspEchoHistSize)*2+side] = int16(s >> 1)
+}
+
+func (dsp *DSP) echoWrite(side int32) {
+	if (dsp.tEchoEnabled & 0x20) == 0 {
+		var addr uint16 = dsp.tEchoPtr + uint16(side*2)
+		dsp.apu.ram[addr] = byte(dsp.tEchoOut[side])
+		dsp.apu.ram[addr+1] = byte(dsp.tEchoOut[side] >> 8)
 	}
-	if dsp.noiseCounter >= dsp.noiseRate && dsp.noiseRate != 0 {
-		var bit int = (int(dsp.noiseSample) & 1) ^ ((int(dsp.noiseSample) >> 1) & 1)
-		dsp.noiseSample = ((dsp.noiseSample >> 1) & 0x3fff) | (int16(bit) << 14)
-		dsp.noiseSample = (int16((dsp.noiseSample & 0x7fff) << 1)) >> 1
-		dsp.noiseCounter = 0
+	dsp.tEchoOut[side] = 0
+}
+
+// echoOutput mixes the main and echo outputs of a side with their volumes
+func (dsp *DSP) echoOutput(side int32) int32 {
+	var main int32 = int32(int16((dsp.tMainOut[side] * int32(int8(dsp.ram[side<<4|0x0c]))) >> 7))
+	var echo int32 = int32(int16((dsp.tEchoIn[side] * int32(int8(dsp.ram[side<<4|0x2c]))) >> 7))
+	return clamp16bit(main + echo)
+}
+
+func (dsp *DSP) echo22() {
+	dsp.echoHistPos++
+	if dsp.echoHistPos >= dspEchoHistSize {
+		dsp.echoHistPos = 0
 	}
+	dsp.tEchoPtr = uint16(dsp.tEsa)<<8 + dsp.echoOffset
+	dsp.echoRead(0)
+	dsp.tEchoIn[0] = dsp.calcFir(0, 0)
+	dsp.tEchoIn[1] = dsp.calcFir(0, 1)
+}
+
+func (dsp *DSP) echo23() {
+	dsp.tEchoIn[0] += dsp.calcFir(1, 0) + dsp.calcFir(2, 0)
+	dsp.tEchoIn[1] += dsp.calcFir(1, 1) + dsp.calcFir(2, 1)
+	dsp.echoRead(1)
+}
+
+func (dsp *DSP) echo24() {
+	dsp.tEchoIn[0] += dsp.calcFir(3, 0) + dsp.calcFir(4, 0) + dsp.calcFir(5, 0)
+	dsp.tEchoIn[1] += dsp.calcFir(3, 1) + dsp.calcFir(4, 1) + dsp.calcFir(5, 1)
+}
+
+func (dsp *DSP) echo25() {
+	for side := int32(0); side < 2; side++ {
+		// the sum wraps before the last tap is added
+		var s int32 = int32(int16(dsp.tEchoIn[side] + dsp.calcFir(6, side)))
+		s += int32(int16(dsp.calcFir(7, side)))
+		dsp.tEchoIn[side] = clamp16bit(s) &^ 1
+	}
+}
+
+func (dsp *DSP) echo26() {
+	// left output, kept for the next step to output both together
+	dsp.tMainOut[0] = dsp.echoOutput(0)
+	// echo feedback
+	for side := int32(0); side < 2; side++ {
+		var s int32 = dsp.tEchoOut[side] + int32(int16((dsp.tEchoIn[side]*int32(int8(dsp.ram[0x0d])))>>7))
+		dsp.tEchoOut[side] = clamp16bit(s) &^ 1
+	}
+}
+
+func (dsp *DSP) echo27() {
+	var outputL int32 = dsp.tMainOut[0]
+	var outputR int32 = dsp.echoOutput(1)
+	dsp.tMainOut[0] = 0
+	dsp.tMainOut[1] = 0
+	if (dsp.ram[0x6c] & 0x40) > 0 {
+		// mute
+		outputL = 0
+		outputR = 0
+	}
+	// put it in the samplebuffer
+	dsp.sampleBuffer[dsp.sampleOffset*2] = int16(outputL)
+	dsp.sampleBuffer[dsp.sampleOffset*2+1] = int16(outputR)
+
+	// prevent sampleOffset from going above 641-1 (out of sampleBuffer bounds)
+	if dsp.sampleOffset < 640 {
+		dsp.sampleOffset++
+	}
+}
+
+func (dsp *DSP) echo28() {
+	dsp.tEchoEnabled = dsp.ram[0x6c]
+}
+
+func (dsp *DSP) echo29() {
+	dsp.tEsa = dsp.ram[0x6d]
+	if dsp.echoOffset == 0 {
+		dsp.echoLength = uint16(dsp.ram[0x7d]&0x0f) * 0x800
+	}
+	dsp.echoOffset += 4
+	if dsp.echoOffset >= dsp.echoLength {
+		dsp.echoOffset = 0
+	}
+	dsp.echoWrite(0)
+	dsp.tEchoEnabled = dsp.ram[0x6c]
+}
+
+func (dsp *DSP) echo30() {
+	dsp.echoWrite(1)
 }
 
 func (dsp *DSP) Read(addr byte) byte {
@@ -463,89 +716,27 @@ func (dsp *DSP) Read(addr byte) byte {
 }
 
 func (dsp *DSP) Write(addr byte, value byte) {
-	var ch int = int(addr) >> 4
-	switch addr {
-	case 0x00, 0x10, 0x20, 0x30, 0x40, 0x50, 0x60, 0x70:
-		dsp.channel[ch].volumeL = int8(value)
-	case 0x01, 0x11, 0x21, 0x31, 0x41, 0x51, 0x61, 0x71:
-		dsp.channel[ch].volumeR = int8(value)
-	case 0x02, 0x12, 0x22, 0x32, 0x42, 0x52, 0x62, 0x72:
-		dsp.channel[ch].pitch = (dsp.channel[ch].pitch & 0x3f00) | uint16(value)
-	case 0x03, 0x13, 0x23, 0x33, 0x43, 0x53, 0x63, 0x73:
-		dsp.channel[ch].pitch = ((dsp.channel[ch].pitch & 0x00ff) | (uint16(value) << 8)) & 0x3fff
-	case 0x04, 0x14, 0x24, 0x34, 0x44, 0x54, 0x64, 0x74:
-		dsp.channel[ch].srcn = value
-	case 0x05, 0x15, 0x25, 0x35, 0x45, 0x55, 0x65, 0x75:
-		dsp.channel[ch].adsrRates[0] = uint16(rateValues[(value&0xf)*2+1])
-		dsp.channel[ch].adsrRates[1] = uint16(rateValues[((value&0x70)>>4)*2+16])
-		dsp.channel[ch].useGain = (value & 0x80) == 0
-	case 0x06, 0x16, 0x26, 0x36, 0x46, 0x56, 0x66, 0x76:
-		dsp.channel[ch].adsrRates[2] = uint16(rateValues[value&0x1f])
-		dsp.channel[ch].sustainLevel = (((uint16(value) & 0xe0) >> 5) + 1) * 0x100
-	case 0x07, 0x17, 0x27, 0x37, 0x47, 0x57, 0x67, 0x77:
-		dsp.channel[ch].directGain = (value & 0x80) == 0
-		if (value & 0x80) > 0 {
-			dsp.channel[ch].gainMode = (value & 0x60) >> 5
-			dsp.channel[ch].adsrRates[3] = uint16(rateValues[value&0x1f])
-		} else {
-			dsp.channel[ch].gainValue = (uint16(value) & 0x7f) * 16
-		}
+	dsp.ram[addr] = value
+	switch addr & 0x0f {
+	case 0x08:
+		dsp.envxBuf = value
+	case 0x09:
+		dsp.outxBuf = value
 	case 0x0c:
-		dsp.masterVolumeL = int8(value)
-	case 0x1c:
-		dsp.masterVolumeR = int8(value)
-	case 0x2c:
-		dsp.echoVolumeL = int8(value)
-	case 0x3c:
-		dsp.echoVolumeR = int8(value)
-	case 0x4c:
-		for i := 0; i < len(dsp.channel); i++ {
-			dsp.channel[i].keyOn = (value & (1 << i)) > 0
-		}
-	case 0x5c:
-		for i := 0; i < len(dsp.channel); i++ {
-			dsp.channel[i].keyOff = (value & (1 << i)) > 0
-		}
-	case 0x6c:
-		dsp.reset = (value & 0x80) > 0
-		dsp.mute = (value & 0x40) > 0
-		dsp.echoWrites = (value & 0x20) == 0
-		dsp.noiseRate = uint16(rateValues[value&0x1f])
-	case 0x7c:
-		value = 0 // any write clears ENDx
-	case 0x0d:
-		dsp.feedbackVolume = int8(value)
-	case 0x2d:
-		for i := 0; i < len(dsp.channel); i++ {
-			dsp.channel[i].pitchModulation = (value & (1 << i)) > 0
-		}
-	case 0x3d:
-		for i := 0; i < len(dsp.channel); i++ {
-			dsp.channel[i].useNoise = (value & (1 << i)) > 0
+		if addr == 0x4c {
+			dsp.newKon = value
 		}
-	case 0x4d:
-		for i := 0; i < len(dsp.channel); i++ {
-			dsp.channel[i].echoEnable = (value & (1 << i)) > 0
+		if addr == 0x7c {
+			// any write clears ENDX
+			dsp.endxBuf = 0
+			dsp.ram[0x7c] = 0
 		}
-	case 0x5d:
-		dsp.dirPage = uint16(value) << 8
-	case 0x6d:
-		dsp.echoBufferAddr = uint16(value) << 8
-	case 0x7d:
-		dsp.echoDelay = (uint16(value) & 0xf) * 512 // 2048-byte steps, stereo sample is 4 bytes
-		if dsp.echoDelay == 0 {
-			dsp.echoDelay = 1
-		}
-	case 0x0f, 0x1f, 0x2f, 0x3f, 0x4f, 0x5f, 0x6f, 0x7f:
-		dsp.firValues[ch] = int8(value)
 	}
-
-	dsp.ram[addr] = value
 }
 
 // utilities
 
-func clamp16bit(total int) int {
+func clamp16bit(total int32) int32 {
 	// clamp 16-bit
 	if total < -0x8000 {
 		return -0x8000
@@ -559,8 +750,17 @@ func clamp16bit(total int) int {
 }
 
 func (dsp *DSP) getSamples(sampleData []int16, samplesPerFrame int) {
-	// resample from 534 samples per frame to wanted value
-	var adder float64 = 534.0 / float64(samplesPerFrame)
+	// resample from the samples of the frame (about 533 (NTSC) or 640 (PAL))
+	// to wanted value
+	var dspSamplesPerFrame float64 = float64(dsp.sampleOffset)
+	if dspSamplesPerFrame == 0 {
+		// no sample yet, silence
+		for i := 0; i < samplesPerFrame*2; i++ {
+			sampleData[i] = 0
+		}
+		return
+	}
+	var adder float64 = dspSamplesPerFrame / float64(samplesPerFrame)
 	var location float64 = 0.0
 	for i := 0; i < samplesPerFrame; i++ {
 		sampleData[i*2] = dsp.sampleBuffer[int(location)*2]
@@ -569,3 +769,61 @@ func (dsp *DSP) getSamples(sampleData []int16, samplesPerFrame int) {
 	}
 	dsp.sampleOffset = 0
 }
+
+func (dsp *DSP) serialize(s *serializer) {
+	s.bytes(dsp.ram[:])
+	for i := 0; i < len(dsp.channel); i++ {
+		var ch *DSPChannel = &dsp.channel[i]
+		s.i16s(ch.buf[:])
+		s.i32(&ch.bufPos)
+		s.i32(&ch.interpPos)
+		s.u16(&ch.brrAddr)
+		s.u16(&ch.brrOffset)
+		s.u8(&ch.envMode)
+		s.i32(&ch.env)
+		s.i32(&ch.hiddenEnv)
+		s.u8(&ch.envxOut)
+		s.u8(&ch.konDelay)
+	}
+
+	s.u8(&dsp.phase)
+	s.bool(&dsp.everyOtherSample)
+	s.u8(&dsp.kon)
+	s.u8(&dsp.newKon)
+	s.i32(&dsp.counter)
+	s.i32(&dsp.noise)
+	s.u8(&dsp.endxBuf)
+	s.u8(&dsp.envxBuf)
+	s.u8(&dsp.outxBuf)
+
+	s.u8(&dsp.tPmon)
+	s.u8(&dsp.tNon)
+	s.u8(&dsp.tEon)
+	s.u8(&dsp.tDir)
+	s.u8(&dsp.tKoff)
+	s.u8(&dsp.tSrcn)
+	s.u8(&dsp.tAdsr0)
+	s.u8(&dsp.tBrrHeader)
+	s.u8(&dsp.tBrrByte)
+	s.u16(&dsp.tBrrNextAddr)
+	s.u16(&dsp.tDirAddr)
+	s.i32(&dsp.tPitch)
+	s.i32(&dsp.tOutput)
+	s.u8(&dsp.tLooped)
+	for i := 0; i < 2; i++ {
+		s.i32(&dsp.tMainOut[i])
+		s.i32(&dsp.tEchoOut[i])
+		s.i32(&dsp.tEchoIn[i])
+	}
+
+	s.u8(&dsp.tEsa)
+	s.u8(&dsp.tEchoEnabled)
+	s.u16(&dsp.tEchoPtr)
+	s.u16(&dsp.echoOffset)
+	s.u16(&dsp.echoLength)
+	s.i32(&dsp.echoHistPos)
+	s.i16s(dsp.echoHist[:])
+
+	s.i16s(dsp.sampleBuffer[:])
+	s.u16(&dsp.sampleOffset)
+}
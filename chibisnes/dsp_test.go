@@ -0,0 +1,31 @@
+package chibisnes
+
+import "testing"
+
+func TestDSPVoiceStartAddress(t *testing.T) {
+	var apu *APU = NewAPU(nil)
+	var dsp *DSP = apu.dsp
+	dsp.Reset()
+	// directory at $1000, sample s starts at $2000 + s * $100
+	for s := 0; s < 8; s++ {
+		var start uint16 = 0x2000 + uint16(s)<<8
+		apu.ram[0x1000+s*4] = byte(start)
+		apu.ram[0x1000+s*4+1] = byte(start >> 8)
+	}
+	dsp.Write(0x5d, 0x10) // DIR
+	dsp.Write(0x6c, 0x20) // FLG: no reset, no mute
+	for v := 0; v < 8; v++ {
+		// voice v plays sample 7 - v, pitch 0 keeps it on its first block
+		dsp.Write(byte(v<<4|0x04), byte(7-v))
+	}
+	dsp.Write(0x4c, 0xff) // KON
+	for i := 0; i < 32*16; i++ {
+		dsp.Cycle()
+	}
+	for v := 0; v < 8; v++ {
+		var want uint16 = 0x2000 + uint16(7-v)<<8
+		if dsp.channel[v].brrAddr != want {
+			t.Errorf("voice %d starts at $%04x, want $%04x", v, dsp.channel[v].brrAddr, want)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package chibisnes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// GameBoy is the Game Boy inside the Super Game Boy: the LR35902, the DMG
+// PPU and APU, the Game Boy cartridge (ROM only, MBC1, MBC2, MBC3 or MBC5)
+// and the memory and i/o registers around them. The screen and the joypads
+// are connected to the ICD2.
+type GameBoy struct {
+	icd2 *ICD2
+
+	cpu *GBCPU
+	ppu *GBPPU
+	apu *GBAPU
+
+	bootROM     []byte // nil to start at $0100 with the header sent by us
+	bootEnabled bool
+
+	wram [0x2000]byte
+	hram [0x7f]byte
+
+	ie       byte
+	intFlags byte // $ff0f
+
+	// timer
+	divider  uint16 // $ff04 is the high byte
+	tima     byte
+	tma      byte
+	tac      byte
+	overflow bool // tima reloads from tma on the next cycle
+
+	// serial, nothing is connected
+	serialData    byte
+	serialControl byte
+	serialCycles  int32
+
+	joyp byte // selection bits 4-5 of $ff00
+
+	// cartridge
+	rom        []byte
+	romSize    uint32
+	ram        *SRAM
+	ramSize    uint32
+	mbc        byte // 0: none, 1: MBC1, 2: MBC2, 3: MBC3, 5: MBC5
+	romBank    uint16
+	ramBank    byte
+	ramEnable  bool
+	mbc1Mode   byte
+	rtc        [5]byte // MBC3 clock: seconds, minutes, hours, days low, days high/halt/carry
+	rtcLatched [5]byte
+	rtcLatch   byte
+	rtcTime    int64 // host time the clock was at 0
+	title      string
+}
+
+const (
+	gbIntVBlank byte = 0x01
+	gbIntSTAT   byte = 0x02
+	gbIntTimer  byte = 0x04
+	gbIntSerial byte = 0x08
+	gbIntJoypad byte = 0x10
+)
+
+func NewGameBoy(icd2 *ICD2, data []byte, filePath string, bootROM []byte) (*GameBoy, error) {
+	gb := &GameBoy{
+		icd2:    icd2,
+		bootROM: bootROM,
+	}
+	gb.cpu = NewGBCPU(gb)
+	gb.ppu = NewGBPPU(gb)
+	gb.apu = NewGBAPU(gb)
+
+	if len(data) < 0x150 {
+		msg := fmt.Sprintf("Failed to load rom: Game Boy rom to small (%d bytes)\n", len(data))
+		return nil, errors.New(msg)
+	}
+
+	// expand to a power of 2
+	var romSize int = 0x8000
+	for romSize < len(data) {
+		romSize *= 2
+	}
+	gb.rom = make([]byte, romSize)
+	gb.romSize = uint32(romSize)
+	for i := 0; i < romSize; i++ {
+		gb.rom[i] = data[i%len(data)]
+	}
+
+	var title []byte
+	for i := 0x134; i < 0x144 && data[i] >= 0x20 && data[i] < 0x7f; i++ {
+		title = append(title, data[i])
+	}
+	gb.title = string(title)
+
+	var cartType byte = data[0x147]
+	var battery bool
+	switch cartType {
+	case 0x00, 0x08, 0x09:
+		gb.mbc = 0
+		battery = cartType == 0x09
+	case 0x01, 0x02, 0x03:
+		gb.mbc = 1
+		battery = cartType == 0x03
+	case 0x05, 0x06:
+		gb.mbc = 2
+		battery = cartType == 0x06
+	case 0x0f, 0x10, 0x11, 0x12, 0x13:
+		gb.mbc = 3
+		battery = cartType == 0x0f || cartType == 0x10 || cartType == 0x13
+	case 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e:
+		gb.mbc = 5
+		battery = cartType == 0x1b || cartType == 0x1e
+	default:
+		msg := fmt.Sprintf("Failed to load rom: unsupported Game Boy cartridge type ($%02x)\n", cartType)
+		return nil, errors.New(msg)
+	}
+
+	var ramSizes [6]uint32 = [6]uint32{0, 0x800, 0x2000, 0x8000, 0x20000, 0x10000}
+	if data[0x149] < 6 {
+		gb.ramSize = ramSizes[data[0x149]]
+	}
+	if gb.mbc == 2 {
+		// 512 nibbles inside the MBC2
+		gb.ramSize = 0x200
+	}
+	if gb.ramSize > 0 {
+		if battery {
+			var ramFileName string = getFileNameWithoutExtension(filePath)
+			var ramFileDir string = filepath.Dir(filepath.Clean(filePath))
+			gb.ram = NewSRAM(filepath.Join(ramFileDir, ramFileName+`.srm`), int(gb.ramSize))
+		}
+		if gb.ram == nil {
+			gb.ram = newVolatileSRAM(int(gb.ramSize))
+		}
+	}
+	gb.rtcTime = time.Now().Unix()
+
+	log.Printf("ROM: Game Boy rom \"%s\", MBC%d, RAM size: 0x%x\n", gb.title, gb.mbc, gb.ramSize)
+	return gb, nil
+}
+
+func (gb *GameBoy) Reset() {
+	gb.cpu.Reset()
+	gb.ppu.Reset()
+	gb.apu.Reset()
+	for i := 0; i < len(gb.wram); i++ {
+		gb.wram[i] = 0
+	}
+	for i := 0; i < len(gb.hram); i++ {
+		gb.hram[i] = 0
+	}
+	gb.ie = 0
+	gb.intFlags = 0
+	gb.divider = 0
+	gb.tima = 0
+	gb.tma = 0
+	gb.tac = 0
+	gb.overflow = false
+	gb.serialData = 0
+	gb.serialControl = 0
+	gb.serialCycles = 0
+	gb.joyp = 0x30
+	gb.romBank = 1
+	gb.ramBank = 0
+	gb.ramEnable = false
+	gb.mbc1Mode = 0
+	gb.rtcLatch = 0xff
+
+	gb.bootEnabled = gb.bootROM != nil
+	if !gb.bootEnabled {
+		gb.cpu.skipBoot()
+		gb.ppu.skipBoot()
+		gb.apu.skipBoot()
+		gb.icd2.sendHeader(gb.rom[0x104:])
+	}
+}
+
+func (gb *GameBoy) Close() {
+	if gb.ram != nil {
+		gb.ram.Close()
+	}
+}
+
+func (gb *GameBoy) requestInterrupt(flag byte) {
+	gb.intFlags |= flag
+}
+
+// tick runs everything but the cpu for a number of clocks
+func (gb *GameBoy) tick(cycles int) {
+	for i := 0; i < cycles; i++ {
+		gb.tickTimer()
+	}
+	if gb.serialCycles > 0 {
+		gb.serialCycles -= int32(cycles)
+		if gb.serialCycles <= 0 {
+			// nothing answers
+			gb.serialData = 0xff
+			gb.serialControl &= 0x7f
+			gb.requestInterrupt(gbIntSerial)
+		}
+	}
+	gb.ppu.tick(cycles)
+	gb.apu.tick(cycles)
+}
+
+func (gb *GameBoy) tickTimer() {
+	if gb.overflow {
+		gb.overflow = false
+		gb.tima = gb.tma
+		gb.requestInterrupt(gbIntTimer)
+	}
+	var oldDivider uint16 = gb.divider
+	gb.divider++
+	if (oldDivider&0x1fff) == 0x1fff && (gb.divider&0x1fff) == 0 {
+		// 512 Hz, bit 12 of the divider falling
+		gb.apu.frameSequencer()
+	}
+	if (gb.tac & 4) == 0 {
+		return
+	}
+	var bits [4]uint16 = [4]uint16{1 << 9, 1 << 3, 1 << 5, 1 << 7}
+	var bit uint16 = bits[gb.tac&3]
+	if (oldDivider&bit) > 0 && (gb.divider&bit) == 0 {
+		gb.incrementTIMA()
+	}
+}
+
+func (gb *GameBoy) incrementTIMA() {
+	gb.tima++
+	if gb.tima == 0 {
+		gb.overflow = true
+	}
+}
+
+func (gb *GameBoy) read(addr uint16) byte {
+	switch {
+	case addr < 0x100 && gb.bootEnabled:
+		return gb.bootROM[addr]
+	case addr < 0x8000:
+		return gb.readROM(addr)
+	case addr < 0xa000:
+		return gb.ppu.readVRAM(addr)
+	case addr < 0xc000:
+		return gb.readRAM(addr)
+	case addr < 0xfe00:
+		return gb.wram[addr&0x1fff]
+	case addr < 0xfea0:
+		return gb.ppu.readOAM(addr)
+	case addr < 0xff00:
+		return 0
+	case addr >= 0xff80 && addr < 0xffff:
+		return gb.hram[addr-0xff80]
+	case addr == 0xffff:
+		return gb.ie
+	}
+	return gb.readIO(addr)
+}
+
+func (gb *GameBoy) write(addr uint16, value byte) {
+	switch {
+	case addr < 0x8000:
+		gb.writeMBC(addr, value)
+	case addr < 0xa000:
+		gb.ppu.writeVRAM(addr, value)
+	case addr < 0xc000:
+		gb.writeRAM(addr, value)
+	case addr < 0xfe00:
+		gb.wram[addr&0x1fff] = value
+	case addr < 0xfea0:
+		gb.ppu.writeOAM(addr, value)
+	case addr < 0xff00:
+		// unusable
+	case addr >= 0xff80 && addr < 0xffff:
+		gb.hram[addr-0xff80] = value
+	case addr == 0xffff:
+		gb.ie = value
+	default:
+		gb.writeIO(addr, value)
+	}
+}
+
+func (gb *GameBoy) readIO(addr uint16) byte {
+	switch {
+	case addr == 0xff00:
+		return 0xc0 | gb.joyp | gb.icd2.joypadInput(gb.joyp)
+	case addr == 0xff01:
+		return gb.serialData
+	case addr == 0xff02:
+		return gb.serialControl | 0x7e
+	case addr == 0xff04:
+		return byte(gb.divider >> 8)
+	case addr == 0xff05:
+		return gb.tima
+	case addr == 0xff06:
+		return gb.tma
+	case addr == 0xff07:
+		return gb.tac | 0xf8
+	case addr == 0xff0f:
+		return gb.intFlags | 0xe0
+	case addr >= 0xff10 && addr < 0xff40:
+		return gb.apu.Read(addr)
+	case addr >= 0xff40 && addr < 0xff4c:
+		return gb.ppu.Read(addr)
+	}
+	return 0xff
+}
+
+func (gb *GameBoy) writeIO(addr uint16, value byte) {
+	switch {
+	case addr == 0xff00:
+		gb.joyp = value & 0x30
+		gb.icd2.joypWrite((value&0x10) > 0, (value&0x20) > 0)
+	case addr == 0xff01:
+		gb.serialData = value
+	case addr == 0xff02:
+		gb.serialControl = value & 0x81
+		if (value & 0x81) == 0x81 {
+			// 8 bits at 8192 Hz
+			gb.serialCycles = 8 * 512
+		}
+	case addr == 0xff04:
+		var bits [4]uint16 = [4]uint16{1 << 9, 1 << 3, 1 << 5, 1 << 7}
+		if (gb.tac&4) > 0 && (gb.divider&bits[gb.tac&3]) > 0 {
+			gb.incrementTIMA()
+		}
+		gb.divider = 0
+	case addr == 0xff05:
+		gb.tima = value
+		gb.overflow = false
+	case addr == 0xff06:
+		gb.tma = value
+	case addr == 0xff07:
+		gb.tac = value & 7
+	case addr == 0xff0f:
+		gb.intFlags = value & 0x1f
+	case addr >= 0xff10 && addr < 0xff40:
+		gb.apu.Write(addr, value)
+	case addr >= 0xff40 && addr < 0xff4c:
+		gb.ppu.Write(addr, value)
+	case addr == 0xff50:
+		if value > 0 {
+			gb.bootEnabled = false
+		}
+	}
+}
+
+func (gb *GameBoy) readROM(addr uint16) byte {
+	var bank uint32
+	if addr >= 0x4000 {
+		bank = uint32(gb.romBank)
+	} else if gb.mbc == 1 && gb.mbc1Mode == 1 {
+		// mode 1: the upper bits also switch bank 0
+		bank = uint32(gb.romBank) & 0x60
+	}
+	return gb.rom[(bank<<14|uint32(addr&0x3fff))&(gb.romSize-1)]
+}
+
+func (gb *GameBoy) writeMBC(addr uint16, value byte) {
+	switch gb.mbc {
+	case 1:
+		switch {
+		case addr < 0x2000:
+			gb.ramEnable = (value & 0xf) == 0xa
+		case addr < 0x4000:
+			value &= 0x1f
+			if value == 0 {
+				value = 1
+			}
+			gb.romBank = (gb.romBank & 0x60) | uint16(value)
+		case addr < 0x6000:
+			gb.romBank = (gb.romBank & 0x1f) | uint16(value&3)<<5
+			gb.ramBank = value & 3
+		default:
+			gb.mbc1Mode = value & 1
+		}
+	case 2:
+		if addr < 0x4000 {
+			if (addr & 0x100) == 0 {
+				gb.ramEnable = (value & 0xf) == 0xa
+			} else {
+				gb.romBank = uint16(value & 0xf)
+				if gb.romBank == 0 {
+					gb.romBank = 1
+				}
+			}
+		}
+	case 3:
+		switch {
+		case addr < 0x2000:
+			gb.ramEnable = (value & 0xf) == 0xa
+		case addr < 0x4000:
+			gb.romBank = uint16(value & 0x7f)
+			if gb.romBank == 0 {
+				gb.romBank = 1
+			}
+		case addr < 0x6000:
+			gb.ramBank = value
+		default:
+			if gb.rtcLatch == 0 && value == 1 {
+				gb.updateRTC()
+				gb.rtcLatched = gb.rtc
+			}
+			gb.rtcLatch = value
+		}
+	case 5:
+		switch {
+		case addr < 0x2000:
+			gb.ramEnable = (value & 0xf) == 0xa
+		case addr < 0x3000:
+			gb.romBank = (gb.romBank & 0x100) | uint16(value)
+		case addr < 0x4000:
+			gb.romBank = (gb.romBank & 0xff) | uint16(value&1)<<8
+		case addr < 0x6000:
+			gb.ramBank = value & 0xf
+		}
+	}
+}
+
+// ramOffset returns the offset in the cartridge ram for $a000-$bfff
+func (gb *GameBoy) ramOffset(addr uint16) (uint32, bool) {
+	if gb.ram == nil || (!gb.ramEnable && gb.mbc != 0) {
+		return 0, false
+	}
+	var bank uint32 = 0
+	switch gb.mbc {
+	case 1:
+		if gb.mbc1Mode == 1 {
+			bank = uint32(gb.ramBank)
+		}
+	case 2:
+		return uint32(addr) & 0x1ff, true
+	case 3:
+		if gb.ramBank > 3 {
+			return 0, false
+		}
+		bank = uint32(gb.ramBank)
+	case 5:
+		bank = uint32(gb.ramBank)
+	}
+	return (bank<<13 | uint32(addr&0x1fff)) % gb.ramSize, true
+}
+
+func (gb *GameBoy) readRAM(addr uint16) byte {
+	if gb.mbc == 3 && gb.ramEnable && gb.ramBank >= 0x08 && gb.ramBank <= 0x0c {
+		return gb.rtcLatched[gb.ramBank-0x08]
+	}
+	if offset, ok := gb.ramOffset(addr); ok {
+		if gb.mbc == 2 {
+			return gb.ram.Read(offset) | 0xf0
+		}
+		return gb.ram.Read(offset)
+	}
+	return 0xff
+}
+
+func (gb *GameBoy) writeRAM(addr uint16, value byte) {
+	if gb.mbc == 3 && gb.ramEnable && gb.ramBank >= 0x08 && gb.ramBank <= 0x0c {
+		gb.updateRTC()
+		gb.rtc[gb.ramBank-0x08] = value
+		gb.rtcTime = time.Now().Unix() - gb.rtcSeconds()
+		return
+	}
+	if offset, ok := gb.ramOffset(addr); ok {
+		if gb.mbc == 2 {
+			value &= 0x0f
+		}
+		gb.ram.Write(offset, value)
+	}
+}
+
+// rtcSeconds returns the MBC3 clock in seconds
+func (gb *GameBoy) rtcSeconds() int64 {
+	var days int64 = int64(gb.rtc[3]) | int64(gb.rtc[4]&1)<<8
+	return ((days*24+int64(gb.rtc[2]))*60+int64(gb.rtc[1]))*60 + int64(gb.rtc[0])
+}
+
+// updateRTC sets the MBC3 clock from the host time, unless it is halted
+func (gb *GameBoy) updateRTC() {
+	var now int64 = time.Now().Unix()
+	if (gb.rtc[4] & 0x40) > 0 {
+		gb.rtcTime = now - gb.rtcSeconds()
+		return
+	}
+	var seconds int64 = now - gb.rtcTime
+	var days int64 = seconds / 86400
+	gb.rtc[0] = byte(seconds % 60)
+	gb.rtc[1] = byte((seconds / 60) % 60)
+	gb.rtc[2] = byte((seconds / 3600) % 24)
+	gb.rtc[3] = byte(days)
+	gb.rtc[4] = (gb.rtc[4] & 0xc0) | byte((days>>8)&1)
+	if days > 511 {
+		gb.rtc[4] |= 0x80
+	}
+}
+
+func (gb *GameBoy) serialize(s *serializer) {
+	gb.cpu.serialize(s)
+	gb.ppu.serialize(s)
+	gb.apu.serialize(s)
+	s.bool(&gb.bootEnabled)
+	s.bytes(gb.wram[:])
+	s.bytes(gb.hram[:])
+	s.u8(&gb.ie)
+	s.u8(&gb.intFlags)
+	s.u16(&gb.divider)
+	s.u8(&gb.tima)
+	s.u8(&gb.tma)
+	s.u8(&gb.tac)
+	s.bool(&gb.overflow)
+	s.u8(&gb.serialData)
+	s.u8(&gb.serialControl)
+	s.i32(&gb.serialCycles)
+	s.u8(&gb.joyp)
+	if gb.ram != nil {
+		gb.ram.serialize(s)
+	}
+	s.u16(&gb.romBank)
+	s.u8(&gb.ramBank)
+	s.bool(&gb.ramEnable)
+	s.u8(&gb.mbc1Mode)
+	s.bytes(gb.rtc[:])
+	s.bytes(gb.rtcLatched[:])
+	s.u8(&gb.rtcLatch)
+	var rtcTime uint64 = uint64(gb.rtcTime)
+	s.u64(&rtcTime)
+	gb.rtcTime = int64(rtcTime)
+}
@@ -0,0 +1,432 @@
+package chibisnes
+
+// GBAPU is the DMG APU: 2 square channels (the first with a frequency
+// sweep), a wave channel and a noise channel. Samples are made at 44.1kHz
+// from the Game Boy clock and mixed to the SNES output, as the SGB does
+// through the cartridge audio input.
+type GBAPU struct {
+	gb *GameBoy
+
+	regs  [0x30]byte // $ff10-$ff3f as written, wave ram at $ff30
+	power bool
+	step  byte // frame sequencer step
+
+	channels [4]gbChannel
+
+	// channel 1 sweep
+	sweepEnabled bool
+	sweepShadow  uint16
+	sweepTimer   byte
+
+	lfsr uint16 // channel 4
+
+	sampleBuffer  [1024 * 2]int16
+	sampleOffset  uint16
+	sampleCounter uint32     // game boy clocks * 44100
+	capacitor     [2]float64 // high pass filter of the output
+}
+
+type gbChannel struct {
+	enabled      bool
+	dacEnabled   bool
+	length       uint16
+	lengthEnable bool
+	volume       byte
+	envTimer     byte
+	timer        int32 // clocks to the next step of the waveform
+	position     byte  // duty step or wave sample
+}
+
+const (
+	gbClock        = 4194304
+	gbAPUFrequency = 44100
+)
+
+var gbDutyTable [4]byte = [4]byte{0x01, 0x81, 0x87, 0x7e}
+
+var gbNoiseDivisors [8]int32 = [8]int32{8, 16, 32, 48, 64, 80, 96, 112}
+
+// bits always read as 1 in $ff10-$ff2f
+var gbAPUReadMask [0x20]byte = [0x20]byte{
+	0x80, 0x3f, 0x00, 0xff, 0xbf,
+	0xff, 0x3f, 0x00, 0xff, 0xbf,
+	0x7f, 0xff, 0x9f, 0xff, 0xbf,
+	0xff, 0xff, 0x00, 0x00, 0xbf,
+	0x00, 0x00, 0x70,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+}
+
+func NewGBAPU(gb *GameBoy) *GBAPU {
+	return &GBAPU{
+		gb: gb,
+	}
+}
+
+func (apu *GBAPU) Reset() {
+	for i := 0; i < len(apu.regs); i++ {
+		apu.regs[i] = 0
+	}
+	apu.power = false
+	apu.step = 0
+	for i := 0; i < len(apu.channels); i++ {
+		apu.channels[i] = gbChannel{}
+	}
+	apu.sweepEnabled = false
+	apu.sweepShadow = 0
+	apu.sweepTimer = 0
+	apu.lfsr = 0x7fff
+	apu.sampleOffset = 0
+	apu.sampleCounter = 0
+	apu.capacitor[0] = 0
+	apu.capacitor[1] = 0
+}
+
+// skipBoot sets the registers as the boot rom leaves them
+func (apu *GBAPU) skipBoot() {
+	apu.power = true
+	apu.regs[0x01] = 0x80
+	apu.regs[0x02] = 0xf3
+	apu.regs[0x14] = 0x77
+	apu.regs[0x15] = 0xf3
+	apu.channels[0].dacEnabled = true
+}
+
+func (apu *GBAPU) frequency(channel int) uint16 {
+	var base int = channel * 5
+	return uint16(apu.regs[base+3]) | uint16(apu.regs[base+4]&7)<<8
+}
+
+func (apu *GBAPU) period(channel int) int32 {
+	switch channel {
+	case 0, 1:
+		return (2048 - int32(apu.frequency(channel))) * 4
+	case 2:
+		return (2048 - int32(apu.frequency(channel))) * 2
+	}
+	var poly byte = apu.regs[0x12]
+	return gbNoiseDivisors[poly&7] << (poly >> 4)
+}
+
+func (apu *GBAPU) tick(cycles int) {
+	if apu.power {
+		for i := 0; i < len(apu.channels); i++ {
+			var channel *gbChannel = &apu.channels[i]
+			channel.timer -= int32(cycles)
+			for channel.timer <= 0 {
+				channel.timer += apu.period(i)
+				switch i {
+				case 0, 1:
+					channel.position = (channel.position + 1) & 7
+				case 2:
+					channel.position = (channel.position + 1) & 31
+				case 3:
+					var xor uint16 = (apu.lfsr & 1) ^ ((apu.lfsr >> 1) & 1)
+					apu.lfsr = (apu.lfsr >> 1) | xor<<14
+					if (apu.regs[0x12] & 0x08) > 0 {
+						apu.lfsr = (apu.lfsr &^ 0x40) | xor<<6
+					}
+				}
+			}
+		}
+	}
+
+	apu.sampleCounter += gbAPUFrequency * uint32(cycles)
+	for apu.sampleCounter >= gbClock {
+		apu.sampleCounter -= gbClock
+		apu.outputSample()
+	}
+}
+
+// channelOutput returns the output of the dac of a channel, -15 to 15
+func (apu *GBAPU) channelOutput(i int) int32 {
+	var channel *gbChannel = &apu.channels[i]
+	if !channel.dacEnabled {
+		return 0
+	}
+	var digital byte = 0
+	if channel.enabled {
+		switch i {
+		case 0, 1:
+			var duty byte = gbDutyTable[apu.regs[i*5+1]>>6]
+			if ((duty >> channel.position) & 1) > 0 {
+				digital = channel.volume
+			}
+		case 2:
+			var sample byte = apu.regs[0x20+channel.position/2]
+			if (channel.position & 1) == 0 {
+				sample >>= 4
+			}
+			sample &= 0xf
+			var volume byte = (apu.regs[0x0c] >> 5) & 3
+			if volume == 0 {
+				sample = 0
+			} else {
+				sample >>= volume - 1
+			}
+			digital = sample
+		case 3:
+			if (apu.lfsr & 1) == 0 {
+				digital = channel.volume
+			}
+		}
+	}
+	return int32(digital)*2 - 15
+}
+
+func (apu *GBAPU) outputSample() {
+	var left, right int32
+	if apu.power {
+		var panning byte = apu.regs[0x15]
+		for i := 0; i < 4; i++ {
+			var output int32 = apu.channelOutput(i)
+			if (panning & (0x10 << i)) > 0 {
+				left += output
+			}
+			if (panning & (1 << i)) > 0 {
+				right += output
+			}
+		}
+		left *= int32((apu.regs[0x14]>>4)&7) + 1
+		right *= int32(apu.regs[0x14]&7) + 1
+	}
+
+	var samples [2]int32 = [2]int32{left * 32, right * 32}
+	for j := 0; j < 2; j++ {
+		// remove the dc offset of the dacs
+		var in float64 = float64(samples[j])
+		var out float64 = in - apu.capacitor[j]
+		apu.capacitor[j] = in - out*0.996
+		apu.sampleBuffer[apu.sampleOffset*2+uint16(j)] = int16(out)
+	}
+	// prevent sampleOffset from going out of sampleBuffer bounds
+	if apu.sampleOffset < 1023 {
+		apu.sampleOffset++
+	}
+}
+
+// frameSequencer runs at 512Hz: length at 256Hz, sweep at 128Hz and
+// envelope at 64Hz
+func (apu *GBAPU) frameSequencer() {
+	if !apu.power {
+		return
+	}
+	if (apu.step & 1) == 0 {
+		for i := 0; i < len(apu.channels); i++ {
+			var channel *gbChannel = &apu.channels[i]
+			if channel.lengthEnable && channel.length > 0 {
+				channel.length--
+				if channel.length == 0 {
+					channel.enabled = false
+				}
+			}
+		}
+	}
+	if apu.step == 2 || apu.step == 6 {
+		apu.clockSweep()
+	}
+	if apu.step == 7 {
+		for _, i := range []int{0, 1, 3} {
+			var channel *gbChannel = &apu.channels[i]
+			var envelope byte = apu.regs[i*5+2]
+			if (envelope & 7) == 0 {
+				continue
+			}
+			channel.envTimer--
+			if channel.envTimer == 0 {
+				channel.envTimer = envelope & 7
+				if (envelope&0x08) > 0 && channel.volume < 15 {
+					channel.volume++
+				} else if (envelope&0x08) == 0 && channel.volume > 0 {
+					channel.volume--
+				}
+			}
+		}
+	}
+	apu.step = (apu.step + 1) & 7
+}
+
+func (apu *GBAPU) clockSweep() {
+	var sweep byte = apu.regs[0x00]
+	apu.sweepTimer--
+	if apu.sweepTimer > 0 {
+		return
+	}
+	apu.sweepTimer = (sweep >> 4) & 7
+	if apu.sweepTimer == 0 {
+		apu.sweepTimer = 8
+	}
+	if !apu.sweepEnabled || ((sweep>>4)&7) == 0 {
+		return
+	}
+	var frequency uint16 = apu.sweepFrequency()
+	if frequency <= 2047 && (sweep&7) > 0 {
+		apu.sweepShadow = frequency
+		apu.regs[0x03] = byte(frequency)
+		apu.regs[0x04] = (apu.regs[0x04] &^ 7) | byte(frequency>>8)
+		apu.sweepFrequency()
+	}
+}
+
+// sweepFrequency returns the next frequency of the sweep, the channel is
+// disabled on an overflow
+func (apu *GBAPU) sweepFrequency() uint16 {
+	var sweep byte = apu.regs[0x00]
+	var delta uint16 = apu.sweepShadow >> (sweep & 7)
+	var frequency uint16
+	if (sweep & 0x08) > 0 {
+		frequency = apu.sweepShadow - delta
+	} else {
+		frequency = apu.sweepShadow + delta
+	}
+	if frequency > 2047 {
+		apu.channels[0].enabled = false
+	}
+	return frequency
+}
+
+func (apu *GBAPU) trigger(i int) {
+	var channel *gbChannel = &apu.channels[i]
+	channel.enabled = channel.dacEnabled
+	if channel.length == 0 {
+		if i == 2 {
+			channel.length = 256
+		} else {
+			channel.length = 64
+		}
+	}
+	channel.timer = apu.period(i)
+	channel.position = 0
+	if i != 2 {
+		channel.volume = apu.regs[i*5+2] >> 4
+		channel.envTimer = apu.regs[i*5+2] & 7
+	}
+	switch i {
+	case 0:
+		var sweep byte = apu.regs[0x00]
+		apu.sweepShadow = apu.frequency(0)
+		apu.sweepTimer = (sweep >> 4) & 7
+		if apu.sweepTimer == 0 {
+			apu.sweepTimer = 8
+		}
+		apu.sweepEnabled = (sweep & 0x77) > 0
+		if (sweep & 7) > 0 {
+			apu.sweepFrequency()
+		}
+	case 3:
+		apu.lfsr = 0x7fff
+	}
+}
+
+func (apu *GBAPU) Read(addr uint16) byte {
+	var reg uint16 = addr - 0xff10
+	if reg >= 0x20 {
+		return apu.regs[reg]
+	}
+	if reg == 0x16 {
+		var value byte = 0x70
+		if apu.power {
+			value |= 0x80
+		}
+		for i := 0; i < 4; i++ {
+			if apu.channels[i].enabled {
+				value |= 1 << i
+			}
+		}
+		return value
+	}
+	return apu.regs[reg] | gbAPUReadMask[reg]
+}
+
+func (apu *GBAPU) Write(addr uint16, value byte) {
+	var reg uint16 = addr - 0xff10
+	if reg >= 0x20 {
+		apu.regs[reg] = value
+		return
+	}
+	if reg == 0x16 {
+		var power bool = (value & 0x80) > 0
+		if apu.power && !power {
+			for i := 0; i < 0x16; i++ {
+				apu.regs[i] = 0
+			}
+			for i := 0; i < len(apu.channels); i++ {
+				apu.channels[i] = gbChannel{}
+			}
+		} else if !apu.power && power {
+			apu.step = 0
+		}
+		apu.power = power
+		return
+	}
+	if !apu.power || reg >= 0x17 {
+		return
+	}
+	apu.regs[reg] = value
+
+	if reg >= 0x14 {
+		// volume and panning
+		return
+	}
+	var i int = int(reg / 5)
+	var channel *gbChannel = &apu.channels[i]
+	switch reg % 5 {
+	case 0:
+		if i == 2 {
+			channel.dacEnabled = (value & 0x80) > 0
+			if !channel.dacEnabled {
+				channel.enabled = false
+			}
+		}
+	case 1:
+		if i == 2 {
+			channel.length = 256 - uint16(value)
+		} else {
+			channel.length = 64 - uint16(value&0x3f)
+		}
+	case 2:
+		if i != 2 {
+			channel.dacEnabled = (value & 0xf8) > 0
+			if !channel.dacEnabled {
+				channel.enabled = false
+			}
+		}
+	case 4:
+		channel.lengthEnable = (value & 0x40) > 0
+		if (value & 0x80) > 0 {
+			apu.trigger(i)
+		}
+	}
+}
+
+// mixSamples adds the samples of this frame to sampleData, resampled to
+// samplesPerFrame
+func (apu *GBAPU) mixSamples(sampleData []int16, samplesPerFrame int) {
+	mixSampleBuffer(sampleData, samplesPerFrame, apu.sampleBuffer[:apu.sampleOffset*2])
+	apu.sampleOffset = 0
+}
+
+func (apu *GBAPU) serialize(s *serializer) {
+	s.bytes(apu.regs[:])
+	s.bool(&apu.power)
+	s.u8(&apu.step)
+	for i := 0; i < len(apu.channels); i++ {
+		var channel *gbChannel = &apu.channels[i]
+		s.bool(&channel.enabled)
+		s.bool(&channel.dacEnabled)
+		s.u16(&channel.length)
+		s.bool(&channel.lengthEnable)
+		s.u8(&channel.volume)
+		s.u8(&channel.envTimer)
+		s.i32(&channel.timer)
+		s.u8(&channel.position)
+	}
+	s.bool(&apu.sweepEnabled)
+	s.u16(&apu.sweepShadow)
+	s.u8(&apu.sweepTimer)
+	s.u16(&apu.lfsr)
+	s.i16s(apu.sampleBuffer[:])
+	s.u16(&apu.sampleOffset)
+	s.u32(&apu.sampleCounter)
+	s.f64(&apu.capacitor[0])
+	s.f64(&apu.capacitor[1])
+}
@@ -0,0 +1,628 @@
+package chibisnes
+
+// GBCPU is the Sharp LR35902 of the Super Game Boy. Every memory access
+// takes 4 clocks and runs the rest of the Game Boy for that time.
+type GBCPU struct {
+	gb *GameBoy
+
+	a, f     byte
+	b, c     byte
+	d, e     byte
+	h, l     byte
+	sp       uint16
+	pc       uint16
+	ime      bool
+	imeDelay bool // ei takes effect after the next instruction
+	halted   bool
+	stopped  bool
+	cycles   int // clocks taken by the current step
+}
+
+const (
+	gbFlagZ byte = 0x80
+	gbFlagN byte = 0x40
+	gbFlagH byte = 0x20
+	gbFlagC byte = 0x10
+)
+
+func NewGBCPU(gb *GameBoy) *GBCPU {
+	return &GBCPU{
+		gb: gb,
+	}
+}
+
+func (cpu *GBCPU) Reset() {
+	cpu.a, cpu.f = 0, 0
+	cpu.b, cpu.c = 0, 0
+	cpu.d, cpu.e = 0, 0
+	cpu.h, cpu.l = 0, 0
+	cpu.sp = 0
+	cpu.pc = 0
+	cpu.ime = false
+	cpu.imeDelay = false
+	cpu.halted = false
+	cpu.stopped = false
+}
+
+// skipBoot sets the registers the Super Game Boy boot rom leaves behind
+func (cpu *GBCPU) skipBoot() {
+	cpu.a, cpu.f = 0x01, 0x00
+	cpu.b, cpu.c = 0x00, 0x14
+	cpu.d, cpu.e = 0x00, 0x00
+	cpu.h, cpu.l = 0xc0, 0x60
+	cpu.sp = 0xfffe
+	cpu.pc = 0x0100
+}
+
+func (cpu *GBCPU) idle() {
+	cpu.cycles += 4
+	cpu.gb.tick(4)
+}
+
+func (cpu *GBCPU) read(addr uint16) byte {
+	cpu.idle()
+	return cpu.gb.read(addr)
+}
+
+func (cpu *GBCPU) write(addr uint16, value byte) {
+	cpu.idle()
+	cpu.gb.write(addr, value)
+}
+
+func (cpu *GBCPU) fetch() byte {
+	var value byte = cpu.read(cpu.pc)
+	cpu.pc++
+	return value
+}
+
+func (cpu *GBCPU) fetch16() uint16 {
+	var low byte = cpu.fetch()
+	return uint16(low) | uint16(cpu.fetch())<<8
+}
+
+func (cpu *GBCPU) push(value uint16) {
+	cpu.sp--
+	cpu.write(cpu.sp, byte(value>>8))
+	cpu.sp--
+	cpu.write(cpu.sp, byte(value))
+}
+
+func (cpu *GBCPU) pop() uint16 {
+	var low byte = cpu.read(cpu.sp)
+	cpu.sp++
+	var high byte = cpu.read(cpu.sp)
+	cpu.sp++
+	return uint16(low) | uint16(high)<<8
+}
+
+func (cpu *GBCPU) hl() uint16 {
+	return uint16(cpu.h)<<8 | uint16(cpu.l)
+}
+
+func (cpu *GBCPU) setHL(value uint16) {
+	cpu.h, cpu.l = byte(value>>8), byte(value)
+}
+
+// getRP returns register pair p: bc, de, hl, sp (af instead of sp if af)
+func (cpu *GBCPU) getRP(p byte, af bool) uint16 {
+	switch p {
+	case 0:
+		return uint16(cpu.b)<<8 | uint16(cpu.c)
+	case 1:
+		return uint16(cpu.d)<<8 | uint16(cpu.e)
+	case 2:
+		return cpu.hl()
+	}
+	if af {
+		return uint16(cpu.a)<<8 | uint16(cpu.f)
+	}
+	return cpu.sp
+}
+
+func (cpu *GBCPU) setRP(p byte, value uint16, af bool) {
+	switch p {
+	case 0:
+		cpu.b, cpu.c = byte(value>>8), byte(value)
+	case 1:
+		cpu.d, cpu.e = byte(value>>8), byte(value)
+	case 2:
+		cpu.setHL(value)
+	default:
+		if af {
+			cpu.a, cpu.f = byte(value>>8), byte(value)&0xf0
+		} else {
+			cpu.sp = value
+		}
+	}
+}
+
+// getR returns register r: b, c, d, e, h, l, (hl), a
+func (cpu *GBCPU) getR(r byte) byte {
+	switch r {
+	case 0:
+		return cpu.b
+	case 1:
+		return cpu.c
+	case 2:
+		return cpu.d
+	case 3:
+		return cpu.e
+	case 4:
+		return cpu.h
+	case 5:
+		return cpu.l
+	case 6:
+		return cpu.read(cpu.hl())
+	}
+	return cpu.a
+}
+
+func (cpu *GBCPU) setR(r byte, value byte) {
+	switch r {
+	case 0:
+		cpu.b = value
+	case 1:
+		cpu.c = value
+	case 2:
+		cpu.d = value
+	case 3:
+		cpu.e = value
+	case 4:
+		cpu.h = value
+	case 5:
+		cpu.l = value
+	case 6:
+		cpu.write(cpu.hl(), value)
+	default:
+		cpu.a = value
+	}
+}
+
+// condition returns condition cc: nz, z, nc, c
+func (cpu *GBCPU) condition(cc byte) bool {
+	switch cc {
+	case 0:
+		return (cpu.f & gbFlagZ) == 0
+	case 1:
+		return (cpu.f & gbFlagZ) > 0
+	case 2:
+		return (cpu.f & gbFlagC) == 0
+	}
+	return (cpu.f & gbFlagC) > 0
+}
+
+func (cpu *GBCPU) setFlags(z, n, h, c bool) {
+	cpu.f = 0
+	if z {
+		cpu.f |= gbFlagZ
+	}
+	if n {
+		cpu.f |= gbFlagN
+	}
+	if h {
+		cpu.f |= gbFlagH
+	}
+	if c {
+		cpu.f |= gbFlagC
+	}
+}
+
+// Step runs an instruction or an interrupt and returns the clocks taken
+func (cpu *GBCPU) Step() int {
+	cpu.cycles = 0
+	var gb *GameBoy = cpu.gb
+
+	var pending byte = gb.ie & gb.intFlags & 0x1f
+	if pending > 0 {
+		cpu.halted = false
+		cpu.stopped = false
+		if cpu.ime {
+			cpu.ime = false
+			cpu.idle()
+			cpu.idle()
+			cpu.push(cpu.pc)
+			// the push can change ie
+			pending = gb.ie & gb.intFlags & 0x1f
+			cpu.pc = 0
+			for i := uint(0); i < 5; i++ {
+				if (pending & (1 << i)) > 0 {
+					gb.intFlags &= ^(1 << i)
+					cpu.pc = 0x40 + uint16(i)*8
+					break
+				}
+			}
+			cpu.idle()
+			return cpu.cycles
+		}
+	}
+	if cpu.halted || cpu.stopped {
+		cpu.idle()
+		return cpu.cycles
+	}
+
+	var enableIME bool = cpu.imeDelay
+	cpu.imeDelay = false
+	cpu.execute(cpu.fetch())
+	if enableIME {
+		cpu.ime = true
+	}
+	return cpu.cycles
+}
+
+func (cpu *GBCPU) execute(opcode byte) {
+	var x byte = opcode >> 6
+	var y byte = (opcode >> 3) & 7
+	var z byte = opcode & 7
+	var p byte = y >> 1
+	var q byte = y & 1
+
+	switch x {
+	case 0:
+		switch z {
+		case 0:
+			switch {
+			case y == 0:
+				// nop
+			case y == 1:
+				var addr uint16 = cpu.fetch16()
+				cpu.write(addr, byte(cpu.sp))
+				cpu.write(addr+1, byte(cpu.sp>>8))
+			case y == 2:
+				cpu.fetch()
+				cpu.stopped = true
+			case y == 3:
+				cpu.jr(true)
+			default:
+				cpu.jr(cpu.condition(y - 4))
+			}
+		case 1:
+			if q == 0 {
+				cpu.setRP(p, cpu.fetch16(), false)
+			} else {
+				var hl uint16 = cpu.hl()
+				var value uint16 = cpu.getRP(p, false)
+				var result uint32 = uint32(hl) + uint32(value)
+				cpu.f = (cpu.f & gbFlagZ)
+				if ((hl & 0xfff) + (value & 0xfff)) > 0xfff {
+					cpu.f |= gbFlagH
+				}
+				if result > 0xffff {
+					cpu.f |= gbFlagC
+				}
+				cpu.setHL(uint16(result))
+				cpu.idle()
+			}
+		case 2:
+			var addr uint16
+			switch p {
+			case 0, 1:
+				addr = cpu.getRP(p, false)
+			case 2:
+				addr = cpu.hl()
+				cpu.setHL(addr + 1)
+			case 3:
+				addr = cpu.hl()
+				cpu.setHL(addr - 1)
+			}
+			if q == 0 {
+				cpu.write(addr, cpu.a)
+			} else {
+				cpu.a = cpu.read(addr)
+			}
+		case 3:
+			if q == 0 {
+				cpu.setRP(p, cpu.getRP(p, false)+1, false)
+			} else {
+				cpu.setRP(p, cpu.getRP(p, false)-1, false)
+			}
+			cpu.idle()
+		case 4:
+			var value byte = cpu.getR(y) + 1
+			cpu.setR(y, value)
+			cpu.f = (cpu.f & gbFlagC)
+			if value == 0 {
+				cpu.f |= gbFlagZ
+			}
+			if (value & 0xf) == 0 {
+				cpu.f |= gbFlagH
+			}
+		case 5:
+			var value byte = cpu.getR(y) - 1
+			cpu.setR(y, value)
+			cpu.f = (cpu.f & gbFlagC) | gbFlagN
+			if value == 0 {
+				cpu.f |= gbFlagZ
+			}
+			if (value & 0xf) == 0xf {
+				cpu.f |= gbFlagH
+			}
+		case 6:
+			cpu.setR(y, cpu.fetch())
+		case 7:
+			cpu.accumulatorOp(y)
+		}
+	case 1:
+		if z == 6 && y == 6 {
+			cpu.halted = true
+		} else {
+			cpu.setR(y, cpu.getR(z))
+		}
+	case 2:
+		cpu.alu(y, cpu.getR(z))
+	case 3:
+		cpu.executeX3(y, z, p, q)
+	}
+}
+
+func (cpu *GBCPU) executeX3(y, z, p, q byte) {
+	switch z {
+	case 0:
+		switch {
+		case y < 4:
+			cpu.idle()
+			if cpu.condition(y) {
+				cpu.pc = cpu.pop()
+				cpu.idle()
+			}
+		case y == 4:
+			cpu.write(0xff00|uint16(cpu.fetch()), cpu.a)
+		case y == 5:
+			cpu.sp = cpu.addSP(cpu.fetch())
+			cpu.idle()
+			cpu.idle()
+		case y == 6:
+			cpu.a = cpu.read(0xff00 | uint16(cpu.fetch()))
+		case y == 7:
+			cpu.setHL(cpu.addSP(cpu.fetch()))
+			cpu.idle()
+		}
+	case 1:
+		if q == 0 {
+			cpu.setRP(p, cpu.pop(), true)
+			return
+		}
+		switch p {
+		case 0:
+			cpu.pc = cpu.pop()
+			cpu.idle()
+		case 1:
+			cpu.pc = cpu.pop()
+			cpu.idle()
+			cpu.ime = true
+		case 2:
+			cpu.pc = cpu.hl()
+		case 3:
+			cpu.sp = cpu.hl()
+			cpu.idle()
+		}
+	case 2:
+		switch {
+		case y < 4:
+			var addr uint16 = cpu.fetch16()
+			if cpu.condition(y) {
+				cpu.pc = addr
+				cpu.idle()
+			}
+		case y == 4:
+			cpu.write(0xff00|uint16(cpu.c), cpu.a)
+		case y == 5:
+			cpu.write(cpu.fetch16(), cpu.a)
+		case y == 6:
+			cpu.a = cpu.read(0xff00 | uint16(cpu.c))
+		case y == 7:
+			cpu.a = cpu.read(cpu.fetch16())
+		}
+	case 3:
+		switch y {
+		case 0:
+			cpu.pc = cpu.fetch16()
+			cpu.idle()
+		case 1:
+			cpu.executeCB(cpu.fetch())
+		case 6:
+			cpu.ime = false
+			cpu.imeDelay = false
+		case 7:
+			cpu.imeDelay = true
+		default:
+			// illegal opcode, locks up the cpu
+			cpu.pc--
+		}
+	case 4:
+		if y < 4 {
+			var addr uint16 = cpu.fetch16()
+			if cpu.condition(y) {
+				cpu.idle()
+				cpu.push(cpu.pc)
+				cpu.pc = addr
+			}
+		} else {
+			cpu.pc--
+		}
+	case 5:
+		if q == 0 {
+			cpu.idle()
+			cpu.push(cpu.getRP(p, true))
+		} else if p == 0 {
+			var addr uint16 = cpu.fetch16()
+			cpu.idle()
+			cpu.push(cpu.pc)
+			cpu.pc = addr
+		} else {
+			cpu.pc--
+		}
+	case 6:
+		cpu.alu(y, cpu.fetch())
+	case 7:
+		cpu.idle()
+		cpu.push(cpu.pc)
+		cpu.pc = uint16(y) * 8
+	}
+}
+
+func (cpu *GBCPU) jr(taken bool) {
+	var offset int8 = int8(cpu.fetch())
+	if taken {
+		cpu.pc = uint16(int32(cpu.pc) + int32(offset))
+		cpu.idle()
+	}
+}
+
+// addSP returns sp plus a signed offset, setting the flags
+func (cpu *GBCPU) addSP(value byte) uint16 {
+	var offset uint16 = uint16(int16(int8(value)))
+	cpu.setFlags(false, false, ((cpu.sp&0xf)+(uint16(value)&0xf)) > 0xf, ((cpu.sp&0xff)+uint16(value)) > 0xff)
+	return cpu.sp + offset
+}
+
+func (cpu *GBCPU) alu(op byte, value byte) {
+	var a byte = cpu.a
+	switch op {
+	case 0, 1:
+		// add, adc
+		var carry byte = 0
+		if op == 1 && (cpu.f&gbFlagC) > 0 {
+			carry = 1
+		}
+		var result uint16 = uint16(a) + uint16(value) + uint16(carry)
+		cpu.a = byte(result)
+		cpu.setFlags(cpu.a == 0, false, (a&0xf)+(value&0xf)+carry > 0xf, result > 0xff)
+	case 2, 3, 7:
+		// sub, sbc, cp
+		var carry byte = 0
+		if op == 3 && (cpu.f&gbFlagC) > 0 {
+			carry = 1
+		}
+		var result int16 = int16(a) - int16(value) - int16(carry)
+		cpu.setFlags(byte(result) == 0, true, int16(a&0xf)-int16(value&0xf)-int16(carry) < 0, result < 0)
+		if op != 7 {
+			cpu.a = byte(result)
+		}
+	case 4:
+		cpu.a &= value
+		cpu.setFlags(cpu.a == 0, false, true, false)
+	case 5:
+		cpu.a ^= value
+		cpu.setFlags(cpu.a == 0, false, false, false)
+	case 6:
+		cpu.a |= value
+		cpu.setFlags(cpu.a == 0, false, false, false)
+	}
+}
+
+// accumulatorOp runs rlca, rrca, rla, rra, daa, cpl, scf or ccf
+func (cpu *GBCPU) accumulatorOp(op byte) {
+	var a byte = cpu.a
+	switch op {
+	case 0:
+		cpu.a = a<<1 | a>>7
+		cpu.setFlags(false, false, false, (a&0x80) > 0)
+	case 1:
+		cpu.a = a>>1 | a<<7
+		cpu.setFlags(false, false, false, (a&1) > 0)
+	case 2:
+		cpu.a = a << 1
+		if (cpu.f & gbFlagC) > 0 {
+			cpu.a |= 1
+		}
+		cpu.setFlags(false, false, false, (a&0x80) > 0)
+	case 3:
+		cpu.a = a >> 1
+		if (cpu.f & gbFlagC) > 0 {
+			cpu.a |= 0x80
+		}
+		cpu.setFlags(false, false, false, (a&1) > 0)
+	case 4:
+		var carry bool = (cpu.f & gbFlagC) > 0
+		if (cpu.f & gbFlagN) == 0 {
+			if carry || a > 0x99 {
+				a += 0x60
+				carry = true
+			}
+			if (cpu.f&gbFlagH) > 0 || (a&0xf) > 9 {
+				a += 0x06
+			}
+		} else {
+			if carry {
+				a -= 0x60
+			}
+			if (cpu.f & gbFlagH) > 0 {
+				a -= 0x06
+			}
+		}
+		cpu.a = a
+		cpu.setFlags(a == 0, (cpu.f&gbFlagN) > 0, false, carry)
+	case 5:
+		cpu.a = ^a
+		cpu.f |= gbFlagN | gbFlagH
+	case 6:
+		cpu.f = (cpu.f & gbFlagZ) | gbFlagC
+	case 7:
+		cpu.f = (cpu.f & (gbFlagZ | gbFlagC)) ^ gbFlagC
+	}
+}
+
+func (cpu *GBCPU) executeCB(opcode byte) {
+	var x byte = opcode >> 6
+	var y byte = (opcode >> 3) & 7
+	var z byte = opcode & 7
+	var value byte = cpu.getR(z)
+
+	switch x {
+	case 0:
+		var result byte
+		var carry bool
+		switch y {
+		case 0:
+			result, carry = value<<1|value>>7, (value&0x80) > 0
+		case 1:
+			result, carry = value>>1|value<<7, (value&1) > 0
+		case 2:
+			result, carry = value<<1, (value&0x80) > 0
+			if (cpu.f & gbFlagC) > 0 {
+				result |= 1
+			}
+		case 3:
+			result, carry = value>>1, (value&1) > 0
+			if (cpu.f & gbFlagC) > 0 {
+				result |= 0x80
+			}
+		case 4:
+			result, carry = value<<1, (value&0x80) > 0
+		case 5:
+			result, carry = value>>1|(value&0x80), (value&1) > 0
+		case 6:
+			result, carry = value<<4|value>>4, false
+		case 7:
+			result, carry = value>>1, (value&1) > 0
+		}
+		cpu.setFlags(result == 0, false, false, carry)
+		cpu.setR(z, result)
+	case 1:
+		cpu.f = (cpu.f & gbFlagC) | gbFlagH
+		if (value & (1 << y)) == 0 {
+			cpu.f |= gbFlagZ
+		}
+	case 2:
+		cpu.setR(z, value & ^(1<<y))
+	case 3:
+		cpu.setR(z, value|(1<<y))
+	}
+}
+
+func (cpu *GBCPU) serialize(s *serializer) {
+	s.u8(&cpu.a)
+	s.u8(&cpu.f)
+	s.u8(&cpu.b)
+	s.u8(&cpu.c)
+	s.u8(&cpu.d)
+	s.u8(&cpu.e)
+	s.u8(&cpu.h)
+	s.u8(&cpu.l)
+	s.u16(&cpu.sp)
+	s.u16(&cpu.pc)
+	s.bool(&cpu.ime)
+	s.bool(&cpu.imeDelay)
+	s.bool(&cpu.halted)
+	s.bool(&cpu.stopped)
+}
@@ -0,0 +1,380 @@
+package chibisnes
+
+// GBPPU is the DMG PPU. Lines are drawn at once when mode 3 ends, each of
+// the 160 pixels (a shade from 0 to 3) is sent to the ICD2.
+type GBPPU struct {
+	gb *GameBoy
+
+	vram [0x2000]byte
+	oam  [0xa0]byte
+
+	lcdc byte
+	stat byte // interrupt enables, bits 3-6
+	scy  byte
+	scx  byte
+	ly   byte
+	lyc  byte
+	bgp  byte
+	obp  [2]byte
+	wy   byte
+	wx   byte
+
+	dot        uint16 // position in the line, 0-455
+	mode       byte
+	statLine   bool // or of the stat interrupt sources, the interrupt fires on a rising edge
+	windowLine byte // line of the window to draw next
+	dmaSource  byte
+}
+
+const (
+	gbDotsPerLine   = 456
+	gbLinesPerFrame = 154
+)
+
+func NewGBPPU(gb *GameBoy) *GBPPU {
+	return &GBPPU{
+		gb: gb,
+	}
+}
+
+func (ppu *GBPPU) Reset() {
+	for i := 0; i < len(ppu.vram); i++ {
+		ppu.vram[i] = 0
+	}
+	for i := 0; i < len(ppu.oam); i++ {
+		ppu.oam[i] = 0
+	}
+	ppu.lcdc = 0
+	ppu.stat = 0
+	ppu.scy = 0
+	ppu.scx = 0
+	ppu.ly = 0
+	ppu.lyc = 0
+	ppu.bgp = 0
+	ppu.obp[0] = 0
+	ppu.obp[1] = 0
+	ppu.wy = 0
+	ppu.wx = 0
+	ppu.dot = 0
+	ppu.mode = 0
+	ppu.statLine = false
+	ppu.windowLine = 0
+	ppu.dmaSource = 0
+}
+
+// skipBoot sets the registers as the boot rom leaves them
+func (ppu *GBPPU) skipBoot() {
+	ppu.lcdc = 0x91
+	ppu.bgp = 0xfc
+	ppu.obp[0] = 0xff
+	ppu.obp[1] = 0xff
+}
+
+func (ppu *GBPPU) enabled() bool {
+	return (ppu.lcdc & 0x80) > 0
+}
+
+func (ppu *GBPPU) tick(cycles int) {
+	if !ppu.enabled() {
+		return
+	}
+	for i := 0; i < cycles; i++ {
+		ppu.dot++
+		if ppu.ly < 144 {
+			switch ppu.dot {
+			case 80:
+				ppu.mode = 3
+			case 252:
+				ppu.renderLine()
+				ppu.mode = 0
+			}
+		}
+		if ppu.dot == gbDotsPerLine {
+			ppu.dot = 0
+			ppu.nextLine()
+		}
+		ppu.updateStat()
+	}
+}
+
+func (ppu *GBPPU) nextLine() {
+	ppu.ly++
+	if ppu.ly == gbLinesPerFrame {
+		ppu.ly = 0
+		ppu.windowLine = 0
+		ppu.gb.icd2.ppuVreset()
+	} else {
+		ppu.gb.icd2.ppuHreset()
+	}
+	switch {
+	case ppu.ly < 144:
+		ppu.mode = 2
+	case ppu.ly == 144:
+		ppu.mode = 1
+		ppu.gb.requestInterrupt(gbIntVBlank)
+	}
+}
+
+func (ppu *GBPPU) updateStat() {
+	var line bool = (ppu.ly == ppu.lyc && (ppu.stat&0x40) > 0) ||
+		(ppu.mode == 0 && (ppu.stat&0x08) > 0) ||
+		(ppu.mode == 1 && (ppu.stat&0x10) > 0) ||
+		(ppu.mode == 2 && (ppu.stat&0x20) > 0)
+	if line && !ppu.statLine {
+		ppu.gb.requestInterrupt(gbIntSTAT)
+	}
+	ppu.statLine = line
+}
+
+// tileRow returns the 2 bitplanes of a row of a tile
+func (ppu *GBPPU) tileRow(tile byte, row byte, signed bool) (byte, byte) {
+	var addr uint16
+	if signed {
+		addr = uint16(0x1000 + int(int8(tile))*16)
+	} else {
+		addr = uint16(tile) * 16
+	}
+	addr += uint16(row) * 2
+	return ppu.vram[addr], ppu.vram[addr+1]
+}
+
+func (ppu *GBPPU) renderLine() {
+	var colors [160]byte // color before the palette, for the sprite priority
+	var line [160]byte
+	var signed bool = (ppu.lcdc & 0x10) == 0
+
+	if (ppu.lcdc & 0x01) > 0 {
+		var mapBase uint16 = 0x1800
+		if (ppu.lcdc & 0x08) > 0 {
+			mapBase = 0x1c00
+		}
+		var y byte = ppu.ly + ppu.scy
+		for x := 0; x < 160; x++ {
+			var bx byte = byte(x) + ppu.scx
+			var tile byte = ppu.vram[mapBase+uint16(y>>3)*32+uint16(bx>>3)]
+			low, high := ppu.tileRow(tile, y&7, signed)
+			var bit byte = 7 - (bx & 7)
+			colors[x] = ((low >> bit) & 1) | ((high>>bit)&1)<<1
+		}
+
+		var windowX int = int(ppu.wx) - 7
+		if (ppu.lcdc&0x20) > 0 && ppu.ly >= ppu.wy && windowX < 160 {
+			mapBase = 0x1800
+			if (ppu.lcdc & 0x40) > 0 {
+				mapBase = 0x1c00
+			}
+			var wy byte = ppu.windowLine
+			for x := windowX; x < 160; x++ {
+				if x < 0 {
+					continue
+				}
+				var wx byte = byte(x - windowX)
+				var tile byte = ppu.vram[mapBase+uint16(wy>>3)*32+uint16(wx>>3)]
+				low, high := ppu.tileRow(tile, wy&7, signed)
+				var bit byte = 7 - (wx & 7)
+				colors[x] = ((low >> bit) & 1) | ((high>>bit)&1)<<1
+			}
+			ppu.windowLine++
+		}
+	}
+	for x := 0; x < 160; x++ {
+		line[x] = (ppu.bgp >> (colors[x] * 2)) & 3
+	}
+
+	if (ppu.lcdc & 0x02) > 0 {
+		ppu.renderSprites(&colors, &line)
+	}
+
+	for x := 0; x < 160; x++ {
+		ppu.gb.icd2.ppuWrite(line[x])
+	}
+}
+
+func (ppu *GBPPU) renderSprites(colors *[160]byte, line *[160]byte) {
+	var height int = 8
+	if (ppu.lcdc & 0x04) > 0 {
+		height = 16
+	}
+
+	// the first 10 sprites on the line, lower x wins, then lower index
+	var sprites [10]int
+	var count int = 0
+	for i := 0; i < 40 && count < 10; i++ {
+		var y int = int(ppu.oam[i*4]) - 16
+		if int(ppu.ly) >= y && int(ppu.ly) < y+height {
+			sprites[count] = i
+			count++
+		}
+	}
+	var drawn [160]bool
+	for n := 0; n < count; n++ {
+		// pick the sprite with the lowest x left
+		var best int = -1
+		for j := 0; j < count; j++ {
+			if sprites[j] < 0 {
+				continue
+			}
+			if best < 0 || ppu.oam[sprites[j]*4+1] < ppu.oam[sprites[best]*4+1] {
+				best = j
+			}
+		}
+		var i int = sprites[best]
+		sprites[best] = -1
+
+		var y int = int(ppu.oam[i*4]) - 16
+		var x int = int(ppu.oam[i*4+1]) - 8
+		var tile byte = ppu.oam[i*4+2]
+		var attr byte = ppu.oam[i*4+3]
+		var row int = int(ppu.ly) - y
+		if (attr & 0x40) > 0 {
+			row = height - 1 - row
+		}
+		if height == 16 {
+			tile &= 0xfe
+		}
+		var addr uint16 = uint16(tile)*16 + uint16(row)*2
+		var low, high byte = ppu.vram[addr], ppu.vram[addr+1]
+		var palette byte = ppu.obp[(attr>>4)&1]
+		for px := 0; px < 8; px++ {
+			var sx int = x + px
+			if sx < 0 || sx >= 160 || drawn[sx] {
+				continue
+			}
+			var bit int = 7 - px
+			if (attr & 0x20) > 0 {
+				bit = px
+			}
+			var color byte = ((low >> bit) & 1) | ((high>>bit)&1)<<1
+			if color == 0 {
+				continue
+			}
+			drawn[sx] = true
+			if (attr&0x80) > 0 && colors[sx] != 0 {
+				continue
+			}
+			line[sx] = (palette >> (color * 2)) & 3
+		}
+	}
+}
+
+func (ppu *GBPPU) readVRAM(addr uint16) byte {
+	if ppu.enabled() && ppu.mode == 3 {
+		return 0xff
+	}
+	return ppu.vram[addr&0x1fff]
+}
+
+func (ppu *GBPPU) writeVRAM(addr uint16, value byte) {
+	if ppu.enabled() && ppu.mode == 3 {
+		return
+	}
+	ppu.vram[addr&0x1fff] = value
+}
+
+func (ppu *GBPPU) readOAM(addr uint16) byte {
+	if ppu.enabled() && (ppu.mode == 2 || ppu.mode == 3) {
+		return 0xff
+	}
+	return ppu.oam[addr-0xfe00]
+}
+
+func (ppu *GBPPU) writeOAM(addr uint16, value byte) {
+	if ppu.enabled() && (ppu.mode == 2 || ppu.mode == 3) {
+		return
+	}
+	ppu.oam[addr-0xfe00] = value
+}
+
+func (ppu *GBPPU) Read(addr uint16) byte {
+	switch addr {
+	case 0xff40:
+		return ppu.lcdc
+	case 0xff41:
+		var value byte = 0x80 | ppu.stat | ppu.mode
+		if ppu.ly == ppu.lyc {
+			value |= 0x04
+		}
+		return value
+	case 0xff42:
+		return ppu.scy
+	case 0xff43:
+		return ppu.scx
+	case 0xff44:
+		return ppu.ly
+	case 0xff45:
+		return ppu.lyc
+	case 0xff46:
+		return ppu.dmaSource
+	case 0xff47:
+		return ppu.bgp
+	case 0xff48, 0xff49:
+		return ppu.obp[addr-0xff48]
+	case 0xff4a:
+		return ppu.wy
+	case 0xff4b:
+		return ppu.wx
+	}
+	return 0xff
+}
+
+func (ppu *GBPPU) Write(addr uint16, value byte) {
+	switch addr {
+	case 0xff40:
+		var wasEnabled bool = ppu.enabled()
+		ppu.lcdc = value
+		if wasEnabled && !ppu.enabled() {
+			ppu.ly = 0
+			ppu.dot = 0
+			ppu.mode = 0
+			ppu.windowLine = 0
+		} else if !wasEnabled && ppu.enabled() {
+			ppu.mode = 2
+			ppu.gb.icd2.ppuVreset()
+		}
+	case 0xff41:
+		ppu.stat = value & 0x78
+	case 0xff42:
+		ppu.scy = value
+	case 0xff43:
+		ppu.scx = value
+	case 0xff45:
+		ppu.lyc = value
+	case 0xff46:
+		// the copy is done at once
+		ppu.dmaSource = value
+		for i := uint16(0); i < 0xa0; i++ {
+			ppu.oam[i] = ppu.gb.read(uint16(value)<<8 | i)
+		}
+	case 0xff47:
+		ppu.bgp = value
+	case 0xff48, 0xff49:
+		ppu.obp[addr-0xff48] = value
+	case 0xff4a:
+		ppu.wy = value
+	case 0xff4b:
+		ppu.wx = value
+	}
+	if ppu.enabled() {
+		ppu.updateStat()
+	}
+}
+
+func (ppu *GBPPU) serialize(s *serializer) {
+	s.bytes(ppu.vram[:])
+	s.bytes(ppu.oam[:])
+	s.u8(&ppu.lcdc)
+	s.u8(&ppu.stat)
+	s.u8(&ppu.scy)
+	s.u8(&ppu.scx)
+	s.u8(&ppu.ly)
+	s.u8(&ppu.lyc)
+	s.u8(&ppu.bgp)
+	s.bytes(ppu.obp[:])
+	s.u8(&ppu.wy)
+	s.u8(&ppu.wx)
+	s.u16(&ppu.dot)
+	s.u8(&ppu.mode)
+	s.bool(&ppu.statLine)
+	s.u8(&ppu.windowLine)
+	s.u8(&ppu.dmaSource)
+}
@@ -0,0 +1,1272 @@
+package chibisnes
+
+import "log"
+
+// GSU is the SuperFX (Mario Chip / GSU-1 / GSU-2) coprocessor: a 16 bit RISC
+// cpu with 16 registers, a 512 byte instruction cache, buffered ROM and
+// Game Pak RAM access and a pixel cache that writes bitplane graphics.
+//
+// it runs on the master clock (21.47 MHz), or half of it when CLSR is 0.
+type GSU struct {
+	cartridge *Cartridge
+
+	r           [16]uint16
+	r14Modified bool
+	r15Modified bool
+
+	// SFR, status flag register
+	z    bool // zero
+	cy   bool // carry
+	s    bool // sign
+	ov   bool // overflow
+	g    bool // go (running)
+	rf   bool // rom buffer being read
+	alt1 bool
+	alt2 bool
+	il   bool // immediate lower (unused)
+	ih   bool // immediate upper (unused)
+	b    bool // WITH prefix
+	irq  bool
+
+	pbr   byte   // program bank
+	rombr byte   // rom bank
+	rambr byte   // ram bank
+	cbr   uint16 // cache base
+	scbr  byte   // screen base (1KB units)
+	scmr  byte   // screen mode
+	colr  byte   // color
+	por   byte   // plot option
+	bramr byte   // backup ram enable
+	vcr   byte   // version
+	cfgr  byte   // config
+	clsr  byte   // clock select
+
+	pipeline byte
+	sreg     byte
+	dreg     byte
+	ramAddr  uint16 // last ram address, used by SBK
+
+	romcl byte // cycles until the rom buffer is filled
+	romdr byte
+	ramcl byte // cycles until the ram buffer is written
+	ramar uint16
+	ramdr byte
+
+	cache      [512]byte
+	cacheValid [32]bool
+
+	pixelCache [2]gsuPixelCache
+
+	cyclesLeft int // master cycles the GSU may still run
+}
+
+type gsuPixelCache struct {
+	offset  uint16
+	bitpend byte
+	data    [8]byte
+}
+
+const (
+	gsuPORTransparent = 0x01
+	gsuPORDither      = 0x02
+	gsuPORHighNibble  = 0x04
+	gsuPORFreezeHigh  = 0x08
+	gsuPORObj         = 0x10
+
+	gsuSCMRRAN = 0x08 // GSU owns game pak ram
+	gsuSCMRRON = 0x10 // GSU owns rom
+
+	gsuCFGRMS0 = 0x20 // fast multiplier
+	gsuCFGRIRQ = 0x80 // irq mask
+)
+
+// vectors the S-CPU sees while the GSU owns the rom
+var gsuCPUVectors [16]byte = [16]byte{
+	0x00, 0x01, 0x00, 0x01, 0x04, 0x01, 0x00, 0x01,
+	0x00, 0x01, 0x08, 0x01, 0x00, 0x01, 0x0c, 0x01,
+}
+
+func NewGSU(cartridge *Cartridge, revision2 bool) *GSU {
+	gsu := &GSU{
+		cartridge: cartridge,
+	}
+	if revision2 {
+		gsu.vcr = 0x04
+	} else {
+		gsu.vcr = 0x01
+	}
+	return gsu
+}
+
+func init() {
+	registerBoard(mapperRegistration{
+		name:     "SuperFX",
+		priority: 1,
+		match: func(header *CartridgeHeader) bool {
+			return header.coprocessor == 1
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			if cartridge.ram == nil {
+				cartridge.ramSize = 0x8000
+				cartridge.ram = newVolatileSRAM(int(cartridge.ramSize))
+			}
+			// chipset $13/$14: Mario Chip / GSU-1, $15/$1a: GSU-2
+			var revision2 bool = header.chips == 5 || header.chips == 0xa
+			log.Printf("ROM: SuperFX enabled, RAM size: 0x%x\n", cartridge.ramSize)
+			return NewGSU(cartridge, revision2), nil
+		},
+	})
+}
+
+func (gsu *GSU) Reset() {
+	for i := 0; i < 16; i++ {
+		gsu.r[i] = 0
+	}
+	gsu.r14Modified = false
+	gsu.r15Modified = false
+	gsu.setSFR(0)
+	gsu.pbr = 0
+	gsu.rombr = 0
+	gsu.rambr = 0
+	gsu.cbr = 0
+	gsu.scbr = 0
+	gsu.scmr = 0
+	gsu.colr = 0
+	gsu.por = 0
+	gsu.bramr = 0
+	gsu.cfgr = 0
+	gsu.clsr = 0
+	gsu.pipeline = 0x01 // nop
+	gsu.sreg = 0
+	gsu.dreg = 0
+	gsu.ramAddr = 0
+	gsu.romcl = 0
+	gsu.romdr = 0
+	gsu.ramcl = 0
+	gsu.ramar = 0
+	gsu.ramdr = 0
+	for i := 0; i < len(gsu.cache); i++ {
+		gsu.cache[i] = 0
+	}
+	gsu.flushCache()
+	gsu.pixelCache[0] = gsuPixelCache{}
+	gsu.pixelCache[1] = gsuPixelCache{}
+	gsu.cyclesLeft = 0
+}
+
+// Cycle runs the GSU for 2 master cycles
+func (gsu *GSU) Cycle() {
+	if gsu.irq {
+		// keep the S-CPU irq line up until SFR is read
+		gsu.cartridge.console.CPU.irqWanted = true
+	}
+
+	if !gsu.g {
+		// let pending rom/ram buffer transfers finish
+		gsu.step(2)
+		gsu.cyclesLeft = 0
+		return
+	}
+
+	gsu.cyclesLeft += 2
+	for gsu.cyclesLeft > 0 && gsu.g {
+		gsu.runInstruction()
+	}
+}
+
+func (gsu *GSU) runInstruction() {
+	var opcode byte = gsu.peekPipe()
+	gsu.execute(opcode)
+
+	if gsu.r14Modified {
+		gsu.r14Modified = false
+		gsu.updateROMBuffer()
+	}
+	if gsu.r15Modified {
+		gsu.r15Modified = false
+	} else {
+		gsu.r[15]++
+	}
+}
+
+func (gsu *GSU) step(clocks int) {
+	if gsu.romcl > 0 {
+		if int(gsu.romcl) > clocks {
+			gsu.romcl -= byte(clocks)
+		} else {
+			gsu.romcl = 0
+			gsu.rf = false
+			gsu.romdr = gsu.busRead((uint32(gsu.rombr) << 16) + uint32(gsu.r[14]))
+		}
+	}
+	if gsu.ramcl > 0 {
+		if int(gsu.ramcl) > clocks {
+			gsu.ramcl -= byte(clocks)
+		} else {
+			gsu.ramcl = 0
+			gsu.busWrite(0x700000+(uint32(gsu.rambr)<<16)+uint32(gsu.ramar), gsu.ramdr)
+		}
+	}
+	gsu.cyclesLeft -= clocks
+}
+
+// cycles for a rom/ram access and for a cache access
+func (gsu *GSU) memoryClocks() int {
+	if gsu.clsr > 0 {
+		return 5
+	}
+	return 6
+}
+
+func (gsu *GSU) cacheClocks() int {
+	if gsu.clsr > 0 {
+		return 1
+	}
+	return 2
+}
+
+func (gsu *GSU) setR(n byte, value uint16) {
+	gsu.r[n] = value
+	if n == 14 {
+		gsu.r14Modified = true
+	} else if n == 15 {
+		gsu.r15Modified = true
+	}
+}
+
+func (gsu *GSU) sr() uint16 {
+	return gsu.r[gsu.sreg]
+}
+
+func (gsu *GSU) setDR(value uint16) {
+	gsu.setR(gsu.dreg, value)
+}
+
+// resetPrefix clears ALT/WITH state after an instruction
+func (gsu *GSU) resetPrefix() {
+	gsu.b = false
+	gsu.alt1 = false
+	gsu.alt2 = false
+	gsu.sreg = 0
+	gsu.dreg = 0
+}
+
+func (gsu *GSU) setSZ(value uint16) {
+	gsu.s = (value & 0x8000) > 0
+	gsu.z = value == 0
+}
+
+func (gsu *GSU) getSFR() uint16 {
+	var value uint16 = 0
+	flags := [16]bool{
+		false, gsu.z, gsu.cy, gsu.s, gsu.ov, gsu.g, gsu.rf, false,
+		gsu.alt1, gsu.alt2, gsu.il, gsu.ih, gsu.b, false, false, gsu.irq,
+	}
+	for i := 0; i < 16; i++ {
+		if flags[i] {
+			value |= 1 << i
+		}
+	}
+	return value
+}
+
+func (gsu *GSU) setSFR(value uint16) {
+	gsu.z = (value & 0x0002) > 0
+	gsu.cy = (value & 0x0004) > 0
+	gsu.s = (value & 0x0008) > 0
+	gsu.ov = (value & 0x0010) > 0
+	gsu.g = (value & 0x0020) > 0
+	gsu.rf = (value & 0x0040) > 0
+	gsu.alt1 = (value & 0x0100) > 0
+	gsu.alt2 = (value & 0x0200) > 0
+	gsu.il = (value & 0x0400) > 0
+	gsu.ih = (value & 0x0800) > 0
+	gsu.b = (value & 0x1000) > 0
+	gsu.irq = (value & 0x8000) > 0
+}
+
+// S-CPU side
+
+func (gsu *GSU) Read(bank byte, addr uint16) byte {
+	var console *Console = gsu.cartridge.console
+	if (bank & 0x7f) < 0x40 {
+		switch {
+		case addr >= 0x3000 && addr < 0x3300:
+			return gsu.readIO(addr)
+		case addr >= 0x6000 && addr < 0x8000:
+			if !gsu.cpuHasRAM() {
+				return console.openBus
+			}
+			return gsu.readRAM(uint32(addr & 0x1fff))
+		case addr >= 0x8000:
+			if !gsu.cpuHasROM() {
+				return gsuCPUVectors[addr&0xf]
+			}
+			return gsu.readROM((uint32(bank&0x3f) << 15) | uint32(addr&0x7fff))
+		}
+		return console.openBus
+	}
+	if (bank & 0x7f) < 0x60 {
+		// banks 40-5f, c0-df
+		if !gsu.cpuHasROM() {
+			return gsuCPUVectors[addr&0xf]
+		}
+		return gsu.readROM((uint32(bank&0x1f) << 16) | uint32(addr))
+	}
+	if (bank&0x7f) == 0x70 || (bank&0x7f) == 0x71 {
+		if !gsu.cpuHasRAM() {
+			return console.openBus
+		}
+		return gsu.readRAM((uint32(bank&1) << 16) | uint32(addr))
+	}
+
+	return console.openBus
+}
+
+func (gsu *GSU) Write(bank byte, addr uint16, value byte) {
+	if (bank & 0x7f) < 0x40 {
+		switch {
+		case addr >= 0x3000 && addr < 0x3300:
+			gsu.writeIO(addr, value)
+		case addr >= 0x6000 && addr < 0x8000:
+			if gsu.cpuHasRAM() {
+				gsu.writeRAM(uint32(addr&0x1fff), value)
+			}
+		}
+		return
+	}
+	if (bank&0x7f) == 0x70 || (bank&0x7f) == 0x71 {
+		if gsu.cpuHasRAM() {
+			gsu.writeRAM((uint32(bank&1)<<16)|uint32(addr), value)
+		}
+	}
+}
+
+// the S-CPU loses rom/ram access while the GSU runs and owns them
+func (gsu *GSU) cpuHasROM() bool {
+	return !gsu.g || (gsu.scmr&gsuSCMRRON) == 0
+}
+
+func (gsu *GSU) cpuHasRAM() bool {
+	return !gsu.g || (gsu.scmr&gsuSCMRRAN) == 0
+}
+
+func (gsu *GSU) readROM(offset uint32) byte {
+	return gsu.cartridge.rom[offset&(gsu.cartridge.romSize-1)]
+}
+
+func (gsu *GSU) readRAM(offset uint32) byte {
+	if gsu.cartridge.ramSize == 0 {
+		return gsu.cartridge.console.openBus
+	}
+	return gsu.cartridge.ram.Read(offset & (gsu.cartridge.ramSize - 1))
+}
+
+func (gsu *GSU) writeRAM(offset uint32, value byte) {
+	if gsu.cartridge.ramSize == 0 {
+		return
+	}
+	gsu.cartridge.ram.Write(offset&(gsu.cartridge.ramSize-1), value)
+}
+
+func (gsu *GSU) readIO(addr uint16) byte {
+	if addr >= 0x3100 {
+		return gsu.cache[(uint16(addr-0x3100)+gsu.cbr)&0x1ff]
+	}
+	if addr < 0x3020 {
+		return byte(gsu.r[(addr>>1)&0xf] >> ((addr & 1) * 8))
+	}
+
+	switch addr {
+	case 0x3030:
+		return byte(gsu.getSFR())
+	case 0x3031:
+		var value byte = byte(gsu.getSFR() >> 8)
+		gsu.irq = false
+		var console *Console = gsu.cartridge.console
+		console.CPU.irqWanted = console.inIRQ
+		return value
+	case 0x3034:
+		return gsu.pbr
+	case 0x3036:
+		return gsu.rombr
+	case 0x303b:
+		return gsu.vcr
+	case 0x303c:
+		return gsu.rambr
+	case 0x303e:
+		return byte(gsu.cbr)
+	case 0x303f:
+		return byte(gsu.cbr >> 8)
+	}
+
+	return 0
+}
+
+func (gsu *GSU) writeIO(addr uint16, value byte) {
+	if addr >= 0x3100 {
+		var offset uint16 = (uint16(addr-0x3100) + gsu.cbr) & 0x1ff
+		gsu.cache[offset] = value
+		if (offset & 0xf) == 0xf {
+			gsu.cacheValid[offset>>4] = true
+		}
+		return
+	}
+	if addr < 0x3020 {
+		var n byte = byte((addr >> 1) & 0xf)
+		if (addr & 1) == 0 {
+			gsu.r[n] = (gsu.r[n] & 0xff00) | uint16(value)
+		} else {
+			gsu.r[n] = (gsu.r[n] & 0x00ff) | (uint16(value) << 8)
+		}
+		if n == 14 {
+			gsu.updateROMBuffer()
+		}
+		if addr == 0x301f {
+			// writing the high byte of r15 starts the GSU
+			gsu.g = true
+		}
+		return
+	}
+
+	switch addr {
+	case 0x3030:
+		var wasRunning bool = gsu.g
+		gsu.setSFR((gsu.getSFR() & 0xff00) | uint16(value))
+		if wasRunning && !gsu.g {
+			gsu.cbr = 0
+			gsu.flushCache()
+		}
+	case 0x3031:
+		gsu.setSFR((gsu.getSFR() & 0x00ff) | (uint16(value) << 8))
+	case 0x3033:
+		gsu.bramr = value & 0x01
+	case 0x3034:
+		gsu.pbr = value & 0x7f
+		gsu.flushCache()
+	case 0x3037:
+		gsu.cfgr = value
+	case 0x3038:
+		gsu.scbr = value
+	case 0x3039:
+		gsu.clsr = value & 0x01
+	case 0x303a:
+		gsu.scmr = value
+	}
+}
+
+// GSU side
+
+func (gsu *GSU) busRead(addr uint32) byte {
+	var bank byte = byte(addr>>16) & 0x7f
+	var offset uint16 = uint16(addr)
+	if bank < 0x40 {
+		// banks 00-3f: lorom
+		return gsu.readROM((uint32(bank&0x3f) << 15) | uint32(offset&0x7fff))
+	}
+	if bank < 0x60 {
+		// banks 40-5f: linear
+		return gsu.readROM((uint32(bank&0x1f) << 16) | uint32(offset))
+	}
+	if bank == 0x70 || bank == 0x71 {
+		return gsu.readRAM((uint32(bank&1) << 16) | uint32(offset))
+	}
+	return 0
+}
+
+func (gsu *GSU) busWrite(addr uint32, value byte) {
+	var bank byte = byte(addr>>16) & 0x7f
+	if bank == 0x70 || bank == 0x71 {
+		gsu.writeRAM((uint32(bank&1)<<16)|uint32(uint16(addr)), value)
+	}
+}
+
+func (gsu *GSU) syncROMBuffer() {
+	if gsu.romcl > 0 {
+		gsu.step(int(gsu.romcl))
+	}
+}
+
+func (gsu *GSU) readROMBuffer() byte {
+	gsu.syncROMBuffer()
+	return gsu.romdr
+}
+
+func (gsu *GSU) updateROMBuffer() {
+	gsu.rf = true
+	gsu.romcl = byte(gsu.memoryClocks())
+}
+
+func (gsu *GSU) syncRAMBuffer() {
+	if gsu.ramcl > 0 {
+		gsu.step(int(gsu.ramcl))
+	}
+}
+
+func (gsu *GSU) readRAMBuffer(addr uint16) byte {
+	gsu.syncRAMBuffer()
+	return gsu.busRead(0x700000 + (uint32(gsu.rambr) << 16) + uint32(addr))
+}
+
+func (gsu *GSU) writeRAMBuffer(addr uint16, value byte) {
+	gsu.syncRAMBuffer()
+	gsu.ramcl = byte(gsu.memoryClocks())
+	gsu.ramar = addr
+	gsu.ramdr = value
+}
+
+func (gsu *GSU) flushCache() {
+	for i := 0; i < len(gsu.cacheValid); i++ {
+		gsu.cacheValid[i] = false
+	}
+}
+
+func (gsu *GSU) readOpcode(addr uint16) byte {
+	var offset uint16 = addr - gsu.cbr
+	if offset < 512 {
+		if !gsu.cacheValid[offset>>4] {
+			// fill the 16 byte cache line
+			var dp uint16 = offset & 0xfff0
+			var sp uint32 = (uint32(gsu.pbr) << 16) + uint32((gsu.cbr+dp)&0xfff0)
+			for i := 0; i < 16; i++ {
+				gsu.step(gsu.memoryClocks())
+				gsu.cache[dp] = gsu.busRead(sp)
+				dp++
+				sp++
+			}
+			gsu.cacheValid[offset>>4] = true
+		} else {
+			gsu.step(gsu.cacheClocks())
+		}
+		return gsu.cache[offset]
+	}
+
+	if gsu.pbr <= 0x5f {
+		gsu.syncROMBuffer()
+	} else {
+		gsu.syncRAMBuffer()
+	}
+	gsu.step(gsu.memoryClocks())
+	return gsu.busRead((uint32(gsu.pbr) << 16) | uint32(addr))
+}
+
+// peekPipe returns the prefetched opcode and prefetches the one at r15
+func (gsu *GSU) peekPipe() byte {
+	var result byte = gsu.pipeline
+	gsu.pipeline = gsu.readOpcode(gsu.r[15])
+	gsu.r15Modified = false
+	return result
+}
+
+// pipe returns the prefetched byte and prefetches the next one
+func (gsu *GSU) pipe() byte {
+	var result byte = gsu.pipeline
+	gsu.r[15]++
+	gsu.pipeline = gsu.readOpcode(gsu.r[15])
+	gsu.r15Modified = false
+	return result
+}
+
+// plotting
+
+func (gsu *GSU) color(source byte) byte {
+	if (gsu.por & gsuPORHighNibble) > 0 {
+		return (gsu.colr & 0xf0) | (source >> 4)
+	}
+	if (gsu.por & gsuPORFreezeHigh) > 0 {
+		return (gsu.colr & 0xf0) | (source & 0x0f)
+	}
+	return source
+}
+
+// colorDepth returns the bitplanes per pixel (2, 4 or 8)
+func (gsu *GSU) colorDepth() uint32 {
+	var md byte = gsu.scmr & 3
+	return 2 << (md - (md >> 1))
+}
+
+// screenHeight returns the height mode (0: 128, 1: 160, 2: 192, 3: obj)
+func (gsu *GSU) screenHeight() byte {
+	if (gsu.por & gsuPORObj) > 0 {
+		return 3
+	}
+	return ((gsu.scmr >> 2) & 1) | ((gsu.scmr >> 4) & 2)
+}
+
+func (gsu *GSU) charAddress(x byte, y byte) uint32 {
+	var cn uint32
+	var cx uint32 = uint32(x)
+	var cy uint32 = uint32(y)
+	switch gsu.screenHeight() {
+	case 0:
+		cn = ((cx & 0xf8) << 1) + ((cy & 0xf8) >> 3)
+	case 1:
+		cn = ((cx & 0xf8) << 1) + ((cx & 0xf8) >> 1) + ((cy & 0xf8) >> 3)
+	case 2:
+		cn = ((cx & 0xf8) << 1) + (cx & 0xf8) + ((cy & 0xf8) >> 3)
+	default:
+		cn = ((cy & 0x80) << 2) + ((cx & 0x80) << 1) + ((cy & 0x78) << 1) + ((cx & 0x78) >> 3)
+	}
+	return 0x700000 + (cn * (gsu.colorDepth() << 3)) + (uint32(gsu.scbr) << 10) + ((cy & 7) * 2)
+}
+
+func (gsu *GSU) plot(x byte, y byte) {
+	if (gsu.por & gsuPORTransparent) == 0 {
+		if (gsu.scmr & 3) == 3 {
+			if (gsu.por & gsuPORFreezeHigh) > 0 {
+				if (gsu.colr & 0x0f) == 0 {
+					return
+				}
+			} else if gsu.colr == 0 {
+				return
+			}
+		} else if (gsu.colr & 0x0f) == 0 {
+			return
+		}
+	}
+
+	var color byte = gsu.colr
+	if (gsu.por&gsuPORDither) > 0 && (gsu.scmr&3) != 3 {
+		if ((x ^ y) & 1) > 0 {
+			color >>= 4
+		}
+		color &= 0x0f
+	}
+
+	var offset uint16 = (uint16(y) << 5) + uint16(x>>3)
+	if offset != gsu.pixelCache[0].offset {
+		gsu.flushPixelCache(&gsu.pixelCache[1])
+		gsu.pixelCache[1] = gsu.pixelCache[0]
+		gsu.pixelCache[0].bitpend = 0
+		gsu.pixelCache[0].offset = offset
+	}
+
+	x = (x & 7) ^ 7
+	gsu.pixelCache[0].data[x] = color
+	gsu.pixelCache[0].bitpend |= 1 << x
+	if gsu.pixelCache[0].bitpend == 0xff {
+		gsu.flushPixelCache(&gsu.pixelCache[1])
+		gsu.pixelCache[1] = gsu.pixelCache[0]
+		gsu.pixelCache[0].bitpend = 0
+	}
+}
+
+func (gsu *GSU) rpix(x byte, y byte) byte {
+	gsu.flushPixelCache(&gsu.pixelCache[1])
+	gsu.flushPixelCache(&gsu.pixelCache[0])
+
+	var addr uint32 = gsu.charAddress(x, y)
+	var bpp uint32 = gsu.colorDepth()
+	var data byte = 0
+	x = (x & 7) ^ 7
+
+	for n := uint32(0); n < bpp; n++ {
+		// bitplane pairs are 16 bytes apart
+		var offset uint32 = ((n >> 1) << 4) + (n & 1)
+		gsu.step(gsu.memoryClocks())
+		data |= ((gsu.busRead(addr+offset) >> x) & 1) << n
+	}
+
+	return data
+}
+
+func (gsu *GSU) flushPixelCache(cache *gsuPixelCache) {
+	if cache.bitpend == 0 {
+		return
+	}
+
+	var x byte = byte(cache.offset << 3)
+	var y byte = byte(cache.offset >> 5)
+	var addr uint32 = gsu.charAddress(x, y)
+	var bpp uint32 = gsu.colorDepth()
+
+	for n := uint32(0); n < bpp; n++ {
+		var offset uint32 = ((n >> 1) << 4) + (n & 1)
+		var data byte = 0
+		for i := 0; i < 8; i++ {
+			data |= ((cache.data[i] >> n) & 1) << i
+		}
+		if cache.bitpend != 0xff {
+			// merge with the pixels already in ram
+			gsu.step(gsu.memoryClocks())
+			data &= cache.bitpend
+			data |= gsu.busRead(addr+offset) & ^cache.bitpend
+		}
+		gsu.step(gsu.memoryClocks())
+		gsu.busWrite(addr+offset, data)
+	}
+
+	cache.bitpend = 0
+}
+
+// instructions
+
+func (gsu *GSU) execute(opcode byte) {
+	var n byte = opcode & 0xf
+
+	switch {
+	case opcode == 0x00:
+		gsu.opSTOP()
+	case opcode == 0x01:
+		gsu.resetPrefix()
+	case opcode == 0x02:
+		gsu.opCACHE()
+	case opcode == 0x03:
+		gsu.opLSR()
+	case opcode == 0x04:
+		gsu.opROL()
+	case opcode >= 0x05 && opcode <= 0x0f:
+		gsu.opBranch(opcode)
+	case opcode >= 0x10 && opcode <= 0x1f:
+		gsu.opTOMOVE(n)
+	case opcode >= 0x20 && opcode <= 0x2f:
+		gsu.opWITH(n)
+	case opcode >= 0x30 && opcode <= 0x3b:
+		gsu.opStore(n)
+	case opcode == 0x3c:
+		gsu.opLOOP()
+	case opcode == 0x3d:
+		gsu.b = false
+		gsu.alt1 = true
+	case opcode == 0x3e:
+		gsu.b = false
+		gsu.alt2 = true
+	case opcode == 0x3f:
+		gsu.b = false
+		gsu.alt1 = true
+		gsu.alt2 = true
+	case opcode >= 0x40 && opcode <= 0x4b:
+		gsu.opLoad(n)
+	case opcode == 0x4c:
+		gsu.opPLOTRPIX()
+	case opcode == 0x4d:
+		gsu.opSWAP()
+	case opcode == 0x4e:
+		gsu.opCOLORCMODE()
+	case opcode == 0x4f:
+		gsu.opNOT()
+	case opcode >= 0x50 && opcode <= 0x5f:
+		gsu.opADDADC(n)
+	case opcode >= 0x60 && opcode <= 0x6f:
+		gsu.opSUBSBCCMP(n)
+	case opcode == 0x70:
+		gsu.opMERGE()
+	case opcode >= 0x71 && opcode <= 0x7f:
+		gsu.opANDBIC(n)
+	case opcode >= 0x80 && opcode <= 0x8f:
+		gsu.opMULTUMULT(n)
+	case opcode == 0x90:
+		gsu.opSBK()
+	case opcode >= 0x91 && opcode <= 0x94:
+		gsu.opLINK(n)
+	case opcode == 0x95:
+		gsu.opSEX()
+	case opcode == 0x96:
+		gsu.opASRDIV2()
+	case opcode == 0x97:
+		gsu.opROR()
+	case opcode >= 0x98 && opcode <= 0x9d:
+		gsu.opJMPLJMP(n)
+	case opcode == 0x9e:
+		gsu.opLOB()
+	case opcode == 0x9f:
+		gsu.opFMULTLMULT()
+	case opcode >= 0xa0 && opcode <= 0xaf:
+		gsu.opIBTLMSSMS(n)
+	case opcode >= 0xb0 && opcode <= 0xbf:
+		gsu.opFROMMOVES(n)
+	case opcode == 0xc0:
+		gsu.opHIB()
+	case opcode >= 0xc1 && opcode <= 0xcf:
+		gsu.opORXOR(n)
+	case opcode >= 0xd0 && opcode <= 0xde:
+		gsu.opINC(n)
+	case opcode == 0xdf:
+		gsu.opGETCRAMBROMB()
+	case opcode >= 0xe0 && opcode <= 0xee:
+		gsu.opDEC(n)
+	case opcode == 0xef:
+		gsu.opGETB()
+	default:
+		// f0-ff
+		gsu.opIWTLMSM(n)
+	}
+}
+
+func (gsu *GSU) opSTOP() {
+	if (gsu.cfgr & gsuCFGRIRQ) == 0 {
+		gsu.irq = true
+		gsu.cartridge.console.CPU.irqWanted = true
+	}
+	gsu.g = false
+	gsu.pipeline = 0x01 // nop
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opCACHE() {
+	if gsu.cbr != (gsu.r[15] & 0xfff0) {
+		gsu.cbr = gsu.r[15] & 0xfff0
+		gsu.flushCache()
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opLSR() {
+	gsu.cy = (gsu.sr() & 1) > 0
+	var value uint16 = gsu.sr() >> 1
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opROL() {
+	var carry bool = (gsu.sr() & 0x8000) > 0
+	var value uint16 = gsu.sr() << 1
+	if gsu.cy {
+		value |= 1
+	}
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.cy = carry
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opBranch(opcode byte) {
+	var take bool
+	switch opcode {
+	case 0x05:
+		take = true // BRA
+	case 0x06:
+		take = gsu.s == gsu.ov // BGE
+	case 0x07:
+		take = gsu.s != gsu.ov // BLT
+	case 0x08:
+		take = !gsu.z // BNE
+	case 0x09:
+		take = gsu.z // BEQ
+	case 0x0a:
+		take = !gsu.s // BPL
+	case 0x0b:
+		take = gsu.s // BMI
+	case 0x0c:
+		take = !gsu.cy // BCC
+	case 0x0d:
+		take = gsu.cy // BCS
+	case 0x0e:
+		take = !gsu.ov // BVC
+	case 0x0f:
+		take = gsu.ov // BVS
+	}
+	var displacement int8 = int8(gsu.pipe())
+	if take {
+		// the instruction after the branch is still executed
+		gsu.setR(15, gsu.r[15]+uint16(displacement))
+	}
+}
+
+func (gsu *GSU) opTOMOVE(n byte) {
+	if !gsu.b {
+		gsu.dreg = n
+	} else {
+		gsu.setR(n, gsu.sr())
+		gsu.resetPrefix()
+	}
+}
+
+func (gsu *GSU) opWITH(n byte) {
+	gsu.sreg = n
+	gsu.dreg = n
+	gsu.b = true
+}
+
+func (gsu *GSU) opStore(n byte) {
+	gsu.ramAddr = gsu.r[n]
+	gsu.writeRAMBuffer(gsu.ramAddr, byte(gsu.sr()))
+	if !gsu.alt1 {
+		gsu.writeRAMBuffer(gsu.ramAddr^1, byte(gsu.sr()>>8))
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opLOOP() {
+	gsu.setR(12, gsu.r[12]-1)
+	gsu.setSZ(gsu.r[12])
+	if !gsu.z {
+		gsu.setR(15, gsu.r[13])
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opLoad(n byte) {
+	gsu.ramAddr = gsu.r[n]
+	var value uint16 = uint16(gsu.readRAMBuffer(gsu.ramAddr))
+	if !gsu.alt1 {
+		value |= uint16(gsu.readRAMBuffer(gsu.ramAddr^1)) << 8
+	}
+	gsu.setDR(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opPLOTRPIX() {
+	if !gsu.alt1 {
+		gsu.plot(byte(gsu.r[1]), byte(gsu.r[2]))
+		gsu.setR(1, gsu.r[1]+1)
+	} else {
+		var value uint16 = uint16(gsu.rpix(byte(gsu.r[1]), byte(gsu.r[2])))
+		gsu.setDR(value)
+		gsu.setSZ(value)
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opSWAP() {
+	var value uint16 = (gsu.sr() >> 8) | (gsu.sr() << 8)
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opCOLORCMODE() {
+	if !gsu.alt1 {
+		gsu.colr = gsu.color(byte(gsu.sr()))
+	} else {
+		gsu.por = byte(gsu.sr())
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opNOT() {
+	var value uint16 = ^gsu.sr()
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opADDADC(n byte) {
+	var operand uint16 = uint16(n) // ADD #n, ADC #n
+	if !gsu.alt2 {
+		operand = gsu.r[n] // ADD Rn, ADC Rn
+	}
+	var result uint32 = uint32(gsu.sr()) + uint32(operand)
+	if gsu.alt1 && gsu.cy {
+		result++
+	}
+	gsu.ov = (^(gsu.sr() ^ operand) & (operand ^ uint16(result)) & 0x8000) > 0
+	gsu.cy = result >= 0x10000
+	gsu.setSZ(uint16(result))
+	gsu.setDR(uint16(result))
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opSUBSBCCMP(n byte) {
+	var operand uint16 = uint16(n) // SUB #n
+	if !gsu.alt2 || gsu.alt1 {
+		operand = gsu.r[n] // SUB Rn, SBC Rn, CMP Rn
+	}
+	var result int32 = int32(gsu.sr()) - int32(operand)
+	if !gsu.alt2 && gsu.alt1 && !gsu.cy {
+		result--
+	}
+	gsu.ov = ((gsu.sr() ^ operand) & (gsu.sr() ^ uint16(result)) & 0x8000) > 0
+	gsu.cy = result >= 0
+	gsu.setSZ(uint16(result))
+	if !gsu.alt2 || !gsu.alt1 {
+		// CMP doesn't store the result
+		gsu.setDR(uint16(result))
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opMERGE() {
+	var value uint16 = (gsu.r[7] & 0xff00) | (gsu.r[8] >> 8)
+	gsu.setDR(value)
+	gsu.ov = (value & 0xc0c0) > 0
+	gsu.s = (value & 0x8080) > 0
+	gsu.cy = (value & 0xe0e0) > 0
+	gsu.z = (value & 0xf0f0) > 0
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opANDBIC(n byte) {
+	var operand uint16 = uint16(n)
+	if !gsu.alt2 {
+		operand = gsu.r[n]
+	}
+	if gsu.alt1 {
+		operand = ^operand // BIC
+	}
+	var value uint16 = gsu.sr() & operand
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opMULTUMULT(n byte) {
+	var operand uint16 = uint16(n)
+	if !gsu.alt2 {
+		operand = gsu.r[n]
+	}
+	var value uint16
+	if !gsu.alt1 {
+		value = uint16(int16(int8(gsu.sr())) * int16(int8(operand)))
+	} else {
+		value = uint16(byte(gsu.sr())) * uint16(byte(operand))
+	}
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.resetPrefix()
+	if (gsu.cfgr & gsuCFGRMS0) == 0 {
+		gsu.step(gsu.cacheClocks())
+	}
+}
+
+func (gsu *GSU) opSBK() {
+	gsu.writeRAMBuffer(gsu.ramAddr, byte(gsu.sr()))
+	gsu.writeRAMBuffer(gsu.ramAddr^1, byte(gsu.sr()>>8))
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opLINK(n byte) {
+	gsu.setR(11, gsu.r[15]+uint16(n))
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opSEX() {
+	var value uint16 = uint16(int16(int8(gsu.sr())))
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opASRDIV2() {
+	gsu.cy = (gsu.sr() & 1) > 0
+	var value uint16 = uint16(int16(gsu.sr()) >> 1)
+	if gsu.alt1 && gsu.sr() == 0xffff {
+		// DIV2 rounds -1 to 0
+		value = 0
+	}
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opROR() {
+	var carry bool = (gsu.sr() & 1) > 0
+	var value uint16 = gsu.sr() >> 1
+	if gsu.cy {
+		value |= 0x8000
+	}
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.cy = carry
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opJMPLJMP(n byte) {
+	if !gsu.alt1 {
+		gsu.setR(15, gsu.r[n])
+	} else {
+		gsu.pbr = byte(gsu.r[n]) & 0x7f
+		gsu.setR(15, gsu.sr())
+		gsu.cbr = gsu.r[15] & 0xfff0
+		gsu.flushCache()
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opLOB() {
+	var value uint16 = gsu.sr() & 0xff
+	gsu.setDR(value)
+	gsu.s = (value & 0x80) > 0
+	gsu.z = value == 0
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opFMULTLMULT() {
+	var result uint32 = uint32(int32(int16(gsu.sr())) * int32(int16(gsu.r[6])))
+	if gsu.alt1 {
+		gsu.setR(4, uint16(result))
+	}
+	var value uint16 = uint16(result >> 16)
+	gsu.setDR(value)
+	gsu.s = (value & 0x8000) > 0
+	gsu.cy = (result & 0x8000) > 0
+	gsu.z = value == 0
+	gsu.resetPrefix()
+	if (gsu.cfgr & gsuCFGRMS0) > 0 {
+		gsu.step(3 * gsu.cacheClocks())
+	} else {
+		gsu.step(7 * gsu.cacheClocks())
+	}
+}
+
+func (gsu *GSU) opIBTLMSSMS(n byte) {
+	if gsu.alt1 {
+		// LMS Rn, (yy)
+		gsu.ramAddr = uint16(gsu.pipe()) << 1
+		var low byte = gsu.readRAMBuffer(gsu.ramAddr)
+		gsu.setR(n, (uint16(gsu.readRAMBuffer(gsu.ramAddr^1))<<8)|uint16(low))
+	} else if gsu.alt2 {
+		// SMS (yy), Rn
+		gsu.ramAddr = uint16(gsu.pipe()) << 1
+		gsu.writeRAMBuffer(gsu.ramAddr, byte(gsu.r[n]))
+		gsu.writeRAMBuffer(gsu.ramAddr^1, byte(gsu.r[n]>>8))
+	} else {
+		// IBT Rn, #pp
+		gsu.setR(n, uint16(int16(int8(gsu.pipe()))))
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opFROMMOVES(n byte) {
+	if !gsu.b {
+		gsu.sreg = n
+	} else {
+		var value uint16 = gsu.r[n]
+		gsu.setDR(value)
+		gsu.ov = (value & 0x80) > 0
+		gsu.setSZ(value)
+		gsu.resetPrefix()
+	}
+}
+
+func (gsu *GSU) opHIB() {
+	var value uint16 = gsu.sr() >> 8
+	gsu.setDR(value)
+	gsu.s = (value & 0x80) > 0
+	gsu.z = value == 0
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opORXOR(n byte) {
+	var operand uint16 = uint16(n)
+	if !gsu.alt2 {
+		operand = gsu.r[n]
+	}
+	var value uint16
+	if !gsu.alt1 {
+		value = gsu.sr() | operand
+	} else {
+		value = gsu.sr() ^ operand
+	}
+	gsu.setDR(value)
+	gsu.setSZ(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opINC(n byte) {
+	gsu.setR(n, gsu.r[n]+1)
+	gsu.setSZ(gsu.r[n])
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opGETCRAMBROMB() {
+	if !gsu.alt2 {
+		// GETC
+		gsu.colr = gsu.color(gsu.readROMBuffer())
+	} else if !gsu.alt1 {
+		// RAMB
+		gsu.syncRAMBuffer()
+		gsu.rambr = byte(gsu.sr()) & 0x01
+	} else {
+		// ROMB
+		gsu.syncROMBuffer()
+		gsu.rombr = byte(gsu.sr()) & 0x7f
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opDEC(n byte) {
+	gsu.setR(n, gsu.r[n]-1)
+	gsu.setSZ(gsu.r[n])
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opGETB() {
+	var value uint16
+	switch {
+	case !gsu.alt2 && !gsu.alt1:
+		// GETB
+		value = uint16(gsu.readROMBuffer())
+	case !gsu.alt2 && gsu.alt1:
+		// GETBH
+		value = (uint16(gsu.readROMBuffer()) << 8) | (gsu.sr() & 0xff)
+	case gsu.alt2 && !gsu.alt1:
+		// GETBL
+		value = (gsu.sr() & 0xff00) | uint16(gsu.readROMBuffer())
+	default:
+		// GETBS
+		value = uint16(int16(int8(gsu.readROMBuffer())))
+	}
+	gsu.setDR(value)
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) opIWTLMSM(n byte) {
+	if gsu.alt1 {
+		// LM Rn, (xx)
+		gsu.ramAddr = uint16(gsu.pipe())
+		gsu.ramAddr |= uint16(gsu.pipe()) << 8
+		var low byte = gsu.readRAMBuffer(gsu.ramAddr)
+		gsu.setR(n, (uint16(gsu.readRAMBuffer(gsu.ramAddr^1))<<8)|uint16(low))
+	} else if gsu.alt2 {
+		// SM (xx), Rn
+		gsu.ramAddr = uint16(gsu.pipe())
+		gsu.ramAddr |= uint16(gsu.pipe()) << 8
+		gsu.writeRAMBuffer(gsu.ramAddr, byte(gsu.r[n]))
+		gsu.writeRAMBuffer(gsu.ramAddr^1, byte(gsu.r[n]>>8))
+	} else {
+		// IWT Rn, #xx
+		var low byte = gsu.pipe()
+		gsu.setR(n, (uint16(gsu.pipe())<<8)|uint16(low))
+	}
+	gsu.resetPrefix()
+}
+
+func (gsu *GSU) Close() {
+}
+
+func (gsu *GSU) Serialize(s *serializer) {
+	s.u16s(gsu.r[:])
+	s.bool(&gsu.r14Modified)
+	s.bool(&gsu.r15Modified)
+
+	var sfr uint16 = gsu.getSFR()
+	s.u16(&sfr)
+	gsu.setSFR(sfr)
+
+	s.u8(&gsu.pbr)
+	s.u8(&gsu.rombr)
+	s.u8(&gsu.rambr)
+	s.u16(&gsu.cbr)
+	s.u8(&gsu.scbr)
+	s.u8(&gsu.scmr)
+	s.u8(&gsu.colr)
+	s.u8(&gsu.por)
+	s.u8(&gsu.bramr)
+	s.u8(&gsu.vcr)
+	s.u8(&gsu.cfgr)
+	s.u8(&gsu.clsr)
+
+	s.u8(&gsu.pipeline)
+	s.u8(&gsu.sreg)
+	s.u8(&gsu.dreg)
+	s.u16(&gsu.ramAddr)
+	s.u8(&gsu.romcl)
+	s.u8(&gsu.romdr)
+	s.u8(&gsu.ramcl)
+	s.u16(&gsu.ramar)
+	s.u8(&gsu.ramdr)
+
+	s.bytes(gsu.cache[:])
+	s.bools(gsu.cacheValid[:])
+	for i := 0; i < len(gsu.pixelCache); i++ {
+		s.u16(&gsu.pixelCache[i].offset)
+		s.u8(&gsu.pixelCache[i].bitpend)
+		s.bytes(gsu.pixelCache[i].data[:])
+	}
+
+	var cyclesLeft uint32 = uint32(int32(gsu.cyclesLeft))
+	s.u32(&cyclesLeft)
+	gsu.cyclesLeft = int(int32(cyclesLeft))
+}
@@ -0,0 +1,120 @@
+package chibisnes
+
+// HiROM maps the rom in 64KB banks at 40-7d and c0-ff (the upper halves
+// mirrored at 8000-ffff of banks 00-3f and 80-bf) and the ram in 8KB pages
+// at 00-3f,80-bf:6000-7fff.
+type HiROM struct {
+	cartridge *Cartridge
+}
+
+// ExHiROM is HiROM with more than 4MB of rom: the first 4MB are in banks
+// 80-ff and the rest in banks 00-7d.
+type ExHiROM struct {
+	cartridge *Cartridge
+}
+
+func init() {
+	registerBoard(mapperRegistration{
+		name: "HiROM",
+		match: func(header *CartridgeHeader) bool {
+			return header.cartType == 2
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			return NewHiROM(cartridge), nil
+		},
+	})
+	registerBoard(mapperRegistration{
+		name: "ExHiROM",
+		match: func(header *CartridgeHeader) bool {
+			return header.cartType == 4
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			return NewExHiROM(cartridge), nil
+		},
+	})
+}
+
+func NewHiROM(cartridge *Cartridge) *HiROM {
+	return &HiROM{
+		cartridge: cartridge,
+	}
+}
+
+func NewExHiROM(cartridge *Cartridge) *ExHiROM {
+	return &ExHiROM{
+		cartridge: cartridge,
+	}
+}
+
+func (hiROM *HiROM) Read(bank byte, addr uint16) byte {
+	var cartridge *Cartridge = hiROM.cartridge
+	bank &= 0x7f
+	if bank < 0x40 && addr >= 0x6000 && addr < 0x8000 && cartridge.ramSize > 0 {
+		// banks 00-3f and 80-bf, adr 6000-7fff
+		// return cartridge.ram[(((uint32(bank)&0x3f)<<13)|(uint32(addr)&0x1fff))&(uint32(cartridge.ramSize)-1)]
+		return cartridge.ram.Read((((uint32(bank) & 0x3f) << 13) | (uint32(addr) & 0x1fff)) & (uint32(cartridge.ramSize) - 1))
+	}
+	if addr >= 0x8000 || bank >= 0x40 {
+		// addr 8000-ffff in all banks or all addresses in banks 40-7f and c0-ff
+		return cartridge.rom[(((uint32(bank)&0x3f)<<16)|uint32(addr))&(uint32(cartridge.romSize)-1)]
+	}
+	return cartridge.console.openBus
+}
+
+func (hiROM *HiROM) Write(bank byte, addr uint16, value byte) {
+	writeHiROMRAM(hiROM.cartridge, bank, addr, value)
+}
+
+// writeHiROMRAM writes the ram of HiROM and ExHiROM
+func writeHiROMRAM(cartridge *Cartridge, bank byte, addr uint16, value byte) {
+	bank &= 0x7f
+	if bank < 0x40 && addr >= 0x6000 && addr < 0x8000 && cartridge.ramSize > 0 {
+		// banks 00-3f and 80-bf, adr 6000-7fff
+		// cartridge.ram[(((uint32(bank)&0x3f)<<13)|(uint32(addr)&0x1fff))&(uint32(cartridge.ramSize)-1)] = value
+		cartridge.ram.Write((((uint32(bank)&0x3f)<<13)|(uint32(addr)&0x1fff))&(uint32(cartridge.ramSize)-1), value)
+	}
+}
+
+func (hiROM *HiROM) Reset() {
+}
+
+func (hiROM *HiROM) Cycle() {
+}
+
+func (hiROM *HiROM) Close() {
+}
+
+func (hiROM *HiROM) Serialize(s *serializer) {
+}
+
+func (exHiROM *ExHiROM) Read(bank byte, addr uint16) byte {
+	var cartridge *Cartridge = exHiROM.cartridge
+	if (bank&0x7f) < 0x40 && addr >= 0x6000 && addr < 0x8000 && cartridge.ramSize > 0 {
+		// banks 00-3f and 80-bf, adr 6000-7fff
+		return cartridge.ram.Read((((uint32(bank) & 0x3f) << 13) | (uint32(addr) & 0x1fff)) & (uint32(cartridge.ramSize) - 1))
+	}
+	if addr >= 0x8000 || (bank&0x7f) >= 0x40 {
+		var offset uint32 = ((uint32(bank) & 0x3f) << 16) | uint32(addr)
+		if bank < 0x80 {
+			offset |= 0x400000
+		}
+		return cartridge.rom[offset&(cartridge.romSize-1)]
+	}
+	return cartridge.console.openBus
+}
+
+func (exHiROM *ExHiROM) Write(bank byte, addr uint16, value byte) {
+	writeHiROMRAM(exHiROM.cartridge, bank, addr, value)
+}
+
+func (exHiROM *ExHiROM) Reset() {
+}
+
+func (exHiROM *ExHiROM) Cycle() {
+}
+
+func (exHiROM *ExHiROM) Close() {
+}
+
+func (exHiROM *ExHiROM) Serialize(s *serializer) {
+}
@@ -0,0 +1,118 @@
+package chibisnes
+
+// LoROM maps the rom in 32KB banks at 8000-ffff of banks 00-7d and 80-ff
+// (all of banks 40-7d and c0-ff) and the ram at 70-7d,f0-ff:0000-7fff.
+type LoROM struct {
+	cartridge *Cartridge
+}
+
+// ExLoROM is LoROM with more than 4MB of rom: the first 4MB are in banks
+// 80-ff and the rest in banks 00-7d.
+type ExLoROM struct {
+	cartridge *Cartridge
+}
+
+func init() {
+	registerBoard(mapperRegistration{
+		name: "LoROM",
+		match: func(header *CartridgeHeader) bool {
+			return header.cartType == 1
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			return NewLoROM(cartridge), nil
+		},
+	})
+	registerBoard(mapperRegistration{
+		name: "ExLoROM",
+		match: func(header *CartridgeHeader) bool {
+			return header.cartType == 5
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			return NewExLoROM(cartridge), nil
+		},
+	})
+}
+
+func NewLoROM(cartridge *Cartridge) *LoROM {
+	return &LoROM{
+		cartridge: cartridge,
+	}
+}
+
+func NewExLoROM(cartridge *Cartridge) *ExLoROM {
+	return &ExLoROM{
+		cartridge: cartridge,
+	}
+}
+
+func (loROM *LoROM) Read(bank byte, addr uint16) byte {
+	var cartridge *Cartridge = loROM.cartridge
+	if ((bank >= 0x70 && bank < 0x7e) || bank >= 0xf0) && addr < 0x8000 && cartridge.ramSize > 0 {
+		// banks 70-7e and f0-ff, adr 0000-7fff
+		// return cartridge.ram[(((uint32(bank)&0xf)<<15)|uint32(addr))&(uint32(cartridge.ramSize)-1)]
+		return cartridge.ram.Read((((uint32(bank) & 0xf) << 15) | uint32(addr)) & (uint32(cartridge.ramSize) - 1))
+	}
+	bank &= 0x7f
+	if addr >= 0x8000 || bank >= 0x40 {
+		// adr 8000-ffff in all banks or all addresses in banks 40-7f and c0-ff
+		return cartridge.rom[((uint32(bank)<<15)|(uint32(addr)&0x7fff))&(cartridge.romSize-1)]
+	}
+	return cartridge.console.openBus
+}
+
+func (loROM *LoROM) Write(bank byte, addr uint16, value byte) {
+	writeLoROMRAM(loROM.cartridge, bank, addr, value)
+}
+
+// writeLoROMRAM writes the ram of LoROM and ExLoROM
+func writeLoROMRAM(cartridge *Cartridge, bank byte, addr uint16, value byte) {
+	if ((bank >= 0x70 && bank < 0x7e) || bank > 0xf0) && addr < 0x8000 && cartridge.ramSize > 0 {
+		// banks 70-7e and f0-ff, adr 0000-7fff
+		// cartridge.ram[(((uint32(bank)&0xf)<<15)|uint32(addr))&(uint32(cartridge.ramSize)-1)] = value
+		cartridge.ram.Write((((uint32(bank)&0xf)<<15)|uint32(addr))&(uint32(cartridge.ramSize)-1), value)
+	}
+}
+
+func (loROM *LoROM) Reset() {
+}
+
+func (loROM *LoROM) Cycle() {
+}
+
+func (loROM *LoROM) Close() {
+}
+
+func (loROM *LoROM) Serialize(s *serializer) {
+}
+
+func (exLoROM *ExLoROM) Read(bank byte, addr uint16) byte {
+	var cartridge *Cartridge = exLoROM.cartridge
+	if ((bank >= 0x70 && bank < 0x7e) || bank >= 0xf0) && addr < 0x8000 && cartridge.ramSize > 0 {
+		// banks 70-7e and f0-ff, adr 0000-7fff
+		return cartridge.ram.Read((((uint32(bank) & 0xf) << 15) | uint32(addr)) & (uint32(cartridge.ramSize) - 1))
+	}
+	if addr >= 0x8000 || (bank&0x7f) >= 0x40 {
+		var offset uint32 = ((uint32(bank) & 0x7f) << 15) | (uint32(addr) & 0x7fff)
+		if bank < 0x80 {
+			offset |= 0x400000
+		}
+		return cartridge.rom[offset&(cartridge.romSize-1)]
+	}
+	return cartridge.console.openBus
+}
+
+func (exLoROM *ExLoROM) Write(bank byte, addr uint16, value byte) {
+	writeLoROMRAM(exLoROM.cartridge, bank, addr, value)
+}
+
+func (exLoROM *ExLoROM) Reset() {
+}
+
+func (exLoROM *ExLoROM) Cycle() {
+}
+
+func (exLoROM *ExLoROM) Close() {
+}
+
+func (exLoROM *ExLoROM) Serialize(s *serializer) {
+}
@@ -0,0 +1,308 @@
+package chibisnes
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// manifest is a <rom>.manifest file next to the rom saying how to map it,
+// for roms with a broken header (homebrew, prototypes). It is a simple BML
+// like text: one "key: value" per line, indentation is ignored and comments
+// start with # or //. Keys left out are taken from the header. It is not
+// named .bml so the higan/bsnes manifests kept next to roms are left alone.
+//
+//	mapping: hirom       # lorom, hirom, exlorom, exhirom
+//	rom: 2MB             # rom size, a longer file is cut to it
+//	ram: 0x2000          # ram size, 0 for none
+//	coprocessor: sa1     # see manifestCoprocessors
+//	region: ntsc         # ntsc, pal
+//	copier: no           # yes if the file has a 512 byte copier header
+//	board: SA-1          # name of a registered board, picks the mapper
+type manifest struct {
+	path string
+
+	cartType    byte // 0: from the header
+	romSize     int  // -1: from the header
+	ramSize     int  // -1: from the header
+	coprocessor string
+	region      string
+	copier      int // -1: from the header scoring, 0: no, 1: yes
+	board       string
+}
+
+// manifestCoprocessor is what a coprocessor name of the manifest puts in
+// the header
+type manifestCoprocessor struct {
+	coprocessor   byte
+	chips         byte
+	exCoprocessor byte
+}
+
+var manifestCoprocessors = map[string]manifestCoprocessor{
+	"none":       {0x0, 0x0, 0x00},
+	"dsp":        {0x0, 0x3, 0x00}, // DSP-1 to 4, picked from the name like without a manifest
+	"superfx":    {0x1, 0x3, 0x00},
+	"superfx2":   {0x1, 0xa, 0x00},
+	"obc1":       {0x2, 0x5, 0x00},
+	"sa1":        {0x3, 0x5, 0x00},
+	"sdd1":       {0x4, 0x3, 0x00},
+	"srtc":       {0x5, 0x5, 0x00},
+	"spc7110":    {0xf, 0x5, 0x00},
+	"spc7110rtc": {0xf, 0x9, 0x00},
+	"st010":      {0xf, 0x6, 0x01}, // ST010 or ST011 from the rom size
+	"st011":      {0xf, 0x6, 0x01},
+	"st018":      {0xf, 0x5, 0x02},
+	"cx4":        {0xf, 0x3, 0x10},
+}
+
+// manifestFilePath returns the path of the .manifest next to the rom
+func manifestFilePath(romFilePath string) string {
+	var fileName string = getFileNameWithoutExtension(romFilePath)
+	var fileDir string = filepath.Dir(filepath.Clean(romFilePath))
+	return filepath.Join(fileDir, fileName+`.manifest`)
+}
+
+// loadManifest reads the manifest next to the rom, nil if there is none
+func loadManifest(romFilePath string) (*manifest, error) {
+	var path string = manifestFilePath(romFilePath)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to load rom: manifest %s: %s\n", path, err.Error())
+		return nil, errors.New(msg)
+	}
+	m, err := parseManifest(path, data)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("ROM: Manifest %s\n", path)
+	return m, nil
+}
+
+func parseManifest(path string, data []byte) (*manifest, error) {
+	m := &manifest{
+		path:    path,
+		romSize: -1,
+		ramSize: -1,
+		copier:  -1,
+	}
+
+	var scanner *bufio.Scanner = bufio.NewScanner(bytes.NewReader(data))
+	var lineNumber int = 0
+	for scanner.Scan() {
+		lineNumber++
+		key, value, ok := splitManifestLine(scanner.Text())
+		if !ok {
+			return nil, m.lineError(lineNumber, "want \"key: value\"")
+		}
+		if key == "" {
+			continue
+		}
+		if err := m.set(key, value); err != nil {
+			return nil, m.lineError(lineNumber, err.Error())
+		}
+	}
+	if err := m.check(); err != nil {
+		msg := fmt.Sprintf("Failed to load rom: manifest %s: %s\n", m.path, err.Error())
+		return nil, errors.New(msg)
+	}
+
+	return m, nil
+}
+
+// splitManifestLine drops the comment of a line and splits it in a key and
+// a value, the key is "" for a blank line
+func splitManifestLine(line string) (string, string, bool) {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", "", true
+	}
+
+	key, value, found := strings.Cut(line, ":")
+	if !found {
+		key, value, found = strings.Cut(line, "=")
+	}
+	key = strings.ToLower(strings.TrimSpace(key))
+	value = strings.TrimSpace(value)
+	return key, value, found && key != "" && value != ""
+}
+
+// set sets a key of the manifest
+func (m *manifest) set(key string, value string) error {
+	switch key {
+	case "mapping":
+		switch strings.ToLower(value) {
+		case "lorom":
+			m.cartType = 1
+		case "hirom":
+			m.cartType = 2
+		case "exhirom":
+			m.cartType = 4
+		case "exlorom":
+			m.cartType = 5
+		default:
+			return errors.New(fmt.Sprintf("unknown mapping %q", value))
+		}
+	case "rom", "ram":
+		size, err := parseManifestSize(value)
+		if err != nil {
+			return err
+		}
+		if key == "rom" {
+			if size < 0x8000 {
+				return errors.New("rom smaller than 32KB")
+			}
+			m.romSize = size
+		} else {
+			m.ramSize = size
+		}
+	case "coprocessor":
+		value = strings.ToLower(strings.ReplaceAll(value, "-", ""))
+		if _, ok := manifestCoprocessors[value]; !ok {
+			return errors.New(fmt.Sprintf("unknown coprocessor %q", value))
+		}
+		m.coprocessor = value
+	case "region":
+		value = strings.ToLower(value)
+		if value != "ntsc" && value != "pal" {
+			return errors.New(fmt.Sprintf("unknown region %q", value))
+		}
+		m.region = value
+	case "copier":
+		switch strings.ToLower(value) {
+		case "yes", "true", "512":
+			m.copier = 1
+		case "no", "false", "0":
+			m.copier = 0
+		default:
+			return errors.New(fmt.Sprintf("want yes or no, not %q", value))
+		}
+	case "board":
+		m.board = value
+	default:
+		return errors.New(fmt.Sprintf("unknown key %q", key))
+	}
+	return nil
+}
+
+// check looks at the keys together once they are all set
+func (m *manifest) check() error {
+	if m.board != "" && !isRegisteredBoard(m.board) {
+		return errors.New(fmt.Sprintf("unknown board %q", m.board))
+	}
+	if (m.coprocessor == "spc7110" || m.coprocessor == "spc7110rtc") && m.cartType != 0 && m.cartType != 2 {
+		return errors.New("the SPC7110 is HiROM only")
+	}
+	return nil
+}
+
+func (m *manifest) lineError(lineNumber int, text string) error {
+	msg := fmt.Sprintf("Failed to load rom: manifest %s line %d: %s\n", m.path, lineNumber, text)
+	return errors.New(msg)
+}
+
+// parseManifestSize parses a size: 1024, 0x400, 1KB or 1MB
+func parseManifestSize(value string) (int, error) {
+	var unit int = 1
+	var number string = strings.ToLower(value)
+	switch {
+	case strings.HasSuffix(number, "kb"):
+		unit = 0x400
+		number = strings.TrimSuffix(number, "kb")
+	case strings.HasSuffix(number, "mb"):
+		unit = 0x100000
+		number = strings.TrimSuffix(number, "mb")
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(number), 0, 32)
+	if err != nil || size < 0 || size*int64(unit) > 0x1000000 {
+		return 0, errors.New(fmt.Sprintf("bad size %q", value))
+	}
+	return int(size) * unit, nil
+}
+
+// headerIndex returns which of the 8 headers of LoadROM the manifest
+// picks, used is the one picked by the scoring, an error if the rom is too
+// small for it
+func (m *manifest) headerIndex(used int, dataLen int) (int, error) {
+	var mapping int = used >> 1
+	switch m.cartType {
+	case 1:
+		mapping = 0 // $7fc0
+	case 2:
+		mapping = 1 // $ffc0
+	case 5:
+		mapping = 2 // $407fc0
+	case 4:
+		mapping = 3 // $40ffc0
+	}
+	var copier int = used & 1
+	if m.copier >= 0 {
+		copier = m.copier
+	} else if m.cartType != 0 {
+		// a copier header makes the file 512 bytes longer than 32KB blocks
+		if (dataLen & 0x7fff) == 0x200 {
+			copier = 1
+		} else {
+			copier = 0
+		}
+	}
+	var index int = mapping<<1 | copier
+	if dataLen < manifestHeaderEnds[index] {
+		msg := fmt.Sprintf("Failed to load rom: manifest %s: mapping does not fit the rom size (%d bytes)\n", m.path, dataLen)
+		return used, errors.New(msg)
+	}
+	return index, nil
+}
+
+// manifestHeaderEnds is the smallest rom having each header of LoadROM
+var manifestHeaderEnds = [8]int{0x8000, 0x8200, 0x10000, 0x10200, 0x408000, 0x408200, 0x410000, 0x410200}
+
+// apply puts what the manifest says in the header picked by headerIndex
+func (m *manifest) apply(header *CartridgeHeader) {
+	if m.cartType != 0 && !(m.cartType == 2 && header.cartType == 3) {
+		// HiROM keeps the SPC7110 of the header
+		header.cartType = m.cartType
+	}
+	if m.coprocessor != "" {
+		var c manifestCoprocessor = manifestCoprocessors[m.coprocessor]
+		header.coprocessor = c.coprocessor
+		header.chips = c.chips
+		header.exCoprocessor = c.exCoprocessor
+		if m.coprocessor == "spc7110" || m.coprocessor == "spc7110rtc" {
+			header.cartType = 3
+		} else if header.cartType == 3 {
+			header.cartType = 2
+		}
+	}
+	if m.romSize >= 0 {
+		header.romSize = uint32(m.romSize)
+	}
+	if m.ramSize >= 0 {
+		header.ramSize = uint32(m.ramSize)
+		header.exRamSize = uint32(m.ramSize)
+	}
+	switch m.region {
+	case "ntsc":
+		header.pal = false
+	case "pal":
+		header.pal = true
+	}
+	if m.board != "" {
+		header.board = m.board
+	}
+}
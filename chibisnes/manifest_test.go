@@ -0,0 +1,140 @@
+package chibisnes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	var tests = []struct {
+		name string
+		text string
+		ok   bool
+		want manifest
+	}{
+		{"all keys", "# prototype\nmapping: HiROM\n  rom: 2MB\nram = 0x2000 // sram\ncoprocessor: SA-1\nregion: PAL\ncopier: yes\nboard: SA-1\n", true,
+			manifest{cartType: 2, romSize: 0x200000, ramSize: 0x2000, coprocessor: "sa1", region: "pal", copier: 1, board: "SA-1"}},
+		{"empty", "\n# nothing\n", true, manifest{romSize: -1, ramSize: -1, copier: -1}},
+		{"no ram", "ram: 0\ncopier: no\n", true, manifest{romSize: -1, ramSize: 0, copier: 0}},
+		{"sizes", "rom: 512KB\nram: 2048\n", true, manifest{romSize: 0x80000, ramSize: 0x800, copier: -1}},
+		{"unknown key", "mapping: hirom\nbogus: 1\n", false, manifest{}},
+		{"no separator", "mapping hirom\n", false, manifest{}},
+		{"no value", "ram:\n", false, manifest{}},
+		{"no key", ": hirom\n", false, manifest{}},
+		{"unknown mapping", "mapping: midrom\n", false, manifest{}},
+		{"unknown coprocessor", "coprocessor: gsu3\n", false, manifest{}},
+		{"unknown region", "region: secam\n", false, manifest{}},
+		{"bad copier", "copier: maybe\n", false, manifest{}},
+		{"unknown board", "board: NoSuchBoard\n", false, manifest{}},
+		{"rom too small", "rom: 16KB\n", false, manifest{}},
+		{"size too big", "ram: 32MB\n", false, manifest{}},
+		{"bad size unit", "ram: 8GB\n", false, manifest{}},
+		{"negative size", "ram: -1\n", false, manifest{}},
+		{"spc7110 lorom", "coprocessor: spc7110\nmapping: lorom\n", false, manifest{}},
+		{"spc7110 exhirom", "mapping: exhirom\ncoprocessor: spc7110rtc\n", false, manifest{}},
+		{"spc7110 hirom", "coprocessor: spc7110\nmapping: hirom\n", true,
+			manifest{cartType: 2, romSize: -1, ramSize: -1, coprocessor: "spc7110", copier: -1}},
+	}
+	for _, test := range tests {
+		m, err := parseManifest("test.manifest", []byte(test.text))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			if !strings.HasPrefix(err.Error(), "Failed to load rom: manifest test.manifest") {
+				t.Errorf("%s: error %q", test.name, err.Error())
+			}
+			continue
+		}
+		test.want.path = "test.manifest"
+		if *m != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, *m, test.want)
+		}
+	}
+}
+
+func TestManifestHeaderIndex(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cartType byte
+		copier   int
+		used     int
+		dataLen  int
+		want     int // -1: the rom is too small
+	}{
+		{"header kept", 0, -1, 3, 0x10200, 3},
+		{"lorom", 1, -1, 2, 0x10000, 0},
+		{"hirom", 2, -1, 0, 0x10000, 2},
+		{"hirom copier found", 2, -1, 0, 0x10200, 3},
+		{"hirom copier forced off", 2, 0, 0, 0x10200, 2},
+		{"copier forced on", 0, 1, 2, 0x10200, 3},
+		{"exlorom", 5, -1, 0, 0x408000, 4},
+		{"exhirom", 4, -1, 0, 0x410200, 7},
+		{"hirom too small", 2, -1, 0, 0x8000, -1},
+		{"exhirom too small", 4, -1, 2, 0x10000, -1},
+		{"copier too small", 1, 1, 0, 0x8000, -1},
+	}
+	for _, test := range tests {
+		var m *manifest = &manifest{path: "test.manifest", cartType: test.cartType, romSize: -1, ramSize: -1, copier: test.copier}
+		index, err := m.headerIndex(test.used, test.dataLen)
+		if test.want < 0 {
+			if err == nil {
+				t.Errorf("%s: header %d, want an error", test.name, index)
+			}
+			continue
+		}
+		if err != nil || index != test.want {
+			t.Errorf("%s: header %d (%v), want %d", test.name, index, err, test.want)
+		}
+	}
+}
+
+func TestManifestApply(t *testing.T) {
+	var tests = []struct {
+		name        string
+		text        string
+		cartType    byte // of the header before
+		wantType    byte
+		wantRAMSize uint32
+		wantPAL     bool
+	}{
+		{"hirom", "mapping: hirom\nram: 8KB\nregion: pal\n", 1, 2, 0x2000, true},
+		{"hirom keeps spc7110", "mapping: hirom\n", 3, 3, 0x400, false},
+		{"spc7110", "coprocessor: spc7110\n", 2, 3, 0x400, false},
+		{"spc7110 removed", "coprocessor: sa1\n", 3, 2, 0x400, false},
+	}
+	for _, test := range tests {
+		m, err := parseManifest("test.manifest", []byte(test.text))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var header CartridgeHeader = CartridgeHeader{cartType: test.cartType, ramSize: 0x400}
+		m.apply(&header)
+		if header.cartType != test.wantType || header.ramSize != test.wantRAMSize || header.pal != test.wantPAL {
+			t.Errorf("%s: type %d ram 0x%x pal %v", test.name, header.cartType, header.ramSize, header.pal)
+		}
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	var dir string = t.TempDir()
+	var romPath string = filepath.Join(dir, "game.sfc")
+
+	// no manifest
+	if m, err := loadManifest(romPath); m != nil || err != nil {
+		t.Errorf("no manifest: %v %v", m, err)
+	}
+
+	// a manifest that can't be read stops the loading
+	if err := os.Mkdir(filepath.Join(dir, "game.manifest"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var rom []byte = make([]byte, 0x10000)
+	err := NewConsole().LoadROM(romPath, rom, len(rom))
+	if err == nil || !strings.Contains(err.Error(), "game.manifest") {
+		t.Errorf("unreadable manifest: %v", err)
+	}
+}
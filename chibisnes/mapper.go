@@ -0,0 +1,97 @@
+package chibisnes
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Mapper is something on the cartridge bus. The board of a cartridge is a
+// Mapper answering the whole bus (LoROM, HiROM, ... or a chip doing the
+// mapping itself like the SA-1), the chips in front of it answer only their
+// part of the bus.
+type Mapper interface {
+	Read(bank byte, addr uint16) byte
+	Write(bank byte, addr uint16, value byte)
+	Reset()
+	Cycle() // runs for 2 master clocks
+	Serialize(s *serializer)
+	Close()
+}
+
+// Chip is a Mapper in front of the board, for the addresses it maps
+type Chip interface {
+	Mapper
+	Mapped(bank byte, addr uint16) bool
+}
+
+// mapperRegistration is a board or a chip in the registry. It is picked by
+// the board name of a rom database hit (header.board) or by match, which
+// looks at the header mapping mode (cartType) and chipset.
+type mapperRegistration struct {
+	name     string
+	priority int // boards matching the header are tried from the highest priority
+	match    func(header *CartridgeHeader) bool
+	// ram changes the cartridge ram size and the save file size (the ram
+	// with what is saved after it), nil to keep them
+	ram    func(header *CartridgeHeader, ramSize int, saveSize int) (int, int)
+	create func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error)
+}
+
+var (
+	boardRegistry []mapperRegistration
+	chipRegistry  []mapperRegistration
+)
+
+// registerBoard adds a board, called from init
+func registerBoard(registration mapperRegistration) {
+	boardRegistry = append(boardRegistry, registration)
+	sort.SliceStable(boardRegistry, func(i, j int) bool {
+		return boardRegistry[i].priority > boardRegistry[j].priority
+	})
+}
+
+// registerChip adds a chip, called from init
+func registerChip(registration mapperRegistration) {
+	chipRegistry = append(chipRegistry, registration)
+}
+
+// findBoard returns the board of a header, the one named by the rom
+// database if there is one
+func findBoard(header *CartridgeHeader) (*mapperRegistration, error) {
+	if header.board != "" {
+		for i := 0; i < len(boardRegistry); i++ {
+			if boardRegistry[i].name == header.board {
+				return &boardRegistry[i], nil
+			}
+		}
+	}
+	for i := 0; i < len(boardRegistry); i++ {
+		if boardRegistry[i].match != nil && boardRegistry[i].match(header) {
+			return &boardRegistry[i], nil
+		}
+	}
+	msg := fmt.Sprintf("Failed to load rom: no board for type %d, chipset $%x%x\n", header.cartType, header.coprocessor, header.chips)
+	return nil, errors.New(msg)
+}
+
+// isRegisteredBoard reports if name is the name of a board
+func isRegisteredBoard(name string) bool {
+	for i := 0; i < len(boardRegistry); i++ {
+		if boardRegistry[i].name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findChips returns the chips of a header
+func findChips(header *CartridgeHeader) []*mapperRegistration {
+	var found []*mapperRegistration
+	for i := 0; i < len(chipRegistry); i++ {
+		if chipRegistry[i].match(header) {
+			found = append(found, &chipRegistry[i])
+		}
+	}
+	return found
+}
@@ -0,0 +1,64 @@
+package chibisnes
+
+import "testing"
+
+// newTestCartridge sets up a cartridge on a bare console (only the open bus
+// is used by the boards) with a rom where every byte holds its rom bank
+func newTestCartridge(romSize int, ramSize int) *Cartridge {
+	var console *Console = &Console{openBus: 0xee}
+	var cartridge *Cartridge = NewCartridge(console)
+	cartridge.rom = make([]byte, romSize)
+	cartridge.romSize = uint32(romSize)
+	for i := 0; i < romSize; i++ {
+		cartridge.rom[i] = byte(i>>15) ^ byte(i)
+	}
+	if ramSize > 0 {
+		cartridge.ram = newVolatileSRAM(ramSize)
+		cartridge.ramSize = uint32(ramSize)
+	}
+	return cartridge
+}
+
+func TestBoardMapping(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cartType byte
+		bank     byte
+		addr     uint16
+		write    bool
+		value    byte
+	}{
+		// LoROM: 32KB rom banks at 8000-ffff, ram at 70-7d:0000-7fff
+		{"LoROM", 1, 0x00, 0x8000, false, 0x00},
+		{"LoROM", 1, 0x01, 0x8123, false, 0x22},
+		{"LoROM", 1, 0x81, 0xffff, false, 0xfe},
+		{"LoROM", 1, 0x00, 0x2000, false, 0xee},
+		{"LoROM", 1, 0x70, 0x0010, true, 0x5a},
+		// HiROM: 64KB rom banks, ram at 20-3f:6000-7fff
+		{"HiROM", 2, 0xc0, 0x1234, false, 0x34},
+		{"HiROM", 2, 0x01, 0x8000, false, 0x03},
+		{"HiROM", 2, 0x00, 0x4000, false, 0xee},
+		{"HiROM", 2, 0x20, 0x6010, true, 0xa5},
+	}
+	for _, test := range tests {
+		var cartridge *Cartridge = newTestCartridge(0x20000, 0x2000)
+		board, err := findBoard(&CartridgeHeader{cartType: test.cartType})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if board.name != test.name {
+			t.Fatalf("cart type %d picked %s, want %s", test.cartType, board.name, test.name)
+		}
+		mapper, err := board.create(cartridge, &CartridgeHeader{cartType: test.cartType})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.write {
+			mapper.Write(test.bank, test.addr, test.value)
+		}
+		if got := mapper.Read(test.bank, test.addr); got != test.value {
+			t.Errorf("%s %02x:%04x = %02x, want %02x", test.name, test.bank, test.addr, got, test.value)
+		}
+		mapper.Close()
+	}
+}
@@ -0,0 +1,335 @@
+package chibisnes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MSU1 is the MSU-1 expansion used by romhacks, at $2000-$2007. It streams
+// data from <rom>.msu and plays 44.1kHz 16 bit stereo pcm tracks from
+// <rom>-N.pcm ("MSU1", u32 loop sample, samples). The tracks are mixed into
+// the output of Console.SetAudioSamples.
+//
+// registers: $2000-$2003 data seek offset (w), $2000 status (r), $2001 data
+// port (r), $2002-$2007 "S-MSU1" (r), $2004-$2005 track (w), $2006 volume (w),
+// $2007 control (w): bit 0 play, bit 1 repeat, bit 2 resume.
+type MSU1 struct {
+	console *Console
+
+	basePath string // rom path without the extension
+
+	dataFile       *os.File
+	dataSeekOffset uint32
+	dataReadOffset uint32
+
+	audioFile         *os.File
+	audioSize         uint32
+	audioTrack        uint16
+	audioVolume       byte
+	audioPlayOffset   uint32
+	audioLoopOffset   uint32
+	audioResumeTrack  uint16
+	audioResumeOffset uint32
+	audioPlay         bool
+	audioRepeat       bool
+	audioError        bool
+
+	// pcm read cache
+	audioCache       [4096]byte
+	audioCacheOffset uint32
+	audioCacheSize   uint32
+
+	// samples generated this frame, at 44.1kHz
+	sampleBuffer  [1024 * 2]int16
+	sampleOffset  uint16
+	sampleCounter uint32 // master clocks * 44100
+}
+
+const (
+	msu1Revision  = 2
+	msu1Frequency = 44100
+)
+
+var msu1Identifier = [6]byte{'S', '-', 'M', 'S', 'U', '1'}
+
+// NewMSU1 returns the MSU-1 for the rom, or nil if there is neither a .msu
+// data file nor a .pcm track next to it
+func NewMSU1(console *Console, romFilePath string) *MSU1 {
+	var romDir string = filepath.Dir(filepath.Clean(romFilePath))
+	var romName string = getFileNameWithoutExtension(romFilePath)
+	var basePath string = filepath.Join(romDir, romName)
+	var tracks int = 0
+	entries, _ := os.ReadDir(romDir)
+	for _, entry := range entries {
+		var name string = entry.Name()
+		if strings.HasPrefix(name, romName+"-") && strings.HasSuffix(name, ".pcm") {
+			tracks++
+		}
+	}
+	_, err := os.Stat(basePath + ".msu")
+	if err != nil && tracks == 0 {
+		return nil
+	}
+
+	msu1 := &MSU1{
+		console:  console,
+		basePath: basePath,
+	}
+	if err == nil {
+		msu1.dataFile, err = os.Open(basePath + ".msu")
+		if err != nil {
+			log.Printf("MSU-1: data file open failed. Error: %s\n", err)
+		}
+	}
+	log.Printf("MSU-1: enabled, data file: %t, tracks: %d\n", msu1.dataFile != nil, tracks)
+	return msu1
+}
+
+func (msu1 *MSU1) Reset() {
+	msu1.dataSeekOffset = 0
+	msu1.dataReadOffset = 0
+	msu1.closeAudio()
+	msu1.audioTrack = 0
+	msu1.audioVolume = 0
+	msu1.audioPlayOffset = 0
+	msu1.audioLoopOffset = 0
+	msu1.audioResumeTrack = 0xffff
+	msu1.audioResumeOffset = 0
+	msu1.audioPlay = false
+	msu1.audioRepeat = false
+	msu1.audioError = false
+	msu1.sampleOffset = 0
+	msu1.sampleCounter = 0
+}
+
+func (msu1 *MSU1) Close() {
+	msu1.closeAudio()
+	if msu1.dataFile != nil {
+		msu1.dataFile.Close()
+		msu1.dataFile = nil
+	}
+}
+
+func (msu1 *MSU1) Read(addr uint16) byte {
+	switch addr & 7 {
+	case 0:
+		// data and audio are never busy, files are read right away
+		var value byte = msu1Revision
+		if msu1.audioRepeat {
+			value |= 0x20
+		}
+		if msu1.audioPlay {
+			value |= 0x10
+		}
+		if msu1.audioError {
+			value |= 0x08
+		}
+		return value
+	case 1:
+		if msu1.dataFile == nil {
+			return 0
+		}
+		var value [1]byte
+		if n, _ := msu1.dataFile.ReadAt(value[:], int64(msu1.dataReadOffset)); n == 0 {
+			return 0
+		}
+		msu1.dataReadOffset++
+		return value[0]
+	}
+	return msu1Identifier[(addr&7)-2]
+}
+
+func (msu1 *MSU1) Write(addr uint16, value byte) {
+	switch addr & 7 {
+	case 0:
+		msu1.dataSeekOffset = (msu1.dataSeekOffset & 0xffffff00) | uint32(value)
+	case 1:
+		msu1.dataSeekOffset = (msu1.dataSeekOffset & 0xffff00ff) | uint32(value)<<8
+	case 2:
+		msu1.dataSeekOffset = (msu1.dataSeekOffset & 0xff00ffff) | uint32(value)<<16
+	case 3:
+		msu1.dataSeekOffset = (msu1.dataSeekOffset & 0x00ffffff) | uint32(value)<<24
+		msu1.dataReadOffset = msu1.dataSeekOffset
+	case 4:
+		msu1.audioTrack = (msu1.audioTrack & 0xff00) | uint16(value)
+	case 5:
+		msu1.audioTrack = (msu1.audioTrack & 0x00ff) | uint16(value)<<8
+		msu1.openAudio()
+		if msu1.audioResumeTrack == msu1.audioTrack {
+			msu1.audioPlayOffset = msu1.audioResumeOffset
+			msu1.audioResumeTrack = 0xffff
+			msu1.audioResumeOffset = 0
+		} else {
+			msu1.audioPlayOffset = 8
+		}
+		msu1.audioPlay = false
+		msu1.audioRepeat = false
+	case 6:
+		msu1.audioVolume = value
+	case 7:
+		if msu1.audioError {
+			break
+		}
+		msu1.audioPlay = (value & 1) > 0
+		msu1.audioRepeat = (value & 2) > 0
+		if !msu1.audioPlay && (value&4) > 0 {
+			msu1.audioResumeTrack = msu1.audioTrack
+			msu1.audioResumeOffset = msu1.audioPlayOffset
+		}
+	}
+}
+
+// openAudio opens the pcm file of the selected track
+func (msu1 *MSU1) openAudio() {
+	msu1.closeAudio()
+	msu1.audioError = true
+	file, err := os.Open(msu1.trackFilePath())
+	if err != nil {
+		return
+	}
+	info, err := file.Stat()
+	var header [8]byte
+	if err != nil || info.Size() < 8 || info.Size() > 0xffffffff {
+		file.Close()
+		return
+	}
+	if _, err := file.ReadAt(header[:], 0); err != nil || string(header[:4]) != "MSU1" {
+		file.Close()
+		return
+	}
+	msu1.audioFile = file
+	msu1.audioSize = uint32(info.Size())
+	msu1.audioLoopOffset = 8 + binary.LittleEndian.Uint32(header[4:])*4
+	if msu1.audioLoopOffset > msu1.audioSize {
+		msu1.audioLoopOffset = 8
+	}
+	msu1.audioError = false
+}
+
+func (msu1 *MSU1) closeAudio() {
+	if msu1.audioFile != nil {
+		msu1.audioFile.Close()
+		msu1.audioFile = nil
+	}
+	msu1.audioSize = 0
+	msu1.audioCacheSize = 0
+}
+
+func (msu1 *MSU1) trackFilePath() string {
+	return fmt.Sprintf("%s-%d.pcm", msu1.basePath, msu1.audioTrack)
+}
+
+// readAudio reads the stereo sample at offset in the track
+func (msu1 *MSU1) readAudio(offset uint32) (int16, int16) {
+	if offset < msu1.audioCacheOffset || offset+4 > msu1.audioCacheOffset+msu1.audioCacheSize {
+		n, err := msu1.audioFile.ReadAt(msu1.audioCache[:], int64(offset))
+		if err != nil && err != io.EOF {
+			n = 0
+		}
+		msu1.audioCacheOffset = offset
+		msu1.audioCacheSize = uint32(n)
+		if n < 4 {
+			return 0, 0
+		}
+	}
+	var data []byte = msu1.audioCache[offset-msu1.audioCacheOffset:]
+	return int16(binary.LittleEndian.Uint16(data)), int16(binary.LittleEndian.Uint16(data[2:]))
+}
+
+// Cycle runs for 2 master clocks, generating samples at 44.1kHz
+func (msu1 *MSU1) Cycle() {
+	var masterClock uint32 = 21477272
+	if msu1.console.pal {
+		masterClock = 21281370
+	}
+	msu1.sampleCounter += msu1Frequency * 2
+	if msu1.sampleCounter < masterClock {
+		return
+	}
+	msu1.sampleCounter -= masterClock
+
+	var left, right int16
+	if msu1.audioPlay {
+		if msu1.audioFile == nil {
+			msu1.audioPlay = false
+		} else if msu1.audioPlayOffset+4 > msu1.audioSize {
+			if msu1.audioRepeat {
+				msu1.audioPlayOffset = msu1.audioLoopOffset
+			} else {
+				msu1.audioPlay = false
+				msu1.audioPlayOffset = 8
+			}
+		} else {
+			left, right = msu1.readAudio(msu1.audioPlayOffset)
+			msu1.audioPlayOffset += 4
+		}
+	}
+
+	msu1.sampleBuffer[msu1.sampleOffset*2] = int16((int32(left) * int32(msu1.audioVolume)) / 255)
+	msu1.sampleBuffer[msu1.sampleOffset*2+1] = int16((int32(right) * int32(msu1.audioVolume)) / 255)
+	// prevent sampleOffset from going out of sampleBuffer bounds
+	if msu1.sampleOffset < 1023 {
+		msu1.sampleOffset++
+	}
+}
+
+// mixSamples adds the samples of this frame to sampleData, resampled to
+// samplesPerFrame
+func (msu1 *MSU1) mixSamples(sampleData []int16, samplesPerFrame int) {
+	mixSampleBuffer(sampleData, samplesPerFrame, msu1.sampleBuffer[:msu1.sampleOffset*2])
+	msu1.sampleOffset = 0
+}
+
+// mixSampleBuffer adds the stereo samples of buffer to sampleData,
+// resampled to samplesPerFrame
+func mixSampleBuffer(sampleData []int16, samplesPerFrame int, buffer []int16) {
+	if len(buffer) < 2 {
+		return
+	}
+	var adder float64 = float64(len(buffer)/2) / float64(samplesPerFrame)
+	var location float64 = 0.0
+	for i := 0; i < samplesPerFrame; i++ {
+		for j := 0; j < 2; j++ {
+			var sample int32 = int32(sampleData[i*2+j]) + int32(buffer[int(location)*2+j])
+			if sample > 0x7fff {
+				sample = 0x7fff
+			} else if sample < -0x8000 {
+				sample = -0x8000
+			}
+			sampleData[i*2+j] = int16(sample)
+		}
+		location += adder
+	}
+}
+
+func (msu1 *MSU1) serialize(s *serializer) {
+	var audioTrack uint16 = msu1.audioTrack
+	s.u32(&msu1.dataSeekOffset)
+	s.u32(&msu1.dataReadOffset)
+	s.u16(&msu1.audioTrack)
+	s.u8(&msu1.audioVolume)
+	s.u32(&msu1.audioPlayOffset)
+	s.u32(&msu1.audioLoopOffset)
+	s.u16(&msu1.audioResumeTrack)
+	s.u32(&msu1.audioResumeOffset)
+	s.bool(&msu1.audioPlay)
+	s.bool(&msu1.audioRepeat)
+	s.bool(&msu1.audioError)
+	s.i16s(msu1.sampleBuffer[:])
+	s.u16(&msu1.sampleOffset)
+	s.u32(&msu1.sampleCounter)
+
+	if s.loading && (audioTrack != msu1.audioTrack || msu1.audioFile == nil) {
+		// reopen the track of the state, keeping its loop point
+		var audioLoopOffset uint32 = msu1.audioLoopOffset
+		var audioError bool = msu1.audioError
+		msu1.openAudio()
+		msu1.audioLoopOffset = audioLoopOffset
+		msu1.audioError = audioError
+	}
+}
@@ -0,0 +1,768 @@
+package chibisnes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NECDSP is the NEC uPD77C25 (DSP-1, DSP-1B, DSP-2, DSP-3, DSP-4) and
+// uPD96050 (ST010, ST011) fixed point DSP. The program and data rom are not
+// in the game rom, they are loaded from a firmware file next to it (e.g.
+// dsp1b.rom: 2048 24 bit program words then 1024 16 bit data words, little
+// endian).
+type NECDSP struct {
+	cartridge *Cartridge
+
+	name      string // firmware name, e.g. "dsp1b"
+	upd96050  bool
+	frequency int64 // instructions per second
+	clock     int64 // master clocks * frequency left to run
+
+	programROM []uint32 // 24 bit
+	dataROM    []uint16
+	dataRAM    *SRAM // 16 bit little endian words, battery backed on the ST010
+
+	pcMask    uint16
+	rpMask    uint16
+	dpMask    uint16
+	stackMask byte
+
+	// where the S-CPU sees the chip
+	bankLow  byte
+	bankHigh byte
+	addrLow  uint16
+	addrHigh uint16
+	srSelect uint16 // address bit that selects SR instead of DR
+	ramBank  byte   // ST01x data ram at ramBank-(ramBank+7):0000-7fff, 0 if not mapped
+
+	stack [16]uint16
+	pc    uint16
+	rp    uint16
+	dp    uint16
+	sp    byte
+
+	k uint16
+	l uint16
+	m uint16
+	n uint16
+	a uint16
+	b uint16
+
+	flagA necDSPFlags
+	flagB necDSPFlags
+
+	tr  uint16
+	trb uint16
+	sr  uint16
+	dr  uint16
+	si  uint16
+	so  uint16
+}
+
+type necDSPFlags struct {
+	ov0 bool
+	ov1 bool
+	z   bool
+	c   bool
+	s0  bool
+	s1  bool
+}
+
+// SR bits
+const (
+	necDSPSRRQM  = 0x8000
+	necDSPSRUSF1 = 0x4000
+	necDSPSRUSF0 = 0x2000
+	necDSPSRDRS  = 0x1000
+	necDSPSRDMA  = 0x0800
+	necDSPSRDRC  = 0x0400
+	necDSPSRSOC  = 0x0200
+	necDSPSRSIC  = 0x0100
+	necDSPSREI   = 0x0080
+	necDSPSRP1   = 0x0002
+	necDSPSRP0   = 0x0001
+)
+
+func init() {
+	registerChip(mapperRegistration{
+		name: "DSP",
+		match: func(header *CartridgeHeader) bool {
+			return (header.coprocessor == 0 && header.chips >= 3 && header.chips <= 5) || isST01xHeader(header)
+		},
+		ram: func(header *CartridgeHeader, ramSize int, saveSize int) (int, int) {
+			if isST01xHeader(header) {
+				// ST010/ST011: the only ram is the DSP data ram
+				return 0, 0
+			}
+			return ramSize, saveSize
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			dsp, err := NewNECDSP(cartridge, header)
+			if err != nil {
+				return nil, err
+			}
+			return dsp, nil
+		},
+	})
+}
+
+// isST01xHeader reports if the header is the one of a ST010/ST011 game,
+// chipset $f5 with $01 in the extended header
+func isST01xHeader(header *CartridgeHeader) bool {
+	return header.coprocessor == 0xf && header.exCoprocessor == 0x01
+}
+
+func NewNECDSP(cartridge *Cartridge, header *CartridgeHeader) (*NECDSP, error) {
+	dsp := &NECDSP{
+		cartridge: cartridge,
+	}
+
+	var name string = strings.TrimSpace(string(header.name[:21]))
+	if header.coprocessor == 0xf {
+		// ST010 (F1 ROC II, 1MB) or ST011 (Morita Shogi, 512KB)
+		if header.romSize >= 0x100000 {
+			dsp.name = "st010"
+			dsp.frequency = 11000000
+		} else {
+			dsp.name = "st011"
+			dsp.frequency = 15000000
+		}
+		dsp.upd96050 = true
+		dsp.bankLow, dsp.bankHigh = 0x60, 0x67
+		dsp.addrLow, dsp.addrHigh = 0x0000, 0x3fff
+		dsp.srSelect = 0x0001
+		dsp.ramBank = 0x68
+	} else {
+		dsp.frequency = 7600000
+		switch {
+		case strings.HasPrefix(name, "DUNGEON MASTER"):
+			dsp.name = "dsp2"
+			dsp.bankLow, dsp.bankHigh = 0x20, 0x3f
+		case strings.HasPrefix(name, "SD GUNDAM GX"):
+			dsp.name = "dsp3"
+			dsp.bankLow, dsp.bankHigh = 0x20, 0x3f
+		case strings.HasPrefix(name, "TOP GEAR 3000") || strings.HasPrefix(name, "PLANETS CHAMP TG3000"):
+			dsp.name = "dsp4"
+			dsp.bankLow, dsp.bankHigh = 0x30, 0x3f
+		default:
+			// DSP-1, Pilotwings only works with the original revision
+			if strings.HasPrefix(name, "PILOTWINGS") {
+				dsp.name = "dsp1"
+			} else {
+				dsp.name = "dsp1b"
+			}
+			dsp.bankLow, dsp.bankHigh = 0x30, 0x3f
+		}
+		dsp.addrLow, dsp.addrHigh = 0x8000, 0xffff
+		dsp.srSelect = 0x4000
+
+		if header.cartType == 2 {
+			// HiROM boards: 00-1f:6000-6fff DR, 7000-7fff SR
+			dsp.bankLow, dsp.bankHigh = 0x00, 0x1f
+			dsp.addrLow, dsp.addrHigh = 0x6000, 0x7fff
+			dsp.srSelect = 0x1000
+		} else if header.romSize > 0x100000 {
+			// large LoROM boards: 60-6f:0000-3fff DR, 4000-7fff SR
+			dsp.bankLow, dsp.bankHigh = 0x60, 0x6f
+			dsp.addrLow, dsp.addrHigh = 0x0000, 0x7fff
+		}
+	}
+
+	var programSize, dataROMSize, dataRAMSize int
+	if dsp.upd96050 {
+		programSize, dataROMSize, dataRAMSize = 16384, 2048, 2048
+		dsp.pcMask, dsp.rpMask, dsp.dpMask, dsp.stackMask = 0x3fff, 0x7ff, 0x7ff, 15
+	} else {
+		programSize, dataROMSize, dataRAMSize = 2048, 1024, 256
+		dsp.pcMask, dsp.rpMask, dsp.dpMask, dsp.stackMask = 0x7ff, 0x3ff, 0xff, 3
+	}
+
+	if err := dsp.loadFirmware(programSize, dataROMSize); err != nil {
+		return nil, err
+	}
+
+	if dsp.name == "st010" {
+		// the ST010 data ram is battery backed
+		dsp.dataRAM = NewSRAM(cartridge.saveFilePath(), dataRAMSize*2)
+	}
+	if dsp.dataRAM == nil {
+		dsp.dataRAM = newVolatileSRAM(dataRAMSize * 2)
+	}
+
+	log.Printf("ROM: NEC DSP enabled, firmware: %s\n", dsp.name)
+
+	return dsp, nil
+}
+
+func (dsp *NECDSP) loadFirmware(programSize int, dataROMSize int) error {
+	var names []string = []string{dsp.name}
+	if dsp.name == "dsp1" {
+		names = append(names, "dsp1b")
+	} else if dsp.name == "dsp1b" {
+		names = append(names, "dsp1")
+	}
+
+	var romDir string = filepath.Dir(filepath.Clean(dsp.cartridge.console.RomFilePath))
+	var data []byte
+	var err error
+	for _, name := range names {
+		data, err = os.ReadFile(filepath.Join(romDir, name+".rom"))
+		if err == nil {
+			dsp.name = name
+			break
+		}
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to load rom: DSP firmware %s.rom not found next to the rom\n", dsp.name)
+		return errors.New(msg)
+	}
+
+	var size int = programSize*3 + dataROMSize*2
+	if len(data) < size {
+		msg := fmt.Sprintf("Failed to load rom: DSP firmware %s.rom is %d bytes, want %d\n", dsp.name, len(data), size)
+		return errors.New(msg)
+	}
+
+	dsp.programROM = make([]uint32, programSize)
+	for i := 0; i < programSize; i++ {
+		dsp.programROM[i] = uint32(data[i*3]) | (uint32(data[i*3+1]) << 8) | (uint32(data[i*3+2]) << 16)
+	}
+	var offset int = programSize * 3
+	dsp.dataROM = make([]uint16, dataROMSize)
+	for i := 0; i < dataROMSize; i++ {
+		dsp.dataROM[i] = uint16(data[offset+i*2]) | (uint16(data[offset+i*2+1]) << 8)
+	}
+
+	return nil
+}
+
+func (dsp *NECDSP) Reset() {
+	for i := 0; i < len(dsp.stack); i++ {
+		dsp.stack[i] = 0
+	}
+	dsp.pc = 0
+	dsp.rp = 0
+	dsp.dp = 0
+	dsp.sp = 0
+	dsp.k = 0
+	dsp.l = 0
+	dsp.m = 0
+	dsp.n = 0
+	dsp.a = 0
+	dsp.b = 0
+	dsp.flagA = necDSPFlags{}
+	dsp.flagB = necDSPFlags{}
+	dsp.tr = 0
+	dsp.trb = 0
+	dsp.sr = 0
+	dsp.dr = 0
+	dsp.si = 0
+	dsp.so = 0
+	dsp.clock = 0
+}
+
+// Cycle runs the DSP for 2 master cycles
+func (dsp *NECDSP) Cycle() {
+	// 21.477 MHz master clock
+	dsp.clock += 2 * dsp.frequency
+	for dsp.clock >= 21477272 {
+		dsp.clock -= 21477272
+		dsp.exec()
+	}
+}
+
+// S-CPU side
+
+// Mapped reports if the chip answers at this address
+func (dsp *NECDSP) Mapped(bank byte, addr uint16) bool {
+	bank &= 0x7f
+	if bank >= dsp.bankLow && bank <= dsp.bankHigh && addr >= dsp.addrLow && addr <= dsp.addrHigh {
+		return true
+	}
+	if dsp.ramBank > 0 && bank >= dsp.ramBank && bank <= dsp.ramBank+7 && addr < 0x8000 {
+		return true
+	}
+	return false
+}
+
+func (dsp *NECDSP) Read(bank byte, addr uint16) byte {
+	if dsp.ramBank > 0 && (bank&0x7f) >= dsp.ramBank {
+		return dsp.readDP(addr)
+	}
+	if (addr & dsp.srSelect) > 0 {
+		return dsp.readSR()
+	}
+	return dsp.readDR()
+}
+
+func (dsp *NECDSP) Write(bank byte, addr uint16, value byte) {
+	if dsp.ramBank > 0 && (bank&0x7f) >= dsp.ramBank {
+		dsp.writeDP(addr, value)
+		return
+	}
+	if (addr & dsp.srSelect) > 0 {
+		// SR is read only
+		return
+	}
+	dsp.writeDR(value)
+}
+
+func (dsp *NECDSP) readSR() byte {
+	return byte(dsp.sr >> 8)
+}
+
+func (dsp *NECDSP) readDR() byte {
+	if (dsp.sr & necDSPSRDRC) == 0 {
+		// 16 bit
+		if (dsp.sr & necDSPSRDRS) == 0 {
+			dsp.sr |= necDSPSRDRS
+			return byte(dsp.dr)
+		}
+		dsp.sr &= ^uint16(necDSPSRRQM | necDSPSRDRS)
+		return byte(dsp.dr >> 8)
+	}
+	// 8 bit
+	dsp.sr &= ^uint16(necDSPSRRQM)
+	return byte(dsp.dr)
+}
+
+func (dsp *NECDSP) writeDR(value byte) {
+	if (dsp.sr & necDSPSRDRC) == 0 {
+		// 16 bit
+		if (dsp.sr & necDSPSRDRS) == 0 {
+			dsp.sr |= necDSPSRDRS
+			dsp.dr = (dsp.dr & 0xff00) | uint16(value)
+			return
+		}
+		dsp.sr &= ^uint16(necDSPSRRQM | necDSPSRDRS)
+		dsp.dr = (uint16(value) << 8) | (dsp.dr & 0x00ff)
+		return
+	}
+	// 8 bit
+	dsp.sr &= ^uint16(necDSPSRRQM)
+	dsp.dr = (dsp.dr & 0xff00) | uint16(value)
+}
+
+func (dsp *NECDSP) readDP(addr uint16) byte {
+	return dsp.dataRAM.Read(uint32(addr) & uint32(dsp.dpMask*2+1))
+}
+
+func (dsp *NECDSP) writeDP(addr uint16, value byte) {
+	dsp.dataRAM.Write(uint32(addr)&uint32(dsp.dpMask*2+1), value)
+}
+
+// DSP side
+
+func (dsp *NECDSP) readRAM(addr uint16) uint16 {
+	var offset uint32 = uint32(addr&dsp.dpMask) * 2
+	return uint16(dsp.dataRAM.Read(offset)) | (uint16(dsp.dataRAM.Read(offset+1)) << 8)
+}
+
+func (dsp *NECDSP) writeRAM(addr uint16, value uint16) {
+	var offset uint32 = uint32(addr&dsp.dpMask) * 2
+	dsp.dataRAM.Write(offset, byte(value))
+	dsp.dataRAM.Write(offset+1, byte(value>>8))
+}
+
+func (dsp *NECDSP) exec() {
+	var opcode uint32 = dsp.programROM[dsp.pc]
+	dsp.pc = (dsp.pc + 1) & dsp.pcMask
+
+	switch opcode >> 22 {
+	case 0:
+		dsp.execOP(opcode)
+	case 1:
+		dsp.execRT(opcode)
+	case 2:
+		dsp.execJP(opcode)
+	case 3:
+		dsp.execLD(opcode)
+	}
+
+	// the multiplier runs every instruction: sign + 30 bit result
+	var result int32 = int32(int16(dsp.k)) * int32(int16(dsp.l))
+	dsp.m = uint16(result >> 15)
+	dsp.n = uint16(result << 1)
+}
+
+func (dsp *NECDSP) execOP(opcode uint32) {
+	var pselect byte = byte(opcode>>20) & 3  // P select
+	var alu byte = byte(opcode>>16) & 15     // ALU operation
+	var asl byte = byte(opcode>>15) & 1      // accumulator select
+	var dpl byte = byte(opcode>>13) & 3      // DP low modify
+	var dphm uint16 = uint16(opcode>>9) & 15 // DP high xor modify
+	var rpdcr bool = ((opcode >> 8) & 1) > 0 // RP decrement
+	var src byte = byte(opcode>>4) & 15      // move source
+	var dst byte = byte(opcode) & 15         // move destination
+
+	var idb uint16
+	switch src {
+	case 0:
+		idb = dsp.trb
+	case 1:
+		idb = dsp.a
+	case 2:
+		idb = dsp.b
+	case 3:
+		idb = dsp.tr
+	case 4:
+		idb = dsp.dp
+	case 5:
+		idb = dsp.rp
+	case 6:
+		idb = dsp.dataROM[dsp.rp]
+	case 7:
+		idb = 0x8000
+		if dsp.flagA.s1 {
+			idb--
+		}
+	case 8:
+		idb = dsp.dr
+		dsp.sr |= necDSPSRRQM
+	case 9:
+		idb = dsp.dr
+	case 10:
+		idb = dsp.sr
+	case 11, 12:
+		idb = dsp.si
+	case 13:
+		idb = dsp.k
+	case 14:
+		idb = dsp.l
+	case 15:
+		idb = dsp.readRAM(dsp.dp)
+	}
+
+	if alu > 0 {
+		var p, q, r uint16
+		var flag necDSPFlags
+		var c uint16
+
+		switch pselect {
+		case 0:
+			p = dsp.readRAM(dsp.dp)
+		case 1:
+			p = idb
+		case 2:
+			p = dsp.m
+		case 3:
+			p = dsp.n
+		}
+
+		if asl == 0 {
+			q = dsp.a
+			flag = dsp.flagA
+			if dsp.flagB.c {
+				c = 1
+			}
+		} else {
+			q = dsp.b
+			flag = dsp.flagB
+			if dsp.flagA.c {
+				c = 1
+			}
+		}
+
+		switch alu {
+		case 1:
+			r = q | p // OR
+		case 2:
+			r = q & p // AND
+		case 3:
+			r = q ^ p // XOR
+		case 4:
+			r = q - p // SUB
+		case 5:
+			r = q + p // ADD
+		case 6:
+			r = q - p - c // SBB
+		case 7:
+			r = q + p + c // ADC
+		case 8:
+			r = q - 1 // DEC
+			p = 1
+		case 9:
+			r = q + 1 // INC
+			p = 1
+		case 10:
+			r = ^q // CMP
+		case 11:
+			r = (q >> 1) | (q & 0x8000) // SHR1
+		case 12:
+			r = (q << 1) | c // SHL1
+		case 13:
+			r = (q << 2) | 3 // SHL2
+		case 14:
+			r = (q << 4) | 15 // SHL4
+		case 15:
+			r = (q << 8) | (q >> 8) // XCHG
+		}
+
+		flag.s0 = (r & 0x8000) > 0
+		flag.z = r == 0
+		if !flag.ov1 {
+			flag.s1 = flag.s0
+		}
+
+		switch alu {
+		case 1, 2, 3, 10, 13, 14, 15:
+			flag.c = false
+			flag.ov0 = false
+			flag.ov1 = false
+		case 4, 5, 6, 7, 8, 9:
+			if (alu & 1) > 0 {
+				// addition
+				flag.ov0 = ((q ^ r) & ^(q ^ p) & 0x8000) > 0
+				flag.c = r < q
+			} else {
+				// subtraction
+				flag.ov0 = ((q ^ r) & (q ^ p) & 0x8000) > 0
+				flag.c = r > q
+			}
+			if flag.ov0 && flag.ov1 {
+				flag.ov1 = flag.s1 == flag.s0
+			} else {
+				flag.ov1 = flag.ov0 || flag.ov1
+			}
+		case 11:
+			flag.c = (q & 1) > 0
+			flag.ov0 = false
+			flag.ov1 = false
+		case 12:
+			flag.c = (q >> 15) > 0
+			flag.ov0 = false
+			flag.ov1 = false
+		}
+
+		if asl == 0 {
+			dsp.a = r
+			dsp.flagA = flag
+		} else {
+			dsp.b = r
+			dsp.flagB = flag
+		}
+	}
+
+	dsp.load(idb, dst)
+
+	switch dpl {
+	case 1:
+		dsp.dp = (dsp.dp & 0xfff0) | ((dsp.dp + 1) & 0x0f) // DPINC
+	case 2:
+		dsp.dp = (dsp.dp & 0xfff0) | ((dsp.dp - 1) & 0x0f) // DPDEC
+	case 3:
+		dsp.dp = dsp.dp & 0xfff0 // DPCLR
+	}
+	dsp.dp = (dsp.dp ^ (dphm << 4)) & dsp.dpMask
+
+	if rpdcr {
+		dsp.rp = (dsp.rp - 1) & dsp.rpMask
+	}
+}
+
+func (dsp *NECDSP) execRT(opcode uint32) {
+	dsp.execOP(opcode)
+	dsp.sp = (dsp.sp - 1) & dsp.stackMask
+	dsp.pc = dsp.stack[dsp.sp] & dsp.pcMask
+}
+
+func (dsp *NECDSP) execJP(opcode uint32) {
+	var brch uint16 = uint16(opcode>>13) & 0x1ff // branch
+	var na uint16 = uint16(opcode>>2) & 0x7ff    // next address
+	var bank uint16 = uint16(opcode) & 3         // bank address
+
+	var jp uint16 = (dsp.pc & 0x2000) | (bank << 11) | na
+	var take bool
+
+	switch brch {
+	case 0x000:
+		// JMPSO
+		dsp.pc = dsp.so & dsp.pcMask
+		return
+	case 0x080:
+		take = !dsp.flagA.c // JNCA
+	case 0x082:
+		take = dsp.flagA.c // JCA
+	case 0x084:
+		take = !dsp.flagB.c // JNCB
+	case 0x086:
+		take = dsp.flagB.c // JCB
+	case 0x088:
+		take = !dsp.flagA.z // JNZA
+	case 0x08a:
+		take = dsp.flagA.z // JZA
+	case 0x08c:
+		take = !dsp.flagB.z // JNZB
+	case 0x08e:
+		take = dsp.flagB.z // JZB
+	case 0x090:
+		take = !dsp.flagA.ov0 // JNOVA0
+	case 0x092:
+		take = dsp.flagA.ov0 // JOVA0
+	case 0x094:
+		take = !dsp.flagB.ov0 // JNOVB0
+	case 0x096:
+		take = dsp.flagB.ov0 // JOVB0
+	case 0x098:
+		take = !dsp.flagA.ov1 // JNOVA1
+	case 0x09a:
+		take = dsp.flagA.ov1 // JOVA1
+	case 0x09c:
+		take = !dsp.flagB.ov1 // JNOVB1
+	case 0x09e:
+		take = dsp.flagB.ov1 // JOVB1
+	case 0x0a0:
+		take = !dsp.flagA.s0 // JNSA0
+	case 0x0a2:
+		take = dsp.flagA.s0 // JSA0
+	case 0x0a4:
+		take = !dsp.flagB.s0 // JNSB0
+	case 0x0a6:
+		take = dsp.flagB.s0 // JSB0
+	case 0x0a8:
+		take = !dsp.flagA.s1 // JNSA1
+	case 0x0aa:
+		take = dsp.flagA.s1 // JSA1
+	case 0x0ac:
+		take = !dsp.flagB.s1 // JNSB1
+	case 0x0ae:
+		take = dsp.flagB.s1 // JSB1
+	case 0x0b0:
+		take = (dsp.dp & 0x0f) == 0x00 // JDPL0
+	case 0x0b1:
+		take = (dsp.dp & 0x0f) != 0x00 // JDPLN0
+	case 0x0b2:
+		take = (dsp.dp & 0x0f) == 0x0f // JDPLF
+	case 0x0b3:
+		take = (dsp.dp & 0x0f) != 0x0f // JDPLNF
+	case 0x0b4, 0x0b8:
+		take = true // JNSIAK, JNSOAK: serial port is not connected
+	case 0x0b6, 0x0ba:
+		take = false // JSIAK, JSOAK
+	case 0x0bc:
+		take = (dsp.sr & necDSPSRRQM) == 0 // JNRQM
+	case 0x0be:
+		take = (dsp.sr & necDSPSRRQM) > 0 // JRQM
+	case 0x100:
+		// LJMP
+		dsp.pc = (jp & ^uint16(0x2000)) & dsp.pcMask
+		return
+	case 0x101:
+		// HJMP
+		dsp.pc = (jp | 0x2000) & dsp.pcMask
+		return
+	case 0x140:
+		// LCALL
+		dsp.push()
+		dsp.pc = (jp & ^uint16(0x2000)) & dsp.pcMask
+		return
+	case 0x141:
+		// HCALL
+		dsp.push()
+		dsp.pc = (jp | 0x2000) & dsp.pcMask
+		return
+	}
+
+	if take {
+		dsp.pc = jp & dsp.pcMask
+	}
+}
+
+func (dsp *NECDSP) push() {
+	dsp.stack[dsp.sp] = dsp.pc
+	dsp.sp = (dsp.sp + 1) & dsp.stackMask
+}
+
+func (dsp *NECDSP) execLD(opcode uint32) {
+	var id uint16 = uint16(opcode >> 6)
+	var dst byte = byte(opcode) & 15
+	dsp.load(id, dst)
+}
+
+func (dsp *NECDSP) load(value uint16, dst byte) {
+	switch dst {
+	case 0:
+		// none
+	case 1:
+		dsp.a = value
+	case 2:
+		dsp.b = value
+	case 3:
+		dsp.tr = value
+	case 4:
+		dsp.dp = value & dsp.dpMask
+	case 5:
+		dsp.rp = value & dsp.rpMask
+	case 6:
+		dsp.dr = value
+		dsp.sr |= necDSPSRRQM
+	case 7:
+		// RQM, DRS and the unused bits can't be written
+		dsp.sr = (dsp.sr & 0x907c) | (value & ^uint16(0x907c))
+	case 8:
+		// serial out, lsb first
+		var reversed uint16 = 0
+		for i := 0; i < 16; i++ {
+			reversed |= ((value >> i) & 1) << (15 - i)
+		}
+		dsp.so = reversed
+	case 9:
+		dsp.so = value // serial out, msb first
+	case 10:
+		dsp.k = value
+	case 11:
+		dsp.k = value
+		dsp.l = dsp.dataROM[dsp.rp]
+	case 12:
+		dsp.l = value
+		dsp.k = dsp.readRAM(dsp.dp | 0x40)
+	case 13:
+		dsp.l = value
+	case 14:
+		dsp.trb = value
+	case 15:
+		dsp.writeRAM(dsp.dp, value)
+	}
+}
+
+func (dsp *NECDSP) Close() {
+	dsp.dataRAM.Close()
+}
+
+func (dsp *NECDSP) Serialize(s *serializer) {
+	s.u16s(dsp.stack[:])
+	s.u16(&dsp.pc)
+	s.u16(&dsp.rp)
+	s.u16(&dsp.dp)
+	s.u8(&dsp.sp)
+	s.u16(&dsp.k)
+	s.u16(&dsp.l)
+	s.u16(&dsp.m)
+	s.u16(&dsp.n)
+	s.u16(&dsp.a)
+	s.u16(&dsp.b)
+	for _, flag := range []*necDSPFlags{&dsp.flagA, &dsp.flagB} {
+		s.bool(&flag.ov0)
+		s.bool(&flag.ov1)
+		s.bool(&flag.z)
+		s.bool(&flag.c)
+		s.bool(&flag.s0)
+		s.bool(&flag.s1)
+	}
+	s.u16(&dsp.tr)
+	s.u16(&dsp.trb)
+	s.u16(&dsp.sr)
+	s.u16(&dsp.dr)
+	s.u16(&dsp.si)
+	s.u16(&dsp.so)
+
+	var clock uint64 = uint64(dsp.clock)
+	s.u64(&clock)
+	dsp.clock = int64(clock)
+
+	dsp.dataRAM.serialize(s)
+}
@@ -0,0 +1,315 @@
+package chibisnes
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// NintendoPower is the Nintendo Power flash cartridge (MX15001TFC mapper,
+// 4MB of flash, 32KB of ram). After a reset the cartridge is in menu mode:
+// the whole flash is mapped as LoROM, with the menu in the first 512KB, and
+// all of the ram at 70-7d,f0-ff:0000-7fff. The menu writes the mapping of a
+// game to the registers and switches to it, the game then only sees its part
+// of the flash and of the ram until the next reset.
+//
+// registers (00-3f,80-bf:2400-2407):
+// $2400 (w) command: $09 unlock the mapping registers, $0a lock them, $80
+// switch to the game
+// $2401 (r) status: bit 0 game mode, bit 1 unlocked
+// $2404 mapping: bits 0-1 ram size (0: none, 1: 2KB, 2: 8KB, 3: 32KB),
+// bits 2-3 rom size (512KB << x), bit 7 HiROM
+// $2405 rom base in 512KB blocks
+// $2406 ram base in 2KB blocks
+//
+// The flash takes the usual commands in menu mode: $aa to $5555, $55 to
+// $2aaa, then $a0 program byte, $90 read id, $f0 read array, or $80 and a
+// second unlock followed by $10 (erase chip) or $30 (erase 128KB sector at
+// the address written). Writes go to the rom file itself.
+type NintendoPower struct {
+	cartridge *Cartridge
+
+	flash     *SRAM
+	flashSize uint32
+
+	gameMode bool
+	unlocked bool
+	mapping  byte
+	romBase  byte
+	ramBase  byte
+
+	flashCycle   byte // position in the unlock sequence
+	flashErase   bool // $80 was written, erase command follows
+	flashProgram bool // next write is programmed
+	flashReadID  bool
+}
+
+const (
+	nintendoPowerBlockSize  = 0x80000
+	nintendoPowerSectorSize = 0x20000
+	nintendoPowerMaker      = 0xc2 // Macronix
+)
+
+func init() {
+	registerBoard(mapperRegistration{
+		name:     "Nintendo Power",
+		priority: 1,
+		match:    isNintendoPowerHeader,
+		ram: func(header *CartridgeHeader, ramSize int, saveSize int) (int, int) {
+			// 32KB of ram shared by the games
+			return 0x8000, 0x8000
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			log.Printf("ROM: Nintendo Power enabled\n")
+			return NewNintendoPower(cartridge), nil
+		},
+	})
+}
+
+// isNintendoPowerHeader reports if the header is the one of the Nintendo
+// Power menu
+func isNintendoPowerHeader(header *CartridgeHeader) bool {
+	return header.cartType == 1 && strings.HasPrefix(string(header.name[:]), "NINTENDO POWER")
+}
+
+// NewNintendoPower maps the rom file as the flash, if the file doesn't
+// match the loaded rom the flash is only kept in memory
+func NewNintendoPower(cartridge *Cartridge) *NintendoPower {
+	nintendoPower := &NintendoPower{
+		cartridge: cartridge,
+		flashSize: cartridge.romSize,
+	}
+	var filePath string = cartridge.console.RomFilePath
+	if info, err := os.Stat(filePath); err == nil && info.Size() == int64(cartridge.romSize) {
+		nintendoPower.flash = NewSRAM(filePath, int(cartridge.romSize))
+	}
+	if nintendoPower.flash == nil {
+		log.Printf("Nintendo Power: rom file doesn't match the rom, flash writes are not saved\n")
+		nintendoPower.flash = newVolatileSRAM(int(cartridge.romSize))
+		copy(nintendoPower.flash.mmap, cartridge.rom)
+	}
+	return nintendoPower
+}
+
+func (nintendoPower *NintendoPower) Reset() {
+	nintendoPower.gameMode = false
+	nintendoPower.unlocked = false
+	nintendoPower.mapping = 0
+	nintendoPower.romBase = 0
+	nintendoPower.ramBase = 0
+	nintendoPower.flashCycle = 0
+	nintendoPower.flashErase = false
+	nintendoPower.flashProgram = false
+	nintendoPower.flashReadID = false
+}
+
+func (nintendoPower *NintendoPower) Close() {
+	nintendoPower.flash.Close()
+}
+
+func (nintendoPower *NintendoPower) Read(bank byte, addr uint16) byte {
+	if (bank&0x7f) < 0x40 && addr >= 0x2400 && addr < 0x2408 {
+		return nintendoPower.readRegister(addr)
+	}
+	if offset, ok := nintendoPower.ramOffset(bank, addr); ok {
+		return nintendoPower.cartridge.ram.Read(offset)
+	}
+	if offset, ok := nintendoPower.romOffset(bank, addr); ok {
+		if nintendoPower.flashReadID {
+			if (offset & 0xff) == 0 {
+				return nintendoPowerMaker
+			}
+			return 0xff
+		}
+		return nintendoPower.flash.Read(offset)
+	}
+	return nintendoPower.cartridge.console.openBus
+}
+
+func (nintendoPower *NintendoPower) Write(bank byte, addr uint16, value byte) {
+	if (bank&0x7f) < 0x40 && addr >= 0x2400 && addr < 0x2408 {
+		nintendoPower.writeRegister(addr, value)
+		return
+	}
+	if offset, ok := nintendoPower.ramOffset(bank, addr); ok {
+		nintendoPower.cartridge.ram.Write(offset, value)
+		return
+	}
+	if offset, ok := nintendoPower.romOffset(bank, addr); ok && !nintendoPower.gameMode {
+		nintendoPower.writeFlash(offset, value)
+	}
+}
+
+func (nintendoPower *NintendoPower) readRegister(addr uint16) byte {
+	switch addr {
+	case 0x2401:
+		var value byte = 0
+		if nintendoPower.gameMode {
+			value |= 1
+		}
+		if nintendoPower.unlocked {
+			value |= 2
+		}
+		return value
+	case 0x2404:
+		return nintendoPower.mapping
+	case 0x2405:
+		return nintendoPower.romBase
+	case 0x2406:
+		return nintendoPower.ramBase
+	}
+	return nintendoPower.cartridge.console.openBus
+}
+
+func (nintendoPower *NintendoPower) writeRegister(addr uint16, value byte) {
+	if addr == 0x2400 {
+		switch value {
+		case 0x09:
+			nintendoPower.unlocked = true
+		case 0x0a:
+			nintendoPower.unlocked = false
+		case 0x80:
+			if nintendoPower.unlocked {
+				nintendoPower.gameMode = true
+				nintendoPower.flashCycle = 0
+				nintendoPower.flashProgram = false
+				nintendoPower.flashReadID = false
+			}
+		}
+		return
+	}
+	if !nintendoPower.unlocked || nintendoPower.gameMode {
+		return
+	}
+	switch addr {
+	case 0x2404:
+		nintendoPower.mapping = value
+	case 0x2405:
+		nintendoPower.romBase = value
+	case 0x2406:
+		nintendoPower.ramBase = value
+	}
+}
+
+// romOffset returns the offset in the flash for a rom address
+func (nintendoPower *NintendoPower) romOffset(bank byte, addr uint16) (uint32, bool) {
+	var offset uint32
+	var hiROM bool = nintendoPower.gameMode && (nintendoPower.mapping&0x80) > 0
+	bank &= 0x7f
+	switch {
+	case hiROM && (addr >= 0x8000 || bank >= 0x40):
+		offset = (uint32(bank&0x3f) << 16) | uint32(addr)
+	case !hiROM && (addr >= 0x8000 || bank >= 0x40) && !(bank >= 0x70 && addr < 0x8000):
+		offset = (uint32(bank) << 15) | (uint32(addr) & 0x7fff)
+	default:
+		return 0, false
+	}
+	if nintendoPower.gameMode {
+		var size uint32 = nintendoPowerBlockSize << ((nintendoPower.mapping >> 2) & 3)
+		offset = (offset & (size - 1)) + uint32(nintendoPower.romBase)*nintendoPowerBlockSize
+	}
+	return offset & (nintendoPower.flashSize - 1), true
+}
+
+// ramOffset returns the offset in the ram for a ram address, in game mode
+// only the part of the game is accessible
+func (nintendoPower *NintendoPower) ramOffset(bank byte, addr uint16) (uint32, bool) {
+	var cartridge *Cartridge = nintendoPower.cartridge
+	if cartridge.ramSize == 0 {
+		return 0, false
+	}
+	var offset uint32
+	var hiROM bool = nintendoPower.gameMode && (nintendoPower.mapping&0x80) > 0
+	bank &= 0x7f
+	switch {
+	case hiROM && bank >= 0x20 && bank < 0x40 && addr >= 0x6000 && addr < 0x8000:
+		offset = (uint32(bank&0x1f) << 13) | (uint32(addr) & 0x1fff)
+	case !hiROM && bank >= 0x70 && bank < 0x7e && addr < 0x8000:
+		offset = (uint32(bank&0xf) << 15) | uint32(addr)
+	default:
+		return 0, false
+	}
+	if nintendoPower.gameMode {
+		var sizes [4]uint32 = [4]uint32{0, 0x800, 0x2000, 0x8000}
+		var size uint32 = sizes[nintendoPower.mapping&3]
+		if size == 0 {
+			return 0, false
+		}
+		offset = (offset & (size - 1)) + uint32(nintendoPower.ramBase)*0x800
+	}
+	return offset & (cartridge.ramSize - 1), true
+}
+
+func (nintendoPower *NintendoPower) writeFlash(offset uint32, value byte) {
+	if nintendoPower.flashProgram {
+		// flash can only clear bits
+		nintendoPower.flash.Write(offset, nintendoPower.flash.Read(offset)&value)
+		nintendoPower.flashProgram = false
+		return
+	}
+	if value == 0xf0 {
+		nintendoPower.flashCycle = 0
+		nintendoPower.flashErase = false
+		nintendoPower.flashReadID = false
+		return
+	}
+
+	var chipAddr uint32 = offset & 0xffff
+	switch nintendoPower.flashCycle {
+	case 0:
+		if chipAddr == 0x5555 && value == 0xaa {
+			nintendoPower.flashCycle = 1
+		}
+		return
+	case 1:
+		if chipAddr == 0x2aaa && value == 0x55 {
+			nintendoPower.flashCycle = 2
+		} else {
+			nintendoPower.flashCycle = 0
+		}
+		return
+	}
+
+	nintendoPower.flashCycle = 0
+	if nintendoPower.flashErase {
+		nintendoPower.flashErase = false
+		switch {
+		case chipAddr == 0x5555 && value == 0x10:
+			for i := uint32(0); i < nintendoPower.flashSize; i++ {
+				nintendoPower.flash.Write(i, 0xff)
+			}
+		case value == 0x30:
+			var start uint32 = offset &^ (nintendoPowerSectorSize - 1)
+			for i := start; i < start+nintendoPowerSectorSize && i < nintendoPower.flashSize; i++ {
+				nintendoPower.flash.Write(i, 0xff)
+			}
+		}
+		return
+	}
+	if chipAddr != 0x5555 {
+		return
+	}
+	switch value {
+	case 0xa0:
+		nintendoPower.flashProgram = true
+	case 0x90:
+		nintendoPower.flashReadID = true
+	case 0x80:
+		nintendoPower.flashErase = true
+	}
+}
+
+func (nintendoPower *NintendoPower) Cycle() {
+}
+
+func (nintendoPower *NintendoPower) Serialize(s *serializer) {
+	s.bool(&nintendoPower.gameMode)
+	s.bool(&nintendoPower.unlocked)
+	s.u8(&nintendoPower.mapping)
+	s.u8(&nintendoPower.romBase)
+	s.u8(&nintendoPower.ramBase)
+	s.u8(&nintendoPower.flashCycle)
+	s.bool(&nintendoPower.flashErase)
+	s.bool(&nintendoPower.flashProgram)
+	s.bool(&nintendoPower.flashReadID)
+}
@@ -0,0 +1,115 @@
+package chibisnes
+
+import "log"
+
+// OBC1 is the OBC-1 (Metal Combat: Falcon's Revenge), a sprite helper in
+// front of the 8KB save ram at $6000-$7fff. $7ff0-$7ff4 read and write an
+// oam style table in one of two banks of that ram: $7ff0-$7ff3 the 4 bytes
+// of the selected sprite, $7ff4 its 2 high bits.
+type OBC1 struct {
+	cartridge *Cartridge
+
+	basePtr uint16 // $1800 or $1c00, bank selected by $7ff5
+	address uint16 // sprite number, $7ff6
+	shift   byte   // position of the high bits, $7ff6
+}
+
+func init() {
+	registerChip(mapperRegistration{
+		name: "OBC-1",
+		match: func(header *CartridgeHeader) bool {
+			return header.coprocessor == 2
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			log.Printf("ROM: OBC-1 enabled\n")
+			return NewOBC1(cartridge), nil
+		},
+	})
+}
+
+func NewOBC1(cartridge *Cartridge) *OBC1 {
+	return &OBC1{
+		cartridge: cartridge,
+	}
+}
+
+func (obc1 *OBC1) Reset() {
+	obc1.setBase(obc1.ramRead(0x1ff5))
+	obc1.setAddress(obc1.ramRead(0x1ff6))
+}
+
+func (obc1 *OBC1) setBase(value byte) {
+	if (value & 1) > 0 {
+		obc1.basePtr = 0x1800
+	} else {
+		obc1.basePtr = 0x1c00
+	}
+}
+
+func (obc1 *OBC1) setAddress(value byte) {
+	obc1.address = uint16(value & 0x7f)
+	obc1.shift = (value & 3) << 1
+}
+
+func (obc1 *OBC1) ramRead(addr uint16) byte {
+	var cartridge *Cartridge = obc1.cartridge
+	if cartridge.ramSize == 0 {
+		return 0
+	}
+	return cartridge.ram.Read(uint32(addr&0x1fff) & (cartridge.ramSize - 1))
+}
+
+func (obc1 *OBC1) ramWrite(addr uint16, value byte) {
+	var cartridge *Cartridge = obc1.cartridge
+	if cartridge.ramSize == 0 {
+		return
+	}
+	cartridge.ram.Write(uint32(addr&0x1fff)&(cartridge.ramSize-1), value)
+}
+
+func (obc1 *OBC1) Mapped(bank byte, addr uint16) bool {
+	return (bank&0x7f) < 0x40 && addr >= 0x6000 && addr < 0x8000
+}
+
+func (obc1 *OBC1) Read(bank byte, addr uint16) byte {
+	addr &= 0x1fff
+	switch addr {
+	case 0x1ff0, 0x1ff1, 0x1ff2, 0x1ff3:
+		return obc1.ramRead(obc1.basePtr + (obc1.address << 2) + (addr & 3))
+	case 0x1ff4:
+		return obc1.ramRead(obc1.basePtr + (obc1.address >> 2) + 0x200)
+	}
+	return obc1.ramRead(addr)
+}
+
+func (obc1 *OBC1) Write(bank byte, addr uint16, value byte) {
+	addr &= 0x1fff
+	switch addr {
+	case 0x1ff0, 0x1ff1, 0x1ff2, 0x1ff3:
+		obc1.ramWrite(obc1.basePtr+(obc1.address<<2)+(addr&3), value)
+		return
+	case 0x1ff4:
+		var highAddr uint16 = obc1.basePtr + (obc1.address >> 2) + 0x200
+		var temp byte = obc1.ramRead(highAddr)
+		temp = (temp & ^(3 << obc1.shift)) | ((value & 3) << obc1.shift)
+		obc1.ramWrite(highAddr, temp)
+		return
+	case 0x1ff5:
+		obc1.setBase(value)
+	case 0x1ff6:
+		obc1.setAddress(value)
+	}
+	obc1.ramWrite(addr, value)
+}
+
+func (obc1 *OBC1) Cycle() {
+}
+
+func (obc1 *OBC1) Close() {
+}
+
+func (obc1 *OBC1) Serialize(s *serializer) {
+	s.u16(&obc1.basePtr)
+	s.u16(&obc1.address)
+	s.u8(&obc1.shift)
+}
@@ -127,6 +127,11 @@ type PPU struct {
 	ppu1OpenBus     byte
 	ppu2OpenBus     byte
 
+	// dot renderer
+	dotRenderer bool // draw the pixels in step with hPos instead of a line at once
+	lineX       int  // next pixel of the line to draw
+	lineStarted bool // startLine is done for the line
+
 	// pixel buffer (xbgr)
 	// times 2 for event and odd frame
 	pixelBuffer [512 * 4 * 239 * 2]byte
@@ -213,6 +218,16 @@ func (ppu *PPU) handleVBlank() {
 }
 
 func (ppu *PPU) runLine(line int) {
+	ppu.startLine(line)
+	if line != 0 {
+		for x := 0; x < 256; x++ {
+			ppu.handlePixel(x, line)
+		}
+	}
+}
+
+// startLine does what comes before the pixels of a line
+func (ppu *PPU) startLine(line int) {
 	if line == 0 {
 		// pre-render line
 		// TODO: this now happens halfway into the first line
@@ -235,9 +250,41 @@ func (ppu *PPU) runLine(line int) {
 		if ppu.mode == 7 {
 			ppu.calculateMode7Starts(line)
 		}
-		for x := 0; x < 256; x++ {
-			ppu.handlePixel(x, line)
+	}
+}
+
+// runDot is the dot renderer: it draws the pixels of the line up to hPos,
+// so writes made during the line (hdma, timed cpu writes) change the pixels
+// after them. Pixel x is drawn at dot x (hPos 4 times the dot), all 256 are
+// done before the hblank at hPos 1024.
+func (ppu *PPU) runDot(line int, hPos uint16) {
+	if hPos == 0 {
+		ppu.lineX = 0
+		ppu.lineStarted = false
+	}
+	if ppu.lineX >= 256 {
+		return
+	}
+	if !ppu.lineStarted {
+		ppu.startLine(line)
+		ppu.lineStarted = true
+	}
+	ppu.drawPixels(line, int(hPos)/4+1)
+}
+
+// drawPixels draws the pixels of the line up to x (not included), the
+// registers are read as each pixel is drawn
+func (ppu *PPU) drawPixels(line int, x int) {
+	if line == 0 {
+		// the pre-render line has no pixels
+		ppu.lineX = x
+		return
+	}
+	for ; ppu.lineX < x; ppu.lineX++ {
+		if ppu.mode == 7 {
+			ppu.calculateMode7Starts(line)
 		}
+		ppu.handlePixel(ppu.lineX, line)
 	}
 }
 
@@ -956,6 +1003,9 @@ func (ppu *PPU) Read(addr byte) byte {
 		return val
 	case 0x3f:
 		var val byte = 0x3 // ppu2 version (4 bit), bit 4: ntsc/pal
+		if ppu.console.pal {
+			val |= 1 << 4
+		}
 		val |= ppu.ppu2OpenBus & 0x20
 		if ppu.countersLatched {
 			val |= 1 << 6
@@ -1240,3 +1290,118 @@ func (ppu *PPU) putPixels(pixels []byte) {
 		}
 	}
 }
+
+func (ppu *PPU) serialize(s *serializer) {
+	// the pixel buffer is output only, it is rebuilt by the next frame
+	s.u16s(ppu.vram[:])
+	s.u16(&ppu.vramPointer)
+	s.bool(&ppu.vramIncrementOnHigh)
+	s.u16(&ppu.vramIncrement)
+	s.u8(&ppu.vramRemapMode)
+	s.u16(&ppu.vramReadBuffer)
+
+	s.u16s(ppu.cgram[:])
+	s.u8(&ppu.cgramPointer)
+	s.bool(&ppu.cgramSecondWrite)
+	s.u8(&ppu.cgramBuffer)
+
+	s.u16s(ppu.oam[:])
+	s.bytes(ppu.highOAM[:])
+	s.u8(&ppu.oamAddr)
+	s.u8(&ppu.oamAddrWritten)
+	s.bool(&ppu.oamInHigh)
+	s.bool(&ppu.oamInHighWritten)
+	s.bool(&ppu.oamSecondWrite)
+	s.u8(&ppu.oamBuffer)
+
+	s.bool(&ppu.objPriority)
+	s.u16(&ppu.objTileAddr1)
+	s.u16(&ppu.objTileAddr2)
+	s.u8(&ppu.objSize)
+	s.bytes(ppu.objPixelBuffer[:])
+	s.bytes(ppu.objPriorityBuffer[:])
+	s.bool(&ppu.timeOver)
+	s.bool(&ppu.rangeOver)
+	s.bool(&ppu.objInterlace)
+
+	for i := 0; i < len(ppu.bgLayer); i++ {
+		var bg *BGLayer = &ppu.bgLayer[i]
+		s.u16(&bg.hScroll)
+		s.u16(&bg.vScroll)
+		s.bool(&bg.tilemapWider)
+		s.bool(&bg.tilemapHigher)
+		s.u16(&bg.tilemapAddr)
+		s.u16(&bg.tileAddr)
+		s.bool(&bg.bigTiles)
+		s.bool(&bg.mosaicEnabled)
+	}
+	s.u8(&ppu.scrollPrev)
+	s.u8(&ppu.scrollPrev2)
+	s.u8(&ppu.mosaicSize)
+	s.u8(&ppu.mosaicStartLine)
+	var lineX uint32 = uint32(ppu.lineX)
+	s.u32(&lineX)
+	ppu.lineX = int(lineX)
+	s.bool(&ppu.lineStarted)
+
+	for i := 0; i < len(ppu.layer); i++ {
+		s.bool(&ppu.layer[i].mainScreenEnabled)
+		s.bool(&ppu.layer[i].subScreenEnabled)
+		s.bool(&ppu.layer[i].mainScreenWindowed)
+		s.bool(&ppu.layer[i].subScreenWindowed)
+	}
+
+	for i := 0; i < len(ppu.mode7Matrix); i++ {
+		s.i16(&ppu.mode7Matrix[i])
+	}
+	s.u8(&ppu.mode7Prev)
+	s.bool(&ppu.mode7LargeField)
+	s.bool(&ppu.mode7CharFill)
+	s.bool(&ppu.mode7XFlip)
+	s.bool(&ppu.mode7YFlip)
+	s.bool(&ppu.mode7ExtBG)
+	s.i32(&ppu.mode7StartX)
+	s.i32(&ppu.mode7StartY)
+
+	for i := 0; i < len(ppu.windowLayer); i++ {
+		s.bool(&ppu.windowLayer[i].window1Enabled)
+		s.bool(&ppu.windowLayer[i].window2Enabled)
+		s.bool(&ppu.windowLayer[i].window1Inversed)
+		s.bool(&ppu.windowLayer[i].window2Inversed)
+		s.u8(&ppu.windowLayer[i].maskLogic)
+	}
+	s.u8(&ppu.window1Left)
+	s.u8(&ppu.window1Right)
+	s.u8(&ppu.window2Left)
+	s.u8(&ppu.window2Right)
+
+	s.u8(&ppu.clipMode)
+	s.u8(&ppu.preventMathMode)
+	s.bool(&ppu.addSubscreen)
+	s.bool(&ppu.subtractColor)
+	s.bool(&ppu.halfColor)
+	s.bools(ppu.mathEnabled[:])
+	s.u8(&ppu.fixedColorR)
+	s.u8(&ppu.fixedColorG)
+	s.u8(&ppu.fixedColorB)
+
+	s.bool(&ppu.forcedBlank)
+	s.u8(&ppu.brightness)
+	s.u8(&ppu.mode)
+	s.bool(&ppu.bg3priority)
+	s.bool(&ppu.evenFrame)
+	s.bool(&ppu.pseudoHires)
+	s.bool(&ppu.overscan)
+	s.bool(&ppu.frameOverscan)
+	s.bool(&ppu.interlace)
+	s.bool(&ppu.frameInterlace)
+	s.bool(&ppu.directColor)
+
+	s.u16(&ppu.hCount)
+	s.u16(&ppu.vCount)
+	s.bool(&ppu.hCountSecond)
+	s.bool(&ppu.vCountSecond)
+	s.bool(&ppu.countersLatched)
+	s.u8(&ppu.ppu1OpenBus)
+	s.u8(&ppu.ppu2OpenBus)
+}
@@ -0,0 +1,157 @@
+package chibisnes
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// Rewind is an in-memory history of save states.
+//
+// Only the newest snapshot is kept as-is. Every older snapshot is stored as
+// the flate compressed xor of itself and its successor, which is mostly zero
+// bytes between two nearby frames. Popping walks the chain backwards, and the
+// oldest deltas are dropped first once the history grows past its budget.
+type Rewind struct {
+	budget  int
+	current []byte
+	deltas  [][]byte
+	used    int // bytes held by deltas
+
+	state      bytes.Buffer
+	compressed bytes.Buffer
+	writer     *flate.Writer
+}
+
+// NewRewind creates a rewind history that keeps at most budget bytes of
+// snapshots in memory.
+func NewRewind(budget int) *Rewind {
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &Rewind{
+		budget: budget,
+		writer: writer,
+	}
+}
+
+// Push takes a snapshot of the console and adds it to the history.
+func (rewind *Rewind) Push(console *Console) error {
+	rewind.state.Reset()
+	if err := console.SaveState(&rewind.state); err != nil {
+		return err
+	}
+	var snapshot []byte = rewind.state.Bytes()
+
+	if rewind.current != nil && len(rewind.current) == len(snapshot) {
+		// store how to get from the new snapshot back to the current one
+		xorBytes(rewind.current, snapshot)
+		delta, err := rewind.compress(rewind.current)
+		if err != nil {
+			return err
+		}
+		rewind.deltas = append(rewind.deltas, delta)
+		rewind.used += len(delta)
+		copy(rewind.current, snapshot)
+	} else {
+		// first snapshot, or the state layout changed: start a new chain
+		rewind.Reset()
+		rewind.current = append([]byte{}, snapshot...)
+	}
+
+	for len(rewind.deltas) > 0 && rewind.used+len(rewind.current) > rewind.budget {
+		rewind.used -= len(rewind.deltas[0])
+		rewind.deltas[0] = nil
+		rewind.deltas = rewind.deltas[1:]
+	}
+
+	return nil
+}
+
+// Pop restores the newest snapshot and removes it from the history. The
+// oldest snapshot is never removed, so popping repeatedly stops there.
+// It reports false if there is nothing to restore.
+func (rewind *Rewind) Pop(console *Console) (bool, error) {
+	if rewind.current == nil {
+		return false, nil
+	}
+
+	if err := console.LoadState(bytes.NewReader(rewind.current)); err != nil {
+		return false, err
+	}
+
+	if len(rewind.deltas) > 0 {
+		var last int = len(rewind.deltas) - 1
+		if err := rewind.decompressXor(rewind.deltas[last], rewind.current); err != nil {
+			return false, err
+		}
+		rewind.used -= len(rewind.deltas[last])
+		rewind.deltas[last] = nil
+		rewind.deltas = rewind.deltas[:last]
+	}
+
+	return true, nil
+}
+
+// Len returns the number of snapshots in the history.
+func (rewind *Rewind) Len() int {
+	if rewind.current == nil {
+		return 0
+	}
+	return len(rewind.deltas) + 1
+}
+
+// Size returns the number of bytes held by the history.
+func (rewind *Rewind) Size() int {
+	return rewind.used + len(rewind.current)
+}
+
+// Reset empties the history.
+func (rewind *Rewind) Reset() {
+	rewind.current = nil
+	rewind.deltas = nil
+	rewind.used = 0
+}
+
+func (rewind *Rewind) compress(data []byte) ([]byte, error) {
+	rewind.compressed.Reset()
+	rewind.writer.Reset(&rewind.compressed)
+	if _, err := rewind.writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := rewind.writer.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, rewind.compressed.Bytes()...), nil
+}
+
+func (rewind *Rewind) decompressXor(delta []byte, dst []byte) error {
+	reader := flate.NewReader(bytes.NewReader(delta))
+	defer reader.Close()
+
+	var buf [4096]byte
+	var offset int = 0
+	for offset < len(dst) {
+		n, err := reader.Read(buf[:])
+		if n > len(dst)-offset {
+			n = len(dst) - offset
+		}
+		xorBytes(dst[offset:offset+n], buf[:n])
+		offset += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if offset != len(dst) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return nil
+}
+
+func xorBytes(dst []byte, src []byte) {
+	for i := 0; i < len(dst); i++ {
+		dst[i] ^= src[i]
+	}
+}
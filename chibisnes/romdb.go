@@ -0,0 +1,208 @@
+package chibisnes
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// ROMInfo is what the rom database knows of a dump
+type ROMInfo struct {
+	Title   string
+	Region  string // ntsc or pal, "" if unknown
+	Mapping string // lorom, hirom, exlorom or exhirom, "" if unknown
+	Board   string // name of the board picking the mapper, "" if unknown
+	Good    bool   // false for a known bad dump
+	CRC32   uint32
+	SHA256  string // lower case hex
+}
+
+// romDatabaseEntry is a game of the database, with the manifest it stands
+// for when the rom is loaded
+type romDatabaseEntry struct {
+	info     ROMInfo
+	manifest *manifest
+}
+
+// the rom database starts empty, the front end adds database files to it
+var (
+	romDatabaseCRC32  = map[uint32]*romDatabaseEntry{}
+	romDatabaseSHA256 = map[string]*romDatabaseEntry{}
+)
+
+// AddROMDatabase adds the games of a database file to the database, games
+// already in it are replaced. There is one "game" block per dump, keyed by
+// the crc32 and the sha-256 of the rom without a copier header, the other
+// keys are the ones of a .manifest and a hit is used like a manifest when
+// the rom is loaded:
+//
+//	game
+//	  title: Game Name (Region)
+//	  crc32: 0123abcd
+//	  sha256: 0123...(64 hex digits)
+//	  status: good          # good, bad
+//	  mapping: lorom
+//	  board: LoROM
+//	  region: ntsc
+func AddROMDatabase(name string, data []byte) error {
+	var entry *romDatabaseEntry = nil
+	var entryLine int = 0
+	var scanner *bufio.Scanner = bufio.NewScanner(bytes.NewReader(data))
+	var lineNumber int = 0
+	for scanner.Scan() {
+		lineNumber++
+		var line string = strings.TrimSpace(scanner.Text())
+		if strings.EqualFold(line, "game") {
+			if err := addROMDatabaseEntry(name, entryLine, entry); err != nil {
+				return err
+			}
+			entry = &romDatabaseEntry{
+				info: ROMInfo{
+					Good: true,
+				},
+				manifest: &manifest{
+					path:    name,
+					romSize: -1,
+					ramSize: -1,
+					copier:  -1,
+				},
+			}
+			entryLine = lineNumber
+			continue
+		}
+
+		key, value, ok := splitManifestLine(line)
+		if ok && key == "" {
+			continue
+		}
+		if !ok || entry == nil {
+			msg := fmt.Sprintf("rom database %s line %d: want \"game\" or \"key: value\"\n", name, lineNumber)
+			return errors.New(msg)
+		}
+		if err := entry.set(key, value); err != nil {
+			msg := fmt.Sprintf("rom database %s line %d: %s\n", name, lineNumber, err.Error())
+			return errors.New(msg)
+		}
+	}
+	return addROMDatabaseEntry(name, entryLine, entry)
+}
+
+func (entry *romDatabaseEntry) set(key string, value string) error {
+	switch key {
+	case "title":
+		entry.info.Title = value
+	case "crc32":
+		crc, err := strconv.ParseUint(value, 16, 32)
+		if err != nil || len(value) != 8 {
+			return errors.New(fmt.Sprintf("bad crc32 %q", value))
+		}
+		entry.info.CRC32 = uint32(crc)
+	case "sha256":
+		value = strings.ToLower(value)
+		if _, err := hex.DecodeString(value); err != nil || len(value) != sha256.Size*2 {
+			return errors.New(fmt.Sprintf("bad sha256 %q", value))
+		}
+		entry.info.SHA256 = value
+	case "status":
+		switch strings.ToLower(value) {
+		case "good":
+			entry.info.Good = true
+		case "bad":
+			entry.info.Good = false
+		default:
+			return errors.New(fmt.Sprintf("unknown status %q", value))
+		}
+	default:
+		if err := entry.manifest.set(key, value); err != nil {
+			return err
+		}
+		switch key {
+		case "region":
+			entry.info.Region = entry.manifest.region
+		case "mapping":
+			entry.info.Mapping = strings.ToLower(value)
+		case "board":
+			entry.info.Board = value
+		}
+	}
+	return nil
+}
+
+// addROMDatabaseEntry puts a game read by AddROMDatabase in the database
+func addROMDatabaseEntry(name string, line int, entry *romDatabaseEntry) error {
+	if entry == nil {
+		return nil
+	}
+	if entry.info.SHA256 == "" {
+		msg := fmt.Sprintf("rom database %s line %d: game without sha256\n", name, line)
+		return errors.New(msg)
+	}
+	if err := entry.manifest.check(); err != nil {
+		msg := fmt.Sprintf("rom database %s line %d: %s\n", name, line, err.Error())
+		return errors.New(msg)
+	}
+	if entry.info.CRC32 != 0 {
+		romDatabaseCRC32[entry.info.CRC32] = entry
+	}
+	romDatabaseSHA256[entry.info.SHA256] = entry
+	return nil
+}
+
+// findROM looks for a rom without its copier header in the database, the
+// crc32 only narrows the search down, the sha-256 has to match
+func findROM(data []byte) *romDatabaseEntry {
+	if len(romDatabaseSHA256) == 0 {
+		return nil
+	}
+	if len(romDatabaseCRC32) == len(romDatabaseSHA256) {
+		// every game has a crc32, no need to hash more if it isn't there
+		if _, ok := romDatabaseCRC32[crc32.ChecksumIEEE(data)]; !ok {
+			return nil
+		}
+	}
+	var sum [sha256.Size]byte = sha256.Sum256(data)
+	entry, ok := romDatabaseSHA256[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil
+	}
+	return entry
+}
+
+// lookupROM looks for a rom file in the database, with or without a copier
+// header, copier is 1 if it was found without the first 512 bytes
+func lookupROM(data []byte) (*romDatabaseEntry, int) {
+	if entry := findROM(data); entry != nil {
+		return entry, 0
+	}
+	if (len(data) & 0x7fff) == 0x200 {
+		if entry := findROM(data[0x200:]); entry != nil {
+			return entry, 1
+		}
+	}
+	return nil, 0
+}
+
+// LookupROM returns what the rom database knows of a rom file, with or
+// without a copier header
+func LookupROM(data []byte) (ROMInfo, bool) {
+	if entry, _ := lookupROM(data); entry != nil {
+		return entry.info, true
+	}
+	return ROMInfo{}, false
+}
+
+// romChecksum returns the sum of the bytes of the rom, to compare with the
+// checksum of the header once LoadROM has expanded the rom to a power of 2
+func romChecksum(rom []byte) uint16 {
+	var sum uint16 = 0
+	for i := 0; i < len(rom); i++ {
+		sum += uint16(rom[i])
+	}
+	return sum
+}
@@ -0,0 +1,80 @@
+package chibisnes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"testing"
+)
+
+func TestLookupROM(t *testing.T) {
+	var rom []byte = make([]byte, 0x10000)
+	for i := 0; i < len(rom); i++ {
+		rom[i] = byte(i*7) ^ byte(i>>8)
+	}
+	var sum [sha256.Size]byte = sha256.Sum256(rom)
+	var database string = fmt.Sprintf(`game
+  title: Lookup Test (Japan)
+  crc32: %08x
+  sha256: %s
+  status: bad
+  mapping: hirom
+  board: HiROM
+  ram: 8KB
+  region: ntsc
+`, crc32.ChecksumIEEE(rom), hex.EncodeToString(sum[:]))
+	if err := AddROMDatabase("test.bml", []byte(database)); err != nil {
+		t.Fatal(err)
+	}
+
+	var copierROM []byte = append(make([]byte, 0x200), rom...)
+	var changedROM []byte = append([]byte{}, rom...)
+	changedROM[0x1234] ^= 0xff
+	var tests = []struct {
+		name   string
+		data   []byte
+		found  bool
+		copier int
+	}{
+		{"plain", rom, true, 0},
+		{"copier header", copierROM, true, 1},
+		{"changed byte", changedROM, false, 0},
+		{"cut", rom[:0x8000], false, 0},
+	}
+	for _, test := range tests {
+		info, found := LookupROM(test.data)
+		if found != test.found {
+			t.Errorf("%s: found %v, want %v", test.name, found, test.found)
+			continue
+		}
+		if !found {
+			continue
+		}
+		if info.Title != "Lookup Test (Japan)" || info.Mapping != "hirom" || info.Board != "HiROM" || info.Region != "ntsc" || info.Good {
+			t.Errorf("%s: got %+v", test.name, info)
+		}
+		entry, copier := lookupROM(test.data)
+		if copier != test.copier {
+			t.Errorf("%s: copier %d, want %d", test.name, copier, test.copier)
+		}
+		if entry.manifest.cartType != 2 || entry.manifest.ramSize != 0x2000 {
+			t.Errorf("%s: manifest %+v", test.name, *entry.manifest)
+		}
+	}
+}
+
+func TestROMDatabaseErrors(t *testing.T) {
+	var tests = []string{
+		"title: no game line\n",
+		"game\n  title: No Hash\n",
+		"game\n  crc32: 123\n  sha256: " + hex.EncodeToString(make([]byte, sha256.Size)) + "\n",
+		"game\n  sha256: 1234\n",
+		"game\n  sha256: " + hex.EncodeToString(make([]byte, sha256.Size)) + "\n  mapping: midrom\n",
+	}
+	for _, test := range tests {
+		if err := AddROMDatabase("bad.bml", []byte(test)); err == nil {
+			t.Errorf("no error for %q", test)
+		}
+	}
+}
@@ -0,0 +1,1054 @@
+package chibisnes
+
+import "log"
+
+// SA1 is the SA-1 coprocessor: a second 65816 at 10.74 MHz with its own
+// memory map, 2KB of I-RAM, the BW-RAM (the cartridge ram), the Super MMC
+// bank switching, an arithmetic unit, DMA and character conversion DMA.
+type SA1 struct {
+	cartridge *Cartridge
+	cpu       *CPU
+
+	iram [0x800]byte
+
+	cyclesLeft int // master cycles left before the next opcode
+	memOps     int // memory accesses done by the current opcode
+
+	// $2200 CCNT (S-CPU)
+	sa1Wait  bool
+	sa1Reset bool
+	smeg     byte // message to SA-1
+	// $2201 SIE (S-CPU)
+	cpuIRQEnable   bool
+	chdmaIRQEnable bool
+	// $2203-$2208 SA-1 reset, nmi and irq vectors
+	crv uint16
+	cnv uint16
+	civ uint16
+	// $2209 SCNT (SA-1)
+	cpuIVSelect bool // use siv for the S-CPU irq vector
+	cpuNVSelect bool // use snv for the S-CPU nmi vector
+	cmeg        byte // message to S-CPU
+	// $220A CIE (SA-1)
+	sa1IRQEnable   bool
+	timerIRQEnable bool
+	dmaIRQEnable   bool
+	sa1NMIEnable   bool
+	// $220C-$220F S-CPU nmi and irq vectors
+	snv uint16
+	siv uint16
+	// interrupt flags (SFR, CFR)
+	cpuIRQFlag   bool
+	chdmaIRQFlag bool
+	sa1IRQFlag   bool
+	timerIRQFlag bool
+	dmaIRQFlag   bool
+	sa1NMIFlag   bool
+
+	// $2210-$2215 timer
+	timerLinear  bool
+	timerHEnable bool
+	timerVEnable bool
+	hCount       uint16 // compare values
+	vCount       uint16
+	hCounter     uint16 // in master cycles
+	vCounter     uint16
+	hLatch       uint16
+	vLatch       uint16
+
+	// $2220-$2223 super mmc (CXB, DXB, EXB, FXB)
+	mmc [4]byte
+
+	// $2224-$222A BW-RAM and I-RAM mapping / protection
+	bmaps byte // S-CPU BW-RAM block at $6000-$7fff
+	bmap  byte // SA-1 BW-RAM block at $6000-$7fff, bit 7: bitmap view
+	sbwe  bool
+	cbwe  bool
+	bwpa  byte
+	siwp  byte
+	ciwp  byte
+
+	// $2230-$2239 dma
+	dmaEnable   bool
+	dmaPriority bool
+	cden        bool // character conversion dma
+	cdsel       bool // character conversion type 1
+	dd          byte // destination: 0 I-RAM, 1 BW-RAM
+	sd          byte // source: 0 ROM, 1 BW-RAM, 2 I-RAM
+	dmaSize     byte // virtual vram width (1 << n characters)
+	dmaCB       byte // color depth: 0 8bpp, 1 4bpp, 2 2bpp
+	sda         uint32
+	dda         uint32
+	dtc         uint16
+	cc1Active   bool // S-CPU BW-RAM reads go through character conversion
+	brf         [16]byte
+	dmaLine     byte
+	bitmap2bpp  bool // $223F BBF
+
+	// $2250-$2254 arithmetic
+	mathDivide bool
+	mathSum    bool
+	ma         uint16
+	mb         uint16
+	mr         uint64 // 40 bit
+	overflow   bool
+
+	// $2258-$225B variable-length bit processing
+	vbdAuto bool
+	vbd     byte
+	vda     uint32
+	vbit    byte
+}
+
+func NewSA1(cartridge *Cartridge) *SA1 {
+	sa1 := &SA1{
+		cartridge: cartridge,
+	}
+	sa1.cpu = newCPUOnBus(cartridge.console, sa1)
+	return sa1
+}
+
+func init() {
+	registerBoard(mapperRegistration{
+		name:     "SA-1",
+		priority: 1,
+		match: func(header *CartridgeHeader) bool {
+			return header.coprocessor == 3
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			if cartridge.ram == nil {
+				// the SA-1 always has BW-RAM, even if nothing is battery backed
+				cartridge.ramSize = 0x2000
+				cartridge.ram = newVolatileSRAM(int(cartridge.ramSize))
+			}
+			log.Printf("ROM: SA-1 enabled, BW-RAM size: 0x%x\n", cartridge.ramSize)
+			return NewSA1(cartridge), nil
+		},
+	})
+}
+
+func (sa1 *SA1) Reset() {
+	for i := 0; i < len(sa1.iram); i++ {
+		sa1.iram[i] = 0
+	}
+	sa1.cyclesLeft = 0
+	sa1.memOps = 0
+
+	// the SA-1 stays in reset until the S-CPU releases it through CCNT
+	sa1.sa1Wait = false
+	sa1.sa1Reset = true
+	sa1.smeg = 0
+	sa1.cpuIRQEnable = false
+	sa1.chdmaIRQEnable = false
+	sa1.crv = 0
+	sa1.cnv = 0
+	sa1.civ = 0
+	sa1.cpuIVSelect = false
+	sa1.cpuNVSelect = false
+	sa1.cmeg = 0
+	sa1.sa1IRQEnable = false
+	sa1.timerIRQEnable = false
+	sa1.dmaIRQEnable = false
+	sa1.sa1NMIEnable = false
+	sa1.snv = 0
+	sa1.siv = 0
+	sa1.cpuIRQFlag = false
+	sa1.chdmaIRQFlag = false
+	sa1.sa1IRQFlag = false
+	sa1.timerIRQFlag = false
+	sa1.dmaIRQFlag = false
+	sa1.sa1NMIFlag = false
+
+	sa1.timerLinear = false
+	sa1.timerHEnable = false
+	sa1.timerVEnable = false
+	sa1.hCount = 0
+	sa1.vCount = 0
+	sa1.hCounter = 0
+	sa1.vCounter = 0
+	sa1.hLatch = 0
+	sa1.vLatch = 0
+
+	sa1.mmc = [4]byte{0, 1, 2, 3}
+
+	sa1.bmaps = 0
+	sa1.bmap = 0
+	sa1.sbwe = false
+	sa1.cbwe = false
+	sa1.bwpa = 0xf
+	sa1.siwp = 0
+	sa1.ciwp = 0
+
+	sa1.dmaEnable = false
+	sa1.dmaPriority = false
+	sa1.cden = false
+	sa1.cdsel = false
+	sa1.dd = 0
+	sa1.sd = 0
+	sa1.dmaSize = 0
+	sa1.dmaCB = 0
+	sa1.sda = 0
+	sa1.dda = 0
+	sa1.dtc = 0
+	sa1.cc1Active = false
+	sa1.dmaLine = 0
+	sa1.bitmap2bpp = false
+
+	sa1.mathDivide = false
+	sa1.mathSum = false
+	sa1.ma = 0
+	sa1.mb = 0
+	sa1.mr = 0
+	sa1.overflow = false
+
+	sa1.vbdAuto = false
+	sa1.vbd = 16
+	sa1.vda = 0
+	sa1.vbit = 0
+}
+
+// Cycle runs the SA-1 for 2 master cycles (1 SA-1 cycle)
+func (sa1 *SA1) Cycle() {
+	sa1.tickTimer()
+
+	// keep the S-CPU irq line up while a SA-1 irq is pending,
+	// reading $4211 drops it otherwise
+	if sa1.cpuIRQLine() {
+		sa1.cartridge.console.CPU.irqWanted = true
+	}
+
+	if sa1.sa1Reset || sa1.sa1Wait {
+		return
+	}
+
+	if sa1.cyclesLeft <= 0 {
+		sa1.memOps = 0
+		sa1.cpu.irqWanted = sa1.sa1IRQLine()
+		var cycles int = sa1.cpu.runOpcode()
+		sa1.cpu.cycleCounter += uint64(cycles)
+		// memory accesses are already counted, every other cycle is 1 SA-1 cycle
+		if cycles > sa1.memOps {
+			sa1.cyclesLeft += (cycles - sa1.memOps) * 2
+		}
+	}
+	sa1.cyclesLeft -= 2
+}
+
+func (sa1 *SA1) tickTimer() {
+	sa1.hCounter += 2
+	if sa1.hCounter >= 1364 {
+		sa1.hCounter = 0
+		sa1.vCounter++
+		var lines uint16 = 262
+		if sa1.cartridge.console.pal {
+			lines = 312
+		}
+		if sa1.vCounter >= lines {
+			sa1.vCounter = 0
+		}
+	}
+
+	var hit bool = false
+	if sa1.timerLinear {
+		// linear mode: 18 bit counter, h in the low 9 bits
+		var counter uint32 = (uint32(sa1.vCounter) << 9) | uint32(sa1.hCounter>>2)
+		var target uint32 = (uint32(sa1.vCount) << 9) | uint32(sa1.hCount)
+		switch {
+		case sa1.timerHEnable && sa1.timerVEnable:
+			hit = counter == target && (sa1.hCounter&3) == 0
+		case sa1.timerHEnable:
+			hit = (counter&0x1ff) == uint32(sa1.hCount) && (sa1.hCounter&3) == 0
+		case sa1.timerVEnable:
+			hit = (counter>>9) == uint32(sa1.vCount) && sa1.hCounter == 0
+		}
+	} else {
+		var hMatch bool = (sa1.hCounter>>2) == sa1.hCount && (sa1.hCounter&3) == 0
+		switch {
+		case sa1.timerHEnable && sa1.timerVEnable:
+			hit = hMatch && sa1.vCounter == sa1.vCount
+		case sa1.timerHEnable:
+			hit = hMatch
+		case sa1.timerVEnable:
+			hit = sa1.hCounter == 0 && sa1.vCounter == sa1.vCount
+		}
+	}
+
+	if hit {
+		sa1.timerIRQFlag = true
+	}
+}
+
+func (sa1 *SA1) cpuIRQLine() bool {
+	return (sa1.cpuIRQFlag && sa1.cpuIRQEnable) || (sa1.chdmaIRQFlag && sa1.chdmaIRQEnable)
+}
+
+func (sa1 *SA1) sa1IRQLine() bool {
+	return (sa1.sa1IRQFlag && sa1.sa1IRQEnable) ||
+		(sa1.timerIRQFlag && sa1.timerIRQEnable) ||
+		(sa1.dmaIRQFlag && sa1.dmaIRQEnable)
+}
+
+func (sa1 *SA1) updateCPUIRQ() {
+	var console *Console = sa1.cartridge.console
+	console.CPU.irqWanted = console.inIRQ || sa1.cpuIRQLine()
+}
+
+// S-CPU side
+
+func (sa1 *SA1) Read(bank byte, addr uint16) byte {
+	if (bank & 0x40) == 0 {
+		// banks 00-3f and 80-bf
+		switch {
+		case addr >= 0x2200 && addr < 0x2400:
+			return sa1.readIO(addr, false)
+		case addr >= 0x3000 && addr < 0x3800:
+			return sa1.iram[addr&0x7ff]
+		case addr >= 0x6000 && addr < 0x8000:
+			return sa1.readBWRAMCPU((uint32(sa1.bmaps&0x1f) << 13) | uint32(addr&0x1fff))
+		case addr >= 0x8000:
+			return sa1.readROMCPU(bank, addr)
+		}
+		return sa1.cartridge.console.openBus
+	}
+	if bank >= 0xc0 {
+		return sa1.readROM(bank, addr)
+	}
+	if bank < 0x50 {
+		// banks 40-4f: BW-RAM
+		return sa1.readBWRAMCPU((uint32(bank&0xf) << 16) | uint32(addr))
+	}
+
+	return sa1.cartridge.console.openBus
+}
+
+func (sa1 *SA1) Write(bank byte, addr uint16, value byte) {
+	if (bank & 0x40) == 0 {
+		switch {
+		case addr >= 0x2200 && addr < 0x2400:
+			sa1.writeIO(addr, value)
+		case addr >= 0x3000 && addr < 0x3800:
+			if (sa1.siwp & (1 << ((addr >> 8) & 7))) > 0 {
+				sa1.iram[addr&0x7ff] = value
+			}
+		case addr >= 0x6000 && addr < 0x8000:
+			sa1.writeBWRAM((uint32(sa1.bmaps&0x1f)<<13)|uint32(addr&0x1fff), value, sa1.sbwe)
+		}
+		return
+	}
+	if bank >= 0x40 && bank < 0x50 {
+		sa1.writeBWRAM((uint32(bank&0xf)<<16)|uint32(addr), value, sa1.sbwe)
+	}
+}
+
+func (sa1 *SA1) readROMCPU(bank byte, addr uint16) byte {
+	// interrupt vector overrides for the S-CPU
+	if (bank&0x7f) == 0x00 && addr >= 0xffe0 {
+		switch addr {
+		case 0xffea, 0xffeb:
+			if sa1.cpuNVSelect {
+				return byte(sa1.snv >> ((addr & 1) * 8))
+			}
+		case 0xffee, 0xffef:
+			if sa1.cpuIVSelect {
+				return byte(sa1.siv >> ((addr & 1) * 8))
+			}
+		}
+	}
+	return sa1.readROM(bank, addr)
+}
+
+func (sa1 *SA1) readROM(bank byte, addr uint16) byte {
+	var offset uint32
+	if (bank & 0x40) == 0 {
+		// 00-1f, 20-3f, 80-9f, a0-bf:8000-ffff, lorom style
+		// fixed to the first 4 MB blocks unless bit 7 of the mmc register is set
+		var sel byte = ((bank >> 5) & 1) | ((bank >> 6) & 2)
+		var block byte = sel
+		if (sa1.mmc[sel] & 0x80) > 0 {
+			block = sa1.mmc[sel] & 7
+		}
+		offset = (uint32(block) << 20) | (uint32(bank&0x1f) << 15) | uint32(addr&0x7fff)
+	} else {
+		// c0-cf, d0-df, e0-ef, f0-ff: 1MB hirom blocks
+		var block byte = sa1.mmc[(bank>>4)&3] & 7
+		offset = (uint32(block) << 20) | (uint32(bank&0x0f) << 16) | uint32(addr)
+	}
+	return sa1.cartridge.rom[offset&(sa1.cartridge.romSize-1)]
+}
+
+func (sa1 *SA1) readBWRAMCPU(offset uint32) byte {
+	if sa1.cc1Active {
+		return sa1.cc1Read(offset)
+	}
+	return sa1.readBWRAM(offset)
+}
+
+func (sa1 *SA1) readBWRAM(offset uint32) byte {
+	return sa1.cartridge.ram.Read(offset & (sa1.cartridge.ramSize - 1))
+}
+
+func (sa1 *SA1) writeBWRAM(offset uint32, value byte, writeEnabled bool) {
+	offset &= sa1.cartridge.ramSize - 1
+	if !writeEnabled && offset < (256<<sa1.bwpa) {
+		// write protected area
+		return
+	}
+	sa1.cartridge.ram.Write(offset, value)
+}
+
+// bitmap view of BW-RAM (2 or 4 bits per byte address)
+func (sa1 *SA1) readBitmap(offset uint32) byte {
+	if sa1.bitmap2bpp {
+		return (sa1.readBWRAM(offset>>2) >> ((offset & 3) * 2)) & 3
+	}
+	return (sa1.readBWRAM(offset>>1) >> ((offset & 1) * 4)) & 15
+}
+
+func (sa1 *SA1) writeBitmap(offset uint32, value byte) {
+	if sa1.bitmap2bpp {
+		var shift uint32 = (offset & 3) * 2
+		var data byte = sa1.readBWRAM(offset >> 2)
+		data = (data & ^byte(3<<shift)) | ((value & 3) << shift)
+		sa1.writeBWRAM(offset>>2, data, sa1.cbwe)
+	} else {
+		var shift uint32 = (offset & 1) * 4
+		var data byte = sa1.readBWRAM(offset >> 1)
+		data = (data & ^byte(15<<shift)) | ((value & 15) << shift)
+		sa1.writeBWRAM(offset>>1, data, sa1.cbwe)
+	}
+}
+
+// SA-1 side
+
+func (sa1 *SA1) CPURead(addr uint32) byte {
+	sa1.memOps++
+	sa1.cyclesLeft += sa1.getAccessTime(addr)
+	return sa1.busRead(addr)
+}
+
+func (sa1 *SA1) CPUWrite(addr uint32, value byte) {
+	sa1.memOps++
+	sa1.cyclesLeft += sa1.getAccessTime(addr)
+	sa1.busWrite(addr, value)
+}
+
+// CPUIdle does nothing, the internal cycles are counted by Cycle
+func (sa1 *SA1) CPUIdle() {
+}
+
+func (sa1 *SA1) getAccessTime(addr uint32) int {
+	var bank byte = byte(addr >> 16)
+	var offset uint16 = uint16(addr)
+	// BW-RAM takes 2 SA-1 cycles, everything else 1
+	if (bank&0x40) == 0 && offset >= 0x6000 && offset < 0x8000 {
+		return 4
+	}
+	if bank >= 0x40 && bank < 0x70 {
+		return 4
+	}
+	return 2
+}
+
+func (sa1 *SA1) busRead(addr uint32) byte {
+	var bank byte = byte(addr >> 16)
+	var offset uint16 = uint16(addr)
+
+	// the SA-1 takes its vectors from the CRV, CNV and CIV registers
+	if bank == 0x00 && offset >= 0xffe0 {
+		switch offset {
+		case 0xfffc, 0xfffd:
+			return byte(sa1.crv >> ((offset & 1) * 8))
+		case 0xffea, 0xffeb:
+			return byte(sa1.cnv >> ((offset & 1) * 8))
+		case 0xffee, 0xffef:
+			return byte(sa1.civ >> ((offset & 1) * 8))
+		}
+	}
+
+	if (bank & 0x40) == 0 {
+		switch {
+		case offset < 0x0800:
+			return sa1.iram[offset]
+		case offset >= 0x2200 && offset < 0x2400:
+			return sa1.readIO(offset, true)
+		case offset >= 0x3000 && offset < 0x3800:
+			return sa1.iram[offset&0x7ff]
+		case offset >= 0x6000 && offset < 0x8000:
+			if (sa1.bmap & 0x80) > 0 {
+				return sa1.readBitmap((uint32(sa1.bmap&0x7f) << 13) | uint32(offset&0x1fff))
+			}
+			return sa1.readBWRAM((uint32(sa1.bmap&0x1f) << 13) | uint32(offset&0x1fff))
+		case offset >= 0x8000:
+			return sa1.readROM(bank, offset)
+		}
+		return 0
+	}
+	if bank >= 0xc0 {
+		return sa1.readROM(bank, offset)
+	}
+	if bank < 0x50 {
+		return sa1.readBWRAM((uint32(bank&0xf) << 16) | uint32(offset))
+	}
+	if bank >= 0x60 && bank < 0x70 {
+		return sa1.readBitmap((uint32(bank&0xf) << 16) | uint32(offset))
+	}
+
+	return 0
+}
+
+func (sa1 *SA1) busWrite(addr uint32, value byte) {
+	var bank byte = byte(addr >> 16)
+	var offset uint16 = uint16(addr)
+
+	if (bank & 0x40) == 0 {
+		switch {
+		case offset < 0x0800:
+			sa1.writeIRAM(offset, value)
+		case offset >= 0x2200 && offset < 0x2400:
+			sa1.writeIO(offset, value)
+		case offset >= 0x3000 && offset < 0x3800:
+			sa1.writeIRAM(offset, value)
+		case offset >= 0x6000 && offset < 0x8000:
+			if (sa1.bmap & 0x80) > 0 {
+				sa1.writeBitmap((uint32(sa1.bmap&0x7f)<<13)|uint32(offset&0x1fff), value)
+			} else {
+				sa1.writeBWRAM((uint32(sa1.bmap&0x1f)<<13)|uint32(offset&0x1fff), value, sa1.cbwe)
+			}
+		}
+		return
+	}
+	if bank >= 0x40 && bank < 0x50 {
+		sa1.writeBWRAM((uint32(bank&0xf)<<16)|uint32(offset), value, sa1.cbwe)
+	}
+	if bank >= 0x60 && bank < 0x70 {
+		sa1.writeBitmap((uint32(bank&0xf)<<16)|uint32(offset), value)
+	}
+}
+
+func (sa1 *SA1) writeIRAM(addr uint16, value byte) {
+	if (sa1.ciwp & (1 << ((addr >> 8) & 7))) > 0 {
+		sa1.iram[addr&0x7ff] = value
+	}
+}
+
+// I/O registers
+
+func (sa1 *SA1) readIO(addr uint16, fromSA1 bool) byte {
+	if !fromSA1 {
+		switch addr {
+		case 0x2300:
+			// SFR
+			var val byte = sa1.cmeg
+			if sa1.cpuIRQFlag {
+				val |= 1 << 7
+			}
+			if sa1.cpuIVSelect {
+				val |= 1 << 6
+			}
+			if sa1.chdmaIRQFlag {
+				val |= 1 << 5
+			}
+			if sa1.cpuNVSelect {
+				val |= 1 << 4
+			}
+			return val
+		case 0x230e:
+			return 0x23 // version
+		}
+		return sa1.cartridge.console.openBus
+	}
+
+	switch addr {
+	case 0x2301:
+		// CFR
+		var val byte = sa1.smeg
+		if sa1.sa1IRQFlag {
+			val |= 1 << 7
+		}
+		if sa1.timerIRQFlag {
+			val |= 1 << 6
+		}
+		if sa1.dmaIRQFlag {
+			val |= 1 << 5
+		}
+		if sa1.sa1NMIFlag {
+			val |= 1 << 4
+		}
+		return val
+	case 0x2302:
+		// reading the low h counter latches both counters
+		sa1.hLatch = sa1.hCounter >> 2
+		sa1.vLatch = sa1.vCounter
+		return byte(sa1.hLatch)
+	case 0x2303:
+		return byte(sa1.hLatch >> 8)
+	case 0x2304:
+		return byte(sa1.vLatch)
+	case 0x2305:
+		return byte(sa1.vLatch >> 8)
+	case 0x2306, 0x2307, 0x2308, 0x2309, 0x230a:
+		return byte(sa1.mr >> ((addr - 0x2306) * 8))
+	case 0x230b:
+		if sa1.overflow {
+			return 0x80
+		}
+		return 0
+	case 0x230c:
+		return byte(sa1.readVBR() >> sa1.vbit)
+	case 0x230d:
+		var val byte = byte(sa1.readVBR() >> (sa1.vbit + 8))
+		if sa1.vbdAuto {
+			sa1.advanceVBR()
+		}
+		return val
+	case 0x230e:
+		return 0x23
+	}
+
+	return 0
+}
+
+func (sa1 *SA1) writeIO(addr uint16, value byte) {
+	switch addr {
+	case 0x2200:
+		// CCNT
+		var wasReset bool = sa1.sa1Reset
+		sa1.sa1Wait = (value & 0x40) > 0
+		sa1.sa1Reset = (value & 0x20) > 0
+		sa1.smeg = value & 0xf
+		if (value & 0x80) > 0 {
+			sa1.sa1IRQFlag = true
+		}
+		if (value & 0x10) > 0 {
+			sa1.sa1NMIFlag = true
+			if sa1.sa1NMIEnable {
+				sa1.cpu.nmiWanted = true
+			}
+		}
+		if wasReset && !sa1.sa1Reset {
+			sa1.resetCPU()
+		}
+	case 0x2201:
+		// SIE
+		sa1.cpuIRQEnable = (value & 0x80) > 0
+		sa1.chdmaIRQEnable = (value & 0x20) > 0
+		sa1.updateCPUIRQ()
+	case 0x2202:
+		// SIC
+		if (value & 0x80) > 0 {
+			sa1.cpuIRQFlag = false
+		}
+		if (value & 0x20) > 0 {
+			sa1.chdmaIRQFlag = false
+		}
+		sa1.updateCPUIRQ()
+	case 0x2203:
+		sa1.crv = (sa1.crv & 0xff00) | uint16(value)
+	case 0x2204:
+		sa1.crv = (sa1.crv & 0x00ff) | (uint16(value) << 8)
+	case 0x2205:
+		sa1.cnv = (sa1.cnv & 0xff00) | uint16(value)
+	case 0x2206:
+		sa1.cnv = (sa1.cnv & 0x00ff) | (uint16(value) << 8)
+	case 0x2207:
+		sa1.civ = (sa1.civ & 0xff00) | uint16(value)
+	case 0x2208:
+		sa1.civ = (sa1.civ & 0x00ff) | (uint16(value) << 8)
+	case 0x2209:
+		// SCNT
+		sa1.cpuIVSelect = (value & 0x40) > 0
+		sa1.cpuNVSelect = (value & 0x10) > 0
+		sa1.cmeg = value & 0xf
+		if (value & 0x80) > 0 {
+			sa1.cpuIRQFlag = true
+		}
+		sa1.updateCPUIRQ()
+	case 0x220a:
+		// CIE
+		var nmiWasEnabled bool = sa1.sa1NMIEnable
+		sa1.sa1IRQEnable = (value & 0x80) > 0
+		sa1.timerIRQEnable = (value & 0x40) > 0
+		sa1.dmaIRQEnable = (value & 0x20) > 0
+		sa1.sa1NMIEnable = (value & 0x10) > 0
+		if !nmiWasEnabled && sa1.sa1NMIEnable && sa1.sa1NMIFlag {
+			sa1.cpu.nmiWanted = true
+		}
+	case 0x220b:
+		// CIC
+		if (value & 0x80) > 0 {
+			sa1.sa1IRQFlag = false
+		}
+		if (value & 0x40) > 0 {
+			sa1.timerIRQFlag = false
+		}
+		if (value & 0x20) > 0 {
+			sa1.dmaIRQFlag = false
+		}
+		if (value & 0x10) > 0 {
+			sa1.sa1NMIFlag = false
+		}
+	case 0x220c:
+		sa1.snv = (sa1.snv & 0xff00) | uint16(value)
+	case 0x220d:
+		sa1.snv = (sa1.snv & 0x00ff) | (uint16(value) << 8)
+	case 0x220e:
+		sa1.siv = (sa1.siv & 0xff00) | uint16(value)
+	case 0x220f:
+		sa1.siv = (sa1.siv & 0x00ff) | (uint16(value) << 8)
+	case 0x2210:
+		// TMC
+		sa1.timerLinear = (value & 0x80) > 0
+		sa1.timerVEnable = (value & 0x02) > 0
+		sa1.timerHEnable = (value & 0x01) > 0
+	case 0x2211:
+		// CTR: restart the timer
+		sa1.hCounter = 0
+		sa1.vCounter = 0
+	case 0x2212:
+		sa1.hCount = (sa1.hCount & 0x100) | uint16(value)
+	case 0x2213:
+		sa1.hCount = (sa1.hCount & 0x0ff) | ((uint16(value) & 1) << 8)
+	case 0x2214:
+		sa1.vCount = (sa1.vCount & 0x100) | uint16(value)
+	case 0x2215:
+		sa1.vCount = (sa1.vCount & 0x0ff) | ((uint16(value) & 1) << 8)
+	case 0x2220, 0x2221, 0x2222, 0x2223:
+		sa1.mmc[addr-0x2220] = value
+	case 0x2224:
+		sa1.bmaps = value & 0x1f
+	case 0x2225:
+		sa1.bmap = value
+	case 0x2226:
+		sa1.sbwe = (value & 0x80) > 0
+	case 0x2227:
+		sa1.cbwe = (value & 0x80) > 0
+	case 0x2228:
+		sa1.bwpa = value & 0xf
+	case 0x2229:
+		sa1.siwp = value
+	case 0x222a:
+		sa1.ciwp = value
+	case 0x2230:
+		// DCNT
+		sa1.dmaEnable = (value & 0x80) > 0
+		sa1.dmaPriority = (value & 0x40) > 0
+		sa1.cden = (value & 0x20) > 0
+		sa1.cdsel = (value & 0x10) > 0
+		sa1.dd = (value >> 2) & 1
+		sa1.sd = value & 3
+		if !sa1.dmaEnable {
+			sa1.dmaLine = 0
+		}
+	case 0x2231:
+		// CDMA
+		sa1.dmaCB = value & 3
+		if sa1.dmaCB == 3 {
+			sa1.dmaCB = 2
+		}
+		sa1.dmaSize = (value >> 2) & 7
+		if sa1.dmaSize > 5 {
+			sa1.dmaSize = 5
+		}
+		if (value & 0x80) > 0 {
+			// end of character conversion type 1
+			sa1.cc1Active = false
+		}
+	case 0x2232:
+		sa1.sda = (sa1.sda & 0xffff00) | uint32(value)
+	case 0x2233:
+		sa1.sda = (sa1.sda & 0xff00ff) | (uint32(value) << 8)
+	case 0x2234:
+		sa1.sda = (sa1.sda & 0x00ffff) | (uint32(value) << 16)
+	case 0x2235:
+		sa1.dda = (sa1.dda & 0xffff00) | uint32(value)
+	case 0x2236:
+		sa1.dda = (sa1.dda & 0xff00ff) | (uint32(value) << 8)
+		if sa1.dmaEnable {
+			if !sa1.cden && sa1.dd == 0 {
+				sa1.dmaNormal()
+			} else if sa1.cden && sa1.cdsel {
+				sa1.dmaCC1()
+			}
+		}
+	case 0x2237:
+		sa1.dda = (sa1.dda & 0x00ffff) | (uint32(value) << 16)
+		if sa1.dmaEnable && !sa1.cden && sa1.dd == 1 {
+			sa1.dmaNormal()
+		}
+	case 0x2238:
+		sa1.dtc = (sa1.dtc & 0xff00) | uint16(value)
+	case 0x2239:
+		sa1.dtc = (sa1.dtc & 0x00ff) | (uint16(value) << 8)
+	case 0x223f:
+		sa1.bitmap2bpp = (value & 0x80) > 0
+	case 0x2240, 0x2241, 0x2242, 0x2243, 0x2244, 0x2245, 0x2246, 0x2247,
+		0x2248, 0x2249, 0x224a, 0x224b, 0x224c, 0x224d, 0x224e, 0x224f:
+		sa1.brf[addr&0xf] = value
+		if (addr&7) == 7 && sa1.dmaEnable && sa1.cden && !sa1.cdsel {
+			sa1.dmaCC2()
+		}
+	case 0x2250:
+		// MCNT
+		sa1.mathDivide = (value & 0x01) > 0
+		sa1.mathSum = (value & 0x02) > 0
+		if sa1.mathSum {
+			sa1.mr = 0
+			sa1.overflow = false
+		}
+	case 0x2251:
+		sa1.ma = (sa1.ma & 0xff00) | uint16(value)
+	case 0x2252:
+		sa1.ma = (sa1.ma & 0x00ff) | (uint16(value) << 8)
+	case 0x2253:
+		sa1.mb = (sa1.mb & 0xff00) | uint16(value)
+	case 0x2254:
+		sa1.mb = (sa1.mb & 0x00ff) | (uint16(value) << 8)
+		sa1.doMath()
+	case 0x2258:
+		// VBD
+		sa1.vbdAuto = (value & 0x80) > 0
+		sa1.vbd = value & 0xf
+		if sa1.vbd == 0 {
+			sa1.vbd = 16
+		}
+		if !sa1.vbdAuto {
+			sa1.advanceVBR()
+		}
+	case 0x2259:
+		sa1.vda = (sa1.vda & 0xffff00) | uint32(value)
+	case 0x225a:
+		sa1.vda = (sa1.vda & 0xff00ff) | (uint32(value) << 8)
+	case 0x225b:
+		sa1.vda = (sa1.vda & 0x00ffff) | (uint32(value) << 16)
+		sa1.vbit = 0
+	}
+}
+
+func (sa1 *SA1) resetCPU() {
+	sa1.cpu.k = 0
+	sa1.cpu.db = 0
+	sa1.cpu.dp = 0
+	sa1.cpu.waiting = false
+	sa1.cpu.stopped = false
+	sa1.cpu.irqWanted = false
+	sa1.cpu.nmiWanted = false
+	sa1.cpu.Reset()
+	sa1.cyclesLeft = 0
+}
+
+func (sa1 *SA1) doMath() {
+	if sa1.mathSum {
+		// cumulative sum, 40 bit
+		sa1.mr += uint64(int64(int16(sa1.ma)) * int64(int16(sa1.mb)))
+		sa1.overflow = sa1.mr >= (1 << 40)
+		sa1.mr &= (1 << 40) - 1
+	} else if sa1.mathDivide {
+		// signed dividend, unsigned divisor
+		var dividend int32 = int32(int16(sa1.ma))
+		var divisor int32 = int32(sa1.mb)
+		var quotient, remainder uint16 = 0, 0
+		if divisor != 0 {
+			var r int32 = ((dividend % divisor) + divisor) % divisor
+			remainder = uint16(r)
+			quotient = uint16((dividend - r) / divisor)
+		}
+		sa1.mr = (uint64(remainder) << 16) | uint64(quotient)
+		sa1.ma = 0
+	} else {
+		sa1.mr = uint64(uint32(int32(int16(sa1.ma)) * int32(int16(sa1.mb))))
+	}
+	sa1.mb = 0
+}
+
+func (sa1 *SA1) readVBR() uint32 {
+	var data uint32 = uint32(sa1.busRead(sa1.vda & 0xffffff))
+	data |= uint32(sa1.busRead((sa1.vda+1)&0xffffff)) << 8
+	data |= uint32(sa1.busRead((sa1.vda+2)&0xffffff)) << 16
+	return data
+}
+
+func (sa1 *SA1) advanceVBR() {
+	sa1.vbit += sa1.vbd
+	sa1.vda += uint32(sa1.vbit >> 3)
+	sa1.vbit &= 7
+}
+
+// dma
+
+func (sa1 *SA1) dmaNormal() {
+	for sa1.dtc > 0 {
+		var value byte
+		switch sa1.sd {
+		case 0:
+			value = sa1.busRead(sa1.sda & 0xffffff)
+		case 1:
+			value = sa1.readBWRAM(sa1.sda)
+		default:
+			value = sa1.iram[sa1.sda&0x7ff]
+		}
+		if sa1.dd == 0 {
+			sa1.iram[sa1.dda&0x7ff] = value
+		} else {
+			sa1.cartridge.ram.Write(sa1.dda&(sa1.cartridge.ramSize-1), value)
+		}
+		sa1.sda++
+		sa1.dda++
+		sa1.dtc--
+	}
+	sa1.dmaIRQFlag = true
+}
+
+// character conversion type 1: the S-CPU dma reads BW-RAM bitmap data,
+// the SA-1 hands out the converted tiles through I-RAM instead
+func (sa1 *SA1) dmaCC1() {
+	sa1.cc1Active = true
+	sa1.chdmaIRQFlag = true
+	sa1.updateCPUIRQ()
+}
+
+func (sa1 *SA1) cc1Read(offset uint32) byte {
+	// 16 bytes per character (2bpp), 32 bytes (4bpp), 64 bytes (8bpp)
+	var charMask uint32 = (1 << (6 - sa1.dmaCB)) - 1
+
+	if (offset & charMask) == 0 {
+		// convert the next character into I-RAM
+		var bpp uint32 = 2 << (2 - sa1.dmaCB)
+		var bpl uint32 = (8 << sa1.dmaSize) >> sa1.dmaCB
+		var bwMask uint32 = sa1.cartridge.ramSize - 1
+		var tile uint32 = ((offset - sa1.sda) & bwMask) >> (6 - sa1.dmaCB)
+		var ty uint32 = tile >> sa1.dmaSize
+		var tx uint32 = tile & ((1 << sa1.dmaSize) - 1)
+		var bwAddr uint32 = sa1.sda + ty*8*bpl + tx*bpp
+
+		for y := uint32(0); y < 8; y++ {
+			var data uint64 = 0
+			for i := uint32(0); i < bpp; i++ {
+				data |= uint64(sa1.readBWRAM((bwAddr+i)&bwMask)) << (i * 8)
+			}
+			bwAddr += bpl
+
+			var out [8]byte
+			for x := 0; x < 8; x++ {
+				for plane := uint32(0); plane < bpp; plane++ {
+					out[plane] |= byte(data&1) << (7 - x)
+					data >>= 1
+				}
+			}
+
+			for i := uint32(0); i < bpp; i++ {
+				var p uint32 = sa1.dda + (y << 1) + ((i & 6) << 3) + (i & 1)
+				sa1.iram[p&0x7ff] = out[i]
+			}
+		}
+	}
+
+	return sa1.iram[(sa1.dda+(offset&charMask))&0x7ff]
+}
+
+// character conversion type 2: the SA-1 writes 8 pixels at a time to the
+// bitmap register file, they are converted to one tile row in I-RAM
+func (sa1 *SA1) dmaCC2() {
+	var brf []byte = sa1.brf[(sa1.dmaLine&1)<<3 : ((sa1.dmaLine&1)<<3)+8]
+	var bpp uint32 = 2 << (2 - sa1.dmaCB)
+	var addr uint32 = sa1.dda & 0x7ff
+	addr &= ^((uint32(1) << (7 - sa1.dmaCB)) - 1)
+	addr += uint32(sa1.dmaLine&8) * bpp
+	addr += uint32(sa1.dmaLine&7) * 2
+
+	for i := uint32(0); i < bpp; i++ {
+		var out byte = 0
+		for bit := 0; bit < 8; bit++ {
+			out |= ((brf[bit] >> i) & 1) << (7 - bit)
+		}
+		sa1.iram[(addr+((i&6)<<3)+(i&1))&0x7ff] = out
+	}
+
+	sa1.dmaLine = (sa1.dmaLine + 1) & 15
+}
+
+func (sa1 *SA1) Close() {
+}
+
+func (sa1 *SA1) Serialize(s *serializer) {
+	sa1.cpu.serialize(s)
+	s.bytes(sa1.iram[:])
+
+	var cyclesLeft uint32 = uint32(int32(sa1.cyclesLeft))
+	var memOps uint32 = uint32(sa1.memOps)
+	s.u32(&cyclesLeft)
+	s.u32(&memOps)
+	sa1.cyclesLeft = int(int32(cyclesLeft))
+	sa1.memOps = int(memOps)
+
+	s.bool(&sa1.sa1Wait)
+	s.bool(&sa1.sa1Reset)
+	s.u8(&sa1.smeg)
+	s.bool(&sa1.cpuIRQEnable)
+	s.bool(&sa1.chdmaIRQEnable)
+	s.u16(&sa1.crv)
+	s.u16(&sa1.cnv)
+	s.u16(&sa1.civ)
+	s.bool(&sa1.cpuIVSelect)
+	s.bool(&sa1.cpuNVSelect)
+	s.u8(&sa1.cmeg)
+	s.bool(&sa1.sa1IRQEnable)
+	s.bool(&sa1.timerIRQEnable)
+	s.bool(&sa1.dmaIRQEnable)
+	s.bool(&sa1.sa1NMIEnable)
+	s.u16(&sa1.snv)
+	s.u16(&sa1.siv)
+	s.bool(&sa1.cpuIRQFlag)
+	s.bool(&sa1.chdmaIRQFlag)
+	s.bool(&sa1.sa1IRQFlag)
+	s.bool(&sa1.timerIRQFlag)
+	s.bool(&sa1.dmaIRQFlag)
+	s.bool(&sa1.sa1NMIFlag)
+
+	s.bool(&sa1.timerLinear)
+	s.bool(&sa1.timerHEnable)
+	s.bool(&sa1.timerVEnable)
+	s.u16(&sa1.hCount)
+	s.u16(&sa1.vCount)
+	s.u16(&sa1.hCounter)
+	s.u16(&sa1.vCounter)
+	s.u16(&sa1.hLatch)
+	s.u16(&sa1.vLatch)
+
+	s.bytes(sa1.mmc[:])
+
+	s.u8(&sa1.bmaps)
+	s.u8(&sa1.bmap)
+	s.bool(&sa1.sbwe)
+	s.bool(&sa1.cbwe)
+	s.u8(&sa1.bwpa)
+	s.u8(&sa1.siwp)
+	s.u8(&sa1.ciwp)
+
+	s.bool(&sa1.dmaEnable)
+	s.bool(&sa1.dmaPriority)
+	s.bool(&sa1.cden)
+	s.bool(&sa1.cdsel)
+	s.u8(&sa1.dd)
+	s.u8(&sa1.sd)
+	s.u8(&sa1.dmaSize)
+	s.u8(&sa1.dmaCB)
+	s.u32(&sa1.sda)
+	s.u32(&sa1.dda)
+	s.u16(&sa1.dtc)
+	s.bool(&sa1.cc1Active)
+	s.bytes(sa1.brf[:])
+	s.u8(&sa1.dmaLine)
+	s.bool(&sa1.bitmap2bpp)
+
+	s.bool(&sa1.mathDivide)
+	s.bool(&sa1.mathSum)
+	s.u16(&sa1.ma)
+	s.u16(&sa1.mb)
+	s.u64(&sa1.mr)
+	s.bool(&sa1.overflow)
+
+	s.bool(&sa1.vbdAuto)
+	s.u8(&sa1.vbd)
+	s.u32(&sa1.vda)
+	s.u8(&sa1.vbit)
+}
@@ -0,0 +1,219 @@
+package chibisnes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Satellaview is the BS-X receiver unit on the expansion port, at
+// $2188-$219f. There is no satellite: the broadcast of a channel is read from
+// BSX<channel>-<n>.bin files (channel as 4 hex digits) next to the rom, one
+// file per transfer, n counting from 0. Files are sent in 22 byte packets,
+// each preceded by a status byte (bit 4: first packet, bit 7: last packet).
+//
+// registers: $2188-$2189 stream 1 channel, $218a queue size, $218b status,
+// $218c data, $218d status summary; $218e-$2193 the same for stream 2,
+// $2194 led, $2196 status, $2197 control, $2198-$2199 serial ports.
+type Satellaview struct {
+	dir string // where the broadcast files are
+
+	streams [2]satellaviewStream
+
+	led     byte
+	status  byte
+	control byte
+	serial  [2]byte
+}
+
+type satellaviewStream struct {
+	channel uint16
+	count   int32  // number of the file being received
+	data    []byte // file being received, nil if none
+	offset  int32  // next data byte
+	summary byte   // or of the status bytes read
+}
+
+const satellaviewPacketSize = 22
+
+func NewSatellaview(romFilePath string) *Satellaview {
+	return &Satellaview{
+		dir: filepath.Dir(filepath.Clean(romFilePath)),
+	}
+}
+
+func (satellaview *Satellaview) Reset() {
+	for i := 0; i < len(satellaview.streams); i++ {
+		satellaview.streams[i] = satellaviewStream{}
+	}
+	satellaview.led = 0
+	satellaview.status = 0
+	satellaview.control = 0
+	satellaview.serial[0] = 0
+	satellaview.serial[1] = 0
+}
+
+func (satellaview *Satellaview) Read(addr byte, openBus byte) byte {
+	switch addr {
+	case 0x94:
+		return satellaview.led
+	case 0x96:
+		return satellaview.status
+	case 0x97:
+		return satellaview.control
+	case 0x98, 0x99:
+		return satellaview.serial[addr-0x98]
+	}
+	if addr < 0x88 || addr >= 0x94 {
+		return openBus
+	}
+
+	var stream *satellaviewStream = &satellaview.streams[(addr-0x88)/6]
+	switch (addr - 0x88) % 6 {
+	case 0:
+		return byte(stream.channel)
+	case 1:
+		return byte(stream.channel >> 8)
+	case 2:
+		if stream.data == nil {
+			satellaview.open(stream)
+		}
+		return stream.queueSize()
+	case 3:
+		var value byte = stream.packetStatus()
+		stream.summary |= value
+		return value
+	case 4:
+		return stream.readData()
+	case 5:
+		var value byte = stream.summary
+		stream.summary = 0
+		return value
+	}
+	return openBus
+}
+
+func (satellaview *Satellaview) Write(addr byte, value byte) {
+	switch addr {
+	case 0x94:
+		satellaview.led = value
+		return
+	case 0x97:
+		satellaview.control = value
+		return
+	case 0x98, 0x99:
+		satellaview.serial[addr-0x98] = value
+		return
+	}
+	if addr < 0x88 || addr >= 0x94 {
+		return
+	}
+
+	var stream *satellaviewStream = &satellaview.streams[(addr-0x88)/6]
+	switch (addr - 0x88) % 6 {
+	case 0:
+		stream.channel = (stream.channel & 0xff00) | uint16(value)
+		stream.tune()
+	case 1:
+		stream.channel = (stream.channel & 0x00ff) | uint16(value)<<8
+		stream.tune()
+	}
+}
+
+// filePath returns the path of a broadcast file of the channel
+func (satellaview *Satellaview) filePath(channel uint16, count int32) string {
+	return filepath.Join(satellaview.dir, fmt.Sprintf("BSX%04X-%d.bin", channel, count))
+}
+
+// open starts receiving the next file of the channel, starting over at the
+// first file after the last one
+func (satellaview *Satellaview) open(stream *satellaviewStream) {
+	data, err := os.ReadFile(satellaview.filePath(stream.channel, stream.count))
+	if err != nil && stream.count > 0 {
+		stream.count = 0
+		data, err = os.ReadFile(satellaview.filePath(stream.channel, stream.count))
+	}
+	if err != nil || len(data) == 0 {
+		return
+	}
+	stream.data = data
+	stream.offset = 0
+}
+
+// tune switches to another channel
+func (stream *satellaviewStream) tune() {
+	stream.count = 0
+	stream.data = nil
+	stream.offset = 0
+	stream.summary = 0
+}
+
+// queueSize returns the number of packets left
+func (stream *satellaviewStream) queueSize() byte {
+	if stream.data == nil {
+		return 0
+	}
+	var packets int32 = (int32(len(stream.data)) - stream.offset + satellaviewPacketSize - 1) / satellaviewPacketSize
+	if packets > 0x7f {
+		packets = 0x7f
+	}
+	return byte(packets)
+}
+
+// packetStatus returns the status byte of the current packet
+func (stream *satellaviewStream) packetStatus() byte {
+	if stream.data == nil {
+		return 0
+	}
+	var value byte = 0
+	if stream.offset < satellaviewPacketSize {
+		value |= 0x10
+	}
+	var packetStart int32 = stream.offset - stream.offset%satellaviewPacketSize
+	if packetStart+satellaviewPacketSize >= int32(len(stream.data)) {
+		value |= 0x80
+	}
+	return value
+}
+
+func (stream *satellaviewStream) readData() byte {
+	if stream.data == nil {
+		return 0
+	}
+	var value byte = 0
+	if stream.offset < int32(len(stream.data)) {
+		value = stream.data[stream.offset]
+	}
+	stream.offset++
+	if stream.offset%satellaviewPacketSize == 0 && stream.offset >= int32(len(stream.data)) {
+		// file done, the next one is received after it
+		stream.data = nil
+		stream.offset = 0
+		stream.count++
+	}
+	return value
+}
+
+func (satellaview *Satellaview) serialize(s *serializer) {
+	for i := 0; i < len(satellaview.streams); i++ {
+		var stream *satellaviewStream = &satellaview.streams[i]
+		var loaded bool = stream.data != nil
+		s.u16(&stream.channel)
+		s.i32(&stream.count)
+		s.bool(&loaded)
+		s.i32(&stream.offset)
+		s.u8(&stream.summary)
+		if s.loading {
+			stream.data = nil
+			if loaded {
+				var offset int32 = stream.offset
+				satellaview.open(stream)
+				stream.offset = offset
+			}
+		}
+	}
+	s.u8(&satellaview.led)
+	s.u8(&satellaview.status)
+	s.u8(&satellaview.control)
+	s.bytes(satellaview.serial[:])
+}
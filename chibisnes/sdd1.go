@@ -0,0 +1,384 @@
+package chibisnes
+
+import "log"
+
+// SDD1 is the S-DD1: it maps 1MB rom banks into c0-ff and decompresses
+// graphics on the fly while a dma channel reads them from there.
+//
+// the decompressor is Andreas Naive's S-DD1 algorithm: an input manager
+// feeding 8 golomb-code bit generators, a probability estimation module
+// with 32 contexts, a context model picking the context from the
+// previous bits of the current bitplane and an output logic merging the
+// bitplanes back into bytes.
+type SDD1 struct {
+	cartridge *Cartridge
+
+	r4800 byte    // dma channels with decompression enabled
+	r4801 byte    // dma channels armed for the next transfer
+	mmc   [4]byte // 1MB rom bank mapped at c0-cf, d0-df, e0-ef, f0-ff
+
+	dmaReady bool // decompressor started for the current transfer
+	dmaLeft  int  // bytes left in the current transfer
+
+	decompressor sdd1Decompressor
+}
+
+type sdd1Decompressor struct {
+	sdd1 *SDD1
+
+	// input manager
+	offset   uint32
+	bitCount byte
+
+	// bits generators, one per golomb code number
+	mpsCount [8]byte
+	lpsIndex [8]byte
+
+	// probability estimation module
+	contextStatus [32]byte
+	contextMps    [32]byte
+
+	// context model
+	cmBitplanesInfo     byte
+	cmContextBitsInfo   byte
+	cmBitNumber         byte
+	cmCurrentBitplane   byte
+	previousBitplaneBit [8]uint16
+
+	// output logic
+	olBitplanesInfo byte
+	r0              byte
+	r1              byte
+	r2              byte
+}
+
+// code number, next state if mps, next state if lps
+var sdd1EvolutionTable [33][3]byte = [33][3]byte{
+	{0, 25, 25}, {0, 2, 1}, {0, 3, 1}, {0, 4, 2}, {0, 5, 3},
+	{1, 6, 4}, {1, 7, 5}, {1, 8, 6}, {1, 9, 7}, {2, 10, 8},
+	{2, 11, 9}, {2, 12, 10}, {2, 13, 11}, {3, 14, 12}, {3, 15, 13},
+	{3, 16, 14}, {3, 17, 15}, {4, 18, 16}, {4, 19, 17}, {5, 20, 18},
+	{5, 21, 19}, {6, 22, 20}, {6, 23, 21}, {7, 24, 22}, {7, 24, 23},
+	{0, 26, 1}, {1, 27, 2}, {2, 28, 4}, {3, 29, 8}, {4, 30, 12},
+	{5, 31, 16}, {6, 32, 18}, {7, 24, 22},
+}
+
+// mps run length for a code word starting with 1 (the lps flag), for code
+// word w in [2^k, 2^(k+1)): (2^k - 1) - bitreverse_k(w - 2^k)
+var sdd1RunCount [256]byte = func() [256]byte {
+	var table [256]byte
+	for k := uint(0); k < 8; k++ {
+		for j := 0; j < (1 << k); j++ {
+			var reversed int = 0
+			for b := uint(0); b < k; b++ {
+				if (j & (1 << b)) > 0 {
+					reversed |= 1 << (k - 1 - b)
+				}
+			}
+			table[(1<<k)+j] = byte((1 << k) - 1 - reversed)
+		}
+	}
+	return table
+}()
+
+func init() {
+	registerChip(mapperRegistration{
+		name: "S-DD1",
+		match: func(header *CartridgeHeader) bool {
+			return header.coprocessor == 4
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			log.Printf("ROM: S-DD1 enabled\n")
+			return NewSDD1(cartridge), nil
+		},
+	})
+}
+
+func NewSDD1(cartridge *Cartridge) *SDD1 {
+	sdd1 := &SDD1{
+		cartridge: cartridge,
+	}
+	sdd1.decompressor.sdd1 = sdd1
+	return sdd1
+}
+
+func (sdd1 *SDD1) Reset() {
+	sdd1.r4800 = 0
+	sdd1.r4801 = 0
+	sdd1.mmc = [4]byte{0, 1, 2, 3}
+	sdd1.dmaReady = false
+	sdd1.dmaLeft = 0
+}
+
+// mmcRead reads the rom through the c0-ff bank mapping
+func (sdd1 *SDD1) mmcRead(addr uint32) byte {
+	var cartridge *Cartridge = sdd1.cartridge
+	var offset uint32 = (uint32(sdd1.mmc[(addr>>20)&3]) << 20) | (addr & 0xfffff)
+	return cartridge.rom[offset&(cartridge.romSize-1)]
+}
+
+func (sdd1 *SDD1) Mapped(bank byte, addr uint16) bool {
+	if bank >= 0xc0 {
+		return true
+	}
+	return (bank&0x7f) < 0x40 && addr >= 0x4800 && addr < 0x4808
+}
+
+func (sdd1 *SDD1) Read(bank byte, addr uint16) byte {
+	if bank >= 0xc0 {
+		return sdd1.mmcRead((uint32(bank) << 16) | uint32(addr))
+	}
+	switch addr {
+	case 0x4800:
+		return sdd1.r4800
+	case 0x4801:
+		return sdd1.r4801
+	case 0x4804, 0x4805, 0x4806, 0x4807:
+		return sdd1.mmc[addr-0x4804]
+	}
+	return sdd1.cartridge.console.openBus
+}
+
+func (sdd1 *SDD1) Write(bank byte, addr uint16, value byte) {
+	if bank >= 0xc0 {
+		return
+	}
+	switch addr {
+	case 0x4800:
+		sdd1.r4800 = value
+	case 0x4801:
+		sdd1.r4801 = value
+	case 0x4804, 0x4805, 0x4806, 0x4807:
+		sdd1.mmc[addr-0x4804] = value & 0xf
+	}
+}
+
+// dmaRead gives the next decompressed byte if dma channel i is reading
+// from c0-ff with decompression enabled and armed
+func (sdd1 *SDD1) dmaRead(i int, addr uint32, size uint16) (byte, bool) {
+	var mask byte = 1 << i
+	if (sdd1.r4800&sdd1.r4801&mask) == 0 || (addr>>16) < 0xc0 {
+		return 0, false
+	}
+	if !sdd1.dmaReady {
+		sdd1.decompressor.init(addr)
+		sdd1.dmaReady = true
+		sdd1.dmaLeft = int(size)
+		if sdd1.dmaLeft == 0 {
+			sdd1.dmaLeft = 0x10000
+		}
+	}
+	var value byte = sdd1.decompressor.read()
+	sdd1.dmaLeft--
+	if sdd1.dmaLeft == 0 {
+		sdd1.dmaReady = false
+		sdd1.r4801 &= ^mask
+	}
+	return value, true
+}
+
+func (sdd1 *SDD1) Cycle() {
+}
+
+func (sdd1 *SDD1) Close() {
+}
+
+func (sdd1 *SDD1) Serialize(s *serializer) {
+	s.u8(&sdd1.r4800)
+	s.u8(&sdd1.r4801)
+	s.bytes(sdd1.mmc[:])
+	s.bool(&sdd1.dmaReady)
+	var dmaLeft uint32 = uint32(sdd1.dmaLeft)
+	s.u32(&dmaLeft)
+	sdd1.dmaLeft = int(dmaLeft)
+
+	var d *sdd1Decompressor = &sdd1.decompressor
+	s.u32(&d.offset)
+	s.u8(&d.bitCount)
+	s.bytes(d.mpsCount[:])
+	s.bytes(d.lpsIndex[:])
+	s.bytes(d.contextStatus[:])
+	s.bytes(d.contextMps[:])
+	s.u8(&d.cmBitplanesInfo)
+	s.u8(&d.cmContextBitsInfo)
+	s.u8(&d.cmBitNumber)
+	s.u8(&d.cmCurrentBitplane)
+	s.u16s(d.previousBitplaneBit[:])
+	s.u8(&d.olBitplanesInfo)
+	s.u8(&d.r0)
+	s.u8(&d.r1)
+	s.u8(&d.r2)
+}
+
+// decompressor
+
+func (d *sdd1Decompressor) init(addr uint32) {
+	// input manager
+	d.offset = addr
+	d.bitCount = 4
+
+	// bits generators
+	for i := 0; i < 8; i++ {
+		d.mpsCount[i] = 0
+		d.lpsIndex[i] = 0
+	}
+
+	// probability estimation module
+	for i := 0; i < 32; i++ {
+		d.contextStatus[i] = 0
+		d.contextMps[i] = 0
+	}
+
+	// context model
+	var header byte = d.sdd1.mmcRead(addr)
+	d.cmBitplanesInfo = header & 0xc0
+	d.cmContextBitsInfo = header & 0x30
+	d.cmBitNumber = 0
+	for i := 0; i < 8; i++ {
+		d.previousBitplaneBit[i] = 0
+	}
+	switch d.cmBitplanesInfo {
+	case 0x00:
+		d.cmCurrentBitplane = 1
+	case 0x40:
+		d.cmCurrentBitplane = 7
+	case 0x80:
+		d.cmCurrentBitplane = 3
+	}
+
+	// output logic
+	d.olBitplanesInfo = header & 0xc0
+	d.r0 = 0x01
+}
+
+// getCodeWord returns the next code word from the input manager
+func (d *sdd1Decompressor) getCodeWord(codeLength byte) byte {
+	var codeWord byte = d.sdd1.mmcRead(d.offset) << d.bitCount
+	d.bitCount++
+	if (codeWord & 0x80) > 0 {
+		codeWord |= d.sdd1.mmcRead(d.offset+1) >> (9 - d.bitCount)
+		d.bitCount += codeLength
+	}
+	if (d.bitCount & 0x08) > 0 {
+		d.offset++
+		d.bitCount &= 0x07
+	}
+	return codeWord
+}
+
+// getRunCount is the golomb-code decoder
+func (d *sdd1Decompressor) getRunCount(codeNumber byte) {
+	var codeWord byte = d.getCodeWord(codeNumber)
+	if (codeWord & 0x80) > 0 {
+		d.lpsIndex[codeNumber] = 1
+		d.mpsCount[codeNumber] = sdd1RunCount[codeWord>>(codeNumber^0x07)]
+	} else {
+		d.mpsCount[codeNumber] = 1 << codeNumber
+	}
+}
+
+// getGeneratorBit returns the next bit of bits generator codeNumber and
+// whether its run ended
+func (d *sdd1Decompressor) getGeneratorBit(codeNumber byte) (byte, bool) {
+	if d.mpsCount[codeNumber] == 0 && d.lpsIndex[codeNumber] == 0 {
+		d.getRunCount(codeNumber)
+	}
+	var bit byte
+	if d.mpsCount[codeNumber] > 0 {
+		bit = 0
+		d.mpsCount[codeNumber]--
+	} else {
+		bit = 1
+		d.lpsIndex[codeNumber] = 0
+	}
+	return bit, d.mpsCount[codeNumber] == 0 && d.lpsIndex[codeNumber] == 0
+}
+
+// getProbableBit is the probability estimation module
+func (d *sdd1Decompressor) getProbableBit(context byte) byte {
+	var currentStatus byte = d.contextStatus[context]
+	var currentMps byte = d.contextMps[context]
+	var state [3]byte = sdd1EvolutionTable[currentStatus]
+
+	bit, endOfRun := d.getGeneratorBit(state[0])
+	if endOfRun {
+		if bit > 0 {
+			if (currentStatus & 0xfe) == 0 {
+				d.contextMps[context] ^= 0x01
+			}
+			d.contextStatus[context] = state[2]
+		} else {
+			d.contextStatus[context] = state[1]
+		}
+	}
+	return bit ^ currentMps
+}
+
+// getContextBit is the context model
+func (d *sdd1Decompressor) getContextBit() byte {
+	switch d.cmBitplanesInfo {
+	case 0x00:
+		d.cmCurrentBitplane ^= 0x01
+	case 0x40:
+		d.cmCurrentBitplane ^= 0x01
+		if (d.cmBitNumber & 0x7f) == 0 {
+			d.cmCurrentBitplane = (d.cmCurrentBitplane + 2) & 0x07
+		}
+	case 0x80:
+		d.cmCurrentBitplane ^= 0x01
+		if (d.cmBitNumber & 0x7f) == 0 {
+			d.cmCurrentBitplane ^= 0x02
+		}
+	case 0xc0:
+		d.cmCurrentBitplane = d.cmBitNumber & 0x07
+	}
+
+	var contextBits uint16 = d.previousBitplaneBit[d.cmCurrentBitplane]
+	var currentContext byte = (d.cmCurrentBitplane & 0x01) << 4
+	switch d.cmContextBitsInfo {
+	case 0x00:
+		currentContext |= byte(((contextBits & 0x01c0) >> 5) | (contextBits & 0x0001))
+	case 0x10:
+		currentContext |= byte(((contextBits & 0x0180) >> 5) | (contextBits & 0x0001))
+	case 0x20:
+		currentContext |= byte(((contextBits & 0x00c0) >> 5) | (contextBits & 0x0001))
+	case 0x30:
+		currentContext |= byte(((contextBits & 0x0180) >> 5) | (contextBits & 0x0003))
+	}
+
+	var bit byte = d.getProbableBit(currentContext)
+	d.previousBitplaneBit[d.cmCurrentBitplane] = (contextBits << 1) | uint16(bit)
+	d.cmBitNumber++
+	return bit
+}
+
+// read is the output logic, it returns the next decompressed byte
+func (d *sdd1Decompressor) read() byte {
+	switch d.olBitplanesInfo {
+	case 0x00, 0x40, 0x80:
+		// 2 bitplanes interleaved, the second byte was decoded with the first
+		if d.r0 == 0 {
+			d.r0 = ^d.r0
+			return d.r2
+		}
+		d.r1 = 0
+		d.r2 = 0
+		for d.r0 = 0x80; d.r0 > 0; d.r0 >>= 1 {
+			if d.getContextBit() > 0 {
+				d.r1 |= d.r0
+			}
+			if d.getContextBit() > 0 {
+				d.r2 |= d.r0
+			}
+		}
+		return d.r1
+	}
+	// 0xc0: mode 7 style, one byte at a time
+	d.r1 = 0
+	for d.r0 = 0x01; d.r0 > 0; d.r0 <<= 1 {
+		if d.getContextBit() > 0 {
+			d.r1 |= d.r0
+		}
+	}
+	return d.r1
+}
@@ -0,0 +1,124 @@
+package chibisnes
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// serializer moves machine state to or from a stream. Every component has a
+// single serialize method that is used for both saving and loading, so the
+// field order only has to be written down once.
+type serializer struct {
+	w       io.Writer
+	r       io.Reader
+	loading bool
+	err     error
+	buf     [8]byte
+}
+
+func newSaveSerializer(w io.Writer) *serializer {
+	return &serializer{w: w}
+}
+
+func newLoadSerializer(r io.Reader) *serializer {
+	return &serializer{r: r, loading: true}
+}
+
+func (s *serializer) raw(data []byte) {
+	if s.err != nil {
+		return
+	}
+	if s.loading {
+		_, s.err = io.ReadFull(s.r, data)
+	} else {
+		_, s.err = s.w.Write(data)
+	}
+}
+
+func (s *serializer) u8(v *byte) {
+	s.buf[0] = *v
+	s.raw(s.buf[:1])
+	if s.loading && s.err == nil {
+		*v = s.buf[0]
+	}
+}
+
+func (s *serializer) u16(v *uint16) {
+	binary.LittleEndian.PutUint16(s.buf[:2], *v)
+	s.raw(s.buf[:2])
+	if s.loading && s.err == nil {
+		*v = binary.LittleEndian.Uint16(s.buf[:2])
+	}
+}
+
+func (s *serializer) u32(v *uint32) {
+	binary.LittleEndian.PutUint32(s.buf[:4], *v)
+	s.raw(s.buf[:4])
+	if s.loading && s.err == nil {
+		*v = binary.LittleEndian.Uint32(s.buf[:4])
+	}
+}
+
+func (s *serializer) u64(v *uint64) {
+	binary.LittleEndian.PutUint64(s.buf[:8], *v)
+	s.raw(s.buf[:8])
+	if s.loading && s.err == nil {
+		*v = binary.LittleEndian.Uint64(s.buf[:8])
+	}
+}
+
+func (s *serializer) i8(v *int8) {
+	var u byte = byte(*v)
+	s.u8(&u)
+	*v = int8(u)
+}
+
+func (s *serializer) i16(v *int16) {
+	var u uint16 = uint16(*v)
+	s.u16(&u)
+	*v = int16(u)
+}
+
+func (s *serializer) i32(v *int32) {
+	var u uint32 = uint32(*v)
+	s.u32(&u)
+	*v = int32(u)
+}
+
+func (s *serializer) f64(v *float64) {
+	var u uint64 = math.Float64bits(*v)
+	s.u64(&u)
+	*v = math.Float64frombits(u)
+}
+
+func (s *serializer) bool(v *bool) {
+	var u byte = 0
+	if *v {
+		u = 1
+	}
+	s.u8(&u)
+	*v = u != 0
+}
+
+func (s *serializer) bytes(data []byte) {
+	s.raw(data)
+}
+
+func (s *serializer) u16s(data []uint16) {
+	for i := 0; i < len(data); i++ {
+		s.u16(&data[i])
+	}
+}
+
+func (s *serializer) i16s(data []int16) {
+	for i := 0; i < len(data); i++ {
+		s.i16(&data[i])
+	}
+}
+
+func (s *serializer) bools(data []bool) {
+	for i := 0; i < len(data); i++ {
+		s.bool(&data[i])
+	}
+}
@@ -0,0 +1,414 @@
+package chibisnes
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ICD2 is the Super Game Boy interface chip between the Game Boy and the
+// SNES. The SGB BIOS is the cartridge rom (LoROM), the ICD2 registers are at
+// 00-3f,80-bf:6000-67ff,7000-7fff. The Game Boy screen is kept as 4 banks of
+// 8 lines of 2bpp tiles, the BIOS copies them to VRAM through $7800. The
+// packets the Game Boy sends through its joypad port (palettes, borders,
+// attributes, ...) are read by the BIOS at $7000, which does the rest.
+//
+// registers:
+// $6000 (r) bits 3-7 line being drawn, bits 0-1 bank being written
+// $6001 (w) bank to read at $7800
+// $6002 (r) bit 0 packet ready, the read moves it to $7000-$700f
+// $6003 (w) bit 7 Game Boy running (reset when 0), bits 4-5 number of
+// joypads, bits 0-1 clock divider (4, 5, 7 or 9 master clocks)
+// $6004-$6007 (w) joypads 1-4
+// $600f (r) revision
+// $7000-$700f (r) packet
+// $7800 (r) screen data of the read bank
+//
+// Without sgb_boot.bin (the 256 bytes Game Boy boot rom of the SGB) next to
+// the BIOS the Game Boy starts at $0100 and the header packets of the boot
+// rom are sent right away.
+type ICD2 struct {
+	cartridge *Cartridge
+
+	gb *GameBoy
+
+	output      [4 * 512]byte
+	readBank    byte
+	readAddress uint16
+	writeBank   byte
+	hcounter    byte
+	vcounter    byte
+
+	r6003   byte
+	joypads [4]byte
+	r7000   [16]byte
+	mltReq  byte // number of joypads: 0 1, 1 2, 3 4
+
+	// packets sent by the Game Boy
+	packets      [64][16]byte
+	packetSize   int32
+	joypPacket   [16]byte
+	packetOffset byte
+	bitData      byte
+	bitOffset    byte
+	joypID       byte
+	joyp14Lock   bool
+	joyp15Lock   bool
+	pulseLock    bool
+	strobeLock   bool
+	packetLock   bool
+
+	cycles int32 // master clocks the Game Boy is behind
+}
+
+var icd2Dividers [4]int32 = [4]int32{4, 5, 7, 9}
+
+// isSuperGameBoyBIOS reports if data is the SGB BIOS
+func isSuperGameBoyBIOS(data []byte) bool {
+	return len(data) >= 0x8000 && strings.HasPrefix(string(data[0x7fc0:0x7fd5]), "Super GAMEBOY")
+}
+
+// isGameBoyFile reports if the file is a Game Boy rom, by its extension
+func isGameBoyFile(filePath string) bool {
+	var ext string = filepath.Ext(filePath)
+	return strings.EqualFold(ext, ".gb") || strings.EqualFold(ext, ".gbc")
+}
+
+func NewICD2(cartridge *Cartridge, file ROMFile) (*ICD2, error) {
+	icd2 := &ICD2{
+		cartridge: cartridge,
+	}
+
+	var romDir string = filepath.Dir(filepath.Clean(cartridge.console.RomFilePath))
+	bootROM, err := os.ReadFile(filepath.Join(romDir, "sgb_boot.bin"))
+	if err != nil || len(bootROM) != 0x100 {
+		bootROM = nil
+	}
+
+	gb, err := NewGameBoy(icd2, file.Data, file.Path, bootROM)
+	if err != nil {
+		return nil, err
+	}
+	icd2.gb = gb
+	log.Printf("ROM: Super Game Boy enabled, boot rom: %t\n", bootROM != nil)
+	return icd2, nil
+}
+
+func (icd2 *ICD2) Reset() {
+	icd2.r6003 = 0
+	icd2.power()
+}
+
+// power resets the ICD2 and the Game Boy, on a reset of the SNES and when
+// the BIOS starts the Game Boy
+func (icd2 *ICD2) power() {
+	for i := 0; i < len(icd2.output); i++ {
+		icd2.output[i] = 0
+	}
+	icd2.readBank = 0
+	icd2.readAddress = 0
+	icd2.writeBank = 0
+	icd2.hcounter = 0
+	icd2.vcounter = 0
+	for i := 0; i < len(icd2.joypads); i++ {
+		icd2.joypads[i] = 0xff
+	}
+	for i := 0; i < len(icd2.r7000); i++ {
+		icd2.r7000[i] = 0
+	}
+	icd2.mltReq = 0
+	icd2.packetSize = 0
+	icd2.packetOffset = 0
+	icd2.bitData = 0
+	icd2.bitOffset = 0
+	icd2.joypID = 3
+	icd2.joyp14Lock = false
+	icd2.joyp15Lock = false
+	icd2.pulseLock = true
+	icd2.strobeLock = false
+	icd2.packetLock = false
+	icd2.cycles = 0
+	icd2.gb.Reset()
+}
+
+func (icd2 *ICD2) Close() {
+	icd2.gb.Close()
+}
+
+// Cycle runs for 2 master clocks
+func (icd2 *ICD2) Cycle() {
+	if (icd2.r6003 & 0x80) == 0 {
+		return
+	}
+	icd2.cycles += 2
+	var divider int32 = icd2Dividers[icd2.r6003&3]
+	for icd2.cycles > 0 {
+		icd2.cycles -= int32(icd2.gb.cpu.Step()) * divider
+	}
+}
+
+func (icd2 *ICD2) Mapped(bank byte, addr uint16) bool {
+	return (bank&0x7f) < 0x40 && ((addr >= 0x6000 && addr < 0x6800) || (addr >= 0x7000 && addr < 0x8000))
+}
+
+func (icd2 *ICD2) Read(bank byte, addr uint16) byte {
+	switch {
+	case addr == 0x6000:
+		return (icd2.vcounter &^ 7) | icd2.writeBank
+	case addr == 0x6002:
+		if icd2.packetSize == 0 {
+			return 0
+		}
+		icd2.r7000 = icd2.packets[0]
+		icd2.packetSize--
+		copy(icd2.packets[:icd2.packetSize], icd2.packets[1:icd2.packetSize+1])
+		return 1
+	case addr == 0x600f:
+		return 0x21
+	case addr >= 0x7000 && addr < 0x7800:
+		return icd2.r7000[addr&0xf]
+	case addr >= 0x7800:
+		var value byte = icd2.output[uint16(icd2.readBank)*512+icd2.readAddress]
+		if icd2.readAddress < 511 {
+			icd2.readAddress++
+		}
+		return value
+	}
+	return 0
+}
+
+func (icd2 *ICD2) Write(bank byte, addr uint16, value byte) {
+	switch addr {
+	case 0x6001:
+		icd2.readBank = value & 3
+		icd2.readAddress = 0
+	case 0x6003:
+		if (icd2.r6003&0x80) == 0 && (value&0x80) > 0 {
+			icd2.power()
+		}
+		icd2.r6003 = value
+	case 0x6004, 0x6005, 0x6006, 0x6007:
+		icd2.joypads[addr-0x6004] = value
+	}
+}
+
+// ppuHreset is called when the Game Boy goes to the next line
+func (icd2 *ICD2) ppuHreset() {
+	icd2.hcounter = 0
+	icd2.vcounter++
+	if (icd2.vcounter & 7) == 0 {
+		icd2.writeBank = (icd2.writeBank + 1) & 3
+	}
+}
+
+// ppuVreset is called when the Game Boy starts a frame
+func (icd2 *ICD2) ppuVreset() {
+	icd2.hcounter = 0
+	icd2.vcounter = 0
+}
+
+// ppuWrite puts the next pixel of the line in the tiles of the write bank
+func (icd2 *ICD2) ppuWrite(color byte) {
+	var x byte = icd2.hcounter
+	icd2.hcounter++
+	if x >= 160 {
+		return
+	}
+	var addr uint16 = uint16(icd2.writeBank)*512 + uint16(icd2.vcounter&7)*2 + uint16(x/8)*16
+	icd2.output[addr] = (icd2.output[addr] << 1) | (color & 1)
+	icd2.output[addr+1] = (icd2.output[addr+1] << 1) | ((color >> 1) & 1)
+}
+
+// joypadInput returns the low nibble of $ff00 for the selected lines
+func (icd2 *ICD2) joypadInput(selection byte) byte {
+	var p14 bool = (selection & 0x10) > 0
+	var p15 bool = (selection & 0x20) > 0
+	var joypad byte = icd2.joypads[icd2.joypID&3]
+	var input byte = 0xf
+	if p14 && p15 {
+		// the joypad id is read with nothing selected
+		input = 0xf - icd2.joypID
+	}
+	if !p14 {
+		input &= joypad & 0xf
+	}
+	if !p15 {
+		input &= joypad >> 4
+	}
+	return input
+}
+
+// joypWrite follows the lines of the joypad port: switching joypads when
+// both go high after a MLT_REQ, and the packets otherwise. A packet starts
+// with both lines low, then each bit is one line low (p14 for 0, p15 for
+// 1) followed by both high, 16 bytes and a final 0.
+func (icd2 *ICD2) joypWrite(p14 bool, p15 bool) {
+	if p14 && p15 {
+		if !icd2.joyp14Lock && !icd2.joyp15Lock {
+			icd2.joyp14Lock = true
+			icd2.joyp15Lock = true
+			icd2.joypID++
+			switch icd2.mltReq {
+			case 0:
+				icd2.joypID &= 0
+			case 1:
+				icd2.joypID &= 1
+			default:
+				icd2.joypID &= 3
+			}
+		}
+	}
+	if !p14 && p15 {
+		icd2.joyp14Lock = false
+	}
+	if p14 && !p15 {
+		icd2.joyp15Lock = false
+	}
+
+	if !p14 && !p15 {
+		// reset pulse
+		icd2.pulseLock = false
+		icd2.packetOffset = 0
+		icd2.bitOffset = 0
+		icd2.strobeLock = true
+		icd2.packetLock = false
+		return
+	}
+	if icd2.pulseLock {
+		return
+	}
+	if p14 && p15 {
+		icd2.strobeLock = false
+		return
+	}
+	if icd2.strobeLock {
+		// malformed packet
+		icd2.packetLock = false
+		icd2.pulseLock = true
+		icd2.bitOffset = 0
+		icd2.packetOffset = 0
+		return
+	}
+
+	icd2.strobeLock = true
+	if icd2.packetLock {
+		if !p14 && p15 {
+			// stop bit
+			if (icd2.joypPacket[0] >> 3) == 0x11 {
+				// MLT_REQ
+				icd2.mltReq = icd2.joypPacket[1] & 3
+				if icd2.mltReq == 2 {
+					icd2.mltReq = 3
+				}
+				icd2.joypID = 0
+			}
+			icd2.queuePacket(icd2.joypPacket)
+			icd2.packetLock = false
+			icd2.pulseLock = true
+		}
+		return
+	}
+
+	var bit byte = 0
+	if !p15 {
+		bit = 1
+	}
+	icd2.bitData = bit<<7 | icd2.bitData>>1
+	icd2.bitOffset = (icd2.bitOffset + 1) & 7
+	if icd2.bitOffset != 0 {
+		return
+	}
+	icd2.joypPacket[icd2.packetOffset] = icd2.bitData
+	icd2.packetOffset = (icd2.packetOffset + 1) & 15
+	if icd2.packetOffset != 0 {
+		return
+	}
+	icd2.packetLock = true
+}
+
+func (icd2 *ICD2) queuePacket(packet [16]byte) {
+	if icd2.packetSize < int32(len(icd2.packets)) {
+		icd2.packets[icd2.packetSize] = packet
+		icd2.packetSize++
+	}
+}
+
+// sendHeader queues the packets the boot rom sends with the cartridge
+// header, when the Game Boy starts without it
+func (icd2 *ICD2) sendHeader(header []byte) {
+	for i := 0; i < 6; i++ {
+		var packet [16]byte
+		packet[0] = byte(0xf1 + i*2)
+		copy(packet[1:], header[i*15:i*15+15])
+		icd2.queuePacket(packet)
+	}
+}
+
+// mixSamples adds the Game Boy audio to sampleData
+func (icd2 *ICD2) mixSamples(sampleData []int16, samplesPerFrame int) {
+	icd2.gb.apu.mixSamples(sampleData, samplesPerFrame)
+}
+
+func (icd2 *ICD2) Serialize(s *serializer) {
+	s.bytes(icd2.output[:])
+	s.u8(&icd2.readBank)
+	s.u16(&icd2.readAddress)
+	s.u8(&icd2.writeBank)
+	s.u8(&icd2.hcounter)
+	s.u8(&icd2.vcounter)
+	s.u8(&icd2.r6003)
+	s.bytes(icd2.joypads[:])
+	s.bytes(icd2.r7000[:])
+	s.u8(&icd2.mltReq)
+	for i := 0; i < len(icd2.packets); i++ {
+		s.bytes(icd2.packets[i][:])
+	}
+	s.i32(&icd2.packetSize)
+	s.bytes(icd2.joypPacket[:])
+	s.u8(&icd2.packetOffset)
+	s.u8(&icd2.bitData)
+	s.u8(&icd2.bitOffset)
+	s.u8(&icd2.joypID)
+	s.bool(&icd2.joyp14Lock)
+	s.bool(&icd2.joyp15Lock)
+	s.bool(&icd2.pulseLock)
+	s.bool(&icd2.strobeLock)
+	s.bool(&icd2.packetLock)
+	s.i32(&icd2.cycles)
+	icd2.gb.serialize(s)
+}
+
+// loadSuperGameBoy loads the SGB BIOS with a Game Boy rom
+func (console *Console) loadSuperGameBoy(files []ROMFile) error {
+	if len(files) != 2 {
+		msg := fmt.Sprintf("Failed to load rom: %d files for the Super Game Boy, want the BIOS and a Game Boy rom\n", len(files))
+		return errors.New(msg)
+	}
+	var bios, game ROMFile = files[0], files[1]
+	if isGameBoyFile(bios.Path) {
+		bios, game = game, bios
+	}
+	if err := console.LoadROM(bios.Path, bios.Data, len(bios.Data)); err != nil {
+		return err
+	}
+
+	var cartridge *Cartridge = console.Cartridge
+	if !isSuperGameBoyBIOS(cartridge.rom) {
+		msg := fmt.Sprintf("Failed to load rom: %s is not the Super Game Boy BIOS\n", bios.Path)
+		return errors.New(msg)
+	}
+	icd2, err := NewICD2(cartridge, game)
+	if err != nil {
+		return err
+	}
+	cartridge.addChip(icd2)
+	// save states belong to the BIOS and the Game Boy rom
+	cartridge.romCRC = crc32.Update(cartridge.romCRC, crc32.IEEETable, icd2.gb.rom)
+	console.Reset(true)
+
+	return nil
+}
@@ -267,3 +267,23 @@ func (spc *SPC) addrIndP() uint16 {
 	spc.x++
 	return uint16(v) | (uint16(spc.p) << 8)
 }
+
+func (spc *SPC) serialize(s *serializer) {
+	s.u8(&spc.a)
+	s.u8(&spc.x)
+	s.u8(&spc.y)
+	s.u8(&spc.sp)
+	s.u16(&spc.pc)
+
+	s.u8(&spc.c)
+	s.u8(&spc.z)
+	s.u8(&spc.i)
+	s.u8(&spc.h)
+	s.u8(&spc.b)
+	s.u8(&spc.p)
+	s.u8(&spc.v)
+	s.u8(&spc.n)
+
+	s.bool(&spc.stopped)
+	s.u8(&spc.cyclesUsed)
+}
@@ -0,0 +1,1237 @@
+package chibisnes
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+// SPC7110 is the Epson SPC7110: a 1MB program rom followed by a data rom
+// that is banked in 1MB pages, a decompression unit, a data port reading
+// the data rom through a pointer with adjust/offset, a multiplier/divider
+// and (Far East of Eden Zero) an Epson RTC-4513 clock.
+//
+// the rtc registers and the time they were last updated are kept after the
+// save ram in the .srm file.
+type SPC7110 struct {
+	cartridge *Cartridge
+
+	// decompression unit
+	r4801 byte // table address
+	r4802 byte
+	r4803 byte
+	r4804 byte // table index
+	r4805 byte // skip bytes
+	r4806 byte
+	r4807 byte
+	r4808 byte
+	r4809 byte // length counter
+	r480a byte
+	r480b byte
+	r480c byte // status
+
+	decomp spc7110Decomp
+
+	// data port unit
+	r4811      byte // data pointer
+	r4812      byte
+	r4813      byte
+	r4814      byte // adjust
+	r4815      byte
+	r4816      byte // increment
+	r4817      byte
+	r4818      byte // mode
+	r481x      byte // which of $4811-$4813 were written
+	r4814Latch bool
+	r4815Latch bool
+
+	// math unit
+	r4820 byte // dividend / multiplicand
+	r4821 byte
+	r4822 byte
+	r4823 byte
+	r4824 byte // multiplier
+	r4825 byte
+	r4826 byte // divisor
+	r4827 byte
+	r4828 byte // result
+	r4829 byte
+	r482a byte
+	r482b byte
+	r482c byte // remainder
+	r482d byte
+	r482e byte // 1: signed
+	r482f byte // status
+
+	// memory mapping unit
+	r4830 byte // sram enable, bank for c0-cf
+	r4831 byte // data rom bank for d0-df
+	r4832 byte // data rom bank for e0-ef
+	r4833 byte // data rom bank for f0-ff
+	r4834 byte // data rom size
+
+	// real-time clock unit
+	hasRTC       bool
+	r4840        byte
+	r4841        byte
+	r4842        byte
+	rtcState     byte
+	rtcMode      byte
+	rtcIndex     byte
+	rtc          [16]byte // 4 bit registers
+	rtcTimestamp int64    // host time of the last update
+}
+
+const (
+	spc7110RTCInactive = iota
+	spc7110RTCModeSelect
+	spc7110RTCIndexSelect
+	spc7110RTCWrite
+)
+
+const (
+	spc7110RTCLinear  = 0x03
+	spc7110RTCIndexed = 0x0c
+)
+
+// rtc registers and an 8 byte timestamp stored after the save ram
+const spc7110RTCSaveSize = 16 + 8
+
+// size of the program rom at the start of the image
+const spc7110PROMSize = 0x100000
+
+func init() {
+	registerBoard(mapperRegistration{
+		name:     "SPC7110",
+		priority: 1,
+		match: func(header *CartridgeHeader) bool {
+			return header.cartType == 3
+		},
+		ram: func(header *CartridgeHeader, ramSize int, saveSize int) (int, int) {
+			if isSPC7110RTCHeader(header) {
+				// the clock is saved after the ram
+				return ramSize, saveSize + spc7110RTCSaveSize
+			}
+			return ramSize, saveSize
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			var hasRTC bool = isSPC7110RTCHeader(header)
+			log.Printf("ROM: SPC7110 enabled, RTC: %t\n", hasRTC)
+			return NewSPC7110(cartridge, hasRTC), nil
+		},
+	})
+}
+
+// isSPC7110RTCHeader reports if the header is the one of a SPC7110 game with
+// the RTC-4513, chipset $f9
+func isSPC7110RTCHeader(header *CartridgeHeader) bool {
+	return header.cartType == 3 && header.chips == 9
+}
+
+func NewSPC7110(cartridge *Cartridge, hasRTC bool) *SPC7110 {
+	spc7110 := &SPC7110{
+		cartridge: cartridge,
+		hasRTC:    hasRTC,
+	}
+	spc7110.decomp.spc7110 = spc7110
+	if hasRTC {
+		spc7110.loadRTC()
+	}
+	return spc7110
+}
+
+func (spc7110 *SPC7110) Reset() {
+	spc7110.r4801 = 0
+	spc7110.r4802 = 0
+	spc7110.r4803 = 0
+	spc7110.r4804 = 0
+	spc7110.r4805 = 0
+	spc7110.r4806 = 0
+	spc7110.r4807 = 0
+	spc7110.r4808 = 0
+	spc7110.r4809 = 0
+	spc7110.r480a = 0
+	spc7110.r480b = 0
+	spc7110.r480c = 0
+	spc7110.decomp.reset()
+
+	spc7110.r4811 = 0
+	spc7110.r4812 = 0
+	spc7110.r4813 = 0
+	spc7110.r4814 = 0
+	spc7110.r4815 = 0
+	spc7110.r4816 = 0
+	spc7110.r4817 = 0
+	spc7110.r4818 = 0
+	spc7110.r481x = 0
+	spc7110.r4814Latch = false
+	spc7110.r4815Latch = false
+
+	spc7110.r4820 = 0
+	spc7110.r4821 = 0
+	spc7110.r4822 = 0
+	spc7110.r4823 = 0
+	spc7110.r4824 = 0
+	spc7110.r4825 = 0
+	spc7110.r4826 = 0
+	spc7110.r4827 = 0
+	spc7110.r4828 = 0
+	spc7110.r4829 = 0
+	spc7110.r482a = 0
+	spc7110.r482b = 0
+	spc7110.r482c = 0
+	spc7110.r482d = 0
+	spc7110.r482e = 0
+	spc7110.r482f = 0
+
+	spc7110.r4830 = 0
+	spc7110.r4831 = 0
+	spc7110.r4832 = 1
+	spc7110.r4833 = 2
+	spc7110.r4834 = 0
+
+	spc7110.r4840 = 0
+	spc7110.r4841 = 0
+	spc7110.r4842 = 0
+	spc7110.rtcState = spc7110RTCInactive
+	spc7110.rtcMode = spc7110RTCLinear
+	spc7110.rtcIndex = 0
+}
+
+// dataROMRead reads the data rom, which starts after the program rom
+func (spc7110 *SPC7110) dataROMRead(addr uint32) byte {
+	var cartridge *Cartridge = spc7110.cartridge
+	if cartridge.romSize <= spc7110PROMSize {
+		return 0
+	}
+	var size uint32 = cartridge.romSize - spc7110PROMSize
+	return cartridge.rom[spc7110PROMSize+(addr%size)]
+}
+
+// romRead reads the rom as seen at c0-ff (and 00-3f:8000-ffff)
+func (spc7110 *SPC7110) romRead(addr uint32) byte {
+	var cartridge *Cartridge = spc7110.cartridge
+	var mask uint32 = (1 << (spc7110.r4834 & 3)) - 1 // 8, 16, 32 or 64 mbit data rom
+	var offset uint32 = addr & 0x0fffff
+	switch addr >> 20 {
+	case 0:
+		return cartridge.rom[offset&(cartridge.romSize-1)]
+	case 1:
+		if (spc7110.r4834 & 4) > 0 {
+			// 16 mbit program rom
+			return cartridge.rom[(0x100000|offset)&(cartridge.romSize-1)]
+		}
+		return spc7110.dataROMRead((uint32(spc7110.r4831)&mask)<<20 | offset)
+	case 2:
+		return spc7110.dataROMRead((uint32(spc7110.r4832)&mask)<<20 | offset)
+	case 3:
+		return spc7110.dataROMRead((uint32(spc7110.r4833)&mask)<<20 | offset)
+	}
+	return spc7110.cartridge.console.openBus
+}
+
+func (spc7110 *SPC7110) Read(bank byte, addr uint16) byte {
+	var cartridge *Cartridge = spc7110.cartridge
+	if bank >= 0xc0 {
+		return spc7110.romRead((uint32(bank&0x3f) << 16) | uint32(addr))
+	}
+	if bank == 0x50 {
+		return spc7110.readIO(0x4800)
+	}
+	if bank == 0x58 {
+		return spc7110.readIO(0x4808)
+	}
+	if (bank & 0x7f) < 0x40 {
+		switch {
+		case addr >= 0x8000:
+			return spc7110.romRead((uint32(bank&0x3f) << 16) | uint32(addr))
+		case addr >= 0x6000:
+			if (spc7110.r4830&0x80) > 0 && cartridge.ramSize > 0 {
+				return cartridge.ram.Read(uint32(addr-0x6000) & (cartridge.ramSize - 1))
+			}
+		case addr >= 0x4800 && addr <= 0x4842:
+			return spc7110.readIO(addr)
+		}
+	}
+	return cartridge.console.openBus
+}
+
+func (spc7110 *SPC7110) Write(bank byte, addr uint16, value byte) {
+	var cartridge *Cartridge = spc7110.cartridge
+	if (bank & 0x7f) >= 0x40 {
+		return
+	}
+	switch {
+	case addr >= 0x8000:
+	case addr >= 0x6000:
+		if (spc7110.r4830&0x80) > 0 && cartridge.ramSize > 0 {
+			cartridge.ram.Write(uint32(addr-0x6000)&(cartridge.ramSize-1), value)
+		}
+	case addr >= 0x4800 && addr <= 0x4842:
+		spc7110.writeIO(addr, value)
+	}
+}
+
+func (spc7110 *SPC7110) dataPointer() uint32 {
+	return uint32(spc7110.r4811) | (uint32(spc7110.r4812) << 8) | (uint32(spc7110.r4813) << 16)
+}
+
+func (spc7110 *SPC7110) setDataPointer(value uint32) {
+	spc7110.r4811 = byte(value)
+	spc7110.r4812 = byte(value >> 8)
+	spc7110.r4813 = byte(value >> 16)
+}
+
+func (spc7110 *SPC7110) dataAdjust() uint32 {
+	return uint32(spc7110.r4814) | (uint32(spc7110.r4815) << 8)
+}
+
+func (spc7110 *SPC7110) setDataAdjust(value uint32) {
+	spc7110.r4814 = byte(value)
+	spc7110.r4815 = byte(value >> 8)
+}
+
+func (spc7110 *SPC7110) dataIncrement() uint32 {
+	return uint32(spc7110.r4816) | (uint32(spc7110.r4817) << 8)
+}
+
+// signExtend16 sign extends a 16 bit value to 32 bits
+func signExtend16(value uint32) uint32 {
+	return uint32(int32(int16(value)))
+}
+
+func (spc7110 *SPC7110) readIO(addr uint16) byte {
+	switch addr {
+	// decompression unit
+	case 0x4800:
+		var counter uint16 = uint16(spc7110.r4809) | (uint16(spc7110.r480a) << 8)
+		counter--
+		spc7110.r4809 = byte(counter)
+		spc7110.r480a = byte(counter >> 8)
+		return spc7110.decomp.read()
+	case 0x4801:
+		return spc7110.r4801
+	case 0x4802:
+		return spc7110.r4802
+	case 0x4803:
+		return spc7110.r4803
+	case 0x4804:
+		return spc7110.r4804
+	case 0x4805:
+		return spc7110.r4805
+	case 0x4806:
+		return spc7110.r4806
+	case 0x4807:
+		return spc7110.r4807
+	case 0x4808:
+		return spc7110.r4808
+	case 0x4809:
+		return spc7110.r4809
+	case 0x480a:
+		return spc7110.r480a
+	case 0x480b:
+		return spc7110.r480b
+	case 0x480c:
+		var status byte = spc7110.r480c
+		spc7110.r480c &= 0x7f
+		return status
+
+	// data port unit
+	case 0x4810:
+		if spc7110.r481x != 0x07 {
+			return 0
+		}
+		var pointer uint32 = spc7110.dataPointer()
+		var adjust uint32 = spc7110.dataAdjust()
+		if (spc7110.r4818 & 8) > 0 {
+			adjust = signExtend16(adjust)
+		}
+		var adjustAddr uint32 = pointer
+		if (spc7110.r4818 & 2) > 0 {
+			adjustAddr += adjust
+			spc7110.setDataAdjust(adjust + 1)
+		}
+		var value byte = spc7110.dataROMRead(adjustAddr & 0xffffff)
+		if (spc7110.r4818 & 2) == 0 {
+			var increment uint32 = 1
+			if (spc7110.r4818 & 1) > 0 {
+				increment = spc7110.dataIncrement()
+			}
+			if (spc7110.r4818 & 4) > 0 {
+				increment = signExtend16(increment)
+			}
+			if (spc7110.r4818 & 16) == 0 {
+				spc7110.setDataPointer(pointer + increment)
+			} else {
+				spc7110.setDataAdjust(adjust + increment)
+			}
+		}
+		return value
+	case 0x4811:
+		return spc7110.r4811
+	case 0x4812:
+		return spc7110.r4812
+	case 0x4813:
+		return spc7110.r4813
+	case 0x4814:
+		return spc7110.r4814
+	case 0x4815:
+		return spc7110.r4815
+	case 0x4816:
+		return spc7110.r4816
+	case 0x4817:
+		return spc7110.r4817
+	case 0x4818:
+		return spc7110.r4818
+	case 0x481a:
+		if spc7110.r481x != 0x07 {
+			return 0
+		}
+		var pointer uint32 = spc7110.dataPointer()
+		var adjust uint32 = spc7110.dataAdjust()
+		if (spc7110.r4818 & 8) > 0 {
+			adjust = signExtend16(adjust)
+		}
+		var value byte = spc7110.dataROMRead((pointer + adjust) & 0xffffff)
+		if (spc7110.r4818 & 0x60) == 0x60 {
+			if (spc7110.r4818 & 16) == 0 {
+				spc7110.setDataPointer(pointer + adjust)
+			} else {
+				spc7110.setDataAdjust(adjust + adjust)
+			}
+		}
+		return value
+
+	// math unit
+	case 0x4820:
+		return spc7110.r4820
+	case 0x4821:
+		return spc7110.r4821
+	case 0x4822:
+		return spc7110.r4822
+	case 0x4823:
+		return spc7110.r4823
+	case 0x4824:
+		return spc7110.r4824
+	case 0x4825:
+		return spc7110.r4825
+	case 0x4826:
+		return spc7110.r4826
+	case 0x4827:
+		return spc7110.r4827
+	case 0x4828:
+		return spc7110.r4828
+	case 0x4829:
+		return spc7110.r4829
+	case 0x482a:
+		return spc7110.r482a
+	case 0x482b:
+		return spc7110.r482b
+	case 0x482c:
+		return spc7110.r482c
+	case 0x482d:
+		return spc7110.r482d
+	case 0x482e:
+		return spc7110.r482e
+	case 0x482f:
+		var status byte = spc7110.r482f
+		spc7110.r482f &= 0x7f
+		return status
+
+	// memory mapping unit
+	case 0x4830:
+		return spc7110.r4830
+	case 0x4831:
+		return spc7110.r4831
+	case 0x4832:
+		return spc7110.r4832
+	case 0x4833:
+		return spc7110.r4833
+	case 0x4834:
+		return spc7110.r4834
+
+	// real-time clock unit
+	case 0x4840:
+		if !spc7110.hasRTC {
+			break
+		}
+		return spc7110.r4840
+	case 0x4841:
+		if !spc7110.hasRTC || spc7110.rtcState == spc7110RTCInactive || spc7110.rtcState == spc7110RTCModeSelect {
+			return 0
+		}
+		spc7110.r4842 = 0x80
+		var value byte = spc7110.rtc[spc7110.rtcIndex]
+		spc7110.rtcIndex = (spc7110.rtcIndex + 1) & 15
+		return value
+	case 0x4842:
+		if !spc7110.hasRTC {
+			break
+		}
+		var status byte = spc7110.r4842
+		spc7110.r4842 &= 0x7f
+		return status
+	}
+	return spc7110.cartridge.console.openBus
+}
+
+func (spc7110 *SPC7110) writeIO(addr uint16, value byte) {
+	switch addr {
+	// decompression unit
+	case 0x4801:
+		spc7110.r4801 = value
+	case 0x4802:
+		spc7110.r4802 = value
+	case 0x4803:
+		spc7110.r4803 = value
+	case 0x4804:
+		spc7110.r4804 = value
+	case 0x4805:
+		spc7110.r4805 = value
+	case 0x4806:
+		spc7110.r4806 = value
+		// look up the mode and offset in the table and start decompressing
+		var table uint32 = uint32(spc7110.r4801) | (uint32(spc7110.r4802) << 8) | (uint32(spc7110.r4803) << 16)
+		var index uint32 = uint32(spc7110.r4804) << 2
+		var entry uint32 = table + index
+		var mode byte = spc7110.dataROMRead(entry)
+		var offset uint32 = (uint32(spc7110.dataROMRead(entry+1)) << 16) |
+			(uint32(spc7110.dataROMRead(entry+2)) << 8) |
+			uint32(spc7110.dataROMRead(entry+3))
+		var skip uint32 = uint32(spc7110.r4805) | (uint32(spc7110.r4806) << 8)
+		spc7110.decomp.init(mode, offset, skip<<mode)
+		spc7110.r480c = 0x80
+	case 0x4807:
+		spc7110.r4807 = value
+	case 0x4808:
+		spc7110.r4808 = value
+	case 0x4809:
+		spc7110.r4809 = value
+	case 0x480a:
+		spc7110.r480a = value
+	case 0x480b:
+		spc7110.r480b = value
+
+	// data port unit
+	case 0x4811:
+		spc7110.r4811 = value
+		spc7110.r481x |= 0x01
+	case 0x4812:
+		spc7110.r4812 = value
+		spc7110.r481x |= 0x02
+	case 0x4813:
+		spc7110.r4813 = value
+		spc7110.r481x |= 0x04
+	case 0x4814:
+		spc7110.r4814 = value
+		spc7110.r4814Latch = true
+		if spc7110.r4815Latch {
+			spc7110.adjustPointer()
+		}
+	case 0x4815:
+		spc7110.r4815 = value
+		spc7110.r4815Latch = true
+		if spc7110.r4814Latch {
+			spc7110.adjustPointer()
+		}
+	case 0x4816:
+		spc7110.r4816 = value
+	case 0x4817:
+		spc7110.r4817 = value
+	case 0x4818:
+		if spc7110.r481x != 0x07 {
+			break
+		}
+		spc7110.r4818 = value
+		spc7110.r4814Latch = false
+		spc7110.r4815Latch = false
+
+	// math unit
+	case 0x4820:
+		spc7110.r4820 = value
+	case 0x4821:
+		spc7110.r4821 = value
+	case 0x4822:
+		spc7110.r4822 = value
+	case 0x4823:
+		spc7110.r4823 = value
+	case 0x4824:
+		spc7110.r4824 = value
+	case 0x4825:
+		spc7110.r4825 = value
+		spc7110.multiply()
+	case 0x4826:
+		spc7110.r4826 = value
+	case 0x4827:
+		spc7110.r4827 = value
+		spc7110.divide()
+	case 0x482e:
+		// resets the math unit
+		spc7110.r4820, spc7110.r4821, spc7110.r4822, spc7110.r4823 = 0, 0, 0, 0
+		spc7110.r4824, spc7110.r4825, spc7110.r4826, spc7110.r4827 = 0, 0, 0, 0
+		spc7110.r4828, spc7110.r4829, spc7110.r482a, spc7110.r482b = 0, 0, 0, 0
+		spc7110.r482c, spc7110.r482d = 0, 0
+		spc7110.r482e = value
+
+	// memory mapping unit
+	case 0x4830:
+		spc7110.r4830 = value
+	case 0x4831:
+		spc7110.r4831 = value
+	case 0x4832:
+		spc7110.r4832 = value
+	case 0x4833:
+		spc7110.r4833 = value
+	case 0x4834:
+		spc7110.r4834 = value
+
+	// real-time clock unit
+	case 0x4840:
+		if !spc7110.hasRTC {
+			break
+		}
+		spc7110.r4840 = value
+		if (value & 1) == 0 {
+			spc7110.rtcState = spc7110RTCInactive
+			spc7110.updateTime()
+		} else {
+			// chip select: bring the clock up to date before it is read
+			spc7110.updateTime()
+			spc7110.r4842 = 0x80
+			spc7110.rtcState = spc7110RTCModeSelect
+		}
+	case 0x4841:
+		if !spc7110.hasRTC {
+			break
+		}
+		spc7110.r4841 = value
+		spc7110.writeRTC(value)
+	}
+}
+
+// adjustPointer adds the adjust register to the data pointer once both of
+// its bytes were written, if the mode asks for it
+func (spc7110 *SPC7110) adjustPointer() {
+	if (spc7110.r4818&2) == 0 || (spc7110.r4818&0x10) > 0 {
+		return
+	}
+	switch spc7110.r4818 & 0x60 {
+	case 0x20:
+		var increment uint32 = spc7110.dataAdjust() & 0xff
+		if (spc7110.r4818 & 8) > 0 {
+			increment = uint32(int32(int8(increment)))
+		}
+		spc7110.setDataPointer(spc7110.dataPointer() + increment)
+	case 0x40:
+		var increment uint32 = spc7110.dataAdjust()
+		if (spc7110.r4818 & 8) > 0 {
+			increment = signExtend16(increment)
+		}
+		spc7110.setDataPointer(spc7110.dataPointer() + increment)
+	}
+}
+
+func (spc7110 *SPC7110) multiply() {
+	var multiplier uint16 = uint16(spc7110.r4824) | (uint16(spc7110.r4825) << 8)
+	var multiplicand uint16 = uint16(spc7110.r4820) | (uint16(spc7110.r4821) << 8)
+	var result uint32
+	if (spc7110.r482e & 1) > 0 {
+		result = uint32(int32(int16(multiplier)) * int32(int16(multiplicand)))
+	} else {
+		result = uint32(multiplier) * uint32(multiplicand)
+	}
+	spc7110.r4828 = byte(result)
+	spc7110.r4829 = byte(result >> 8)
+	spc7110.r482a = byte(result >> 16)
+	spc7110.r482b = byte(result >> 24)
+	spc7110.r482f = 0x80
+}
+
+func (spc7110 *SPC7110) divide() {
+	var dividend uint32 = uint32(spc7110.r4820) | (uint32(spc7110.r4821) << 8) |
+		(uint32(spc7110.r4822) << 16) | (uint32(spc7110.r4823) << 24)
+	var divisor uint16 = uint16(spc7110.r4826) | (uint16(spc7110.r4827) << 8)
+	var quotient uint32
+	var remainder uint16
+	if divisor == 0 {
+		quotient = 0
+		remainder = uint16(dividend)
+	} else if (spc7110.r482e & 1) > 0 {
+		quotient = uint32(int32(dividend) / int32(int16(divisor)))
+		remainder = uint16(int32(dividend) % int32(int16(divisor)))
+	} else {
+		quotient = dividend / uint32(divisor)
+		remainder = uint16(dividend % uint32(divisor))
+	}
+	spc7110.r4828 = byte(quotient)
+	spc7110.r4829 = byte(quotient >> 8)
+	spc7110.r482a = byte(quotient >> 16)
+	spc7110.r482b = byte(quotient >> 24)
+	spc7110.r482c = byte(remainder)
+	spc7110.r482d = byte(remainder >> 8)
+	spc7110.r482f = 0x80
+}
+
+// rtc
+
+func (spc7110 *SPC7110) writeRTC(value byte) {
+	switch spc7110.rtcState {
+	case spc7110RTCModeSelect:
+		if value == spc7110RTCLinear || value == spc7110RTCIndexed {
+			spc7110.r4842 = 0x80
+			spc7110.rtcState = spc7110RTCIndexSelect
+			spc7110.rtcMode = value
+			spc7110.rtcIndex = 0
+		}
+	case spc7110RTCIndexSelect:
+		spc7110.r4842 = 0x80
+		spc7110.rtcIndex = value & 15
+		if spc7110.rtcMode == spc7110RTCLinear {
+			spc7110.rtcState = spc7110RTCWrite
+		}
+	case spc7110RTCWrite:
+		spc7110.r4842 = 0x80
+		value &= 15
+		switch spc7110.rtcIndex {
+		case 0x0d:
+			if (value & 8) > 0 {
+				// 30 second adjustment: round to the nearest minute
+				spc7110.updateTime()
+				var second int = int(spc7110.rtc[0]) + int(spc7110.rtc[1])*10
+				spc7110.rtc[0] = 0
+				spc7110.rtc[1] = 0
+				if second >= 30 {
+					spc7110.advanceTime(60)
+				}
+				value &= ^byte(8)
+			}
+		case 0x0f:
+			if (value & 1) > 0 {
+				// reset: clears the seconds
+				spc7110.rtc[0] = 0
+				spc7110.rtc[1] = 0
+			}
+		}
+		spc7110.rtc[spc7110.rtcIndex] = value
+		spc7110.rtcIndex = (spc7110.rtcIndex + 1) & 15
+		spc7110.saveRTC()
+	}
+}
+
+// rtcTime returns the time held in the rtc registers
+func (spc7110 *SPC7110) rtcTime() time.Time {
+	var rtc *[16]byte = &spc7110.rtc
+	var second int = int(rtc[0]) + int(rtc[1]&7)*10
+	var minute int = int(rtc[2]) + int(rtc[3]&7)*10
+	var hour int = int(rtc[4]) + int(rtc[5]&3)*10
+	if (rtc[0xf] & 4) == 0 {
+		// 12 hour mode, $5 bit 2 is pm
+		hour %= 12
+		if (rtc[5] & 4) > 0 {
+			hour += 12
+		}
+	}
+	var day int = int(rtc[6]) + int(rtc[7]&3)*10
+	var month int = int(rtc[8]) + int(rtc[9]&1)*10
+	var year int = int(rtc[0xa]) + int(rtc[0xb])*10
+	if year < 90 {
+		year += 2000
+	} else {
+		year += 1900
+	}
+	if day < 1 {
+		day = 1
+	}
+	if month < 1 {
+		month = 1
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+}
+
+func (spc7110 *SPC7110) setRTCTime(t time.Time) {
+	var rtc *[16]byte = &spc7110.rtc
+	rtc[0] = byte(t.Second() % 10)
+	rtc[1] = byte(t.Second() / 10)
+	rtc[2] = byte(t.Minute() % 10)
+	rtc[3] = byte(t.Minute() / 10)
+	var hour int = t.Hour()
+	var pm byte = 0
+	if (rtc[0xf] & 4) == 0 {
+		if hour >= 12 {
+			pm = 4
+		}
+		hour %= 12
+	}
+	rtc[4] = byte(hour % 10)
+	rtc[5] = byte(hour/10) | pm
+	rtc[6] = byte(t.Day() % 10)
+	rtc[7] = byte(t.Day() / 10)
+	rtc[8] = byte(int(t.Month()) % 10)
+	rtc[9] = byte(int(t.Month()) / 10)
+	rtc[0xa] = byte(t.Year() % 10)
+	rtc[0xb] = byte((t.Year() / 10) % 10)
+	rtc[0xc] = byte(t.Weekday())
+}
+
+func (spc7110 *SPC7110) advanceTime(seconds int64) {
+	spc7110.setRTCTime(spc7110.rtcTime().Add(time.Duration(seconds) * time.Second))
+}
+
+// updateTime advances the clock by the host time passed since the last
+// update, unless it is held or stopped
+func (spc7110 *SPC7110) updateTime() {
+	var now int64 = time.Now().Unix()
+	var elapsed int64 = now - spc7110.rtcTimestamp
+	spc7110.rtcTimestamp = now
+	if (spc7110.rtc[0xd]&1) == 0 && (spc7110.rtc[0xf]&3) == 0 && elapsed > 0 {
+		spc7110.advanceTime(elapsed)
+	}
+	spc7110.saveRTC()
+}
+
+// loadRTC reads the clock from after the save ram, a new save starts
+// at the host time
+func (spc7110 *SPC7110) loadRTC() {
+	var cartridge *Cartridge = spc7110.cartridge
+	var offset int = int(cartridge.ramSize)
+	if cartridge.ram == nil || len(cartridge.ram.mmap) < offset+spc7110RTCSaveSize {
+		return
+	}
+	var data []byte = cartridge.ram.mmap[offset : offset+spc7110RTCSaveSize]
+	copy(spc7110.rtc[:], data[:16])
+	spc7110.rtcTimestamp = int64(binary.LittleEndian.Uint64(data[16:]))
+	if spc7110.rtcTimestamp == 0 {
+		var now time.Time = time.Now()
+		spc7110.rtc[0xd] = 0
+		spc7110.rtc[0xe] = 0
+		spc7110.rtc[0xf] = 4 // 24 hour mode
+		spc7110.setRTCTime(time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC))
+		spc7110.rtcTimestamp = now.Unix()
+		spc7110.saveRTC()
+		log.Printf("SPC7110: RTC set to host time\n")
+	}
+}
+
+func (spc7110 *SPC7110) saveRTC() {
+	var cartridge *Cartridge = spc7110.cartridge
+	var offset int = int(cartridge.ramSize)
+	if cartridge.ram == nil || len(cartridge.ram.mmap) < offset+spc7110RTCSaveSize {
+		return
+	}
+	var data []byte = cartridge.ram.mmap[offset : offset+spc7110RTCSaveSize]
+	copy(data[:16], spc7110.rtc[:])
+	binary.LittleEndian.PutUint64(data[16:], uint64(spc7110.rtcTimestamp))
+}
+
+func (spc7110 *SPC7110) Cycle() {
+}
+
+func (spc7110 *SPC7110) Close() {
+}
+
+func (spc7110 *SPC7110) Serialize(s *serializer) {
+	for _, r := range []*byte{
+		&spc7110.r4801, &spc7110.r4802, &spc7110.r4803, &spc7110.r4804, &spc7110.r4805, &spc7110.r4806,
+		&spc7110.r4807, &spc7110.r4808, &spc7110.r4809, &spc7110.r480a, &spc7110.r480b, &spc7110.r480c,
+		&spc7110.r4811, &spc7110.r4812, &spc7110.r4813, &spc7110.r4814, &spc7110.r4815, &spc7110.r4816,
+		&spc7110.r4817, &spc7110.r4818, &spc7110.r481x,
+		&spc7110.r4820, &spc7110.r4821, &spc7110.r4822, &spc7110.r4823, &spc7110.r4824, &spc7110.r4825,
+		&spc7110.r4826, &spc7110.r4827, &spc7110.r4828, &spc7110.r4829, &spc7110.r482a, &spc7110.r482b,
+		&spc7110.r482c, &spc7110.r482d, &spc7110.r482e, &spc7110.r482f,
+		&spc7110.r4830, &spc7110.r4831, &spc7110.r4832, &spc7110.r4833, &spc7110.r4834,
+		&spc7110.r4840, &spc7110.r4841, &spc7110.r4842, &spc7110.rtcState, &spc7110.rtcMode, &spc7110.rtcIndex,
+	} {
+		s.u8(r)
+	}
+	s.bool(&spc7110.r4814Latch)
+	s.bool(&spc7110.r4815Latch)
+	s.bytes(spc7110.rtc[:])
+	var rtcTimestamp uint64 = uint64(spc7110.rtcTimestamp)
+	s.u64(&rtcTimestamp)
+	spc7110.rtcTimestamp = int64(rtcTimestamp)
+	if spc7110.hasRTC {
+		spc7110.saveRTC()
+	}
+
+	spc7110.decomp.serialize(s)
+}
+
+// decompression unit
+
+type spc7110Decomp struct {
+	spc7110 *SPC7110
+
+	mode   byte
+	offset uint32
+
+	buffer       [64]byte
+	bufferRead   byte
+	bufferWrite  byte
+	bufferLength byte
+
+	contextIndex  [32]byte
+	contextInvert [32]byte
+
+	// coder state
+	val     byte
+	in      byte
+	span    byte
+	inCount int32
+	out     int32
+	out1    int32
+	inverts int32
+	lps     int32
+
+	pixelOrder       [16]byte
+	bitplaneBuffer   [16]byte
+	bitplaneBufIndex byte
+}
+
+// probability, next if lps, next if mps, toggle invert
+var spc7110EvolutionTable [53][4]byte = [53][4]byte{
+	{0x5a, 1, 1, 1},
+	{0x25, 6, 2, 0},
+	{0x11, 8, 3, 0},
+	{0x08, 10, 4, 0},
+	{0x03, 12, 5, 0},
+	{0x01, 15, 5, 0},
+
+	{0x5a, 7, 7, 1},
+	{0x3f, 19, 8, 0},
+	{0x2c, 21, 9, 0},
+	{0x20, 22, 10, 0},
+	{0x17, 23, 11, 0},
+	{0x11, 25, 12, 0},
+	{0x0c, 26, 13, 0},
+	{0x09, 28, 14, 0},
+	{0x07, 29, 15, 0},
+	{0x05, 31, 16, 0},
+	{0x04, 32, 17, 0},
+	{0x03, 34, 18, 0},
+	{0x02, 35, 5, 0},
+
+	{0x5a, 20, 20, 1},
+	{0x48, 39, 21, 0},
+	{0x3a, 40, 22, 0},
+	{0x2e, 42, 23, 0},
+	{0x26, 44, 24, 0},
+	{0x1f, 45, 25, 0},
+	{0x19, 46, 26, 0},
+	{0x15, 25, 27, 0},
+	{0x11, 26, 28, 0},
+	{0x0e, 26, 29, 0},
+	{0x0b, 27, 30, 0},
+	{0x09, 28, 31, 0},
+	{0x08, 29, 32, 0},
+	{0x07, 30, 33, 0},
+	{0x05, 31, 34, 0},
+	{0x04, 33, 35, 0},
+	{0x04, 33, 36, 0},
+	{0x03, 34, 37, 0},
+	{0x02, 35, 38, 0},
+	{0x02, 36, 5, 0},
+
+	{0x58, 39, 40, 1},
+	{0x4d, 47, 41, 0},
+	{0x43, 48, 42, 0},
+	{0x3b, 49, 43, 0},
+	{0x34, 50, 44, 0},
+	{0x2e, 51, 45, 0},
+	{0x29, 44, 46, 0},
+	{0x25, 45, 24, 0},
+
+	{0x56, 47, 48, 1},
+	{0x4f, 47, 49, 0},
+	{0x47, 48, 50, 0},
+	{0x41, 49, 51, 0},
+	{0x3c, 50, 52, 0},
+	{0x37, 51, 43, 0},
+}
+
+// next context in mode 2 for a 0 or 1 symbol
+var spc7110Mode2ContextTable [32][2]byte = [32][2]byte{
+	{1, 2}, {3, 8}, {13, 14}, {15, 16}, {17, 18}, {19, 20}, {21, 22}, {23, 24},
+	{25, 26}, {25, 26}, {25, 26}, {25, 26}, {25, 26}, {27, 28}, {29, 30}, {31, 31},
+	{31, 31}, {31, 31}, {31, 31}, {31, 31}, {31, 31}, {31, 31}, {31, 31}, {31, 31},
+	{31, 31}, {31, 31}, {31, 31}, {31, 31}, {31, 31}, {31, 31}, {31, 31}, {31, 31},
+}
+
+func (d *spc7110Decomp) reset() {
+	// nothing to decompress until $4806 is written
+	d.mode = 3
+	d.offset = 0
+	d.bufferRead = 0
+	d.bufferWrite = 0
+	d.bufferLength = 0
+}
+
+func (d *spc7110Decomp) dataRead() byte {
+	var value byte = d.spc7110.dataROMRead(d.offset)
+	d.offset++
+	return value
+}
+
+func (d *spc7110Decomp) write(value byte) {
+	d.buffer[d.bufferWrite] = value
+	d.bufferWrite = (d.bufferWrite + 1) & 63
+	d.bufferLength++
+}
+
+func (d *spc7110Decomp) read() byte {
+	if d.bufferLength == 0 {
+		switch d.mode {
+		case 0:
+			d.mode0()
+		case 1:
+			d.mode1()
+		case 2:
+			d.mode2()
+		default:
+			return 0
+		}
+	}
+	var value byte = d.buffer[d.bufferRead]
+	d.bufferRead = (d.bufferRead + 1) & 63
+	d.bufferLength--
+	return value
+}
+
+// init starts decompressing at offset in the data rom, skipping the first
+// index bytes of output
+func (d *spc7110Decomp) init(mode byte, offset uint32, index uint32) {
+	d.mode = mode
+	d.offset = offset
+	d.bufferRead = 0
+	d.bufferWrite = 0
+	d.bufferLength = 0
+
+	for i := 0; i < 32; i++ {
+		d.contextIndex[i] = 0
+		d.contextInvert[i] = 0
+	}
+	for i := 0; i < 16; i++ {
+		d.pixelOrder[i] = byte(i)
+	}
+	d.bitplaneBufIndex = 0
+	d.out = 0
+	d.out1 = 0
+	d.inverts = 0
+	d.lps = 0
+	d.span = 0xff
+	d.val = d.dataRead()
+	d.in = d.dataRead()
+	d.inCount = 8
+
+	if mode > 2 {
+		return
+	}
+	for ; index > 0; index-- {
+		d.read()
+	}
+}
+
+// decode decodes one symbol in context con and updates the context
+func (d *spc7110Decomp) decode(con byte) (flagLPS int32, invert int32) {
+	var state *[4]byte = &spc7110EvolutionTable[d.contextIndex[con]]
+	var prob byte = state[0]
+
+	if d.val <= d.span-prob {
+		// mps
+		d.span = d.span - prob
+		flagLPS = 0
+	} else {
+		// lps
+		d.val = d.val - (d.span - (prob - 1))
+		d.span = prob - 1
+		flagLPS = 1
+	}
+
+	// renormalize
+	var shift int = 0
+	for d.span < 0x7f {
+		shift++
+		d.span = (d.span << 1) + 1
+		d.val = (d.val << 1) + (d.in >> 7)
+		d.in <<= 1
+		d.inCount--
+		if d.inCount == 0 {
+			d.in = d.dataRead()
+			d.inCount = 8
+		}
+	}
+
+	invert = int32(d.contextInvert[con])
+	d.lps = (d.lps << 1) + flagLPS
+	d.inverts = (d.inverts << 1) + invert
+
+	if flagLPS > 0 && state[3] > 0 {
+		d.contextInvert[con] ^= 1
+	}
+	if flagLPS > 0 {
+		d.contextIndex[con] = state[1]
+	} else if shift > 0 {
+		d.contextIndex[con] = state[2]
+	}
+	return flagLPS, invert
+}
+
+// mode0 decodes bytes bit by bit
+func (d *spc7110Decomp) mode0() {
+	for d.bufferLength < 32 {
+		for bit := 0; bit < 8; bit++ {
+			var mask int32 = (1 << (bit & 3)) - 1
+			var con byte = byte(mask + ((d.inverts & mask) ^ (d.lps & mask)))
+			if bit > 3 {
+				con += 15
+			}
+			var mps int32 = ((d.out >> 15) & 1) ^ int32(d.contextInvert[con])
+			flagLPS, _ := d.decode(con)
+			if flagLPS > 0 {
+				d.out = (d.out << 1) + 1 - mps
+			} else {
+				d.out = (d.out << 1) + mps
+			}
+		}
+		d.write(byte(d.out))
+	}
+}
+
+// moveToFront moves value to the front of order
+func moveToFront(order []byte, value byte) {
+	var m int
+	for m = 0; m < len(order)-1; m++ {
+		if order[m] == value {
+			break
+		}
+	}
+	for n := m; n > 0; n-- {
+		order[n] = order[n-1]
+	}
+	order[0] = value
+}
+
+// referenceContext picks a context from the pixels to the left (a),
+// above (b) and above left (c)
+func referenceContext(a, b, c byte) byte {
+	if a == b {
+		if b != c {
+			return 1
+		}
+		return 0
+	}
+	if b == c {
+		return 2
+	}
+	if a == c {
+		return 3
+	}
+	return 4
+}
+
+// mode1 decodes 2bpp tiles
+func (d *spc7110Decomp) mode1() {
+	for d.bufferLength < 32 {
+		for pixel := 0; pixel < 8; pixel++ {
+			var a byte = byte((d.out >> (1 * 2)) & 3)
+			var b byte = byte((d.out >> (7 * 2)) & 3)
+			var c byte = byte((d.out >> (8 * 2)) & 3)
+			var con byte = referenceContext(a, b, c)
+
+			moveToFront(d.pixelOrder[:4], a)
+			var realOrder [4]byte
+			copy(realOrder[:], d.pixelOrder[:4])
+			moveToFront(realOrder[:], c)
+			moveToFront(realOrder[:], b)
+			moveToFront(realOrder[:], a)
+
+			for bit := 0; bit < 2; bit++ {
+				d.decode(con)
+				con = 5 + (con << 1) + byte((d.lps^d.inverts)&1)
+			}
+
+			d.out = (d.out << 2) + int32(realOrder[(d.lps^d.inverts)&3])
+		}
+
+		// turn the pixels into bitplanes
+		var plane0 byte = 0
+		var plane1 byte = 0
+		for i := uint(0); i < 8; i++ {
+			plane0 |= byte((d.out>>(2*i))&1) << i
+			plane1 |= byte((d.out>>(2*i+1))&1) << i
+		}
+		d.write(plane1)
+		d.write(plane0)
+	}
+}
+
+// mode2 decodes 4bpp tiles
+func (d *spc7110Decomp) mode2() {
+	for d.bufferLength < 32 {
+		for pixel := 0; pixel < 8; pixel++ {
+			var a byte = byte(d.out & 15)
+			var b byte = byte((d.out >> (7 * 4)) & 15)
+			var c byte = byte(d.out1 & 15)
+			var con byte = 0
+			var refCon byte = referenceContext(a, b, c)
+
+			moveToFront(d.pixelOrder[:], a)
+			var realOrder [16]byte = d.pixelOrder
+			moveToFront(realOrder[:], c)
+			moveToFront(realOrder[:], b)
+			moveToFront(realOrder[:], a)
+
+			for bit := 0; bit < 4; bit++ {
+				flagLPS, invert := d.decode(con)
+				var next byte = spc7110Mode2ContextTable[con][flagLPS^invert]
+				if con == 1 {
+					next += refCon
+				}
+				con = next
+			}
+
+			d.out1 = (d.out1 << 4) + ((d.out >> 28) & 15)
+			d.out = (d.out << 4) + int32(realOrder[(d.lps^d.inverts)&15])
+		}
+
+		// turn the pixels into bitplanes, planes 2 and 3 follow 8 rows later
+		var planes [4]byte
+		for i := uint(0); i < 8; i++ {
+			for p := uint(0); p < 4; p++ {
+				planes[p] |= byte((uint32(d.out)>>(4*i+p))&1) << i
+			}
+		}
+		d.write(planes[3])
+		d.write(planes[2])
+		d.bitplaneBuffer[d.bitplaneBufIndex] = planes[1]
+		d.bitplaneBuffer[d.bitplaneBufIndex+1] = planes[0]
+		d.bitplaneBufIndex += 2
+		if d.bitplaneBufIndex == 16 {
+			for i := 0; i < 16; i++ {
+				d.write(d.bitplaneBuffer[i])
+			}
+			d.bitplaneBufIndex = 0
+		}
+	}
+}
+
+func (d *spc7110Decomp) serialize(s *serializer) {
+	s.u8(&d.mode)
+	s.u32(&d.offset)
+	s.bytes(d.buffer[:])
+	s.u8(&d.bufferRead)
+	s.u8(&d.bufferWrite)
+	s.u8(&d.bufferLength)
+	s.bytes(d.contextIndex[:])
+	s.bytes(d.contextInvert[:])
+	s.u8(&d.val)
+	s.u8(&d.in)
+	s.u8(&d.span)
+	s.i32(&d.inCount)
+	s.i32(&d.out)
+	s.i32(&d.out1)
+	s.i32(&d.inverts)
+	s.i32(&d.lps)
+	s.bytes(d.pixelOrder[:])
+	s.bytes(d.bitplaneBuffer[:])
+	s.u8(&d.bitplaneBufIndex)
+}
@@ -36,6 +36,14 @@ func NewSRAM(filePath string, size int) *SRAM {
 	return sram
 }
 
+// newVolatileSRAM creates a ram that isn't backed by a file
+func newVolatileSRAM(size int) *SRAM {
+	return &SRAM{
+		mmap: make([]byte, size),
+		size: size,
+	}
+}
+
 func (s *SRAM) Read(addr uint32) byte {
 	return s.mmap[addr]
 }
@@ -44,7 +52,18 @@ func (s *SRAM) Write(addr uint32, value byte) {
 	s.mmap[addr] = value
 }
 
+func (s *SRAM) serialize(ser *serializer) {
+	var size int = s.size
+	if size > len(s.mmap) {
+		size = len(s.mmap)
+	}
+	ser.bytes(s.mmap[:size])
+}
+
 func (s *SRAM) Close() {
+	if s.file == nil {
+		return
+	}
 	s.mmap.Unmap()
 	s.file.Close()
 }
@@ -78,6 +97,12 @@ func readRAMFile(ramFilePath string, size int) *SRAM {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// grow files from older versions or other emulators that are too short
+	if info, err := ramFile.Stat(); err == nil && info.Size() < int64(size) {
+		if err := ramFile.Truncate(int64(size)); err != nil {
+			log.Fatal(err)
+		}
+	}
 	ramMMap, err := mmap.Map(ramFile, mmap.RDWR, 0)
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,235 @@
+package chibisnes
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+// SRTC is the Sharp S-RTC real-time clock (Daikaijuu Monogatari 2). It is
+// read nibble by nibble through $2800 and set through $2801.
+//
+// registers: 0-1 second, 2-3 minute, 4-5 hour, 6-7 day, 8 month, 9-10 year,
+// 11 century (9: 1900, 10: 2000), 12 weekday. They and the time they were
+// last updated are kept after the save ram in the .srm file.
+type SRTC struct {
+	cartridge *Cartridge
+
+	rtc          [13]byte
+	mode         byte
+	index        int32
+	rtcTimestamp int64 // host time of the last update
+}
+
+const (
+	srtcReady = iota
+	srtcCommand
+	srtcRead
+	srtcWrite
+)
+
+// rtc registers and an 8 byte timestamp stored after the save ram
+const srtcSaveSize = 13 + 8
+
+func init() {
+	registerChip(mapperRegistration{
+		name: "S-RTC",
+		match: func(header *CartridgeHeader) bool {
+			return header.coprocessor == 5
+		},
+		ram: func(header *CartridgeHeader, ramSize int, saveSize int) (int, int) {
+			// the clock is saved after the ram
+			return ramSize, saveSize + srtcSaveSize
+		},
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			log.Printf("ROM: S-RTC enabled\n")
+			return NewSRTC(cartridge), nil
+		},
+	})
+}
+
+func NewSRTC(cartridge *Cartridge) *SRTC {
+	srtc := &SRTC{
+		cartridge: cartridge,
+	}
+	srtc.load()
+	return srtc
+}
+
+func (srtc *SRTC) Reset() {
+	srtc.mode = srtcReady
+	srtc.index = -1
+}
+
+func (srtc *SRTC) Mapped(bank byte, addr uint16) bool {
+	return (bank&0x7f) < 0x40 && (addr == 0x2800 || addr == 0x2801)
+}
+
+func (srtc *SRTC) Read(bank byte, addr uint16) byte {
+	if addr != 0x2800 || srtc.mode != srtcRead {
+		return 0
+	}
+	if srtc.index < 0 {
+		srtc.updateTime()
+		srtc.index++
+		return 0x0f
+	}
+	if srtc.index > 12 {
+		srtc.index = -1
+		return 0x0f
+	}
+	var value byte = srtc.rtc[srtc.index]
+	srtc.index++
+	return value
+}
+
+func (srtc *SRTC) Write(bank byte, addr uint16, value byte) {
+	if addr != 0x2801 {
+		return
+	}
+	value &= 0x0f
+
+	switch value {
+	case 0x0d:
+		srtc.mode = srtcRead
+		srtc.index = -1
+		return
+	case 0x0e:
+		srtc.mode = srtcCommand
+		return
+	case 0x0f:
+		return
+	}
+
+	switch srtc.mode {
+	case srtcWrite:
+		if srtc.index >= 0 && srtc.index < 12 {
+			srtc.rtc[srtc.index] = value
+			srtc.index++
+			if srtc.index == 12 {
+				// the weekday is calculated by the chip
+				srtc.rtc[12] = byte(srtc.rtcTime().Weekday())
+				srtc.index++
+				srtc.rtcTimestamp = time.Now().Unix()
+			}
+			srtc.save()
+		}
+	case srtcCommand:
+		switch value {
+		case 0:
+			srtc.mode = srtcWrite
+			srtc.index = 0
+		case 4:
+			// clear
+			srtc.mode = srtcReady
+			srtc.index = -1
+			for i := 0; i < len(srtc.rtc); i++ {
+				srtc.rtc[i] = 0
+			}
+			srtc.save()
+		default:
+			srtc.mode = srtcReady
+		}
+	}
+}
+
+// rtcTime returns the time held in the registers
+func (srtc *SRTC) rtcTime() time.Time {
+	var rtc *[13]byte = &srtc.rtc
+	var second int = int(rtc[0]) + int(rtc[1])*10
+	var minute int = int(rtc[2]) + int(rtc[3])*10
+	var hour int = int(rtc[4]) + int(rtc[5])*10
+	var day int = int(rtc[6]) + int(rtc[7])*10
+	var month int = int(rtc[8])
+	var year int = 1000 + int(rtc[9]) + int(rtc[10])*10 + int(rtc[11])*100
+	if day < 1 {
+		day = 1
+	}
+	if month < 1 {
+		month = 1
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+}
+
+func (srtc *SRTC) setRTCTime(t time.Time) {
+	var rtc *[13]byte = &srtc.rtc
+	rtc[0] = byte(t.Second() % 10)
+	rtc[1] = byte(t.Second() / 10)
+	rtc[2] = byte(t.Minute() % 10)
+	rtc[3] = byte(t.Minute() / 10)
+	rtc[4] = byte(t.Hour() % 10)
+	rtc[5] = byte(t.Hour() / 10)
+	rtc[6] = byte(t.Day() % 10)
+	rtc[7] = byte(t.Day() / 10)
+	rtc[8] = byte(t.Month())
+	var year int = t.Year() - 1000
+	rtc[9] = byte(year % 10)
+	rtc[10] = byte((year / 10) % 10)
+	rtc[11] = byte(year / 100)
+	rtc[12] = byte(t.Weekday())
+}
+
+// updateTime advances the clock by the host time passed since the last
+// update
+func (srtc *SRTC) updateTime() {
+	var now int64 = time.Now().Unix()
+	var elapsed int64 = now - srtc.rtcTimestamp
+	srtc.rtcTimestamp = now
+	if elapsed > 0 {
+		srtc.setRTCTime(srtc.rtcTime().Add(time.Duration(elapsed) * time.Second))
+	}
+	srtc.save()
+}
+
+// load reads the clock from after the save ram, a new save starts at the
+// host time
+func (srtc *SRTC) load() {
+	var data []byte = srtc.saveData()
+	if data == nil {
+		return
+	}
+	copy(srtc.rtc[:], data[:13])
+	srtc.rtcTimestamp = int64(binary.LittleEndian.Uint64(data[13:]))
+	if srtc.rtcTimestamp == 0 {
+		var now time.Time = time.Now()
+		srtc.setRTCTime(time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC))
+		srtc.rtcTimestamp = now.Unix()
+		srtc.save()
+		log.Printf("S-RTC: set to host time\n")
+	}
+}
+
+func (srtc *SRTC) save() {
+	var data []byte = srtc.saveData()
+	if data == nil {
+		return
+	}
+	copy(data[:13], srtc.rtc[:])
+	binary.LittleEndian.PutUint64(data[13:], uint64(srtc.rtcTimestamp))
+}
+
+// saveData returns the part of the .srm after the save ram holding the clock
+func (srtc *SRTC) saveData() []byte {
+	var cartridge *Cartridge = srtc.cartridge
+	var offset int = int(cartridge.ramSize)
+	if cartridge.ram == nil || len(cartridge.ram.mmap) < offset+srtcSaveSize {
+		return nil
+	}
+	return cartridge.ram.mmap[offset : offset+srtcSaveSize]
+}
+
+func (srtc *SRTC) Cycle() {
+}
+
+func (srtc *SRTC) Close() {
+}
+
+func (srtc *SRTC) Serialize(s *serializer) {
+	s.bytes(srtc.rtc[:])
+	s.u8(&srtc.mode)
+	s.i32(&srtc.index)
+	var rtcTimestamp uint64 = uint64(srtc.rtcTimestamp)
+	s.u64(&rtcTimestamp)
+	srtc.rtcTimestamp = int64(rtcTimestamp)
+	srtc.save()
+}
@@ -0,0 +1,284 @@
+package chibisnes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ST018 is the Seta ST018: an ARM6 (ARMv3) at 21.47 MHz with a 128KB program
+// rom, a 32KB data rom and 16KB of ram, talking to the SNES through a byte
+// wide mailbox in each direction. The firmware is loaded from st018.rom next
+// to the rom (program rom then data rom).
+//
+// arm map: 00000000 program rom, 40000000 i/o, a0000000 data rom,
+// e0000000 ram
+//
+// snes registers (00-3f,80-bf:3800-38ff, mirrored every 8 bytes):
+// $3800 (r) data from the arm
+// $3802 (r) clear the signal, (w) data to the arm
+// $3804 (r) status: bit 7 ready, bit 3 data to the arm pending, bit 2
+// signal, bit 0 data from the arm pending; (w) bit 0 reset
+//
+// arm i/o: 40000000 (w) data to the snes, 40000010 (r) data from the snes
+// (w) signal, 40000020 (r) status, 40000020-40000028 (w) timer latch,
+// 4000002c (w) start the timer
+type ST018 struct {
+	cartridge *Cartridge
+
+	arm *ARM
+
+	programROM [0x20000]byte
+	dataROM    [0x8000]byte
+	ram        [0x4000]byte
+
+	// bridge between the snes and the arm
+	reset       bool // arm held in reset by the snes
+	ready       bool // arm out of reset
+	readyDelay  int32
+	armToCPU    byte
+	armToCPURdy bool
+	cpuToARM    byte
+	cpuToARMRdy bool
+	signal      bool
+	timer       uint32
+	timerLatch  uint32
+
+	cyclesLeft int32 // master clocks the arm may still run
+}
+
+const (
+	st018FirmwareSize = 0x20000 + 0x8000
+	st018ResetDelay   = 65536 // clocks from the reset to ready
+)
+
+func init() {
+	registerChip(mapperRegistration{
+		name:  "ST018",
+		match: isST018Header,
+		create: func(cartridge *Cartridge, header *CartridgeHeader) (Mapper, error) {
+			st018, err := NewST018(cartridge)
+			if err != nil {
+				return nil, err
+			}
+			return st018, nil
+		},
+	})
+}
+
+// isST018Header reports if the header is the one of a ST018 game, chipset
+// $f5 with $02 in the extended header
+func isST018Header(header *CartridgeHeader) bool {
+	return header.coprocessor == 0xf && header.exCoprocessor == 0x02
+}
+
+func NewST018(cartridge *Cartridge) (*ST018, error) {
+	st018 := &ST018{
+		cartridge: cartridge,
+	}
+	st018.arm = NewARM(st018)
+
+	var romDir string = filepath.Dir(filepath.Clean(cartridge.console.RomFilePath))
+	data, err := os.ReadFile(filepath.Join(romDir, "st018.rom"))
+	if err != nil {
+		return nil, errors.New("Failed to load rom: ST018 firmware st018.rom not found next to the rom\n")
+	}
+	if len(data) < st018FirmwareSize {
+		msg := fmt.Sprintf("Failed to load rom: ST018 firmware st018.rom is %d bytes, want %d\n", len(data), st018FirmwareSize)
+		return nil, errors.New(msg)
+	}
+	copy(st018.programROM[:], data[:0x20000])
+	copy(st018.dataROM[:], data[0x20000:st018FirmwareSize])
+
+	log.Printf("ROM: ST018 enabled\n")
+
+	return st018, nil
+}
+
+func (st018 *ST018) Reset() {
+	for i := 0; i < len(st018.ram); i++ {
+		st018.ram[i] = 0
+	}
+	st018.reset = false
+	st018.cyclesLeft = 0
+	st018.resetARM()
+}
+
+// resetARM resets the arm and the bridge
+func (st018 *ST018) resetARM() {
+	st018.arm.Reset()
+	st018.ready = false
+	st018.readyDelay = st018ResetDelay
+	st018.armToCPU = 0
+	st018.armToCPURdy = false
+	st018.cpuToARM = 0
+	st018.cpuToARMRdy = false
+	st018.signal = false
+	st018.timer = 0
+	st018.timerLatch = 0
+}
+
+// Cycle runs for 2 master clocks, the arm runs at the master clock
+func (st018 *ST018) Cycle() {
+	st018.cyclesLeft += 2
+	for st018.cyclesLeft > 0 {
+		switch {
+		case st018.reset:
+			st018.cyclesLeft = 0
+		case !st018.ready:
+			st018.step(1)
+			st018.readyDelay--
+			if st018.readyDelay <= 0 {
+				st018.ready = true
+			}
+		default:
+			st018.arm.Step()
+		}
+	}
+}
+
+// step takes clocks of the arm
+func (st018 *ST018) step(clocks int32) {
+	if st018.timer > 0 {
+		st018.timer--
+	}
+	st018.cyclesLeft -= clocks
+}
+
+func (st018 *ST018) status() byte {
+	var value byte = 0
+	if st018.ready {
+		value |= 0x80
+	}
+	if st018.cpuToARMRdy {
+		value |= 0x08
+	}
+	if st018.signal {
+		value |= 0x04
+	}
+	if st018.armToCPURdy {
+		value |= 0x01
+	}
+	return value
+}
+
+func (st018 *ST018) Mapped(bank byte, addr uint16) bool {
+	return (bank&0x7f) < 0x40 && addr >= 0x3800 && addr < 0x3900
+}
+
+func (st018 *ST018) Read(bank byte, addr uint16) byte {
+	switch addr & 0xff06 {
+	case 0x3800:
+		if st018.armToCPURdy {
+			st018.armToCPURdy = false
+			return st018.armToCPU
+		}
+	case 0x3802:
+		st018.signal = false
+	case 0x3804:
+		return st018.status()
+	}
+	return 0
+}
+
+func (st018 *ST018) Write(bank byte, addr uint16, value byte) {
+	switch addr & 0xff06 {
+	case 0x3802:
+		st018.cpuToARM = value
+		st018.cpuToARMRdy = true
+	case 0x3804:
+		var reset bool = (value & 1) > 0
+		if reset && !st018.reset {
+			st018.resetARM()
+		}
+		st018.reset = reset
+	}
+}
+
+// armRead is a read of the arm, words are little endian
+func (st018 *ST018) armRead(addr uint32, byteAccess bool) uint32 {
+	st018.step(1)
+	var memory []byte
+	switch addr & 0xe0000000 {
+	case 0x00000000:
+		memory = st018.programROM[:]
+	case 0xa0000000:
+		memory = st018.dataROM[:]
+	case 0xe0000000:
+		memory = st018.ram[:]
+	case 0x40000000:
+		switch addr & 0xe000003f {
+		case 0x40000010:
+			if st018.cpuToARMRdy {
+				st018.cpuToARMRdy = false
+				return uint32(st018.cpuToARM)
+			}
+		case 0x40000020:
+			return uint32(st018.status())
+		}
+		return 0
+	default:
+		return 0
+	}
+	var offset uint32 = addr & uint32(len(memory)-1)
+	if byteAccess {
+		return uint32(memory[offset])
+	}
+	offset &^= 3
+	return uint32(memory[offset]) | uint32(memory[offset+1])<<8 | uint32(memory[offset+2])<<16 | uint32(memory[offset+3])<<24
+}
+
+func (st018 *ST018) armWrite(addr uint32, value uint32, byteAccess bool) {
+	st018.step(1)
+	switch addr & 0xe0000000 {
+	case 0xe0000000:
+		var offset uint32 = addr & 0x3fff
+		if byteAccess {
+			st018.ram[offset] = byte(value)
+			return
+		}
+		offset &^= 3
+		st018.ram[offset] = byte(value)
+		st018.ram[offset+1] = byte(value >> 8)
+		st018.ram[offset+2] = byte(value >> 16)
+		st018.ram[offset+3] = byte(value >> 24)
+	case 0x40000000:
+		value &= 0xff
+		switch addr & 0xe000003f {
+		case 0x40000000:
+			st018.armToCPU = byte(value)
+			st018.armToCPURdy = true
+		case 0x40000010:
+			st018.signal = true
+		case 0x40000020:
+			st018.timerLatch = (st018.timerLatch & 0xffff00) | value
+		case 0x40000024:
+			st018.timerLatch = (st018.timerLatch & 0xff00ff) | value<<8
+		case 0x40000028:
+			st018.timerLatch = (st018.timerLatch & 0x00ffff) | value<<16
+		case 0x4000002c:
+			st018.timer = st018.timerLatch
+		}
+	}
+}
+
+func (st018 *ST018) Close() {
+}
+
+func (st018 *ST018) Serialize(s *serializer) {
+	st018.arm.serialize(s)
+	s.bytes(st018.ram[:])
+	s.bool(&st018.reset)
+	s.bool(&st018.ready)
+	s.i32(&st018.readyDelay)
+	s.u8(&st018.armToCPU)
+	s.bool(&st018.armToCPURdy)
+	s.u8(&st018.cpuToARM)
+	s.bool(&st018.cpuToARMRdy)
+	s.bool(&st018.signal)
+	s.u32(&st018.timer)
+	s.u32(&st018.timerLatch)
+	s.i32(&st018.cyclesLeft)
+}
@@ -0,0 +1,157 @@
+package chibisnes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// save state layout: "CSNS" magic, format version (u32), rom crc32 (u32),
+// then every component in the order of Console.serialize
+const (
+	stateMagic   = "CSNS"
+	stateVersion = 24
+)
+
+var (
+	ErrStateMagic = errors.New("state: not a ChibiSNES save state")
+	ErrStateROM   = errors.New("state: save state belongs to a different rom")
+)
+
+// StateVersionError is returned by LoadState for states written by another
+// version of the save state format.
+type StateVersionError struct {
+	Version uint32
+}
+
+func (e *StateVersionError) Error() string {
+	return fmt.Sprintf("state: unsupported save state version %d (want %d)", e.Version, stateVersion)
+}
+
+// SaveState writes a snapshot of the whole machine to w.
+func (console *Console) SaveState(w io.Writer) error {
+	s := newSaveSerializer(w)
+	console.serializeHeader(s)
+	console.serialize(s)
+	return s.err
+}
+
+// LoadState restores a snapshot written by SaveState. On error the console
+// is left in the state it had before the call.
+func (console *Console) LoadState(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s := newLoadSerializer(bytes.NewReader(data))
+	if err := console.serializeHeader(s); err != nil {
+		return err
+	}
+
+	// keep the current state around, so a truncated state can be undone
+	var backup bytes.Buffer
+	if err := console.SaveState(&backup); err != nil {
+		return err
+	}
+
+	console.serialize(s)
+	if s.err != nil {
+		restore := newLoadSerializer(&backup)
+		console.serializeHeader(restore)
+		console.serialize(restore)
+		return fmt.Errorf("state: %w", s.err)
+	}
+
+	return nil
+}
+
+func (console *Console) serializeHeader(s *serializer) error {
+	var magic []byte = []byte(stateMagic)
+	var version uint32 = stateVersion
+	var romCRC uint32 = console.Cartridge.romCRC
+
+	s.bytes(magic)
+	s.u32(&version)
+	s.u32(&romCRC)
+	if s.err != nil {
+		return fmt.Errorf("state: %w", s.err)
+	}
+	if !s.loading {
+		return nil
+	}
+
+	if string(magic) != stateMagic {
+		return ErrStateMagic
+	}
+	if version != stateVersion {
+		return &StateVersionError{Version: version}
+	}
+	if romCRC != console.Cartridge.romCRC {
+		return ErrStateROM
+	}
+
+	return nil
+}
+
+func (console *Console) serialize(s *serializer) {
+	s.bytes(console.RAM[:])
+	s.u32(&console.RAMAddr)
+
+	s.u16(&console.hPos)
+	s.u16(&console.vPos)
+	s.u32(&console.frames)
+	s.u64(&console.masterClock)
+	s.u8(&console.cpuCycleTime)
+	s.bool(&console.cpuCycleStart)
+
+	var apuClock uint64 = uint64(console.apuClock)
+	s.u64(&apuClock)
+	console.apuClock = int64(apuClock)
+	var apuClockNum uint64 = uint64(console.apuClockNum)
+	s.u64(&apuClockNum)
+	console.apuClockNum = int64(apuClockNum)
+	var apuClockDen uint64 = uint64(console.apuClockDen)
+	s.u64(&apuClockDen)
+	console.apuClockDen = int64(apuClockDen)
+	s.bool(&console.pal)
+
+	s.bool(&console.hIRQEnabled)
+	s.bool(&console.vIRQEnabled)
+	s.bool(&console.nmiEnabled)
+	s.u16(&console.hTimer)
+	s.u16(&console.vTimer)
+
+	s.bool(&console.inNMI)
+	s.bool(&console.inIRQ)
+	s.bool(&console.inVBlank)
+
+	s.u16s(console.portAutoRead[:])
+	s.bool(&console.autoJoyRead)
+	s.u16(&console.autoJoyTimer)
+
+	s.bool(&console.ppuLatch)
+
+	s.u8(&console.multiplyA)
+	s.u16(&console.multiplyResult)
+	s.u16(&console.divideA)
+	s.u16(&console.divideResult)
+
+	s.bool(&console.fastMem)
+	s.u8(&console.openBus)
+
+	console.CPU.serialize(s)
+	console.PPU.serialize(s)
+	console.APU.serialize(s)
+	console.DMA.serialize(s)
+	console.Cartridge.serialize(s)
+	console.Controller1.serialize(s)
+	console.Controller2.serialize(s)
+	if console.msu1 != nil {
+		console.msu1.serialize(s)
+	}
+	if console.satellaview != nil {
+		console.satellaview.serialize(s)
+	}
+}
@@ -0,0 +1,198 @@
+package chibisnes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"path/filepath"
+)
+
+// SufamiTurbo is the Sufami Turbo adapter: the BIOS is the cartridge rom
+// (LoROM), the two mini cartridge slots are mapped behind it. Each mini
+// cartridge has its own .srm file.
+//
+// map: slot A rom 20-3f,a0-bf:8000-ffff, slot A ram 60-63,e0-e3:8000-ffff,
+// slot B rom 40-5f,c0-df:8000-ffff, slot B ram 70-73,f0-f3:8000-ffff.
+type SufamiTurbo struct {
+	cartridge *Cartridge
+
+	slots [2]sufamiTurboSlot
+}
+
+type sufamiTurboSlot struct {
+	rom     []byte // nil if the slot is empty
+	romSize uint32
+	ram     *SRAM
+	ramSize uint32
+}
+
+// ROMFile is a rom image given to LoadROMs
+type ROMFile struct {
+	Path string
+	Data []byte
+}
+
+var (
+	sufamiTurboMagic      = []byte("BANDAI SFC-ADX")
+	sufamiTurboBIOSMagic  = []byte("SFC-ADX BACKUP")
+	sufamiTurboBIOSHeader = []byte("ADD-ON BASE CASSETE")
+)
+
+// isSufamiTurboBIOS reports if data is the Sufami Turbo BIOS
+func isSufamiTurboBIOS(data []byte) bool {
+	if len(data) >= 0x7fc0+len(sufamiTurboBIOSHeader) && bytes.Equal(data[0x7fc0:0x7fc0+len(sufamiTurboBIOSHeader)], sufamiTurboBIOSHeader) {
+		return true
+	}
+	return len(data) >= 0x20 && bytes.Equal(data[:len(sufamiTurboMagic)], sufamiTurboMagic) && bytes.Equal(data[0x10:0x10+len(sufamiTurboBIOSMagic)], sufamiTurboBIOSMagic)
+}
+
+// isSufamiTurboCartridge reports if data is a mini cartridge
+func isSufamiTurboCartridge(data []byte) bool {
+	return len(data) >= 0x40 && bytes.Equal(data[:len(sufamiTurboMagic)], sufamiTurboMagic) && !isSufamiTurboBIOS(data)
+}
+
+func NewSufamiTurbo(cartridge *Cartridge) *SufamiTurbo {
+	return &SufamiTurbo{
+		cartridge: cartridge,
+	}
+}
+
+// loadSlot puts the mini cartridge in file in a slot (0: A, 1: B)
+func (sufamiTurbo *SufamiTurbo) loadSlot(slot int, file ROMFile) {
+	var s *sufamiTurboSlot = &sufamiTurbo.slots[slot]
+
+	// expand to a power of 2, the mini cartridges are multiples of 128KB
+	var romSize int = 0x20000
+	for romSize < len(file.Data) {
+		romSize *= 2
+	}
+	s.rom = make([]byte, romSize)
+	s.romSize = uint32(romSize)
+	for i := 0; i < romSize; i++ {
+		s.rom[i] = file.Data[i%len(file.Data)]
+	}
+
+	// $37: ram size in 2KB units
+	s.ramSize = uint32(file.Data[0x37]) * 0x800
+	s.ram = nil
+	if s.ramSize > 0 {
+		var ramFileName string = getFileNameWithoutExtension(file.Path)
+		var ramFileDir string = filepath.Dir(filepath.Clean(file.Path))
+		s.ram = NewSRAM(filepath.Join(ramFileDir, ramFileName+`.srm`), int(s.ramSize))
+		if s.ram == nil {
+			s.ramSize = 0
+		}
+	}
+
+	var title []byte = bytes.TrimRight(file.Data[0x10:0x1e], " \x00")
+	log.Printf("ROM: Sufami Turbo slot %c: \"%s\", RAM size: 0x%x\n", 'A'+slot, title, s.ramSize)
+}
+
+func (sufamiTurbo *SufamiTurbo) Reset() {
+}
+
+func (sufamiTurbo *SufamiTurbo) Cycle() {
+}
+
+func (sufamiTurbo *SufamiTurbo) Close() {
+	for i := 0; i < len(sufamiTurbo.slots); i++ {
+		if sufamiTurbo.slots[i].ram != nil {
+			sufamiTurbo.slots[i].ram.Close()
+		}
+	}
+}
+
+// decode returns the slot at an address and if it is its ram, nil outside
+// of the slots
+func (sufamiTurbo *SufamiTurbo) decode(bank byte, addr uint16) (*sufamiTurboSlot, bool) {
+	bank &= 0x7f
+	if addr < 0x8000 {
+		return nil, false
+	}
+	switch {
+	case bank >= 0x20 && bank < 0x40:
+		return &sufamiTurbo.slots[0], false
+	case bank >= 0x40 && bank < 0x60:
+		return &sufamiTurbo.slots[1], false
+	case bank >= 0x60 && bank < 0x64:
+		return &sufamiTurbo.slots[0], true
+	case bank >= 0x70 && bank < 0x74:
+		return &sufamiTurbo.slots[1], true
+	}
+	return nil, false
+}
+
+func (sufamiTurbo *SufamiTurbo) Mapped(bank byte, addr uint16) bool {
+	s, _ := sufamiTurbo.decode(bank, addr)
+	return s != nil
+}
+
+func (sufamiTurbo *SufamiTurbo) Read(bank byte, addr uint16) byte {
+	s, ram := sufamiTurbo.decode(bank, addr)
+	switch {
+	case s == nil:
+	case !ram && s.rom != nil:
+		return s.rom[((uint32(bank&0x1f)<<15)|(uint32(addr)&0x7fff))&(s.romSize-1)]
+	case ram && s.ram != nil:
+		return s.ram.Read(((uint32(bank&0x3) << 15) | (uint32(addr) & 0x7fff)) % s.ramSize)
+	}
+	return sufamiTurbo.cartridge.console.openBus
+}
+
+func (sufamiTurbo *SufamiTurbo) Write(bank byte, addr uint16, value byte) {
+	s, ram := sufamiTurbo.decode(bank, addr)
+	if s != nil && ram && s.ram != nil {
+		s.ram.Write(((uint32(bank&0x3)<<15)|(uint32(addr)&0x7fff))%s.ramSize, value)
+	}
+}
+
+func (sufamiTurbo *SufamiTurbo) Serialize(s *serializer) {
+	for i := 0; i < len(sufamiTurbo.slots); i++ {
+		if sufamiTurbo.slots[i].ram != nil {
+			sufamiTurbo.slots[i].ram.serialize(s)
+		}
+	}
+}
+
+// loadSufamiTurbo loads the Sufami Turbo BIOS with one or two mini
+// cartridges, slot A first
+func (console *Console) loadSufamiTurbo(files []ROMFile) error {
+	var bios int = -1
+	var carts []ROMFile
+	for i := 0; i < len(files); i++ {
+		switch {
+		case isSufamiTurboBIOS(files[i].Data):
+			bios = i
+		case isSufamiTurboCartridge(files[i].Data):
+			carts = append(carts, files[i])
+		default:
+			msg := fmt.Sprintf("Failed to load rom: %s is not a Sufami Turbo BIOS or cartridge\n", files[i].Path)
+			return errors.New(msg)
+		}
+	}
+	if bios < 0 {
+		return errors.New("Failed to load rom: the Sufami Turbo BIOS is missing\n")
+	}
+	if len(carts) == 0 || len(carts) > 2 {
+		msg := fmt.Sprintf("Failed to load rom: %d Sufami Turbo cartridges, want 1 or 2\n", len(carts))
+		return errors.New(msg)
+	}
+
+	if err := console.LoadROM(files[bios].Path, files[bios].Data, len(files[bios].Data)); err != nil {
+		return err
+	}
+
+	var cartridge *Cartridge = console.Cartridge
+	var sufamiTurbo *SufamiTurbo = NewSufamiTurbo(cartridge)
+	for i := 0; i < len(carts); i++ {
+		sufamiTurbo.loadSlot(i, carts[i])
+		// save states belong to the BIOS and the cartridges
+		cartridge.romCRC = crc32.Update(cartridge.romCRC, crc32.IEEETable, sufamiTurbo.slots[i].rom)
+	}
+	cartridge.addChip(sufamiTurbo)
+	console.Reset(true)
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package chibisnes
+
+import "testing"
+
+func TestSufamiTurboMapping(t *testing.T) {
+	var sufamiTurbo *SufamiTurbo = NewSufamiTurbo(newTestCartridge(0x8000, 0))
+	for i := 0; i < len(sufamiTurbo.slots); i++ {
+		var s *sufamiTurboSlot = &sufamiTurbo.slots[i]
+		s.romSize = 0x20000
+		s.rom = make([]byte, s.romSize)
+		for j := 0; j < len(s.rom); j++ {
+			s.rom[j] = byte(i<<7) | byte(j>>15)
+		}
+		s.ramSize = 0x2000
+		s.ram = newVolatileSRAM(int(s.ramSize))
+	}
+
+	var tests = []struct {
+		bank   byte
+		addr   uint16
+		mapped bool
+		write  bool
+		value  byte
+	}{
+		{0x20, 0x8000, true, false, 0x00}, // slot A rom
+		{0xa1, 0xffff, true, false, 0x01},
+		{0x20, 0x7fff, false, false, 0xee},
+		{0x40, 0x8000, true, false, 0x80}, // slot B rom
+		{0xdf, 0x8000, true, false, 0x83},
+		{0x40, 0x0000, false, false, 0xee},
+		{0x60, 0x8010, true, true, 0x5a}, // slot A ram
+		{0xe3, 0x9000, true, true, 0x5b},
+		{0x64, 0x8000, false, false, 0xee},
+		{0x60, 0x0010, false, false, 0xee},
+		{0x70, 0x8010, true, true, 0xa5}, // slot B ram
+		{0xf3, 0x9000, true, true, 0xa6},
+		{0x74, 0x8000, false, false, 0xee},
+		{0x7e, 0x8000, false, false, 0xee},
+	}
+	for _, test := range tests {
+		if mapped := sufamiTurbo.Mapped(test.bank, test.addr); mapped != test.mapped {
+			t.Errorf("%02x:%04x mapped %v, want %v", test.bank, test.addr, mapped, test.mapped)
+			continue
+		}
+		if !test.mapped {
+			continue
+		}
+		if test.write {
+			sufamiTurbo.Write(test.bank, test.addr, test.value)
+		}
+		if value := sufamiTurbo.Read(test.bank, test.addr); value != test.value {
+			t.Errorf("%02x:%04x = %02x, want %02x", test.bank, test.addr, value, test.value)
+		}
+	}
+	// the two slots have their own ram
+	if value := sufamiTurbo.Read(0x60, 0x8010); value != 0x5a {
+		t.Errorf("slot A ram changed to %02x", value)
+	}
+}
@@ -3,12 +3,12 @@ package main
 import (
 	"encoding/binary"
 	"flag"
-	"fmt"
 	"image"
 	"log"
 	"math"
 	"os"
 	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
@@ -33,7 +33,22 @@ var (
 	isRunning                      = false
 	console     *chibisnes.Console = nil
 	audioDevice sdl.AudioDeviceID
-	audioBuffer [735 * 4]int16 // *2 for stereo, *2 for sizeof(int16)
+	audioBuffer [882 * 4]int16 // *2 for stereo, *2 for sizeof(int16) (882: PAL, 735: NTSC)
+
+	regionName      string        = "auto" // auto, ntsc or pal
+	romDBPath       string        = ""     // rom database
+	rendererName    string        = "line" // line or dot
+	samplesPerFrame int           = 735    // 44100 Hz / 60 Hz (NTSC), 44100 Hz / 50 Hz (PAL): 882
+	framePeriod     time.Duration          // 0: paced by vsync
+	nextFrameTime   time.Time
+
+	apuSyncWindow int  = chibisnes.DefaultAPUSyncWindow // apu cycles the apu may lag behind
+	dmaMeter      bool = false                          // show the dma time of each line
+
+	rewindInterval int               = 2  // take a snapshot every N frames
+	rewindBudget   int               = 64 // MB of snapshots kept in memory
+	rewindBuffer   *chibisnes.Rewind = nil
+	rewindFrames   int               = 0
 )
 
 // For pprof
@@ -44,19 +59,42 @@ var (
 // }
 
 func main() {
+	flag.IntVar(&rewindInterval, "rewind-interval", rewindInterval, "frames between rewind snapshots")
+	flag.IntVar(&rewindBudget, "rewind-budget", rewindBudget, "memory used for rewind snapshots (MB)")
+	flag.StringVar(&regionName, "region", regionName, "console region: auto, ntsc or pal")
+	flag.StringVar(&rendererName, "renderer", rendererName, "ppu renderer: line (fast) or dot (mid-line raster effects)")
+	flag.IntVar(&apuSyncWindow, "apu-sync", apuSyncWindow, "apu cycles the apu may lag behind the cpu (1: lockstep)")
+	flag.BoolVar(&dmaMeter, "dma-meter", dmaMeter, "show the bus time taken by dma (white) and hdma (red) on each line")
+	flag.StringVar(&romDBPath, "romdb", romDBPath, "rom database file to identify known dumps")
 	flag.Parse()
-	if len(flag.Args()) >= 1 {
-		_, err := os.Stat(flag.Arg(0))
+	if romDBPath != "" {
+		data, err := os.ReadFile(romDBPath)
 		if err != nil {
-			log.Fatalln("no ROM file specified or found")
+			log.Fatalf("romdb: %s\n", err)
+		}
+		if err := chibisnes.AddROMDatabase(romDBPath, data); err != nil {
+			log.Fatalf("romdb: %s", err)
+		}
+	}
+	if rewindInterval < 1 {
+		rewindInterval = 1
+	}
+	if len(flag.Args()) >= 1 {
+		for _, arg := range flag.Args() {
+			_, err := os.Stat(arg)
+			if err != nil {
+				log.Fatalln("no ROM file specified or found")
+			}
 		}
 
-		ResetConsole(flag.Arg(0))
+		// several files: Sufami Turbo BIOS and cartridges
+		ResetConsole(flag.Args()...)
 	}
 	defer StopAudio()
 
 	window := gui.NewMasterWindow("ChibiSNES", WINDOW_WIDTH, WINDOW_HEIGHT, -1)
 	window.SetDropCallback(onDrop)
+	updateSwapInterval()
 	screenImage := image.NewRGBA(image.Rect(0, 0, WINDOW_WIDTH, WINDOW_HEIGHT))
 
 	var texture imgui.TextureID
@@ -72,7 +110,12 @@ func main() {
 			// want to more keys
 			// processInputController2(window.Platform.Window, console)
 
-			console.RunFrame()
+			if window.Platform.Window.GetKey(glfw.KeyBackspace) == glfw.Press {
+				rewindFrame()
+			} else {
+				console.RunFrame()
+				pushRewindFrame()
+			}
 
 			// clear screen
 			for i := 0; i < len(screenImage.Pix); i++ {
@@ -89,16 +132,65 @@ func main() {
 		if isRunning {
 			PlayAudio(console)
 		}
+
+		waitNextFrame()
 	}
 
 	console.Close()
 }
 
+func pushRewindFrame() {
+	rewindFrames++
+	if rewindFrames < rewindInterval {
+		return
+	}
+	rewindFrames = 0
+	if err := rewindBuffer.Push(console); err != nil {
+		log.Printf("Rewind: snapshot failed: %s\n", err)
+	}
+}
+
+func rewindFrame() {
+	rewindFrames = 0
+	if _, err := rewindBuffer.Pop(console); err != nil {
+		log.Printf("Rewind: restore failed: %s\n", err)
+	}
+	// the snapshot holds no picture, run a frame to draw one
+	console.RunFrame()
+}
+
+func updateSwapInterval() {
+	if glfw.GetCurrentContext() == nil {
+		// no window yet, called again once it is created
+		return
+	}
+	if framePeriod == 0 {
+		glfw.SwapInterval(1)
+	} else {
+		glfw.SwapInterval(0)
+	}
+}
+
+// waitNextFrame paces the main loop when the console runs at a different
+// rate than the vsync of the display (PAL: 50 Hz)
+func waitNextFrame() {
+	if framePeriod == 0 {
+		return
+	}
+	now := time.Now()
+	if nextFrameTime.IsZero() || now.Sub(nextFrameTime) > framePeriod*4 {
+		// first frame, or we fell far behind: don't try to catch up
+		nextFrameTime = now
+	}
+	if wait := nextFrameTime.Sub(now); wait > 0 {
+		time.Sleep(wait)
+	}
+	nextFrameTime = nextFrameTime.Add(framePeriod)
+}
+
 func onDrop(names []string) {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("%s", names[0]))
-	dropInFiles := sb.String()
-	ResetConsole(dropInFiles)
+	// a pair of files is the Sufami Turbo BIOS and a cartridge
+	ResetConsole(names...)
 }
 
 func renderGUI(w *gui.MasterWindow, texture *imgui.TextureID) {
@@ -112,6 +204,9 @@ func renderGUI(w *gui.MasterWindow, texture *imgui.TextureID) {
 				imgui.Vec2{X: 0, Y: 0},
 				imgui.Vec2{X: float32(WINDOW_WIDTH), Y: float32(WINDOW_HEIGHT)},
 			)
+		if dmaMeter {
+			drawDMAMeter()
+		}
 	} else {
 		var msg string = "ChibiSNES is currently stopped.\n\nPlease drag and drop ROM file."
 		textSize := imgui.CalcTextSize(msg, false, 0)
@@ -132,17 +227,38 @@ func renderGUI(w *gui.MasterWindow, texture *imgui.TextureID) {
 	w.Platform.PostRender()
 }
 
+// drawDMAMeter draws a bar next to each line of the picture on the right of
+// the screen, a whole line of dma is 64 pixels long
+func drawDMAMeter() {
+	var stats []chibisnes.DMALineStats = console.DMAStats()
+	var right float32 = float32(WINDOW_WIDTH)
+	drawList := imgui.ForegroundDrawList()
+	for line := 1; line <= 240 && line < len(stats); line++ {
+		var top float32 = float32((line - 1) * SCALE)
+		var bottom float32 = top + float32(SCALE)
+		var hdmaLeft float32 = right - float32(stats[line].HDMA)*64/1364
+		var dmaLeft float32 = hdmaLeft - float32(stats[line].DMA)*64/1364
+		if hdmaLeft < right {
+			drawList.AddRectFilled(imgui.Vec2{X: hdmaLeft, Y: top}, imgui.Vec2{X: right, Y: bottom}, imgui.PackedColor(0xC04040FF))
+		}
+		if dmaLeft < hdmaLeft {
+			drawList.AddRectFilled(imgui.Vec2{X: dmaLeft, Y: top}, imgui.Vec2{X: hdmaLeft, Y: bottom}, imgui.PackedColor(0xC0FFFFFF))
+		}
+	}
+}
+
 func PlayAudio(console *chibisnes.Console) {
-	console.SetAudioSamples(audioBuffer[:], 735)
-	if sdl.GetQueuedAudioSize(audioDevice) <= uint32(len(audioBuffer)*6) {
+	console.SetAudioSamples(audioBuffer[:], samplesPerFrame)
+	var size int = samplesPerFrame * 4 // *2 for stereo, *2 for sizeof(int16)
+	if sdl.GetQueuedAudioSize(audioDevice) <= uint32(size*6) {
 		src := (*[len(audioBuffer) * 2]uint8)(unsafe.Pointer(&audioBuffer[0]))
-		dst := make([]uint8, len(audioBuffer)*2)
+		dst := make([]uint8, size)
 		volume := int(math.Floor(float64(sdl.MIX_MAXVOLUME) * AUDIO_MASTER_VOLUME))
 
-		sdl.MixAudioFormat(&dst[0], &src[0], sdl.AUDIO_S16, uint32(len(audioBuffer)*2), volume)
+		sdl.MixAudioFormat(&dst[0], &src[0], sdl.AUDIO_S16, uint32(size), volume)
 
 		// don't queue audio if buffer is still filled
-		sdl.QueueAudio(audioDevice, dst[:len(audioBuffer)])
+		sdl.QueueAudio(audioDevice, dst)
 	}
 }
 
@@ -171,21 +287,47 @@ func StopAudio() {
 	}
 }
 
-func ResetConsole(file_name string) {
+func ResetConsole(file_names ...string) {
 	StopAudio()
 	isRunning = false
 
 	log.Println("Reset Console")
-	log.Printf("ROM file path: %s\n", file_name)
+	for _, file_name := range file_names {
+		log.Printf("ROM file path: %s\n", file_name)
+	}
 	console = chibisnes.NewConsole()
-	romFilePath := file_name
-	data, err := readFile(romFilePath)
-	if err != nil {
-		log.Fatalf("readFile error: %s\n", err)
+	switch strings.ToLower(regionName) {
+	case "ntsc":
+		console.SetRegion(chibisnes.RegionNTSC)
+	case "pal":
+		console.SetRegion(chibisnes.RegionPAL)
+	}
+	console.SetDotRenderer(strings.ToLower(rendererName) == "dot")
+	console.SetAPUSyncWindow(apuSyncWindow)
+	var romFiles []chibisnes.ROMFile
+	for _, romFilePath := range file_names {
+		data, err := readFile(romFilePath)
+		if err != nil {
+			log.Fatalf("readFile error: %s\n", err)
+		}
+		romFiles = append(romFiles, chibisnes.ROMFile{Path: romFilePath, Data: data})
 	}
-	if err := console.LoadROM(romFilePath, data, len(data)); err != nil {
+	if err := console.LoadROMs(romFiles); err != nil {
 		log.Fatalf("%s\n", err)
 	}
+	rewindBuffer = chibisnes.NewRewind(rewindBudget * 1024 * 1024)
+	rewindFrames = 0
+
+	if console.IsPAL() {
+		// 50 Hz doesn't fit a 60 Hz vsync, pace the frames ourselves
+		samplesPerFrame = 882
+		framePeriod = time.Duration(float64(time.Second) / console.FrameRate())
+	} else {
+		samplesPerFrame = 735
+		framePeriod = 0
+	}
+	nextFrameTime = time.Time{}
+	updateSwapInterval()
 	isRunning = true
 
 	StartAudio()